@@ -104,6 +104,19 @@ type AnnounceRequest struct {
 
 	Peer
 	Params
+
+	// AltPeer is the peer of the client in the other address family, if it
+	// reported its address in that family, like with the ipv4 and ipv6
+	// parameters of BEP 7.
+	AltPeer *Peer
+
+	// TrackerID is the tracker id the client received in an earlier
+	// response and sends back, as described in BEP 3.
+	TrackerID string
+
+	// RemoteIP is the IP address the announce was received from. It differs
+	// from the IP of the Peer if the client provided its own.
+	RemoteIP net.IP
 }
 
 // LogFields renders the current response as a set of log fields.
@@ -121,6 +134,9 @@ func (r AnnounceRequest) LogFields() log.Fields {
 		"uploaded":        r.Uploaded,
 		"peer":            r.Peer,
 		"params":          r.Params,
+		"altPeer":         r.AltPeer,
+		"trackerID":       r.TrackerID,
+		"remoteIP":        r.RemoteIP,
 	}
 }
 
@@ -134,17 +150,31 @@ type AnnounceResponse struct {
 	MinInterval time.Duration
 	IPv4Peers   []Peer
 	IPv6Peers   []Peer
+
+	// WarningMessage is shown to the user like a failure reason, but the
+	// response is processed normally.
+	WarningMessage string
+
+	// TrackerID is sent back by the client on its next announces.
+	TrackerID string
+
+	// ExternalIP is the IP address the announce was received from, as
+	// described in BEP 24.
+	ExternalIP net.IP
 }
 
 // LogFields renders the current response as a set of log fields.
 func (r AnnounceResponse) LogFields() log.Fields {
 	return log.Fields{
-		"compact":     r.Compact,
-		"complete":    r.Complete,
-		"interval":    r.Interval,
-		"minInterval": r.MinInterval,
-		"ipv4Peers":   r.IPv4Peers,
-		"ipv6Peers":   r.IPv6Peers,
+		"compact":        r.Compact,
+		"complete":       r.Complete,
+		"interval":       r.Interval,
+		"minInterval":    r.MinInterval,
+		"ipv4Peers":      r.IPv4Peers,
+		"ipv6Peers":      r.IPv6Peers,
+		"warningMessage": r.WarningMessage,
+		"trackerID":      r.TrackerID,
+		"externalIP":     r.ExternalIP,
 	}
 }
 
@@ -153,6 +183,9 @@ type ScrapeRequest struct {
 	AddressFamily AddressFamily
 	InfoHashes    []InfoHash
 	Params        Params
+
+	// IP is the address the request was received from.
+	IP net.IP
 }
 
 // LogFields renders the current response as a set of log fields.
@@ -161,6 +194,7 @@ func (r ScrapeRequest) LogFields() log.Fields {
 		"addressFamily": r.AddressFamily,
 		"infoHashes":    r.InfoHashes,
 		"params":        r.Params,
+		"ip":            r.IP,
 	}
 }
 
@@ -185,6 +219,10 @@ type Scrape struct {
 	Snatches   uint32
 	Complete   uint32
 	Incomplete uint32
+
+	// Name is the name of the torrent, if it is known. It is returned in
+	// HTTP scrapes as described in BEP 48.
+	Name string
 }
 
 // AddressFamily is the address family of an IP address.
@@ -253,3 +291,11 @@ type ClientError string
 
 // Error implements the error interface for ClientError.
 func (c ClientError) Error() string { return string(c) }
+
+// ErrRateLimited is the error returned when a client sends requests faster
+// than it is allowed to.
+//
+// Frontends of connectionless protocols should drop requests failing with
+// this error without responding, so that a flood of spoofed requests does not
+// cause a flood of responses.
+var ErrRateLimited = ClientError("rate limit exceeded")
@@ -0,0 +1,369 @@
+package bittorrent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/doujincafe/chihaya/pkg/log"
+)
+
+// PeerIDStyle is the convention a client used to encode its name and version
+// into its PeerID.
+type PeerIDStyle uint8
+
+// The PeerID styles that can be identified.
+const (
+	// UnknownStyle is used for PeerIDs that follow no known convention.
+	UnknownStyle PeerIDStyle = iota
+
+	// AzureusStyle PeerIDs start with a dash, two characters for the client
+	// and four characters for the version, followed by another dash, e.g.
+	// "-qB4350-".
+	AzureusStyle
+
+	// ShadowStyle PeerIDs start with one character for the client and up to
+	// five characters for the version, padded with dashes, e.g. "T03A0----".
+	ShadowStyle
+
+	// MainlineStyle PeerIDs start with one character for the client and the
+	// decimal version, separated and followed by dashes, e.g. "M4-20-8-".
+	MainlineStyle
+)
+
+// String implements fmt.Stringer for PeerIDStyle.
+func (s PeerIDStyle) String() string {
+	switch s {
+	case AzureusStyle:
+		return "azureus"
+	case ShadowStyle:
+		return "shadow"
+	case MainlineStyle:
+		return "mainline"
+	default:
+		return "unknown"
+	}
+}
+
+// ClientVersion is the version of a BitTorrent client.
+type ClientVersion struct {
+	Major, Minor, Patch int
+}
+
+// ParseClientVersion parses a version of the form "major[.minor[.patch]]".
+// Omitted components are zero.
+func ParseClientVersion(s string) (ClientVersion, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return ClientVersion{}, fmt.Errorf("invalid version %q", s)
+	}
+
+	var components [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return ClientVersion{}, fmt.Errorf("invalid version %q", s)
+		}
+		components[i] = n
+	}
+
+	return ClientVersion{components[0], components[1], components[2]}, nil
+}
+
+// Compare returns -1, 0 or 1 if v is lower than, equal to or greater than x.
+func (v ClientVersion) Compare(x ClientVersion) int {
+	for _, d := range [3]int{v.Major - x.Major, v.Minor - x.Minor, v.Patch - x.Patch} {
+		if d < 0 {
+			return -1
+		} else if d > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// String implements fmt.Stringer for ClientVersion.
+func (v ClientVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// ClientInfo describes the client software of a Peer as encoded in its
+// PeerID.
+type ClientInfo struct {
+	Style PeerIDStyle
+
+	// Code is the client code of the PeerID, e.g. "qB" or "T".
+	Code string
+
+	// Name is the name of the client, or empty if the code is not in the
+	// table of well-known clients.
+	Name string
+
+	Version ClientVersion
+}
+
+// LogFields renders the current ClientInfo as a set of log fields.
+func (c ClientInfo) LogFields() log.Fields {
+	return log.Fields{
+		"style":   c.Style.String(),
+		"code":    c.Code,
+		"name":    c.Name,
+		"version": c.Version.String(),
+	}
+}
+
+// IdentifyClient decodes the client and version from a PeerID.
+//
+// It returns false if the PeerID follows none of the known styles.
+func IdentifyClient(pid PeerID) (ClientInfo, bool) {
+	if info, ok := identifyMainline(pid); ok {
+		return info, true
+	}
+	if info, ok := identifyAzureus(pid); ok {
+		return info, true
+	}
+	if info, ok := identifyShadow(pid); ok {
+		return info, true
+	}
+	return ClientInfo{}, false
+}
+
+func identifyAzureus(pid PeerID) (ClientInfo, bool) {
+	if pid[0] != '-' || pid[7] != '-' {
+		return ClientInfo{}, false
+	}
+
+	var digits [4]int
+	for i, c := range pid[3:7] {
+		d := base36Digit(c)
+		if d < 0 {
+			return ClientInfo{}, false
+		}
+		digits[i] = d
+	}
+
+	code := string(pid[1:3])
+	info := ClientInfo{
+		Style: AzureusStyle,
+		Code:  code,
+		Name:  azureusClients[code],
+	}
+
+	if decode, ok := azureusVersions[code]; ok {
+		info.Version = decode(digits)
+	} else {
+		info.Version = ClientVersion{digits[0], digits[1], digits[2]}
+	}
+
+	return info, true
+}
+
+// shadowDigits are the characters used to encode the version of Shadow-style
+// PeerIDs, in the order of their values.
+const shadowDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+func identifyShadow(pid PeerID) (ClientInfo, bool) {
+	code := string(pid[:1])
+	name, ok := shadowClients[code]
+	if !ok {
+		return ClientInfo{}, false
+	}
+
+	// The version consists of one to five characters followed by at least
+	// two dashes.
+	end := strings.IndexByte(string(pid[1:7]), '-')
+	if end < 1 || pid[end+2] != '-' {
+		return ClientInfo{}, false
+	}
+
+	var digits [3]int
+	for i, c := range pid[1 : 1+end] {
+		d := strings.IndexByte(shadowDigits, c)
+		if d < 0 {
+			return ClientInfo{}, false
+		}
+		if i < len(digits) {
+			digits[i] = d
+		}
+	}
+
+	return ClientInfo{
+		Style:   ShadowStyle,
+		Code:    code,
+		Name:    name,
+		Version: ClientVersion{digits[0], digits[1], digits[2]},
+	}, true
+}
+
+func identifyMainline(pid PeerID) (ClientInfo, bool) {
+	code := string(pid[:1])
+	name, ok := mainlineClients[code]
+	if !ok {
+		return ClientInfo{}, false
+	}
+
+	// The version is three decimal numbers separated and followed by
+	// dashes, padded to eight characters with dashes.
+	parts := strings.SplitN(string(pid[1:8]), "-", 4)
+	if len(parts) != 4 || strings.Trim(parts[3], "-") != "" {
+		return ClientInfo{}, false
+	}
+
+	var digits [3]int
+	for i, part := range parts[:3] {
+		if len(part) == 0 || len(part) > 2 {
+			return ClientInfo{}, false
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return ClientInfo{}, false
+		}
+		digits[i] = n
+	}
+
+	return ClientInfo{
+		Style:   MainlineStyle,
+		Code:    code,
+		Name:    name,
+		Version: ClientVersion{digits[0], digits[1], digits[2]},
+	}, true
+}
+
+// base36Digit returns the value of an alphanumeric character, or -1.
+func base36Digit(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 10
+	default:
+		return -1
+	}
+}
+
+// azureusVersions holds the clients whose version encoding differs from the
+// common one, which uses the first three characters as major, minor and patch
+// version.
+var azureusVersions = map[string]func(digits [4]int) ClientVersion{
+	// Transmission encodes 0.72 as "0072", 2.94 as "2940" and, starting
+	// with 4.0, 4.0.5 as "4050".
+	"TR": func(d [4]int) ClientVersion {
+		switch {
+		case d[0] == 0:
+			return ClientVersion{0, d[2]*10 + d[3], 0}
+		case d[0] < 4:
+			return ClientVersion{d[0], d[1]*10 + d[2], 0}
+		default:
+			return ClientVersion{d[0], d[1], d[2]}
+		}
+	},
+}
+
+// azureusClients maps the codes of Azureus-style PeerIDs to client names.
+var azureusClients = map[string]string{
+	"7T": "aTorrent",
+	"A~": "Ares",
+	"AG": "Ares",
+	"AR": "Arctic",
+	"AT": "Artemis",
+	"AV": "Avicora",
+	"AX": "BitPump",
+	"AZ": "Vuze",
+	"BB": "BitBuddy",
+	"BC": "BitComet",
+	"BE": "BitTorrent SDK",
+	"BF": "Bitflu",
+	"BG": "BTG",
+	"BI": "BiglyBT",
+	"BL": "BitBlinder",
+	"BP": "BitTorrent Pro",
+	"BR": "BitRocket",
+	"BS": "BTSlave",
+	"BT": "BitTorrent",
+	"BW": "BitWombat",
+	"BX": "BittorrentX",
+	"CD": "Enhanced CTorrent",
+	"CT": "CTorrent",
+	"DE": "Deluge",
+	"DP": "Propagate Data Client",
+	"EB": "EBit",
+	"ES": "electric sheep",
+	"FC": "FileCroc",
+	"FD": "Free Download Manager",
+	"FG": "FlashGet",
+	"FT": "FoxTorrent",
+	"FW": "FrostWire",
+	"FX": "Freebox BitTorrent",
+	"GS": "GSTorrent",
+	"HK": "Hekate",
+	"HL": "Halite",
+	"HN": "Hydranode",
+	"KG": "KGet",
+	"KT": "KTorrent",
+	"LC": "LeechCraft",
+	"LH": "LH-ABC",
+	"LP": "Lphant",
+	"LT": "libtorrent (Rasterbar)",
+	"lt": "libTorrent (Rakshasa)",
+	"LW": "LimeWire",
+	"MO": "MonoTorrent",
+	"MP": "MooPolice",
+	"MR": "Miro",
+	"MT": "MoonlightTorrent",
+	"NX": "Net Transport",
+	"OS": "OneSwarm",
+	"OT": "OmegaTorrent",
+	"PD": "Pando",
+	"PI": "PicoTorrent",
+	"qB": "qBittorrent",
+	"QD": "QQDownload",
+	"QT": "Qt 4 Torrent example",
+	"RT": "Retriever",
+	"SB": "Swiftbit",
+	"SD": "Thunder",
+	"SM": "SoMud",
+	"SS": "SwarmScope",
+	"ST": "SymTorrent",
+	"st": "sharktorrent",
+	"SZ": "Shareaza",
+	"TB": "Torch",
+	"TL": "Tribler",
+	"TN": "TorrentDotNET",
+	"TR": "Transmission",
+	"TS": "Torrentstorm",
+	"TT": "TuoTu",
+	"UL": "uLeecher!",
+	"UM": "µTorrent for Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"VG": "Vagaa",
+	"WD": "WebTorrent Desktop",
+	"WT": "BitLet",
+	"WW": "WebTorrent",
+	"WY": "FireTorrent",
+	"XF": "Xfplay",
+	"XL": "Xunlei",
+	"XS": "XSwifter",
+	"XT": "XanTorrent",
+	"XX": "Xtorrent",
+	"ZT": "ZipTorrent",
+}
+
+// shadowClients maps the codes of Shadow-style PeerIDs to client names.
+var shadowClients = map[string]string{
+	"A": "ABC",
+	"O": "Osprey Permaseed",
+	"Q": "BTQueue",
+	"R": "Tribler",
+	"S": "Shadow's client",
+	"T": "BitTornado",
+	"U": "UPnP NAT Bit Torrent",
+}
+
+// mainlineClients maps the codes of Mainline-style PeerIDs to client names.
+var mainlineClients = map[string]string{
+	"M": "BitTorrent Mainline",
+	"Q": "Queen Bee",
+}
@@ -0,0 +1,62 @@
+package bittorrent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentifyClient(t *testing.T) {
+	var table = []struct {
+		peerID   string
+		ok       bool
+		expected ClientInfo
+	}{
+		{"-qB4350-6wfG2wk6wWLc", true, ClientInfo{AzureusStyle, "qB", "qBittorrent", ClientVersion{4, 3, 5}}},
+		{"-UT355W-MNu93JKnm930", true, ClientInfo{AzureusStyle, "UT", "µTorrent", ClientVersion{3, 5, 5}}},
+		{"-DE13F0-2nkdf08Jd890", true, ClientInfo{AzureusStyle, "DE", "Deluge", ClientVersion{1, 3, 15}}},
+		{"-LT1280-2nkdf08Jd890", true, ClientInfo{AzureusStyle, "LT", "libtorrent (Rasterbar)", ClientVersion{1, 2, 8}}},
+		{"-TR0072-6ep6svaa61r4", true, ClientInfo{AzureusStyle, "TR", "Transmission", ClientVersion{0, 72, 0}}},
+		{"-TR2940-6ep6svaa61r4", true, ClientInfo{AzureusStyle, "TR", "Transmission", ClientVersion{2, 94, 0}}},
+		{"-TR4050-6ep6svaa61r4", true, ClientInfo{AzureusStyle, "TR", "Transmission", ClientVersion{4, 0, 5}}},
+		{"-A~0010-a9mn9DFkj39J", true, ClientInfo{AzureusStyle, "A~", "Ares", ClientVersion{0, 0, 1}}},
+		{"-ZZ1234-a9mn9DFkj39J", true, ClientInfo{AzureusStyle, "ZZ", "", ClientVersion{1, 2, 3}}},
+
+		{"T03A0----f089kjsdf6e", true, ClientInfo{ShadowStyle, "T", "BitTornado", ClientVersion{0, 3, 10}}},
+		{"S58B-----nKl34GoNb75", true, ClientInfo{ShadowStyle, "S", "Shadow's client", ClientVersion{5, 8, 11}}},
+		{"A310--001v5Gysr4NxNK", true, ClientInfo{ShadowStyle, "A", "ABC", ClientVersion{3, 1, 0}}},
+
+		{"M4-4-0--9aa757Efd5Bl", true, ClientInfo{MainlineStyle, "M", "BitTorrent Mainline", ClientVersion{4, 4, 0}}},
+		{"M4-20-8-9aa757Efd5Bl", true, ClientInfo{MainlineStyle, "M", "BitTorrent Mainline", ClientVersion{4, 20, 8}}},
+		{"Q1-10-0-Yoiumn39BDfO", true, ClientInfo{MainlineStyle, "Q", "Queen Bee", ClientVersion{1, 10, 0}}},
+
+		{"-ML2.7.2-kgjjfkd9762", false, ClientInfo{}},
+		{"346------SDFknl33408", false, ClientInfo{}},
+		{"exbc0JdSklm834kj9Udf", false, ClientInfo{}},
+		{"M4-4-0-x9aa757Efd5Bl", false, ClientInfo{}},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.peerID, func(t *testing.T) {
+			got, ok := IdentifyClient(PeerIDFromString(tt.peerID))
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestClientVersion(t *testing.T) {
+	v, err := ParseClientVersion("4.3")
+	require.Nil(t, err)
+	require.Equal(t, ClientVersion{4, 3, 0}, v)
+	require.Equal(t, "4.3.0", v.String())
+
+	for _, s := range []string{"", "4.", "a.b", "1.2.3.4", "-1"} {
+		_, err := ParseClientVersion(s)
+		require.NotNil(t, err, s)
+	}
+
+	require.Equal(t, 0, ClientVersion{4, 3, 0}.Compare(ClientVersion{4, 3, 0}))
+	require.Equal(t, -1, ClientVersion{4, 2, 9}.Compare(ClientVersion{4, 3, 0}))
+	require.Equal(t, 1, ClientVersion{5, 0, 0}.Compare(ClientVersion{4, 9, 9}))
+}
@@ -60,6 +60,27 @@ type routeParamsKey struct{}
 // contains the named parameters from the http router.
 var RouteParamsKey = routeParamsKey{}
 
+type routeKey struct{}
+
+// RouteKey is a key for the context of a request that contains the pattern
+// of the http router route that matched the request, e.g.
+// "/announce/:passkey".
+var RouteKey = routeKey{}
+
+type frontendKey struct{}
+
+// FrontendKey is a key for the context of a request that contains the name
+// of the frontend that received the request, e.g. "http" or "udp".
+var FrontendKey = frontendKey{}
+
+type maxNumWantKey struct{}
+
+// MaxNumWantKey is a key for the context of an announce that contains the
+// uint32 maximum number of peers the frontend returns for it.
+//
+// Hooks changing the NumWant of an AnnounceRequest must not exceed it.
+var MaxNumWantKey = maxNumWantKey{}
+
 // RouteParam is a type that contains the values from the named parameters
 // on the route.
 type RouteParam struct {
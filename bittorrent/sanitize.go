@@ -34,6 +34,12 @@ func SanitizeAnnounce(r *AnnounceRequest, maxNumWant, defaultNumWant uint32) err
 		return ErrInvalidIP
 	}
 
+	if r.AltPeer != nil && !sanitizeAltPeer(r.AltPeer, r.Peer.IP.AddressFamily) {
+		// The alternative peer is optional, so an invalid one is dropped
+		// rather than failing the announce.
+		r.AltPeer = nil
+	}
+
 	log.Debug("sanitized announce", r, log.Fields{
 		"maxNumWant":     maxNumWant,
 		"defaultNumWant": defaultNumWant,
@@ -41,6 +47,29 @@ func SanitizeAnnounce(r *AnnounceRequest, maxNumWant, defaultNumWant uint32) err
 	return nil
 }
 
+// sanitizeAltPeer coerces the IP address of an alternative peer into the
+// proper format and reports whether it is valid and not of the address family
+// af of the main peer.
+//
+// The address of an alternative peer is provided by the client and handed out
+// to other peers unverified, so only public unicast addresses are valid:
+// loopback, link-local, multicast, unspecified and private addresses are not.
+func sanitizeAltPeer(p *Peer, af AddressFamily) bool {
+	if ip := p.IP.To4(); ip != nil {
+		p.IP = IP{IP: ip, AddressFamily: IPv4}
+	} else if len(p.IP.IP) == net.IPv6len {
+		p.IP.AddressFamily = IPv6
+	} else {
+		return false
+	}
+
+	if !p.IP.IsGlobalUnicast() || p.IP.IsPrivate() {
+		return false
+	}
+
+	return p.Port != 0 && p.IP.AddressFamily != af
+}
+
 // SanitizeScrape enforces a max number of infohashes for a single scrape
 // request.
 func SanitizeScrape(r *ScrapeRequest, maxScrapeInfoHashes uint32) error {
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/storage"
+)
+
+// defaultWarning is the message logged by Validate methods when they replace
+// a value with its default.
+const defaultWarning = "falling back to default configuration"
+
+// Check validates a configuration without binding ports, connecting to
+// anything or starting background goroutines.
+//
+// Every value replaced by its default is logged as a warning, like it is when
+// starting Chihaya. All errors found are returned at once.
+func (cfg Config) Check() error {
+	var errs []error
+
+	cfg.ResponseConfig.Validate()
+
+	if cfg.MetricsAddr != "" {
+		if _, err := net.ResolveTCPAddr("tcp", cfg.MetricsAddr); err != nil {
+			errs = append(errs, errors.New("metrics_addr: "+err.Error()))
+		}
+	}
+
+	if cfg.AdminConfig.Addr != "" {
+		if err := cfg.AdminConfig.Check(); err != nil {
+			errs = append(errs, errors.New("admin: "+err.Error()))
+		}
+	}
+
+	if cfg.HTTPConfig.Addr != "" {
+		if err := cfg.HTTPConfig.Check(); err != nil {
+			errs = append(errs, errors.New("http: "+err.Error()))
+		}
+	}
+
+	if cfg.UDPConfig.Addr != "" {
+		if err := cfg.UDPConfig.Check(); err != nil {
+			errs = append(errs, errors.New("udp: "+err.Error()))
+		}
+	}
+
+	if err := cfg.checkUDPAddrs(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := storage.CheckConfig(cfg.Storage.Name, cfg.Storage.Config); err != nil {
+		errs = append(errs, errors.New("storage: "+err.Error()))
+	}
+
+	if err := middleware.CheckHookConfigs(cfg.PreHooks); err != nil {
+		errs = append(errs, errors.New("prehooks: "+err.Error()))
+	}
+
+	if err := middleware.CheckHookConfigs(cfg.PostHooks); err != nil {
+		errs = append(errs, errors.New("posthooks: "+err.Error()))
+	}
+
+	if err := middleware.CheckChainConfigs(cfg.Chains); err != nil {
+		errs = append(errs, errors.New("chains: "+err.Error()))
+	}
+
+	if len(errs) != 0 {
+		return combineErrors("invalid config", errs)
+	}
+	return nil
+}
+
+// warning is a warning logged while checking a configuration.
+type warning struct {
+	msg    string
+	fields logrus.Fields
+}
+
+// warningCollector is a logrus.Hook that collects warnings.
+type warningCollector struct {
+	sync.Mutex
+	warnings []warning
+}
+
+func (c *warningCollector) Levels() []logrus.Level {
+	return []logrus.Level{logrus.WarnLevel}
+}
+
+func (c *warningCollector) Fire(e *logrus.Entry) error {
+	fields := make(logrus.Fields, len(e.Data))
+	for k, v := range e.Data {
+		fields[k] = v
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.warnings = append(c.warnings, warning{msg: e.Message, fields: fields})
+	return nil
+}
+
+// CheckRunCmdFunc implements a Cobra command that checks a configuration file
+// and prints every value replaced by its default.
+func CheckRunCmdFunc(cmd *cobra.Command, args []string) error {
+	configFilePath, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return err
+	}
+
+	debugLog, err := cmd.Flags().GetBool("debug")
+	if err != nil {
+		return err
+	}
+
+	// Warnings are printed below, everything else is only of interest when
+	// debugging.
+	if !debugLog {
+		log.SetOutput(ioutil.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+	collector := &warningCollector{}
+	log.AddHook(collector)
+
+	configFile, err := ParseConfigFileStrict(configFilePath)
+	if err != nil {
+		return errors.New("failed to read config: " + err.Error())
+	}
+	checkErr := configFile.Chihaya.Check()
+
+	out := cmd.OutOrStdout()
+	collector.Lock()
+	defer collector.Unlock()
+	for _, w := range collector.warnings {
+		if w.msg == defaultWarning {
+			fmt.Fprintf(out, "default: %v = %v (provided: %v)\n", w.fields["name"], w.fields["default"], w.fields["provided"])
+			continue
+		}
+		fmt.Fprintf(out, "warning: %s %v\n", w.msg, w.fields)
+	}
+
+	if checkErr != nil {
+		return checkErr
+	}
+
+	fmt.Fprintln(out, "config OK")
+	return nil
+}
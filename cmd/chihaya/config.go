@@ -10,9 +10,16 @@ import (
 	"github.com/doujincafe/chihaya/frontend/http"
 	"github.com/doujincafe/chihaya/frontend/udp"
 	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/admin"
 
 	// Imports to register middleware drivers.
 	_ "github.com/doujincafe/chihaya/middleware/clientapproval"
+	_ "github.com/doujincafe/chihaya/middleware/dyninterval"
+	_ "github.com/doujincafe/chihaya/middleware/eventsink"
+	_ "github.com/doujincafe/chihaya/middleware/ipfilter"
+	_ "github.com/doujincafe/chihaya/middleware/jwt"
+	_ "github.com/doujincafe/chihaya/middleware/ratelimit"
+	_ "github.com/doujincafe/chihaya/middleware/script"
 	_ "github.com/doujincafe/chihaya/middleware/torrentapproval"
 	_ "github.com/doujincafe/chihaya/middleware/varinterval"
 	_ "github.com/doujincafe/chihaya/middleware/cutenanami"
@@ -29,12 +36,94 @@ type storageConfig struct {
 // Config represents the configuration used for executing Chihaya.
 type Config struct {
 	middleware.ResponseConfig `yaml:",inline"`
-	MetricsAddr               string                  `yaml:"metrics_addr"`
-	HTTPConfig                http.Config             `yaml:"http"`
-	UDPConfig                 udp.Config              `yaml:"udp"`
-	Storage                   storageConfig           `yaml:"storage"`
-	PreHooks                  []middleware.HookConfig `yaml:"prehooks"`
-	PostHooks                 []middleware.HookConfig `yaml:"posthooks"`
+	MetricsAddr               string                   `yaml:"metrics_addr"`
+	AdminConfig               admin.Config             `yaml:"admin"`
+	HTTPConfig                http.Config              `yaml:"http"`
+	UDPConfig                 udp.Config               `yaml:"udp"`
+	Storage                   storageConfig            `yaml:"storage"`
+	PreHooks                  []middleware.HookConfig  `yaml:"prehooks"`
+	PostHooks                 []middleware.HookConfig  `yaml:"posthooks"`
+	Chains                    []middleware.ChainConfig `yaml:"chains"`
+}
+
+// redactedValue replaces secrets in a config for display.
+const redactedValue = "REDACTED"
+
+// redacted returns the config with secrets replaced, for display.
+//
+// Options of hooks and the storage are opaque to Chihaya and may contain
+// secrets, so all their values are replaced, keeping their keys.
+func (cfg Config) redacted() Config {
+	if cfg.AdminConfig.Token != "" {
+		cfg.AdminConfig.Token = redactedValue
+	}
+	if cfg.UDPConfig.PrivateKey != "" {
+		cfg.UDPConfig.PrivateKey = redactedValue
+	}
+	cfg.Storage.Config = redactOptions(cfg.Storage.Config)
+	cfg.PreHooks = redactHooks(cfg.PreHooks)
+	cfg.PostHooks = redactHooks(cfg.PostHooks)
+	if cfg.Chains != nil {
+		chains := make([]middleware.ChainConfig, len(cfg.Chains))
+		for i, chain := range cfg.Chains {
+			chain.PreHooks = redactHooks(chain.PreHooks)
+			chain.PostHooks = redactHooks(chain.PostHooks)
+			chains[i] = chain
+		}
+		cfg.Chains = chains
+	}
+	return cfg
+}
+
+func redactHooks(hooks []middleware.HookConfig) []middleware.HookConfig {
+	if hooks == nil {
+		return nil
+	}
+	redacted := make([]middleware.HookConfig, len(hooks))
+	for i, hook := range hooks {
+		if hook.Options != nil {
+			hook.Options = redactOptions(hook.Options).(map[string]interface{})
+		}
+		redacted[i] = hook
+	}
+	return redacted
+}
+
+// redactOptions returns a copy of options as parsed from YAML with every
+// value replaced, keeping the keys of maps.
+func redactOptions(options interface{}) interface{} {
+	switch v := options.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			redacted[k] = redactOptions(e)
+		}
+		return redacted
+	case map[interface{}]interface{}:
+		redacted := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			redacted[k] = redactOptions(e)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, e := range v {
+			redacted[i] = redactOptions(e)
+		}
+		return redacted
+	}
+	return redactedValue
+}
+
+// checkUDPAddrs checks that HTTP/3 and the UDP frontend are not configured
+// on the same UDP address.
+func (cfg Config) checkUDPAddrs() error {
+	if cfg.HTTPConfig.EnableHTTP3 && cfg.UDPConfig.Addr != "" && cfg.HTTPConfig.HTTPSAddr == cfg.UDPConfig.Addr {
+		return errors.New("http.https_addr and udp.addr must differ when HTTP/3 is enabled")
+	}
+	return nil
 }
 
 // PreHookNames returns only the names of the configured middleware.
@@ -55,6 +144,15 @@ func (cfg Config) PostHookNames() (names []string) {
 	return
 }
 
+// ChainNames returns only the names of the configured chains.
+func (cfg Config) ChainNames() (names []string) {
+	for _, chain := range cfg.Chains {
+		names = append(names, chain.Name)
+	}
+
+	return
+}
+
 // ConfigFile represents a namespaced YAML configation file.
 type ConfigFile struct {
 	Chihaya Config `yaml:"chihaya"`
@@ -65,6 +163,19 @@ type ConfigFile struct {
 //
 // It supports relative and absolute paths and environment variables.
 func ParseConfigFile(path string) (*ConfigFile, error) {
+	return parseConfigFile(path, yaml.Unmarshal)
+}
+
+// ParseConfigFileStrict is like ParseConfigFile, but unknown keys and
+// duplicate keys are errors.
+//
+// Options of hooks and the storage are not parsed into their types and
+// therefore not checked by this function.
+func ParseConfigFileStrict(path string) (*ConfigFile, error) {
+	return parseConfigFile(path, yaml.UnmarshalStrict)
+}
+
+func parseConfigFile(path string, unmarshal func([]byte, interface{}) error) (*ConfigFile, error) {
 	if path == "" {
 		return nil, errors.New("no config path specified")
 	}
@@ -81,7 +192,7 @@ func ParseConfigFile(path string) (*ConfigFile, error) {
 	}
 
 	var cfgFile ConfigFile
-	err = yaml.Unmarshal(contents, &cfgFile)
+	err = unmarshal(contents, &cfgFile)
 	if err != nil {
 		return nil, err
 	}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"errors"
+	"net"
 	"os"
 	"os/signal"
+	"reflect"
 	"runtime"
 	"strings"
 	"syscall"
@@ -12,9 +14,12 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/doujincafe/chihaya/frontend"
 	"github.com/doujincafe/chihaya/frontend/http"
 	"github.com/doujincafe/chihaya/frontend/udp"
 	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/admin"
+	"github.com/doujincafe/chihaya/pkg/listener"
 	"github.com/doujincafe/chihaya/pkg/log"
 	"github.com/doujincafe/chihaya/pkg/metrics"
 	"github.com/doujincafe/chihaya/pkg/stop"
@@ -24,79 +29,408 @@ import (
 // Run represents the state of a running instance of Chihaya.
 type Run struct {
 	configFilePath string
-	peerStore      storage.PeerStore
-	logic          *middleware.Logic
-	sg             *stop.Group
+
+	// cfg is the configuration the Run was last started with, as it was
+	// provided. It is nil until the Run is started.
+	cfg *Config
+
+	peerStore storage.PeerStore
+	logic     *middleware.Logic
+	swapper   *frontend.SwappableLogic
+	listeners *listener.Set
+
+	metricsSrv   *metrics.Server
+	adminSrv     *admin.Server
+	adminTracker admin.Tracker
+	httpFE       *http.Frontend
+	udpFE        *udp.Frontend
+
+	// udpPrivateKey is the private key used by the UDP frontend, which is
+	// kept across reloads and upgrades if it was generated.
+	udpPrivateKey string
+
+	// reloadRequests receives reloads requested through the admin API.
+	reloadRequests chan struct{}
 }
 
 // NewRun runs an instance of Chihaya.
 func NewRun(configFilePath string) (*Run, error) {
+	configFile, err := ParseConfigFile(configFilePath)
+	if err != nil {
+		return nil, errors.New("failed to read config: " + err.Error())
+	}
+
+	// A process started by an upgrade takes over the sockets and peers of
+	// the process it replaces.
+	handoff, err := inheritedHandoff()
+	if err != nil {
+		return nil, errors.New("failed to take over from previous process: " + err.Error())
+	}
+
+	return newRun(configFilePath, configFile.Chihaya, handoff)
+}
+
+// newRun runs an instance of Chihaya with the given configuration, taking
+// over from the process at the other end of handoff unless it is nil.
+//
+// The logic is created before the previous process is asked to stop serving,
+// so that an invalid configuration does not interrupt it, and the frontends
+// are started once its peers were received.
+func newRun(configFilePath string, cfg Config, handoff *upgradeHandoff) (*Run, error) {
 	r := &Run{
 		configFilePath: configFilePath,
+		listeners:      listener.NewSet(),
+		reloadRequests: make(chan struct{}, 1),
+	}
+
+	var err error
+	if handoff != nil {
+		defer handoff.Close()
+		log.Info("taking over from previous process")
+		if r.listeners, r.udpPrivateKey, err = handoff.receiveListeners(); err != nil {
+			return nil, errors.New("failed to receive sockets: " + err.Error())
+		}
+	}
+
+	log.Info("starting storage", log.Fields{"name": cfg.Storage.Name})
+	r.peerStore, err = storage.NewPeerStore(cfg.Storage.Name, cfg.Storage.Config)
+	if err != nil {
+		r.listeners.Close()
+		return nil, errors.New("failed to create storage: " + err.Error())
 	}
+	log.Info("started storage", r.peerStore)
 
-	return r, r.Start(nil)
+	abort := func(err error) (*Run, error) {
+		if errs := r.peerStore.Stop().Wait(); len(errs) != 0 {
+			log.Error("failed while shutting down peer store", log.Fields{"errors": errs})
+		}
+		r.listeners.Close()
+		return nil, err
+	}
+
+	logic, err := r.prepare(cfg)
+	if err != nil {
+		return abort(err)
+	}
+
+	if handoff != nil {
+		if err := handoff.receivePeers(r.peerStore); err != nil {
+			stopLogged("logic", logic)
+			return abort(errors.New("failed to receive peers: " + err.Error()))
+		}
+	}
+
+	if err := r.start(cfg, logic); err != nil {
+		return abort(err)
+	}
+
+	if handoff != nil {
+		if err := handoff.done(); err != nil {
+			if stopErr := r.Stop(); stopErr != nil {
+				log.Error("failed while shutting down", log.Err(stopErr))
+			}
+			return nil, errors.New("failed to take over from previous process: " + err.Error())
+		}
+		log.Info("took over from previous process")
+	}
+
+	return r, nil
 }
 
-// Start begins an instance of Chihaya.
-// It is optional to provide an instance of the peer store to avoid the
-// creation of a new one.
-func (r *Run) Start(ps storage.PeerStore) error {
-	configFile, err := ParseConfigFile(r.configFilePath)
+// apply starts the Run with the given configuration, or switches a running
+// Run over to it.
+//
+// The sockets of the frontends and the metrics server stay bound if their
+// addresses did not change, and frontends whose configuration did not change
+// keep running. The middleware is replaced without interrupting the
+// frontends. If any part of the new configuration fails to start, the Run
+// is left running with its previous configuration.
+//
+// Storage can not be reconfigured: the peer store is kept as it is.
+func (r *Run) apply(cfg Config) error {
+	logic, err := r.prepare(cfg)
 	if err != nil {
-		return errors.New("failed to read config: " + err.Error())
+		return err
+	}
+	return r.start(cfg, logic)
+}
+
+// prepare checks what can be checked of a configuration before stopping
+// anything and creates its logic.
+func (r *Run) prepare(cfg Config) (*middleware.Logic, error) {
+	if cfg.HTTPConfig.Addr != "" {
+		if err := cfg.HTTPConfig.Check(); err != nil {
+			return nil, errors.New("invalid http config: " + err.Error())
+		}
+	}
+	if cfg.UDPConfig.Addr != "" {
+		if err := cfg.UDPConfig.Check(); err != nil {
+			return nil, errors.New("invalid udp config: " + err.Error())
+		}
+	}
+	if cfg.AdminConfig.Addr != "" {
+		if err := cfg.AdminConfig.Check(); err != nil {
+			return nil, errors.New("invalid admin config: " + err.Error())
+		}
+	}
+	if err := cfg.checkUDPAddrs(); err != nil {
+		return nil, err
+	}
+	if r.cfg != nil && !reflect.DeepEqual(r.cfg.Storage, cfg.Storage) {
+		log.Warn("storage configuration changed, restart to apply it", log.Fields{"name": cfg.Storage.Name})
+	}
+
+	return newLogic(cfg, r.peerStore)
+}
+
+// start switches the Run over to a configuration and the logic prepared for
+// it. If it fails, the logic is stopped and the Run keeps running with its
+// previous configuration.
+func (r *Run) start(cfg Config, logic *middleware.Logic) (err error) {
+	old := r.cfg
+	defer func() {
+		if err != nil {
+			stopLogged("logic", logic)
+		}
+	}()
+
+	metricsSrv := r.metricsSrv
+	if (old == nil || old.MetricsAddr != cfg.MetricsAddr) && cfg.MetricsAddr != "" {
+		log.Info("starting metrics server", log.Fields{"addr": cfg.MetricsAddr})
+		var l net.Listener
+		if l, err = r.listeners.Listen(cfg.MetricsAddr); err != nil {
+			return errors.New("failed to start metrics server: " + err.Error())
+		}
+		metricsSrv = metrics.NewServerWithListener(l)
+		defer func() {
+			if err != nil {
+				stopLogged("metrics server", metricsSrv)
+			}
+		}()
+	} else if cfg.MetricsAddr == "" {
+		metricsSrv = nil
+	}
+
+	tracker := admin.Tracker{
+		Config:    ConfigFile{Chihaya: cfg.redacted()},
+		Logic:     logic,
+		PeerStore: r.peerStore,
+		Reload:    r.requestReload,
+		Started:   time.Now(),
+	}
+	adminSrv := r.adminSrv
+	if old == nil || old.AdminConfig.Addr != cfg.AdminConfig.Addr {
+		adminSrv = nil
+		if cfg.AdminConfig.Addr != "" {
+			log.Info("starting admin API", cfg.AdminConfig)
+			adminCfg := cfg.AdminConfig
+			adminCfg.Listen = r.listeners.Listen
+			adminSrv, err = admin.NewServer(adminCfg, tracker)
+			if err != nil {
+				return errors.New("failed to start admin API: " + err.Error())
+			}
+			defer func() {
+				if err != nil {
+					stopLogged("admin API", adminSrv)
+				}
+			}()
+		}
 	}
-	cfg := configFile.Chihaya
 
-	r.sg = stop.NewGroup()
+	if r.swapper == nil {
+		r.swapper = frontend.NewSwappableLogic(logic)
+	}
 
-	log.Info("starting metrics server", log.Fields{"addr": cfg.MetricsAddr})
-	r.sg.Add(metrics.NewServer(cfg.MetricsAddr))
+	httpChanged := old == nil || !reflect.DeepEqual(old.HTTPConfig, cfg.HTTPConfig)
+	udpChanged := old == nil || !reflect.DeepEqual(old.UDPConfig, cfg.UDPConfig)
 
-	if ps == nil {
-		log.Info("starting storage", log.Fields{"name": cfg.Storage.Name})
-		ps, err = storage.NewPeerStore(cfg.Storage.Name, cfg.Storage.Config)
+	httpFE, udpFE := r.httpFE, r.udpFE
+	if httpChanged {
+		if r.httpFE != nil {
+			stopLogged("HTTP frontend", r.httpFE)
+		}
+		httpFE, err = r.startHTTP(cfg.HTTPConfig)
 		if err != nil {
-			return errors.New("failed to create storage: " + err.Error())
+			r.restoreFrontends(true, false)
+			return errors.New("failed to start HTTP frontend: " + err.Error())
+		}
+	}
+	if udpChanged {
+		if r.udpFE != nil {
+			stopLogged("UDP frontend", r.udpFE)
+		}
+		udpFE, err = r.startUDP(cfg.UDPConfig)
+		if err != nil {
+			if httpChanged && httpFE != nil {
+				stopLogged("HTTP frontend", httpFE)
+			}
+			r.restoreFrontends(httpChanged, true)
+			return errors.New("failed to start UDP frontend: " + err.Error())
 		}
-		log.Info("started storage", ps)
 	}
-	r.peerStore = ps
 
+	// Everything started, switch over to the new configuration.
+	if old != nil {
+		r.swapper.Swap(logic)
+		stopLogged("logic", r.logic)
+	}
+	r.logic = logic
+
+	if r.metricsSrv != nil && r.metricsSrv != metricsSrv {
+		stopLogged("metrics server", r.metricsSrv)
+	}
+	r.metricsSrv = metricsSrv
+
+	if r.adminSrv != nil && r.adminSrv != adminSrv {
+		stopLogged("admin API", r.adminSrv)
+	}
+	r.adminSrv = adminSrv
+
+	r.httpFE, r.udpFE = httpFE, udpFE
+	if udpFE != nil {
+		r.udpPrivateKey = udpFE.PrivateKey
+	}
+
+	effective := cfg
+	effective.ResponseConfig = cfg.ResponseConfig.Validate()
+	if httpFE != nil {
+		effective.HTTPConfig = httpFE.Config
+	}
+	if udpFE != nil {
+		effective.UDPConfig = udpFE.Config
+	}
+	if adminSrv != nil {
+		tracker.Config = ConfigFile{Chihaya: effective.redacted()}
+		adminSrv.Update(cfg.AdminConfig, tracker)
+	}
+	r.adminTracker = tracker
+
+	r.cfg = &cfg
+
+	// Close the sockets no longer in use.
+	var tcpAddrs, udpAddrs []string
+	if metricsSrv != nil {
+		tcpAddrs = append(tcpAddrs, cfg.MetricsAddr)
+	}
+	if adminSrv != nil {
+		tcpAddrs = append(tcpAddrs, cfg.AdminConfig.Addr)
+	}
+	if httpFE != nil {
+		tcpAddrs = append(tcpAddrs, httpFE.Addr, httpFE.HTTPSAddr)
+		if httpFE.EnableHTTP3 {
+			udpAddrs = append(udpAddrs, httpFE.HTTPSAddr)
+		}
+	}
+	if udpFE != nil {
+		udpAddrs = append(udpAddrs, udpFE.Addr)
+	}
+	if err := r.listeners.Retain(tcpAddrs, udpAddrs); err != nil {
+		log.Error("failed to close unused sockets", log.Err(err))
+	}
+
+	return nil
+}
+
+// newLogic creates the hooks and the tracker logic of a configuration.
+func newLogic(cfg Config, ps storage.PeerStore) (*middleware.Logic, error) {
 	preHooks, err := middleware.HooksFromHookConfigs(cfg.PreHooks)
 	if err != nil {
-		return errors.New("failed to validate hook config: " + err.Error())
+		return nil, errors.New("failed to validate hook config: " + err.Error())
 	}
 	postHooks, err := middleware.HooksFromHookConfigs(cfg.PostHooks)
 	if err != nil {
-		return errors.New("failed to validate hook config: " + err.Error())
+		return nil, errors.New("failed to validate hook config: " + err.Error())
+	}
+
+	chains, err := middleware.ChainsFromChainConfigs(cfg.Chains)
+	if err != nil {
+		return nil, errors.New("failed to validate chain config: " + err.Error())
 	}
 
 	log.Info("starting tracker logic", log.Fields{
 		"prehooks":  cfg.PreHookNames(),
 		"posthooks": cfg.PostHookNames(),
+		"chains":    cfg.ChainNames(),
 	})
-	r.logic = middleware.NewLogic(cfg.ResponseConfig, r.peerStore, preHooks, postHooks)
+	return middleware.NewLogic(cfg.ResponseConfig.Validate(), ps, preHooks, postHooks, chains...), nil
+}
 
-	if cfg.HTTPConfig.Addr != "" {
-		log.Info("starting HTTP frontend", cfg.HTTPConfig)
-		httpfe, err := http.NewFrontend(r.logic, cfg.HTTPConfig)
-		if err != nil {
-			return err
-		}
-		r.sg.Add(httpfe)
+// startHTTP starts an HTTP frontend on the sockets of the Run, unless no
+// address is configured.
+func (r *Run) startHTTP(cfg http.Config) (*http.Frontend, error) {
+	if cfg.Addr == "" {
+		return nil, nil
 	}
 
-	if cfg.UDPConfig.Addr != "" {
-		log.Info("starting UDP frontend", cfg.UDPConfig)
-		udpfe, err := udp.NewFrontend(r.logic, cfg.UDPConfig)
-		if err != nil {
-			return err
+	cfg.Listen = r.listeners.Listen
+	cfg.ListenUDP = r.listeners.ListenUDP
+	log.Info("starting HTTP frontend", cfg)
+	return http.NewFrontend(r.swapper, cfg)
+}
+
+// startUDP starts a UDP frontend on the sockets of the Run, unless no
+// address is configured.
+//
+// If neither a private key nor a private key file is configured, the key
+// used before is kept so that connection IDs handed out stay valid.
+func (r *Run) startUDP(cfg udp.Config) (*udp.Frontend, error) {
+	if cfg.Addr == "" {
+		return nil, nil
+	}
+
+	if cfg.PrivateKey == "" && cfg.PrivateKeyFile == "" {
+		cfg.PrivateKey = r.udpPrivateKey
+	}
+	cfg.ListenUDP = r.listeners.ListenUDPGroup
+	log.Info("starting UDP frontend", cfg)
+	return udp.NewFrontend(r.swapper, cfg)
+}
+
+// restoreFrontends starts the stopped frontends of the Run again with the
+// configuration they were running with.
+func (r *Run) restoreFrontends(restoreHTTP, restoreUDP bool) {
+	var err error
+	if restoreHTTP && r.httpFE != nil {
+		log.Info("restoring HTTP frontend", r.httpFE.Config)
+		if r.httpFE, err = http.NewFrontend(r.swapper, r.httpFE.Config); err != nil {
+			log.Error("failed to restore HTTP frontend", log.Err(err))
 		}
-		r.sg.Add(udpfe)
 	}
+	if restoreUDP && r.udpFE != nil {
+		log.Info("restoring UDP frontend", r.udpFE.Config)
+		if r.udpFE, err = udp.NewFrontend(r.swapper, r.udpFE.Config); err != nil {
+			log.Error("failed to restore UDP frontend", log.Err(err))
+		}
+	}
+}
 
-	return nil
+// stopLogged stops s and logs the errors it failed with.
+func stopLogged(name string, s stop.Stopper) {
+	if errs := s.Stop().Wait(); len(errs) != 0 {
+		log.Error("failed while shutting down "+name, log.Fields{"errors": errs})
+	}
+}
+
+// requestReload requests RootRunCmdFunc to reload the Run, unless a reload
+// is pending already.
+func (r *Run) requestReload() {
+	select {
+	case r.reloadRequests <- struct{}{}:
+	default:
+	}
+}
+
+// Reload switches the Run over to the current configuration file.
+//
+// If the new configuration can not be read or fails to start, the Run keeps
+// running with its previous configuration.
+func (r *Run) Reload() error {
+	configFile, err := ParseConfigFile(r.configFilePath)
+	if err != nil {
+		return errors.New("failed to read config: " + err.Error())
+	}
+
+	return r.apply(configFile.Chihaya)
 }
 
 func combineErrors(prefix string, errs []error) error {
@@ -109,26 +443,41 @@ func combineErrors(prefix string, errs []error) error {
 }
 
 // Stop shuts down an instance of Chihaya.
-func (r *Run) Stop(keepPeerStore bool) (storage.PeerStore, error) {
-	log.Debug("stopping frontends and metrics server")
-	if errs := r.sg.Stop().Wait(); len(errs) != 0 {
-		return nil, combineErrors("failed while shutting down frontends", errs)
+func (r *Run) Stop() error {
+	log.Debug("stopping frontends, metrics server and admin API")
+	sg := stop.NewGroup()
+	if r.httpFE != nil {
+		sg.Add(r.httpFE)
 	}
-
-	log.Debug("stopping logic")
-	if errs := r.logic.Stop().Wait(); len(errs) != 0 {
-		return nil, combineErrors("failed while shutting down middleware", errs)
+	if r.udpFE != nil {
+		sg.Add(r.udpFE)
+	}
+	if r.metricsSrv != nil {
+		sg.Add(r.metricsSrv)
+	}
+	if r.adminSrv != nil {
+		sg.Add(r.adminSrv)
+	}
+	if errs := sg.Stop().Wait(); len(errs) != 0 {
+		return combineErrors("failed while shutting down frontends", errs)
+	}
+	if err := r.listeners.Close(); err != nil {
+		return errors.New("failed while closing sockets: " + err.Error())
 	}
 
-	if !keepPeerStore {
-		log.Debug("stopping peer store")
-		if errs := r.peerStore.Stop().Wait(); len(errs) != 0 {
-			return nil, combineErrors("failed while shutting down peer store", errs)
+	if r.logic != nil {
+		log.Debug("stopping logic")
+		if errs := r.logic.Stop().Wait(); len(errs) != 0 {
+			return combineErrors("failed while shutting down middleware", errs)
 		}
-		r.peerStore = nil
 	}
 
-	return r.peerStore, nil
+	log.Debug("stopping peer store")
+	if errs := r.peerStore.Stop().Wait(); len(errs) != 0 {
+		return combineErrors("failed while shutting down peer store", errs)
+	}
+
+	return nil
 }
 
 // RootRunCmdFunc implements a Cobra command that runs an instance of Chihaya
@@ -144,26 +493,36 @@ func RootRunCmdFunc(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
 	reload := makeReloadChan()
+	upgrade := makeUpgradeChan()
 
 	for {
 		select {
 		case <-reload:
 			log.Info("reloading; received SIGUSR1")
-			peerStore, err := r.Stop(true)
-			if err != nil {
-				return err
+			if err := r.Reload(); err != nil {
+				log.Error("failed to reload, keeping the previous configuration", log.Err(err))
 			}
-
-			if err := r.Start(peerStore); err != nil {
-				return err
+		case <-r.reloadRequests:
+			log.Info("reloading; requested through the admin API")
+			if err := r.Reload(); err != nil {
+				log.Error("failed to reload, keeping the previous configuration", log.Err(err))
 			}
+		case <-upgrade:
+			log.Info("upgrading; received SIGUSR2")
+			if err := r.Upgrade(); err != nil {
+				log.Error("failed to upgrade, keeping this process running", log.Err(err))
+				break
+			}
+
+			log.Info("shutting down; upgraded")
+			return r.Stop()
 		case <-quit:
 			log.Info("shutting down; received SIGINT/SIGTERM")
-			if _, err := r.Stop(false); err != nil {
+			if err := r.Stop(); err != nil {
 				return err
 			}
 
@@ -242,6 +601,19 @@ func main() {
 
 	rootCmd.AddCommand(e2eCmd)
 
+	var checkCmd = &cobra.Command{
+		Use:           "check",
+		Short:         "check configuration",
+		Long:          "Check a configuration file strictly without starting Chihaya",
+		RunE:          CheckRunCmdFunc,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	checkCmd.Flags().String("config", "/etc/chihaya.yaml", "location of configuration file")
+
+	rootCmd.AddCommand(checkCmd)
+
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal("failed when executing root cobra command: " + err.Error())
 	}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/frontend/http"
+	"github.com/doujincafe/chihaya/frontend/udp"
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/listener"
+	"github.com/doujincafe/chihaya/storage"
+)
+
+// testConfig returns a config serving HTTP on a loopback address chosen by
+// the kernel and announcing the given interval.
+func testConfig(interval time.Duration) Config {
+	return Config{
+		ResponseConfig: middleware.ResponseConfig{
+			AnnounceInterval:    interval,
+			MinAnnounceInterval: interval / 2,
+		},
+		HTTPConfig: http.Config{
+			Addr:           "127.0.0.1:0",
+			AnnounceRoutes: []string{"/announce"},
+			ScrapeRoutes:   []string{"/scrape"},
+		},
+		Storage: storageConfig{Name: "memory"},
+	}
+}
+
+// newTestRun starts a Run with cfg on a memory peer store, without a config
+// file.
+func newTestRun(t *testing.T, cfg Config) *Run {
+	ps, err := storage.NewPeerStore(cfg.Storage.Name, cfg.Storage.Config)
+	require.Nil(t, err)
+
+	r := &Run{
+		listeners:      listener.NewSet(),
+		peerStore:      ps,
+		reloadRequests: make(chan struct{}, 1),
+	}
+	require.Nil(t, r.apply(cfg))
+	t.Cleanup(func() { require.Nil(t, r.Stop()) })
+	return r
+}
+
+// boundAddr returns the address the socket the Run holds for the TCP address
+// addr is bound to.
+func boundAddr(t *testing.T, r *Run, addr string) string {
+	l, err := r.listeners.Listen(addr)
+	require.Nil(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// announceInterval announces to the HTTP frontend at addr and returns the
+// interval of the response.
+func announceInterval(t *testing.T, addr string) time.Duration {
+	resp, err := nethttp.Get("http://" + addr + "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TR2940-000000000000&port=6881&uploaded=0&downloaded=0&left=0&compact=1")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, nethttp.StatusOK, resp.StatusCode, string(body))
+
+	for _, d := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		if strings.Contains(string(body), "8:intervali"+strconv.Itoa(int(d.Seconds()))+"e") {
+			return d
+		}
+	}
+	t.Fatalf("unexpected response %q", body)
+	return 0
+}
+
+func TestApplyUnchangedAddress(t *testing.T) {
+	r := newTestRun(t, testConfig(time.Minute))
+	addr := boundAddr(t, r, "127.0.0.1:0")
+	require.Equal(t, time.Minute, announceInterval(t, addr))
+
+	// Only the middleware changes, the frontend keeps running.
+	httpFE := r.httpFE
+	require.Nil(t, r.apply(testConfig(2*time.Minute)))
+	require.Same(t, httpFE, r.httpFE)
+	require.Equal(t, 2*time.Minute, announceInterval(t, addr))
+
+	// The frontend is restarted on the socket it was serving on.
+	cfg := testConfig(3 * time.Minute)
+	cfg.HTTPConfig.ReadTimeout = 3 * time.Second
+	require.Nil(t, r.apply(cfg))
+	require.NotSame(t, httpFE, r.httpFE)
+	require.Equal(t, addr, boundAddr(t, r, "127.0.0.1:0"))
+	require.Equal(t, 3*time.Minute, announceInterval(t, addr))
+}
+
+func TestApplyFailureRestoresFrontends(t *testing.T) {
+	cfg := testConfig(time.Minute)
+	r := newTestRun(t, cfg)
+	addr := boundAddr(t, r, "127.0.0.1:0")
+	logic := r.logic
+	readTimeout := r.httpFE.ReadTimeout
+
+	// The UDP frontend of the new config fails to bind after the HTTP
+	// frontend was stopped.
+	taken, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer taken.Close()
+
+	failing := testConfig(2 * time.Minute)
+	failing.HTTPConfig.ReadTimeout = 3 * time.Second
+	failing.UDPConfig = udp.Config{Addr: taken.LocalAddr().String()}
+	require.NotNil(t, r.apply(failing))
+
+	require.Equal(t, cfg, *r.cfg)
+	require.Same(t, logic, r.logic)
+	require.Nil(t, r.udpFE)
+	require.NotNil(t, r.httpFE)
+	require.Equal(t, readTimeout, r.httpFE.ReadTimeout)
+	require.Equal(t, time.Minute, announceInterval(t, addr))
+
+	// A failing middleware config leaves everything running.
+	failing = testConfig(2 * time.Minute)
+	failing.PreHooks = []middleware.HookConfig{{Name: "missing"}}
+	require.NotNil(t, r.apply(failing))
+	require.Same(t, logic, r.logic)
+	require.Equal(t, time.Minute, announceInterval(t, addr))
+}
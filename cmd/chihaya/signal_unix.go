@@ -9,7 +9,7 @@ import (
 )
 
 func makeReloadChan() <-chan os.Signal {
-	reload := make(chan os.Signal)
+	reload := make(chan os.Signal, 1)
 	signal.Notify(reload, syscall.SIGUSR1)
 	return reload
 }
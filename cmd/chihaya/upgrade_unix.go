@@ -0,0 +1,381 @@
+// +build darwin freebsd linux netbsd openbsd dragonfly solaris
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/doujincafe/chihaya/pkg/listener"
+	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/storage"
+)
+
+// upgradeFDEnv is the environment variable telling a process started by an
+// upgrade which file descriptor connects it to the process it takes over
+// from.
+const upgradeFDEnv = "CHIHAYA_UPGRADE_FD"
+
+// upgradeTimeout bounds every step of an upgrade.
+const upgradeTimeout = time.Minute
+
+// maxUpgradeSockets is the maximum number of sockets handed over by an
+// upgrade.
+const maxUpgradeSockets = 64
+
+// Messages exchanged during an upgrade.
+//
+// The old process sends its sockets, the new process answers with
+// upgradeReady once it created its logic, the old process stops serving and
+// sends upgradeSnapshot followed by a snapshot of its peers, or
+// upgradeNoSnapshot, and the new process starts its frontends and answers
+// with upgradeDone once it is serving.
+const (
+	upgradeReady      byte = 'R'
+	upgradeDone       byte = 'D'
+	upgradeSnapshot   byte = 1
+	upgradeNoSnapshot byte = 0
+)
+
+// socketsMessage names the sockets handed over by an upgrade, in the order
+// of their file descriptors.
+//
+// It also holds the private key of the UDP frontend, so that connection IDs
+// handed out by the previous process stay valid if the key was generated.
+// The message must not be logged.
+type socketsMessage struct {
+	TCP []string `json:"tcp"`
+	UDP []string `json:"udp"`
+
+	UDPPrivateKey string `json:"udp_private_key,omitempty"`
+}
+
+func makeUpgradeChan() <-chan os.Signal {
+	upgrade := make(chan os.Signal, 1)
+	signal.Notify(upgrade, syscall.SIGUSR2)
+	return upgrade
+}
+
+// Upgrade starts a new process of the current executable and hands the
+// sockets and peers of the Run over to it.
+//
+// The Run stops serving requests once the new process is ready and before
+// its peers are written, so that no announce is lost: requests arriving in
+// between are queued by the kernel until the new process serves them.
+// If Upgrade returns nil, the Run only has to be stopped. Otherwise the new
+// process was killed and the Run keeps serving.
+func (r *Run) Upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	local := os.NewFile(uintptr(fds[0]), "upgrade")
+	remote := os.NewFile(uintptr(fds[1]), "upgrade")
+	c, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		remote.Close()
+		return err
+	}
+	defer c.Close()
+	conn := c.(*net.UnixConn)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), upgradeFDEnv+"=3")
+	cmd.ExtraFiles = []*os.File{remote}
+	err = cmd.Start()
+	remote.Close()
+	if err != nil {
+		return errors.New("failed to start new process: " + err.Error())
+	}
+	log.Info("started new process", log.Fields{"pid": cmd.Process.Pid, "path": exe})
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Error("new process failed", log.Err(err))
+		}
+	}()
+
+	if err := r.handOver(conn); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	return nil
+}
+
+// handOver hands the sockets and peers of the Run over to the process at the
+// other end of conn.
+//
+// If handOver returns nil, the Run only has to be stopped. Otherwise the Run
+// keeps serving.
+func (r *Run) handOver(conn *net.UnixConn) (err error) {
+	stopped := false
+	defer func() {
+		if err != nil && stopped {
+			r.resume()
+		}
+	}()
+
+	conn.SetDeadline(time.Now().Add(upgradeTimeout))
+	if err := sendSockets(conn, r.listeners, r.udpPrivateKey); err != nil {
+		return errors.New("failed to send sockets: " + err.Error())
+	}
+	if err := expectMessage(conn, upgradeReady); err != nil {
+		return errors.New("new process failed to start: " + err.Error())
+	}
+
+	log.Info("stopping frontends and logic for the new process")
+	stopped = true
+	if r.httpFE != nil {
+		stopLogged("HTTP frontend", r.httpFE)
+	}
+	if r.udpFE != nil {
+		stopLogged("UDP frontend", r.udpFE)
+	}
+	stopLogged("logic", r.logic)
+
+	conn.SetDeadline(time.Now().Add(upgradeTimeout))
+	if sn, ok := r.peerStore.(storage.Snapshotter); ok {
+		if _, err := conn.Write([]byte{upgradeSnapshot}); err != nil {
+			return errors.New("failed to send peers: " + err.Error())
+		}
+		if err := sn.WriteSnapshot(conn); err != nil {
+			return errors.New("failed to send peers: " + err.Error())
+		}
+	} else {
+		log.Warn("storage does not support snapshots, the new process starts without peers", log.Fields{"name": r.cfg.Storage.Name})
+		if _, err := conn.Write([]byte{upgradeNoSnapshot}); err != nil {
+			return errors.New("failed to send peers: " + err.Error())
+		}
+	}
+
+	if err := expectMessage(conn, upgradeDone); err != nil {
+		return errors.New("new process failed to start: " + err.Error())
+	}
+
+	r.httpFE, r.udpFE, r.logic = nil, nil, nil
+	return nil
+}
+
+// resume starts serving again after a failed upgrade stopped the frontends
+// and the logic.
+func (r *Run) resume() {
+	logic, err := newLogic(*r.cfg, r.peerStore)
+	if err != nil {
+		log.Error("failed to restart logic", log.Err(err))
+		return
+	}
+	r.swapper.Swap(logic)
+	r.logic = logic
+
+	if r.adminSrv != nil {
+		r.adminTracker.Logic = logic
+		r.adminSrv.Update(r.cfg.AdminConfig, r.adminTracker)
+	}
+
+	r.restoreFrontends(true, true)
+}
+
+// sendSockets sends duplicates of the sockets of s along with the private key
+// of the UDP frontend.
+func sendSockets(conn *net.UnixConn, s *listener.Set, udpPrivateKey string) error {
+	tcp, udp, err := s.Files()
+	if err != nil {
+		return err
+	}
+
+	msg := socketsMessage{UDPPrivateKey: udpPrivateKey}
+	var fds []int
+	for addr, f := range tcp {
+		defer f.Close()
+		msg.TCP = append(msg.TCP, addr)
+		fds = append(fds, int(f.Fd()))
+	}
+	for addr, f := range udp {
+		defer f.Close()
+		msg.UDP = append(msg.UDP, addr)
+		fds = append(fds, int(f.Fd()))
+	}
+	if len(fds) > maxUpgradeSockets {
+		return errors.New("too many sockets: " + strconv.Itoa(len(fds)))
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	payload := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(payload, uint32(len(b)))
+	copy(payload[4:], b)
+
+	_, _, err = conn.WriteMsgUnix(payload, syscall.UnixRights(fds...), nil)
+	return err
+}
+
+// expectMessage reads a message and returns an error unless it is want.
+func expectMessage(conn *net.UnixConn, want byte) error {
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return err
+	}
+	if b[0] != want {
+		return errors.New("unexpected message " + strconv.Quote(string(b[:])))
+	}
+	return nil
+}
+
+// upgradeHandoff connects a process started by an upgrade to the process it
+// takes over from.
+type upgradeHandoff struct {
+	conn *net.UnixConn
+}
+
+// inheritedHandoff returns the handoff of a process started by an upgrade,
+// or nil if the process was not started by one.
+func inheritedHandoff() (*upgradeHandoff, error) {
+	v := os.Getenv(upgradeFDEnv)
+	if v == "" {
+		return nil, nil
+	}
+	// Processes started by later upgrades get their own handoff.
+	os.Unsetenv(upgradeFDEnv)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, errors.New("invalid " + upgradeFDEnv + ": " + v)
+	}
+	f := os.NewFile(uintptr(fd), "upgrade")
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, errors.New(upgradeFDEnv + " is not a unix socket")
+	}
+
+	return &upgradeHandoff{conn: conn}, nil
+}
+
+// receiveListeners receives the sockets and the private key of the UDP
+// frontend of the previous process.
+func (h *upgradeHandoff) receiveListeners() (_ *listener.Set, udpPrivateKey string, err error) {
+	h.conn.SetDeadline(time.Now().Add(upgradeTimeout))
+
+	buf := make([]byte, 64<<10)
+	oob := make([]byte, syscall.CmsgSpace(maxUpgradeSockets*4))
+	n, oobn, _, _, err := h.conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var fds []int
+	cmsgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range cmsgs {
+		rights, err := syscall.ParseUnixRights(&cmsgs[i])
+		if err != nil {
+			return nil, "", err
+		}
+		fds = append(fds, rights...)
+	}
+	files := make([]*os.File, len(fds))
+	for i, fd := range fds {
+		files[i] = os.NewFile(uintptr(fd), "socket")
+		defer files[i].Close()
+	}
+
+	if n < 4 {
+		if _, err := io.ReadFull(h.conn, buf[n:4]); err != nil {
+			return nil, "", err
+		}
+		n = 4
+	}
+	size := int(binary.BigEndian.Uint32(buf))
+	if 4+size > len(buf) {
+		return nil, "", errors.New("sockets message too large")
+	}
+	if n < 4+size {
+		if _, err := io.ReadFull(h.conn, buf[n:4+size]); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var msg socketsMessage
+	if err := json.Unmarshal(buf[4:4+size], &msg); err != nil {
+		return nil, "", err
+	}
+	if len(msg.TCP)+len(msg.UDP) != len(files) {
+		return nil, "", errors.New("received " + strconv.Itoa(len(files)) + " sockets, expected " + strconv.Itoa(len(msg.TCP)+len(msg.UDP)))
+	}
+
+	tcp := make(map[string]*os.File, len(msg.TCP))
+	for i, addr := range msg.TCP {
+		tcp[addr] = files[i]
+	}
+	udp := make(map[string]*os.File, len(msg.UDP))
+	for i, addr := range msg.UDP {
+		udp[addr] = files[len(msg.TCP)+i]
+	}
+
+	set, err := listener.NewSetFromFiles(tcp, udp)
+	return set, msg.UDPPrivateKey, err
+}
+
+// receivePeers tells the previous process to stop serving and adds the peers
+// it sends to ps.
+func (h *upgradeHandoff) receivePeers(ps storage.PeerStore) error {
+	h.conn.SetDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := h.conn.Write([]byte{upgradeReady}); err != nil {
+		return err
+	}
+
+	var b [1]byte
+	if _, err := io.ReadFull(h.conn, b[:]); err != nil {
+		return err
+	}
+	switch b[0] {
+	case upgradeNoSnapshot:
+		return nil
+	case upgradeSnapshot:
+	default:
+		return errors.New("unexpected message " + strconv.Quote(string(b[:])))
+	}
+
+	sn, ok := ps.(storage.Snapshotter)
+	if !ok {
+		return errors.New("storage does not support snapshots")
+	}
+	return sn.RestoreSnapshot(h.conn)
+}
+
+// done tells the previous process that this process is serving.
+func (h *upgradeHandoff) done() error {
+	h.conn.SetDeadline(time.Now().Add(upgradeTimeout))
+	_, err := h.conn.Write([]byte{upgradeDone})
+	return err
+}
+
+// Close closes the connection to the previous process.
+func (h *upgradeHandoff) Close() error {
+	return h.conn.Close()
+}
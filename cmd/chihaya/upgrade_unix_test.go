@@ -0,0 +1,137 @@
+// +build darwin freebsd linux netbsd openbsd dragonfly solaris
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/frontend/udp"
+	"github.com/doujincafe/chihaya/middleware"
+)
+
+// socketpair returns both ends of a connected pair of unix sockets.
+func socketpair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.Nil(t, err)
+
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "upgrade")
+		c, err := net.FileConn(f)
+		f.Close()
+		require.Nil(t, err)
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func TestHandOver(t *testing.T) {
+	old := newTestRun(t, testConfig(time.Minute))
+	addr := boundAddr(t, old, "127.0.0.1:0")
+	require.Equal(t, time.Minute, announceInterval(t, addr))
+
+	oldConn, newConn := socketpair(t)
+	defer oldConn.Close()
+	handedOver := make(chan error, 1)
+	go func() { handedOver <- old.handOver(oldConn) }()
+
+	r, err := newRun("", testConfig(2*time.Minute), &upgradeHandoff{conn: newConn})
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Nil(t, r.Stop()) })
+	require.Nil(t, <-handedOver)
+	require.Nil(t, old.httpFE)
+	require.Nil(t, old.logic)
+
+	// The peer announced to the old Run was handed over.
+	scrape := r.peerStore.ScrapeSwarm(context.Background(), bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa"), bittorrent.IPv4)
+	require.Equal(t, uint32(1), scrape.Complete)
+
+	// The new Run serves on the socket of the old one.
+	require.Equal(t, addr, boundAddr(t, r, "127.0.0.1:0"))
+	require.Equal(t, 2*time.Minute, announceInterval(t, addr))
+}
+
+func TestHandOverInvalidConfig(t *testing.T) {
+	old := newTestRun(t, testConfig(time.Minute))
+	addr := boundAddr(t, old, "127.0.0.1:0")
+	httpFE, logic := old.httpFE, old.logic
+
+	oldConn, newConn := socketpair(t)
+	defer oldConn.Close()
+	handedOver := make(chan error, 1)
+	go func() { handedOver <- old.handOver(oldConn) }()
+
+	// The new Run fails before the old one stops serving.
+	cfg := testConfig(2 * time.Minute)
+	cfg.PreHooks = []middleware.HookConfig{{Name: "missing"}}
+	_, err := newRun("", cfg, &upgradeHandoff{conn: newConn})
+	require.NotNil(t, err)
+	require.NotNil(t, <-handedOver)
+
+	require.Same(t, httpFE, old.httpFE)
+	require.Same(t, logic, old.logic)
+	require.Equal(t, time.Minute, announceInterval(t, addr))
+}
+
+// udpRoundTrip sends a UDP tracker request with the given connection ID,
+// action and body to conn and returns the action and body of the response.
+func udpRoundTrip(t *testing.T, conn net.Conn, connID uint64, action uint32, body []byte) (uint32, []byte) {
+	packet := make([]byte, 16, 16+len(body))
+	binary.BigEndian.PutUint64(packet, connID)
+	binary.BigEndian.PutUint32(packet[8:], action)
+	binary.BigEndian.PutUint32(packet[12:], 1)
+	_, err := conn.Write(append(packet, body...))
+	require.Nil(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.Nil(t, err)
+	require.True(t, n >= 8)
+	return binary.BigEndian.Uint32(buf), buf[8:n]
+}
+
+func TestHandOverUDPConnectionID(t *testing.T) {
+	// No private key is configured, so the old Run generates one.
+	cfg := testConfig(time.Minute)
+	cfg.UDPConfig = udp.Config{Addr: "127.0.0.1:0", Sockets: 1}
+	old := newTestRun(t, cfg)
+	socket, err := old.listeners.ListenUDPGroup("127.0.0.1:0", 1)
+	require.Nil(t, err)
+	addr := socket[0].LocalAddr().String()
+	socket[0].Close()
+
+	conn, err := net.Dial("udp", addr)
+	require.Nil(t, err)
+	defer conn.Close()
+	action, body := udpRoundTrip(t, conn, 0x41727101980, 0, nil)
+	require.Equal(t, uint32(0), action)
+	connID := binary.BigEndian.Uint64(body)
+
+	oldConn, newConn := socketpair(t)
+	defer oldConn.Close()
+	handedOver := make(chan error, 1)
+	go func() { handedOver <- old.handOver(oldConn) }()
+
+	r, err := newRun("", cfg, &upgradeHandoff{conn: newConn})
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Nil(t, r.Stop()) })
+	require.Nil(t, <-handedOver)
+
+	// The connection ID handed out by the old Run is accepted by the new
+	// one.
+	announce := make([]byte, 82)
+	copy(announce, "aaaaaaaaaaaaaaaaaaaa-TR2940-000000000000")
+	binary.BigEndian.PutUint16(announce[80:], 6881)
+	action, body = udpRoundTrip(t, conn, connID, 1, announce)
+	require.Equal(t, uint32(1), action, string(body))
+}
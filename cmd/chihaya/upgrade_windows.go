@@ -0,0 +1,49 @@
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/doujincafe/chihaya/pkg/listener"
+	"github.com/doujincafe/chihaya/storage"
+)
+
+var errUpgradeUnsupported = errors.New("upgrades are not supported on windows")
+
+func makeUpgradeChan() <-chan os.Signal {
+	return nil
+}
+
+// Upgrade is not supported on Windows.
+func (r *Run) Upgrade() error {
+	return errUpgradeUnsupported
+}
+
+// upgradeHandoff connects a process started by an upgrade to the process it
+// takes over from.
+type upgradeHandoff struct{}
+
+// inheritedHandoff always returns nil, as no process is started by an
+// upgrade on Windows.
+func inheritedHandoff() (*upgradeHandoff, error) {
+	return nil, nil
+}
+
+func (h *upgradeHandoff) receiveListeners() (*listener.Set, string, error) {
+	return nil, "", errUpgradeUnsupported
+}
+
+func (h *upgradeHandoff) receivePeers(ps storage.PeerStore) error {
+	return errUpgradeUnsupported
+}
+
+func (h *upgradeHandoff) done() error {
+	return errUpgradeUnsupported
+}
+
+// Close does nothing.
+func (h *upgradeHandoff) Close() error {
+	return nil
+}
@@ -9,6 +9,9 @@ import (
 // TrackerLogic is the interface used by a frontend in order to: (1) generate a
 // response from a parsed request, and (2) asynchronously observe anything
 // after the response has been delivered to the client.
+//
+// Frontends pass a context that carries the deadline of the request and is
+// cancelled if the client goes away.
 type TrackerLogic interface {
 	// HandleAnnounce generates a response for an Announce.
 	//
@@ -18,6 +21,11 @@ type TrackerLogic interface {
 
 	// AfterAnnounce does something with the results of an Announce after it
 	// has been completed.
+	//
+	// It is called synchronously once the response has been written and
+	// may block, at most until the context is done, to apply back-pressure.
+	// Any work outliving the request must not depend on the context being
+	// alive.
 	AfterAnnounce(context.Context, *bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse)
 
 	// HandleScrape generates a response for a Scrape.
@@ -27,5 +35,27 @@ type TrackerLogic interface {
 	HandleScrape(context.Context, *bittorrent.ScrapeRequest) (context.Context, *bittorrent.ScrapeResponse, error)
 
 	// AfterScrape does something with the results of a Scrape after it has been completed.
+	//
+	// It is called like AfterAnnounce.
 	AfterScrape(context.Context, *bittorrent.ScrapeRequest, *bittorrent.ScrapeResponse)
 }
+
+// ErrFullScrapeUnsupported is returned by FullScrapers that can not scrape all
+// swarms, for example because their storage can not.
+var ErrFullScrapeUnsupported = bittorrent.ClientError("full scrapes are not supported")
+
+// FullScraper is implemented by TrackerLogics that can scrape all swarms, for
+// frontends serving full scrapes.
+type FullScraper interface {
+	// HandleFullScrape checks whether the full scrape requested by req is
+	// allowed, as HandleScrape would for a scrape without infohashes, and
+	// returns the function scraping the swarms of the AddressFamily of req.
+	//
+	// The returned function does not depend on the TrackerLogic, so it can
+	// be called after the TrackerLogic was stopped.
+	HandleFullScrape(context.Context, *bittorrent.ScrapeRequest) (ScrapeSwarmsFunc, error)
+}
+
+// ScrapeSwarmsFunc calls fn with the Scrape of every swarm, until fn or the
+// context returns an error, which is returned.
+type ScrapeSwarmsFunc func(ctx context.Context, fn func(bittorrent.Scrape) error) error
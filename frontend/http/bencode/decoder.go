@@ -29,6 +29,52 @@ func Unmarshal(buf []byte) (interface{}, error) {
 	return unmarshal(r)
 }
 
+// RawDictValues deserializes the bencoded dictionary in buf and returns its
+// values in their bencoded form.
+//
+// This is useful to hash a value exactly as it was encoded, like the info
+// dictionary of a metainfo file.
+func RawDictValues(buf []byte) (map[string][]byte, error) {
+	br := bytes.NewReader(buf)
+	r := bufio.NewReader(br)
+	offset := func() int { return len(buf) - br.Len() - r.Buffered() }
+
+	tok, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	} else if tok != 'd' {
+		return nil, errors.New("bencode: not a dictionary")
+	}
+
+	values := make(map[string][]byte)
+	for {
+		ok, err := readTerminator(r, 'e')
+		if err != nil {
+			return nil, err
+		} else if ok {
+			break
+		}
+
+		v, err := unmarshal(r)
+		if err != nil {
+			return nil, err
+		}
+
+		key, ok := v.(string)
+		if !ok {
+			return nil, errors.New("bencode: non-string map key")
+		}
+
+		start := offset()
+		if _, err = unmarshal(r); err != nil {
+			return nil, err
+		}
+		values[key] = buf[start:offset()]
+	}
+
+	return values, nil
+}
+
 // unmarshal reads bencoded values from a bufio.Reader
 func unmarshal(r *bufio.Reader) (interface{}, error) {
 	tok, err := r.ReadByte()
@@ -57,17 +103,42 @@ func unmarshal(r *bufio.Reader) (interface{}, error) {
 			return nil, errors.New("bencode: unknown input sequence")
 		}
 
-		buf := make([]byte, length)
-		n, err := r.Read(buf)
-
-		if err != nil {
-			return nil, err
-		} else if int64(n) != length {
-			return nil, errors.New("bencode: short read")
+		if length < 0 {
+			return nil, errors.New("bencode: negative string length")
 		}
 
+		return readString(r, length)
+	}
+}
+
+// maxPreallocatedString is the length up to which the buffer of a string is
+// allocated before reading it.
+const maxPreallocatedString = 64 << 10
+
+// readString reads a string of the given length.
+//
+// Longer strings are read into a buffer growing with the data actually read,
+// so that a length claimed by malformed input can not allocate more memory
+// than the input holds.
+func readString(r *bufio.Reader, length int64) (string, error) {
+	if length <= maxPreallocatedString {
+		buf := make([]byte, length)
+		_, err := io.ReadFull(r, buf)
+		if err == io.ErrUnexpectedEOF {
+			return "", errors.New("bencode: short read")
+		} else if err != nil {
+			return "", err
+		}
 		return string(buf), nil
 	}
+
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, length); err == io.EOF {
+		return "", errors.New("bencode: short read")
+	} else if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
 }
 
 func readTerminator(r io.ByteScanner, term byte) (bool, error) {
@@ -1,6 +1,8 @@
 package bencode
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -32,6 +34,42 @@ func TestUnmarshal(t *testing.T) {
 	}
 }
 
+func TestUnmarshalLongString(t *testing.T) {
+	// Longer than the buffer of the underlying bufio.Reader.
+	long := strings.Repeat("x", 10000)
+	got, err := Unmarshal([]byte(fmt.Sprintf("%d:%s", len(long), long)))
+	require.Nil(t, err)
+	require.Equal(t, long, got)
+
+	_, err = Unmarshal([]byte("10:short"))
+	require.NotNil(t, err)
+
+	long = strings.Repeat("x", 100000)
+	got, err = Unmarshal([]byte(fmt.Sprintf("%d:%s", len(long), long)))
+	require.Nil(t, err)
+	require.Equal(t, long, got)
+
+	// Lengths beyond the input fail without allocating them.
+	_, err = Unmarshal([]byte("9223372036854775807:short"))
+	require.EqualError(t, err, "bencode: short read")
+}
+
+func TestRawDictValues(t *testing.T) {
+	got, err := RawDictValues([]byte("d4:infod6:lengthi42e4:name3:fooe3:onel1:ae3:twoi2ee"))
+	require.Nil(t, err)
+	require.Equal(t, map[string][]byte{
+		"info": []byte("d6:lengthi42e4:name3:fooe"),
+		"one":  []byte("l1:ae"),
+		"two":  []byte("i2e"),
+	}, got)
+
+	_, err = RawDictValues([]byte("l1:ae"))
+	require.NotNil(t, err)
+
+	_, err = RawDictValues([]byte("d4:info"))
+	require.NotNil(t, err)
+}
+
 type bufferLoop struct {
 	val string
 }
@@ -1,5 +1,5 @@
 // Package http implements a BitTorrent frontend via the HTTP protocol as
-// described in BEP 3 and BEP 23.
+// described in BEP 3, BEP 23 and BEP 48.
 package http
 
 import (
@@ -11,28 +11,49 @@ import (
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 
 	"github.com/doujincafe/chihaya/bittorrent"
 	"github.com/doujincafe/chihaya/frontend"
 	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/pkg/proxyproto"
 	"github.com/doujincafe/chihaya/pkg/stop"
 )
 
 // Config represents all of the configurable options for an HTTP BitTorrent
 // Frontend.
 type Config struct {
-	Addr                string        `yaml:"addr"`
-	HTTPSAddr           string        `yaml:"https_addr"`
-	ReadTimeout         time.Duration `yaml:"read_timeout"`
-	WriteTimeout        time.Duration `yaml:"write_timeout"`
-	IdleTimeout         time.Duration `yaml:"idle_timeout"`
-	EnableKeepAlive     bool          `yaml:"enable_keepalive"`
-	TLSCertPath         string        `yaml:"tls_cert_path"`
-	TLSKeyPath          string        `yaml:"tls_key_path"`
-	AnnounceRoutes      []string      `yaml:"announce_routes"`
-	ScrapeRoutes        []string      `yaml:"scrape_routes"`
-	EnableRequestTiming bool          `yaml:"enable_request_timing"`
+	Addr                string           `yaml:"addr"`
+	HTTPSAddr           string           `yaml:"https_addr"`
+	ReadTimeout         time.Duration    `yaml:"read_timeout"`
+	WriteTimeout        time.Duration    `yaml:"write_timeout"`
+	IdleTimeout         time.Duration    `yaml:"idle_timeout"`
+	EnableKeepAlive     bool             `yaml:"enable_keepalive"`
+	EnableHTTP2         bool             `yaml:"enable_http2"`
+	EnableHTTP3         bool             `yaml:"enable_http3"`
+	TLSCertPath         string           `yaml:"tls_cert_path"`
+	TLSKeyPath          string           `yaml:"tls_key_path"`
+	TLSCertificates     []TLSCertificate `yaml:"tls_certificates"`
+	TLSReloadInterval   time.Duration    `yaml:"tls_reload_interval"`
+	TLSMinVersion       string           `yaml:"tls_min_version"`
+	TLSCipherSuites     []string         `yaml:"tls_cipher_suites"`
+	AnnounceRoutes      []string         `yaml:"announce_routes"`
+	ScrapeRoutes        []string         `yaml:"scrape_routes"`
+	EnableRequestTiming bool             `yaml:"enable_request_timing"`
+	RequestTimeout      time.Duration    `yaml:"request_timeout"`
+	EnableFullScrape    bool             `yaml:"enable_full_scrape"`
+	FullScrapeInterval  time.Duration    `yaml:"full_scrape_interval"`
+	ProxyProtocol       bool             `yaml:"proxy_protocol"`
 	ParseOptions        `yaml:",inline"`
+
+	// Listen is used to get the listeners for Addr and HTTPSAddr.
+	// If it is nil, the addresses are bound with net.Listen.
+	Listen func(addr string) (net.Listener, error) `yaml:"-"`
+
+	// ListenUDP is used to get the UDP socket HTTP/3 is served on at
+	// HTTPSAddr. If it is nil, the address is bound with net.ListenUDP.
+	ListenUDP func(addr string) (*net.UDPConn, error) `yaml:"-"`
 }
 
 // LogFields renders the current config as a set of Logrus fields.
@@ -44,13 +65,25 @@ func (cfg Config) LogFields() log.Fields {
 		"writeTimeout":        cfg.WriteTimeout,
 		"idleTimeout":         cfg.IdleTimeout,
 		"enableKeepAlive":     cfg.EnableKeepAlive,
+		"enableHTTP2":         cfg.EnableHTTP2,
+		"enableHTTP3":         cfg.EnableHTTP3,
 		"tlsCertPath":         cfg.TLSCertPath,
 		"tlsKeyPath":          cfg.TLSKeyPath,
+		"tlsCertificates":     len(cfg.TLSCertificates),
+		"tlsReloadInterval":   cfg.TLSReloadInterval,
+		"tlsMinVersion":       cfg.TLSMinVersion,
+		"tlsCipherSuites":     cfg.TLSCipherSuites,
 		"announceRoutes":      cfg.AnnounceRoutes,
 		"scrapeRoutes":        cfg.ScrapeRoutes,
 		"enableRequestTiming": cfg.EnableRequestTiming,
+		"requestTimeout":      cfg.RequestTimeout,
+		"enableFullScrape":    cfg.EnableFullScrape,
+		"fullScrapeInterval":  cfg.FullScrapeInterval,
+		"proxyProtocol":       cfg.ProxyProtocol,
 		"allowIPSpoofing":     cfg.AllowIPSpoofing,
+		"allowDualStack":      cfg.AllowDualStack,
 		"realIPHeader":        cfg.RealIPHeader,
+		"trustedProxies":      cfg.TrustedProxies,
 		"maxNumWant":          cfg.MaxNumWant,
 		"defaultNumWant":      cfg.DefaultNumWant,
 		"maxScrapeInfoHashes": cfg.MaxScrapeInfoHashes,
@@ -59,9 +92,14 @@ func (cfg Config) LogFields() log.Fields {
 
 // Default config constants.
 const (
-	defaultReadTimeout  = 2 * time.Second
-	defaultWriteTimeout = 2 * time.Second
-	defaultIdleTimeout  = 30 * time.Second
+	defaultReadTimeout    = 2 * time.Second
+	defaultWriteTimeout   = 2 * time.Second
+	defaultIdleTimeout    = 30 * time.Second
+	defaultRequestTimeout = 2 * time.Second
+
+	defaultFullScrapeInterval = 10 * time.Minute
+
+	defaultTLSReloadInterval = time.Minute
 )
 
 // Validate sanity checks values set in a config and returns a new config with
@@ -102,6 +140,47 @@ func (cfg Config) Validate() Config {
 		}
 	}
 
+	if cfg.TLSReloadInterval <= 0 {
+		validcfg.TLSReloadInterval = defaultTLSReloadInterval
+
+		if len(cfg.certificates()) > 0 {
+			// Without certificates, this configuration isn't used anyway.
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     "http.TLSReloadInterval",
+				"provided": cfg.TLSReloadInterval,
+				"default":  validcfg.TLSReloadInterval,
+			})
+		}
+	}
+
+	if cfg.RequestTimeout <= 0 {
+		validcfg.RequestTimeout = defaultRequestTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "http.RequestTimeout",
+			"provided": cfg.RequestTimeout,
+			"default":  validcfg.RequestTimeout,
+		})
+	}
+
+	if cfg.FullScrapeInterval <= 0 {
+		validcfg.FullScrapeInterval = defaultFullScrapeInterval
+
+		if cfg.EnableFullScrape {
+			// If full scrapes are disabled, this configuration isn't used anyway.
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     "http.FullScrapeInterval",
+				"provided": cfg.FullScrapeInterval,
+				"default":  validcfg.FullScrapeInterval,
+			})
+		}
+	}
+
+	if cfg.RealIPHeader != "" && len(cfg.TrustedProxies) == 0 {
+		log.Warn("http.RealIPHeader is ignored unless http.TrustedProxies is set", log.Fields{
+			"realIPHeader": cfg.RealIPHeader,
+		})
+	}
+
 	if cfg.MaxNumWant <= 0 {
 		validcfg.MaxNumWant = defaultMaxNumWant
 		log.Warn("falling back to default configuration", log.Fields{
@@ -136,7 +215,12 @@ func (cfg Config) Validate() Config {
 type Frontend struct {
 	srv    *http.Server
 	tlsSrv *http.Server
+	h3Srv  *http3.Server
+	h3Conn *net.UDPConn
 	tlsCfg *tls.Config
+	certs  *certificateStore
+
+	fullScrapes *fullScrapeLimiter
 
 	logic frontend.TrackerLogic
 	Config
@@ -146,58 +230,80 @@ type Frontend struct {
 // serves requests.
 func NewFrontend(logic frontend.TrackerLogic, provided Config) (*Frontend, error) {
 	cfg := provided.Validate()
+	if err := cfg.parseTrustedProxies(); err != nil {
+		return nil, err
+	}
 
 	f := &Frontend{
 		logic:  logic,
 		Config: cfg,
 	}
-
-	if cfg.Addr == "" && cfg.HTTPSAddr == "" {
-		return nil, errors.New("must specify addr or https_addr or both")
+	if cfg.EnableFullScrape {
+		f.fullScrapes = newFullScrapeLimiter(cfg.FullScrapeInterval)
 	}
 
-	if len(cfg.AnnounceRoutes) < 1 || len(cfg.ScrapeRoutes) < 1 {
-		return nil, errors.New("must specify routes")
-	}
-
-	// If TLS is enabled, create a key pair.
-	if cfg.TLSCertPath != "" && cfg.TLSKeyPath != "" {
-		var err error
-		f.tlsCfg = &tls.Config{
-			Certificates: make([]tls.Certificate, 1),
-		}
-		f.tlsCfg.Certificates[0], err = tls.LoadX509KeyPair(cfg.TLSCertPath, cfg.TLSKeyPath)
-		if err != nil {
-			return nil, err
-		}
+	var err error
+	f.tlsCfg, f.certs, err = checkConfig(cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	if cfg.HTTPSAddr != "" && f.tlsCfg == nil {
-		return nil, errors.New("must specify tls_cert_path and tls_key_path when using https_addr")
+	listen := cfg.Listen
+	if listen == nil {
+		listen = func(addr string) (net.Listener, error) { return net.Listen("tcp", addr) }
 	}
-	if cfg.HTTPSAddr == "" && f.tlsCfg != nil {
-		return nil, errors.New("must specify https_addr when using tls_cert_path and tls_key_path")
+	if cfg.ProxyProtocol {
+		listenDirect := listen
+		listen = func(addr string) (net.Listener, error) {
+			l, err := listenDirect(addr)
+			if err != nil {
+				return nil, err
+			}
+			return &proxyproto.Listener{Listener: l, Trusted: cfg.trusts, Timeout: cfg.ReadTimeout}, nil
+		}
 	}
 
 	var listenerHTTP, listenerHTTPS net.Listener
-	var err error
 	if cfg.Addr != "" {
-		listenerHTTP, err = net.Listen("tcp", f.Addr)
+		listenerHTTP, err = listen(f.Addr)
 		if err != nil {
 			return nil, err
 		}
 	}
 	if cfg.HTTPSAddr != "" {
-		listenerHTTPS, err = net.Listen("tcp", f.HTTPSAddr)
+		listenerHTTPS, err = listen(f.HTTPSAddr)
 		if err != nil {
 			if listenerHTTP != nil {
 				listenerHTTP.Close()
 			}
 			return nil, err
 		}
+		f.certs.watch(cfg.TLSReloadInterval)
+	}
+	if cfg.EnableHTTP3 {
+		listenUDP := cfg.ListenUDP
+		if listenUDP == nil {
+			listenUDP = func(addr string) (*net.UDPConn, error) {
+				udpAddr, err := net.ResolveUDPAddr("udp", addr)
+				if err != nil {
+					return nil, err
+				}
+				return net.ListenUDP("udp", udpAddr)
+			}
+		}
+		f.h3Conn, err = listenUDP(f.HTTPSAddr)
+		if err != nil {
+			if listenerHTTP != nil {
+				listenerHTTP.Close()
+			}
+			listenerHTTPS.Close()
+			f.certs.Stop().Wait()
+			return nil, err
+		}
 	}
 
 	if cfg.Addr != "" {
+		f.srv = f.newHTTPServer()
 		go func() {
 			if err := f.serveHTTP(listenerHTTP); err != nil {
 				log.Fatal("failed while serving http", log.Err(err))
@@ -205,7 +311,17 @@ func NewFrontend(logic frontend.TrackerLogic, provided Config) (*Frontend, error
 		}()
 	}
 
+	if cfg.EnableHTTP3 {
+		f.h3Srv = f.newHTTP3Server()
+		go func() {
+			if err := f.serveHTTP3(); err != nil {
+				log.Fatal("failed while serving http/3", log.Err(err))
+			}
+		}()
+	}
+
 	if cfg.HTTPSAddr != "" {
+		f.tlsSrv = f.newHTTPSServer()
 		go func() {
 			if err := f.serveHTTPS(listenerHTTPS); err != nil {
 				log.Fatal("failed while serving https", log.Err(err))
@@ -216,6 +332,67 @@ func NewFrontend(logic frontend.TrackerLogic, provided Config) (*Frontend, error
 	return f, nil
 }
 
+// Check validates a config like NewFrontend does, without binding any ports.
+func (cfg Config) Check() error {
+	cfg = cfg.Validate()
+	if err := cfg.parseTrustedProxies(); err != nil {
+		return err
+	}
+
+	if _, _, err := checkConfig(cfg); err != nil {
+		return err
+	}
+
+	for _, addr := range []string{cfg.Addr, cfg.HTTPSAddr} {
+		if addr == "" {
+			continue
+		}
+		if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+			return err
+		}
+	}
+	if cfg.EnableHTTP3 {
+		if _, err := net.ResolveUDPAddr("udp", cfg.HTTPSAddr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkConfig checks a validated config and loads its TLS certificates, if
+// any.
+func checkConfig(cfg Config) (*tls.Config, *certificateStore, error) {
+	if cfg.Addr == "" && cfg.HTTPSAddr == "" {
+		return nil, nil, errors.New("must specify addr or https_addr or both")
+	}
+
+	if len(cfg.AnnounceRoutes) < 1 || len(cfg.ScrapeRoutes) < 1 {
+		return nil, nil, errors.New("must specify routes")
+	}
+
+	if cfg.ProxyProtocol && len(cfg.TrustedProxies) == 0 {
+		return nil, nil, errors.New("must specify trusted_proxies when using proxy_protocol")
+	}
+
+	tlsCfg, certs, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.HTTPSAddr != "" && tlsCfg == nil {
+		return nil, nil, errors.New("must specify tls_cert_path and tls_key_path or tls_certificates when using https_addr")
+	}
+	if cfg.HTTPSAddr == "" && tlsCfg != nil {
+		return nil, nil, errors.New("must specify https_addr when using tls_cert_path and tls_key_path or tls_certificates")
+	}
+	if cfg.HTTPSAddr == "" && cfg.EnableHTTP3 {
+		return nil, nil, errors.New("must specify https_addr when using enable_http3")
+	}
+
+	return tlsCfg, certs, nil
+}
+
 // Stop provides a thread-safe way to shutdown a currently running Frontend.
 func (f *Frontend) Stop() stop.Result {
 	stopGroup := stop.NewGroup()
@@ -226,6 +403,12 @@ func (f *Frontend) Stop() stop.Result {
 	if f.tlsSrv != nil {
 		stopGroup.AddFunc(f.makeStopFunc(f.tlsSrv))
 	}
+	if f.h3Srv != nil {
+		stopGroup.AddFunc(f.stopHTTP3)
+	}
+	if f.certs != nil {
+		stopGroup.Add(f.certs)
+	}
 
 	return stopGroup.Stop()
 }
@@ -240,30 +423,69 @@ func (f *Frontend) makeStopFunc(stopSrv *http.Server) stop.Func {
 	}
 }
 
+// stopHTTP3 shuts the HTTP/3 server down and closes its socket.
+//
+// Clients are given WriteTimeout to finish their requests and close their
+// connections, after which the remaining connections are closed.
+func (f *Frontend) stopHTTP3() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), f.WriteTimeout)
+		defer cancel()
+		err := f.h3Srv.Shutdown(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = nil
+		}
+		if closeErr := f.h3Conn.Close(); err == nil {
+			err = closeErr
+		}
+		c.Done(err)
+	}()
+	return c.Result()
+}
+
 func (f *Frontend) handler() http.Handler {
 	router := httprouter.New()
 	for _, route := range f.AnnounceRoutes {
-		router.GET(route, f.announceRoute)
+		router.GET(route, withRoute(route, f.announceRoute))
 	}
 	for _, route := range f.ScrapeRoutes {
-		router.GET(route, f.scrapeRoute)
+		router.GET(route, withRoute(route, f.scrapeRoute))
 	}
 	return router
 }
 
-// serveHTTP blocks while listening and serving non-TLS HTTP BitTorrent
-// requests until Stop() is called or an error is returned.
-func (f *Frontend) serveHTTP(l net.Listener) error {
-	f.srv = &http.Server{
+// protocols returns the protocols served by the Frontend.
+//
+// HTTP/1.1 is always served. If HTTP/2 is enabled, it is negotiated via ALPN
+// over TLS and accepted without TLS (h2c) from clients that use it with
+// prior knowledge.
+func (f *Frontend) protocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(f.EnableHTTP2)
+	p.SetUnencryptedHTTP2(f.EnableHTTP2)
+	return p
+}
+
+// newHTTPServer creates the server for non-TLS HTTP BitTorrent requests.
+func (f *Frontend) newHTTPServer() *http.Server {
+	srv := &http.Server{
 		Addr:         f.Addr,
 		Handler:      f.handler(),
 		ReadTimeout:  f.ReadTimeout,
 		WriteTimeout: f.WriteTimeout,
 		IdleTimeout:  f.IdleTimeout,
+		Protocols:    f.protocols(),
 	}
 
-	f.srv.SetKeepAlivesEnabled(f.EnableKeepAlive)
+	srv.SetKeepAlivesEnabled(f.EnableKeepAlive)
+	return srv
+}
 
+// serveHTTP blocks while listening and serving non-TLS HTTP BitTorrent
+// requests until Stop() is called or an error is returned.
+func (f *Frontend) serveHTTP(l net.Listener) error {
 	// Start the HTTP server.
 	if err := f.srv.Serve(l); err != http.ErrServerClosed {
 		return err
@@ -271,19 +493,37 @@ func (f *Frontend) serveHTTP(l net.Listener) error {
 	return nil
 }
 
-// serveHTTPS blocks while listening and serving TLS HTTP BitTorrent
-// requests until Stop() is called or an error is returned.
-func (f *Frontend) serveHTTPS(l net.Listener) error {
-	f.tlsSrv = &http.Server{
+// newHTTPSServer creates the server for TLS HTTP BitTorrent requests.
+//
+// If HTTP/3 is enabled, its responses advertise it with an Alt-Svc header.
+func (f *Frontend) newHTTPSServer() *http.Server {
+	handler := f.handler()
+	if f.h3Srv != nil {
+		next := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := f.h3Srv.SetQUICHeaders(w.Header()); err != nil {
+				log.Debug("http: failed to advertise http/3", log.Err(err))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	srv := &http.Server{
 		Addr:         f.HTTPSAddr,
 		TLSConfig:    f.tlsCfg,
-		Handler:      f.handler(),
+		Handler:      handler,
 		ReadTimeout:  f.ReadTimeout,
 		WriteTimeout: f.WriteTimeout,
+		Protocols:    f.protocols(),
 	}
 
-	f.tlsSrv.SetKeepAlivesEnabled(f.EnableKeepAlive)
+	srv.SetKeepAlivesEnabled(f.EnableKeepAlive)
+	return srv
+}
 
+// serveHTTPS blocks while listening and serving TLS HTTP BitTorrent
+// requests until Stop() is called or an error is returned.
+func (f *Frontend) serveHTTPS(l net.Listener) error {
 	// Start the HTTP server.
 	if err := f.tlsSrv.ServeTLS(l, "", ""); err != http.ErrServerClosed {
 		return err
@@ -291,16 +531,57 @@ func (f *Frontend) serveHTTPS(l net.Listener) error {
 	return nil
 }
 
-func injectRouteParamsToContext(ctx context.Context, ps httprouter.Params) context.Context {
+// newHTTP3Server creates the server for HTTP BitTorrent requests over QUIC.
+func (f *Frontend) newHTTP3Server() *http3.Server {
+	handler := f.handler()
+	return &http3.Server{
+		Addr:      f.HTTPSAddr,
+		TLSConfig: f.tlsCfg,
+		QUICConfig: &quic.Config{
+			HandshakeIdleTimeout: f.ReadTimeout,
+			MaxIdleTimeout:       f.IdleTimeout,
+		},
+		// The server has no timeouts of its own, so they are applied to
+		// the streams of the requests.
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rc := http.NewResponseController(w)
+			now := time.Now()
+			rc.SetReadDeadline(now.Add(f.ReadTimeout))
+			rc.SetWriteDeadline(now.Add(f.WriteTimeout))
+			handler.ServeHTTP(w, r)
+		}),
+	}
+}
+
+// serveHTTP3 blocks while serving HTTP BitTorrent requests over QUIC until
+// Stop() is called or an error is returned.
+func (f *Frontend) serveHTTP3() error {
+	if err := f.h3Srv.Serve(f.h3Conn); err != http.ErrServerClosed && !errors.Is(err, quic.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// withRoute adapts a handler that needs to know the route it was registered
+// for to an httprouter.Handle.
+func withRoute(route string, h func(http.ResponseWriter, *http.Request, string, httprouter.Params)) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		h(w, r, route, ps)
+	}
+}
+
+func injectRouteToContext(ctx context.Context, route string, ps httprouter.Params) context.Context {
 	rp := bittorrent.RouteParams{}
 	for _, p := range ps {
 		rp = append(rp, bittorrent.RouteParam{Key: p.Key, Value: p.Value})
 	}
+	ctx = context.WithValue(ctx, bittorrent.FrontendKey, "http")
+	ctx = context.WithValue(ctx, bittorrent.RouteKey, route)
 	return context.WithValue(ctx, bittorrent.RouteParamsKey, rp)
 }
 
 // announceRoute parses and responds to an Announce.
-func (f *Frontend) announceRoute(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (f *Frontend) announceRoute(w http.ResponseWriter, r *http.Request, route string, ps httprouter.Params) {
 	var err error
 	var start time.Time
 	if f.EnableRequestTiming {
@@ -323,7 +604,10 @@ func (f *Frontend) announceRoute(w http.ResponseWriter, r *http.Request, ps http
 	af = new(bittorrent.AddressFamily)
 	*af = req.IP.AddressFamily
 
-	ctx := injectRouteParamsToContext(context.Background(), ps)
+	ctx, cancel := context.WithTimeout(r.Context(), f.RequestTimeout)
+	defer cancel()
+	ctx = injectRouteToContext(ctx, route, ps)
+	ctx = context.WithValue(ctx, bittorrent.MaxNumWantKey, f.MaxNumWant)
 	ctx, resp, err := f.logic.HandleAnnounce(ctx, req)
 	if err != nil {
 		WriteError(w, err)
@@ -337,39 +621,47 @@ func (f *Frontend) announceRoute(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
-	go f.logic.AfterAnnounce(ctx, req, resp)
+	f.logic.AfterAnnounce(ctx, req, resp)
 }
 
 // scrapeRoute parses and responds to a Scrape.
-func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request, route string, ps httprouter.Params) {
 	var err error
 	var start time.Time
 	if f.EnableRequestTiming {
 		start = time.Now()
 	}
+	action := "scrape"
 	var af *bittorrent.AddressFamily
 	defer func() {
 		if f.EnableRequestTiming {
-			recordResponseDuration("scrape", af, err, time.Since(start))
+			recordResponseDuration(action, af, err, time.Since(start))
 		} else {
-			recordResponseDuration("scrape", af, err, time.Duration(0))
+			recordResponseDuration(action, af, err, time.Duration(0))
 		}
 	}()
 
 	req, err := ParseScrape(r, f.ParseOptions)
+	fullScrape := err == errNoInfoHash && f.EnableFullScrape
+	if fullScrape {
+		// A scrape without infohashes is for all swarms.
+		action = "full_scrape"
+		var params *bittorrent.QueryParams
+		params, err = bittorrent.ParseURLData(r.RequestURI)
+		req = &bittorrent.ScrapeRequest{Params: params}
+	}
 	if err != nil {
 		WriteError(w, err)
 		return
 	}
 
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		log.Error("http: unable to determine remote address for scrape", log.Err(err))
-		WriteError(w, err)
+	reqIP := f.clientIP(r)
+	if reqIP == nil {
+		log.Error("http: unable to determine remote address for scrape", log.Fields{"RemoteAddr": r.RemoteAddr})
+		WriteError(w, bittorrent.ErrInvalidIP)
 		return
 	}
-
-	reqIP := net.ParseIP(host)
+	req.IP = reqIP
 	if reqIP.To4() != nil {
 		req.AddressFamily = bittorrent.IPv4
 	} else if len(reqIP) == net.IPv6len { // implies reqIP.To4() == nil
@@ -382,7 +674,17 @@ func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request, ps httpro
 	af = new(bittorrent.AddressFamily)
 	*af = req.AddressFamily
 
-	ctx := injectRouteParamsToContext(context.Background(), ps)
+	if fullScrape {
+		err = f.fullScrape(w, r, route, ps, req)
+		if err != nil {
+			WriteError(w, err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), f.RequestTimeout)
+	defer cancel()
+	ctx = injectRouteToContext(ctx, route, ps)
 	ctx, resp, err := f.logic.HandleScrape(ctx, req)
 	if err != nil {
 		WriteError(w, err)
@@ -390,11 +692,15 @@ func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request, ps httpro
 	}
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	err = WriteScrapeResponse(w, resp)
+	body := bodyWriter(w, r)
+	err = WriteScrapeResponse(body, resp)
+	if err == nil {
+		err = body.Close()
+	}
 	if err != nil {
 		WriteError(w, err)
 		return
 	}
 
-	go f.logic.AfterScrape(ctx, req, resp)
+	f.logic.AfterScrape(ctx, req, resp)
 }
@@ -0,0 +1,211 @@
+package http
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+)
+
+// staticLogic answers every request with the same response.
+type staticLogic struct{}
+
+func (staticLogic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (context.Context, *bittorrent.AnnounceResponse, error) {
+	return ctx, &bittorrent.AnnounceResponse{Interval: time.Minute, MinInterval: time.Minute}, nil
+}
+
+func (staticLogic) AfterAnnounce(context.Context, *bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse) {
+}
+
+func (staticLogic) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (context.Context, *bittorrent.ScrapeResponse, error) {
+	return ctx, &bittorrent.ScrapeResponse{}, nil
+}
+
+func (staticLogic) AfterScrape(context.Context, *bittorrent.ScrapeRequest, *bittorrent.ScrapeResponse) {
+}
+
+const testAnnounceQuery = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=bbbbbbbbbbbbbbbbbbbb&port=6881&uploaded=0&downloaded=0&left=0"
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and the
+// given DNS names and its key to dir, naming the files after name.
+func writeTestCertificate(t *testing.T, dir, name string, serial int64, dnsNames ...string) (certPath, keyPath string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "chihaya test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err = x509.ParseCertificate(der)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	certPath = filepath.Join(dir, name+".pem")
+	keyPath = filepath.Join(dir, name+".key")
+	require.Nil(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.Nil(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return certPath, keyPath, cert
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "chihaya-http")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// newTestFrontend starts a Frontend on loopback addresses and returns the
+// URLs of its HTTP and HTTPS servers.
+func newTestFrontend(t *testing.T, enableHTTP2 bool) (httpURL, httpsURL string, pool *x509.CertPool) {
+	certPath, keyPath, cert := writeTestCertificate(t, tempDir(t), "cert", 1)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+
+	_, addrs := startTestFrontend(t, Config{
+		TLSCertPath: certPath,
+		TLSKeyPath:  keyPath,
+		EnableHTTP2: enableHTTP2,
+	})
+
+	return "http://" + addrs["127.0.0.1:0"], "https://" + addrs["127.0.0.1:1"], pool
+}
+
+// startTestFrontend starts a Frontend with both an HTTP and an HTTPS server on
+// loopback addresses and returns it along with the addresses the servers are
+// bound to, keyed by "127.0.0.1:0" and "127.0.0.1:1", and by "udp 127.0.0.1:1"
+// for HTTP/3.
+func startTestFrontend(t *testing.T, cfg Config) (*Frontend, map[string]string) {
+	cfg.Addr = "127.0.0.1:0"
+	cfg.HTTPSAddr = "127.0.0.1:1"
+	cfg.AnnounceRoutes = []string{"/announce"}
+	cfg.ScrapeRoutes = []string{"/scrape"}
+
+	addrs := make(map[string]string)
+	cfg.Listen = func(addr string) (net.Listener, error) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err == nil {
+			addrs[addr] = l.Addr().String()
+		}
+		return l, err
+	}
+	cfg.ListenUDP = func(addr string) (*net.UDPConn, error) {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err == nil {
+			addrs["udp "+addr] = c.LocalAddr().String()
+		}
+		return c, err
+	}
+
+	f, err := NewFrontend(staticLogic{}, cfg)
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Empty(t, f.Stop().Wait()) })
+
+	return f, addrs
+}
+
+func get(t *testing.T, tr *http.Transport, url string) *http.Response {
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get(url)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	_, err = ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	return resp
+}
+
+func TestHTTP2(t *testing.T) {
+	httpURL, httpsURL, pool := newTestFrontend(t, true)
+
+	h1 := &http.Transport{}
+	require.Equal(t, 1, get(t, h1, httpURL+testAnnounceQuery).ProtoMajor)
+
+	h2c := &http.Transport{Protocols: new(http.Protocols)}
+	h2c.Protocols.SetUnencryptedHTTP2(true)
+	require.Equal(t, 2, get(t, h2c, httpURL+testAnnounceQuery).ProtoMajor)
+	require.Equal(t, 2, get(t, h2c, httpURL+"/scrape?info_hash=aaaaaaaaaaaaaaaaaaaa").ProtoMajor)
+
+	h2 := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true}
+	require.Equal(t, 2, get(t, h2, httpsURL+testAnnounceQuery).ProtoMajor)
+}
+
+func TestHTTP2Disabled(t *testing.T) {
+	httpURL, httpsURL, pool := newTestFrontend(t, false)
+
+	h2c := &http.Transport{Protocols: new(http.Protocols)}
+	h2c.Protocols.SetUnencryptedHTTP2(true)
+	_, err := (&http.Client{Transport: h2c}).Get(httpURL + testAnnounceQuery)
+	require.NotNil(t, err)
+
+	h2 := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true}
+	require.Equal(t, 1, get(t, h2, httpsURL+testAnnounceQuery).ProtoMajor)
+}
+
+func TestHTTP3(t *testing.T) {
+	certPath, keyPath, cert := writeTestCertificate(t, tempDir(t), "cert", 1)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	_, addrs := startTestFrontend(t, Config{
+		TLSCertPath: certPath,
+		TLSKeyPath:  keyPath,
+		EnableHTTP3: true,
+	})
+
+	h3 := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	defer h3.Close()
+	client := &http.Client{Transport: h3}
+	for _, path := range []string{testAnnounceQuery, "/scrape?info_hash=aaaaaaaaaaaaaaaaaaaa"} {
+		resp, err := client.Get("https://" + addrs["udp 127.0.0.1:1"] + path)
+		require.Nil(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		require.Equal(t, 3, resp.ProtoMajor)
+	}
+
+	// HTTPS responses advertise HTTP/3 on the port it is served on.
+	_, port, err := net.SplitHostPort(addrs["udp 127.0.0.1:1"])
+	require.Nil(t, err)
+	h1 := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	resp := get(t, h1, "https://"+addrs["127.0.0.1:1"]+testAnnounceQuery)
+	require.Contains(t, resp.Header.Get("Alt-Svc"), `h3=":`+port+`"`)
+}
+
+func TestHTTP3RequiresHTTPS(t *testing.T) {
+	err := Config{
+		Addr:           "127.0.0.1:0",
+		AnnounceRoutes: []string{"/announce"},
+		ScrapeRoutes:   []string{"/scrape"},
+		EnableHTTP3:    true,
+	}.Check()
+	require.EqualError(t, err, "must specify https_addr when using enable_http3")
+}
@@ -0,0 +1,166 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/frontend"
+	"github.com/doujincafe/chihaya/frontend/http/bencode"
+	"github.com/doujincafe/chihaya/pkg/log"
+)
+
+const (
+	// maxRunningFullScrapes is the maximum number of full scrapes served at
+	// the same time.
+	maxRunningFullScrapes = 4
+
+	// fullScrapeDeadlineSwarms is the number of swarms written to a full
+	// scrape between extensions of its write deadline.
+	fullScrapeDeadlineSwarms = 1024
+)
+
+// fullScrapeLimiter limits full scrapes to one per client and interval, and
+// to maxRunningFullScrapes at the same time.
+type fullScrapeLimiter struct {
+	interval time.Duration
+	running  chan struct{}
+
+	mu     sync.Mutex
+	last   map[string]time.Time
+	pruned time.Time
+}
+
+func newFullScrapeLimiter(interval time.Duration) *fullScrapeLimiter {
+	return &fullScrapeLimiter{
+		interval: interval,
+		running:  make(chan struct{}, maxRunningFullScrapes),
+		last:     make(map[string]time.Time),
+	}
+}
+
+// acquire reserves a full scrape for the client with the IP address ip.
+//
+// It returns false if the client is not allowed another full scrape yet or
+// too many are running. Otherwise, release must be called once the full
+// scrape is done.
+func (l *fullScrapeLimiter) acquire(ip net.IP, now time.Time) bool {
+	select {
+	case l.running <- struct{}{}:
+	default:
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.pruned) >= l.interval {
+		for key, t := range l.last {
+			if now.Sub(t) >= l.interval {
+				delete(l.last, key)
+			}
+		}
+		l.pruned = now
+	}
+
+	key := string(ip.To16())
+	if t, ok := l.last[key]; ok && now.Sub(t) < l.interval {
+		<-l.running
+		return false
+	}
+	l.last[key] = now
+	return true
+}
+
+// release ends a full scrape reserved with acquire.
+func (l *fullScrapeLimiter) release() {
+	<-l.running
+}
+
+// fullScrape streams the Scrapes of all swarms of the AddressFamily of req to
+// the client, without building the whole response in memory.
+//
+// The full scrape is checked by the TrackerLogic within RequestTimeout.
+// Writing the swarms is not bound by it, it takes as long as it takes.
+//
+// Errors are returned if nothing has been written yet. Once the response has
+// started, errors are logged and the connection is aborted, so that the
+// client does not mistake a truncated response for a complete one.
+func (f *Frontend) fullScrape(w http.ResponseWriter, r *http.Request, route string, ps httprouter.Params, req *bittorrent.ScrapeRequest) error {
+	scraper, ok := f.logic.(frontend.FullScraper)
+	if !ok {
+		return frontend.ErrFullScrapeUnsupported
+	}
+
+	if !f.fullScrapes.acquire(req.IP, time.Now()) {
+		return bittorrent.ErrRateLimited
+	}
+	defer f.fullScrapes.release()
+
+	ctx, cancel := context.WithTimeout(r.Context(), f.RequestTimeout)
+	ctx = injectRouteToContext(ctx, route, ps)
+	scrapeSwarms, err := scraper.HandleFullScrape(ctx, req)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	rc := http.NewResponseController(w)
+	var body *bufio.Writer
+	var closeBody func() error
+	start := func() error {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(f.FullScrapeInterval/time.Second)))
+		bw := bodyWriter(w, r)
+		body, closeBody = bufio.NewWriter(bw), bw.Close
+		_, err := body.WriteString("d5:filesd")
+		return err
+	}
+
+	var swarms int
+	err = scrapeSwarms(r.Context(), func(scrape bittorrent.Scrape) error {
+		if body == nil {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+
+		swarms++
+		if swarms%fullScrapeDeadlineSwarms == 0 {
+			// Writing all swarms may take longer than WriteTimeout, but
+			// every batch of them must not.
+			rc.SetWriteDeadline(time.Now().Add(f.WriteTimeout))
+		}
+
+		enc := bencode.NewEncoder(body)
+		if err := enc.Encode(scrape.InfoHash[:]); err != nil {
+			return err
+		}
+		return enc.Encode(scrapeDict(scrape))
+	})
+	if err == nil && body == nil {
+		err = start()
+	}
+	if err == nil {
+		_, err = body.WriteString("ee")
+	}
+	if err == nil {
+		err = body.Flush()
+	}
+	if err == nil {
+		err = closeBody()
+	}
+
+	if err != nil && body != nil {
+		log.Error("http: failed to write full scrape", log.Fields{"swarms": swarms}, log.Err(err))
+		panic(http.ErrAbortHandler)
+	}
+	return err
+}
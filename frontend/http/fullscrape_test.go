@@ -0,0 +1,141 @@
+package http
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/frontend"
+	"github.com/doujincafe/chihaya/frontend/http/bencode"
+)
+
+// swarmLogic serves full scrapes of a fixed set of swarms to clients sending
+// the passkey, if it is set.
+type swarmLogic struct {
+	staticLogic
+	swarms  []bittorrent.Scrape
+	passkey string
+}
+
+var errInvalidPasskey = bittorrent.ClientError("invalid passkey")
+
+func (l swarmLogic) HandleFullScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (frontend.ScrapeSwarmsFunc, error) {
+	if passkey, _ := req.Params.String("passkey"); passkey != l.passkey {
+		return nil, errInvalidPasskey
+	}
+
+	return func(ctx context.Context, fn func(bittorrent.Scrape) error) error {
+		for _, scrape := range l.swarms {
+			if err := fn(scrape); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// startFullScrapeFrontend starts a Frontend for logic on a loopback address
+// and returns the address.
+func startFullScrapeFrontend(t *testing.T, logic swarmLogic, enableFullScrape bool) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	f, err := NewFrontend(logic, Config{
+		Addr:             "127.0.0.1:0",
+		AnnounceRoutes:   []string{"/announce"},
+		ScrapeRoutes:     []string{"/scrape"},
+		EnableFullScrape: enableFullScrape,
+		Listen:           func(string) (net.Listener, error) { return l, nil },
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Empty(t, f.Stop().Wait()) })
+
+	return l.Addr().String()
+}
+
+func TestFullScrapeLimiter(t *testing.T) {
+	l := newFullScrapeLimiter(time.Minute)
+	now := time.Now()
+	a, b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+
+	require.True(t, l.acquire(a, now))
+	l.release()
+	require.False(t, l.acquire(a, now.Add(time.Second)))
+	require.True(t, l.acquire(a, now.Add(time.Minute)))
+	l.release()
+
+	// Clients are limited separately, but share the running full scrapes.
+	for i := 0; i < maxRunningFullScrapes; i++ {
+		require.True(t, l.acquire(net.IPv4(198, 51, 100, byte(i)), now))
+	}
+	require.False(t, l.acquire(b, now))
+	l.release()
+	require.True(t, l.acquire(b, now))
+}
+
+func TestFullScrape(t *testing.T) {
+	var swarms []bittorrent.Scrape
+	expected := bencode.NewDict()
+	for i := 0; i < 2*fullScrapeDeadlineSwarms+1; i++ {
+		var ih bittorrent.InfoHash
+		ih[0], ih[1] = byte(i>>8), byte(i)
+		swarms = append(swarms, bittorrent.Scrape{InfoHash: ih, Complete: uint32(i)})
+		expected[string(ih[:])] = bencode.Dict{"complete": int64(i), "downloaded": int64(0), "incomplete": int64(0)}
+	}
+
+	addr := startFullScrapeFrontend(t, swarmLogic{swarms: swarms}, true)
+
+	req, err := http.NewRequest("GET", "http://"+addr+"/scrape", nil)
+	require.Nil(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	require.Equal(t, "public, max-age=600", resp.Header.Get("Cache-Control"))
+
+	gz, err := gzip.NewReader(resp.Body)
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(gz)
+	require.Nil(t, err)
+	decoded, err := bencode.Unmarshal(body)
+	require.Nil(t, err)
+	require.Equal(t, bencode.Dict{"files": expected}, decoded)
+
+	// Another full scrape within the interval is refused.
+	resp, err = http.Get("http://" + addr + "/scrape")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "d14:failure reason19:rate limit exceedede", string(body))
+}
+
+func TestFullScrapeDisabled(t *testing.T) {
+	addr := startFullScrapeFrontend(t, swarmLogic{}, false)
+
+	resp, err := http.Get("http://" + addr + "/scrape")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "d14:failure reason31:no info_hash parameter suppliede", string(body))
+}
+
+func TestFullScrapeRefused(t *testing.T) {
+	addr := startFullScrapeFrontend(t, swarmLogic{passkey: "secret"}, true)
+
+	resp, err := http.Get("http://" + addr + "/scrape?passkey=wrong")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "d14:failure reason15:invalid passkeye", string(body))
+}
@@ -3,21 +3,34 @@ package http
 import (
 	"net"
 	"net/http"
+	"strconv"
 
 	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/pkg/iptrie"
 )
 
 // ParseOptions is the configuration used to parse an Announce Request.
 //
 // If AllowIPSpoofing is true, IPs provided via BitTorrent params will be used.
-// If RealIPHeader is not empty string, the value of the first HTTP Header with
-// that name will be used.
+// If AllowDualStack is true, the address a client provides via the ipv4 or
+// ipv6 param of BEP 7 in the address family it does not announce from is
+// used as its alternative peer. That address can not be verified: clients
+// can make the tracker hand out any public address to other peers.
+// If RealIPHeader is not empty string and the request comes from one of the
+// TrustedProxies, the HTTP Header with that name will be used. The
+// X-Forwarded-For and Forwarded headers are read from right to left, skipping
+// the addresses of trusted proxies.
 type ParseOptions struct {
-	AllowIPSpoofing     bool   `yaml:"allow_ip_spoofing"`
-	RealIPHeader        string `yaml:"real_ip_header"`
-	MaxNumWant          uint32 `yaml:"max_numwant"`
-	DefaultNumWant      uint32 `yaml:"default_numwant"`
-	MaxScrapeInfoHashes uint32 `yaml:"max_scrape_infohashes"`
+	AllowIPSpoofing     bool     `yaml:"allow_ip_spoofing"`
+	AllowDualStack      bool     `yaml:"allow_dual_stack"`
+	RealIPHeader        string   `yaml:"real_ip_header"`
+	TrustedProxies      []string `yaml:"trusted_proxies"`
+	MaxNumWant          uint32   `yaml:"max_numwant"`
+	DefaultNumWant      uint32   `yaml:"default_numwant"`
+	MaxScrapeInfoHashes uint32   `yaml:"max_scrape_infohashes"`
+
+	// trusted holds the addresses of TrustedProxies, see parseTrustedProxies.
+	trusted *iptrie.Set
 }
 
 // Default parser config constants.
@@ -72,6 +85,9 @@ func ParseAnnounce(r *http.Request, opts ParseOptions) (*bittorrent.AnnounceRequ
 	}
 	request.Peer.ID = bittorrent.PeerIDFromString(peerID)
 
+	// Parse the tracker id the client received in an earlier response.
+	request.TrackerID, _ = qp.String("trackerid")
+
 	// Determine the number of remaining bytes for the client.
 	request.Left, err = qp.Uint64("left")
 	if err != nil {
@@ -107,11 +123,18 @@ func ParseAnnounce(r *http.Request, opts ParseOptions) (*bittorrent.AnnounceRequ
 	request.Peer.Port = uint16(port)
 
 	// Parse the IP address where the client is listening.
-	request.Peer.IP.IP, request.IPProvided = requestedIP(r, qp, opts)
+	request.RemoteIP = opts.clientIP(r)
+	request.Peer.IP.IP, request.IPProvided = requestedIP(request.RemoteIP, qp, opts)
 	if request.Peer.IP.IP == nil {
 		return nil, bittorrent.ClientError("failed to parse peer IP address")
 	}
 
+	// Parse the address where the client is listening in the other address
+	// family.
+	if opts.AllowDualStack {
+		request.AltPeer = altPeer(qp, request.Peer)
+	}
+
 	if err := bittorrent.SanitizeAnnounce(request, opts.MaxNumWant, opts.DefaultNumWant); err != nil {
 		return nil, err
 	}
@@ -119,6 +142,10 @@ func ParseAnnounce(r *http.Request, opts ParseOptions) (*bittorrent.AnnounceRequ
 	return request, nil
 }
 
+// errNoInfoHash is returned by ParseScrape for scrapes without infohashes,
+// which are full scrapes if they are enabled.
+var errNoInfoHash = bittorrent.ClientError("no info_hash parameter supplied")
+
 // ParseScrape parses an bittorrent.ScrapeRequest from an http.Request.
 func ParseScrape(r *http.Request, opts ParseOptions) (*bittorrent.ScrapeRequest, error) {
 	qp, err := bittorrent.ParseURLData(r.RequestURI)
@@ -128,7 +155,7 @@ func ParseScrape(r *http.Request, opts ParseOptions) (*bittorrent.ScrapeRequest,
 
 	infoHashes := qp.InfoHashes()
 	if len(infoHashes) < 1 {
-		return nil, bittorrent.ClientError("no info_hash parameter supplied")
+		return nil, errNoInfoHash
 	}
 
 	request := &bittorrent.ScrapeRequest{
@@ -143,8 +170,9 @@ func ParseScrape(r *http.Request, opts ParseOptions) (*bittorrent.ScrapeRequest,
 	return request, nil
 }
 
-// requestedIP determines the IP address for a BitTorrent client request.
-func requestedIP(r *http.Request, p bittorrent.Params, opts ParseOptions) (ip net.IP, provided bool) {
+// requestedIP determines the IP address for a BitTorrent client request
+// received from remoteIP.
+func requestedIP(remoteIP net.IP, p bittorrent.Params, opts ParseOptions) (ip net.IP, provided bool) {
 	if opts.AllowIPSpoofing {
 		if ipstr, ok := p.String("ip"); ok {
 			return net.ParseIP(ipstr), true
@@ -159,12 +187,42 @@ func requestedIP(r *http.Request, p bittorrent.Params, opts ParseOptions) (ip ne
 		}
 	}
 
-	if opts.RealIPHeader != "" {
-		if ip := r.Header.Get(opts.RealIPHeader); ip != "" {
-			return net.ParseIP(ip), false
-		}
+	return remoteIP, false
+}
+
+// altPeer determines the peer of a client in the address family other than
+// the one of the peer it announces, from the ipv4 or ipv6 param. The param may
+// hold a port, the port of the announced peer is used otherwise.
+//
+// The address is only parsed here: bittorrent.SanitizeAnnounce drops it unless
+// it is a public unicast address of the other address family.
+func altPeer(p bittorrent.Params, peer bittorrent.Peer) *bittorrent.Peer {
+	param := "ipv6"
+	if peer.IP.To4() == nil {
+		param = "ipv4"
 	}
 
-	host, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return net.ParseIP(host), false
+	value, ok := p.String(param)
+	if !ok {
+		return nil
+	}
+
+	alt := &bittorrent.Peer{ID: peer.ID, Port: peer.Port}
+	if alt.IP.IP = net.ParseIP(value); alt.IP.IP != nil {
+		return alt
+	}
+
+	host, portStr, err := net.SplitHostPort(value)
+	if err != nil {
+		return nil
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil
+	}
+	alt.IP.IP, alt.Port = net.ParseIP(host), uint16(port)
+	if alt.IP.IP == nil {
+		return nil
+	}
+	return alt
 }
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAnnounceAltPeer(t *testing.T) {
+	var table = []struct {
+		remoteAddr string
+		query      string
+		allowed    bool
+		expected   string
+	}{
+		{"192.0.2.1:1234", "&ipv6=2001:db8::1", true, "0000000000000000000000000000000000000000@[2001:db8::1]:6881"},
+		{"192.0.2.1:1234", "&ipv6=%5B2001:db8::1%5D:51413", true, "0000000000000000000000000000000000000000@[2001:db8::1]:51413"},
+		{"[2001:db8::1]:1234", "&ipv4=192.0.2.1:51413", true, "0000000000000000000000000000000000000000@[192.0.2.1]:51413"},
+		{"192.0.2.1:1234", "&ipv6=2001:db8::1", false, ""},
+		{"192.0.2.1:1234", "", true, ""},
+
+		// Addresses of the family announced from are not alternatives.
+		{"192.0.2.1:1234", "&ipv4=192.0.2.2", true, ""},
+		{"192.0.2.1:1234", "&ipv6=192.0.2.2", true, ""},
+		{"192.0.2.1:1234", "&ipv6=2001:db8::1:0", true, "0000000000000000000000000000000000000000@[2001:db8::1:0]:6881"},
+		{"192.0.2.1:1234", "&ipv6=%5B2001:db8::1%5D:0", true, ""},
+		{"192.0.2.1:1234", "&ipv6=garbage", true, ""},
+
+		// Only public unicast addresses are handed out to other peers.
+		{"192.0.2.1:1234", "&ipv6=::1", true, ""},
+		{"192.0.2.1:1234", "&ipv6=::", true, ""},
+		{"192.0.2.1:1234", "&ipv6=fe80::1", true, ""},
+		{"192.0.2.1:1234", "&ipv6=ff02::1", true, ""},
+		{"192.0.2.1:1234", "&ipv6=fd00::1", true, ""},
+		{"[2001:db8::1]:1234", "&ipv4=127.0.0.1", true, ""},
+		{"[2001:db8::1]:1234", "&ipv4=0.0.0.0", true, ""},
+		{"[2001:db8::1]:1234", "&ipv4=169.254.0.1", true, ""},
+		{"[2001:db8::1]:1234", "&ipv4=224.0.0.1", true, ""},
+		{"[2001:db8::1]:1234", "&ipv4=255.255.255.255", true, ""},
+		{"[2001:db8::1]:1234", "&ipv4=10.0.0.1", true, ""},
+		{"[2001:db8::1]:1234", "&ipv4=192.168.0.1", true, ""},
+	}
+
+	for _, tt := range table {
+		r := httptest.NewRequest("GET", "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00&port=6881&uploaded=0&downloaded=0&left=0"+tt.query, nil)
+		r.RemoteAddr = tt.remoteAddr
+
+		req, err := ParseAnnounce(r, ParseOptions{AllowDualStack: tt.allowed, MaxNumWant: 50, DefaultNumWant: 50})
+		require.Nil(t, err, tt.query)
+
+		if tt.expected == "" {
+			require.Nil(t, req.AltPeer, tt.query)
+			continue
+		}
+		require.NotNil(t, req.AltPeer, tt.query)
+		require.Equal(t, tt.expected, req.AltPeer.String(), tt.query)
+	}
+}
+
+func TestParseAnnounceTrackerID(t *testing.T) {
+	for query, expected := range map[string]string{
+		"":                 "",
+		"&trackerid=abc":   "abc",
+		"&trackerid=a%20b": "a b",
+	} {
+		r := httptest.NewRequest("GET", testAnnounceQuery+query, nil)
+		req, err := ParseAnnounce(r, ParseOptions{MaxNumWant: 50, DefaultNumWant: 50})
+		require.Nil(t, err, query)
+		require.Equal(t, expected, req.TrackerID, query)
+	}
+}
+
+func TestParseAnnounceRemoteIP(t *testing.T) {
+	r := httptest.NewRequest("GET", testAnnounceQuery+"&ip=198.51.100.1", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	req, err := ParseAnnounce(r, ParseOptions{AllowIPSpoofing: true, MaxNumWant: 50, DefaultNumWant: 50})
+	require.Nil(t, err)
+	require.True(t, req.IPProvided)
+	require.Equal(t, "198.51.100.1", req.IP.String())
+	require.Equal(t, "192.0.2.1", req.RemoteIP.String())
+}
@@ -1,6 +1,7 @@
 package http
 
 import (
+	"crypto/tls"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -10,6 +11,7 @@ import (
 
 func init() {
 	prometheus.MustRegister(promResponseDurationMilliseconds)
+	prometheus.MustRegister(promTLSCertificateExpiry)
 }
 
 var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
@@ -21,6 +23,20 @@ var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
 	[]string{"action", "address_family", "error"},
 )
 
+var promTLSCertificateExpiry = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chihaya_http_tls_certificate_expiry_timestamp_seconds",
+		Help: "The time at which a TLS certificate of the HTTPS server expires, in seconds since the Unix epoch",
+	},
+	[]string{"cert_path"},
+)
+
+// recordCertificateExpiry records the time at which a certificate loaded
+// from path expires.
+func recordCertificateExpiry(path string, cert *tls.Certificate) {
+	promTLSCertificateExpiry.WithLabelValues(path).Set(float64(cert.Leaf.NotAfter.Unix()))
+}
+
 // recordResponseDuration records the duration of time to respond to a Request
 // in milliseconds.
 func recordResponseDuration(action string, af *bittorrent.AddressFamily, err error, duration time.Duration) {
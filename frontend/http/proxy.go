@@ -0,0 +1,148 @@
+package http
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/doujincafe/chihaya/pkg/iptrie"
+)
+
+// parseTrustedProxies parses the addresses of TrustedProxies.
+//
+// It must be called before the options are used to parse requests, requests
+// are treated as if they came from untrusted sources otherwise.
+func (opts *ParseOptions) parseTrustedProxies() error {
+	opts.trusted = nil
+	if len(opts.TrustedProxies) == 0 {
+		return nil
+	}
+
+	trusted := &iptrie.Set{}
+	for _, entry := range opts.TrustedProxies {
+		if err := trusted.Add(entry); err != nil {
+			return errors.New("trusted_proxies: " + err.Error())
+		}
+	}
+	opts.trusted = trusted
+	return nil
+}
+
+// trusts reports whether ip is the address of a trusted proxy.
+func (opts ParseOptions) trusts(ip net.IP) bool {
+	return opts.trusted != nil && opts.trusted.Contains(ip)
+}
+
+// clientIP determines the IP address of the client that sent a request.
+//
+// The address of the connection is used, unless it is the address of a
+// trusted proxy. Then, the addresses in the header named RealIPHeader are
+// followed from right to left, that is from the closest proxy to the client,
+// up to the first address that is not the one of a trusted proxy.
+func (opts ParseOptions) clientIP(r *http.Request) net.IP {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	if opts.RealIPHeader == "" || !opts.trusts(ip) {
+		return ip
+	}
+
+	values := r.Header.Values(opts.RealIPHeader)
+	var hops []string
+	switch http.CanonicalHeaderKey(opts.RealIPHeader) {
+	case "X-Forwarded-For":
+		for _, v := range values {
+			hops = append(hops, splitQuoted(v, ',')...)
+		}
+	case "Forwarded":
+		hops = forwardedFor(values)
+	default:
+		// Headers like X-Real-IP hold only one address, which a client
+		// may have sent along as well. The last one is the one added by
+		// the proxy.
+		if len(values) > 0 {
+			hops = values[len(values)-1:]
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseNode(hops[i])
+		if hop == nil {
+			// The proxy did not know or hid the address it was
+			// connected to, so this is as far as it can be followed.
+			break
+		}
+		ip = hop
+		if !opts.trusts(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedFor returns the "for" parameters of the elements of RFC 7239
+// Forwarded headers, in order. Elements without one are returned as empty
+// strings.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, element := range splitQuoted(v, ',') {
+			hop := ""
+			for _, pair := range splitQuoted(element, ';') {
+				i := strings.IndexByte(pair, '=')
+				if i >= 0 && strings.EqualFold(strings.TrimSpace(pair[:i]), "for") {
+					hop = pair[i+1:]
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits s at every sep that is not within a quoted string.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped := false, false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseNode parses the IP address of a node like it is given in the
+// X-Forwarded-For header or the "for" parameter of the Forwarded header,
+// optionally quoted and with a port.
+//
+// nil is returned for unknown and obfuscated addresses.
+func parseNode(node string) net.IP {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+
+	if strings.HasPrefix(node, "[") {
+		end := strings.IndexByte(node, ']')
+		if end < 0 {
+			return nil
+		}
+		return net.ParseIP(node[1:end])
+	}
+
+	if ip := net.ParseIP(node); ip != nil {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(node)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
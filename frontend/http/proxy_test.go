@@ -0,0 +1,126 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+)
+
+func TestClientIP(t *testing.T) {
+	var table = []struct {
+		remoteAddr string
+		header     string
+		values     []string
+		expected   string
+	}{
+		// Headers are only used if the request comes from a trusted proxy.
+		{"192.0.2.1:1234", "X-Real-IP", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"10.0.0.1:1234", "X-Real-IP", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", "X-Real-IP", []string{"198.51.100.2", "198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", "X-Real-IP", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", "X-Real-IP", []string{"garbage"}, "10.0.0.1"},
+
+		// X-Forwarded-For is read from right to left up to the first
+		// untrusted address, anything to the left of it may be spoofed.
+		{"10.0.0.1:1234", "X-Forwarded-For", []string{"203.0.113.1, 198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", []string{"203.0.113.1, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", []string{"203.0.113.1", "198.51.100.1,10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"10.0.0.1:1234", "X-Forwarded-For", []string{"2001:db8::1, [2001:db8::2]:80"}, "2001:db8::2"},
+		{"10.0.0.1:1234", "X-Forwarded-For", []string{"198.51.100.1:6881"}, "198.51.100.1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", []string{"198.51.100.1, unknown, 10.0.0.2"}, "10.0.0.2"},
+		{"[2001:db8::1]:1234", "X-Forwarded-For", []string{"198.51.100.1"}, "2001:db8::1"},
+
+		{"10.0.0.1:1234", "Forwarded", []string{`for=203.0.113.1, for=198.51.100.1;proto=http`}, "198.51.100.1"},
+		{"10.0.0.1:1234", "Forwarded", []string{`For="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{"10.0.0.1:1234", "Forwarded", []string{`for="198.51.100.1:6881";by="a,b", for=10.0.0.2`}, "198.51.100.1"},
+		{"10.0.0.1:1234", "Forwarded", []string{`for=198.51.100.1, for=_hidden, for=10.0.0.2`}, "10.0.0.2"},
+		{"10.0.0.1:1234", "Forwarded", []string{`for=198.51.100.1, proto=https`}, "10.0.0.1"},
+	}
+
+	for _, tt := range table {
+		opts := ParseOptions{RealIPHeader: tt.header, TrustedProxies: []string{"10.0.0.0/8"}}
+		require.Nil(t, opts.parseTrustedProxies())
+
+		r := httptest.NewRequest("GET", "/announce", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, v := range tt.values {
+			r.Header.Add(tt.header, v)
+		}
+
+		require.Equal(t, net.ParseIP(tt.expected), opts.clientIP(r), "%s %v", tt.header, tt.values)
+	}
+}
+
+func TestClientIPWithoutTrustedProxies(t *testing.T) {
+	opts := ParseOptions{RealIPHeader: "X-Real-IP"}
+	require.Nil(t, opts.parseTrustedProxies())
+
+	r := httptest.NewRequest("GET", "/announce", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Real-IP", "198.51.100.1")
+	require.Equal(t, net.ParseIP("127.0.0.1"), opts.clientIP(r))
+
+	opts.TrustedProxies = []string{"not an address"}
+	require.NotNil(t, opts.parseTrustedProxies())
+}
+
+// peerIPLogic records the IP addresses of the peers announcing.
+type peerIPLogic struct {
+	staticLogic
+	ips chan net.IP
+}
+
+func (l peerIPLogic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (context.Context, *bittorrent.AnnounceResponse, error) {
+	l.ips <- req.Peer.IP.IP
+	return l.staticLogic.HandleAnnounce(ctx, req)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	logic := peerIPLogic{ips: make(chan net.IP, 1)}
+	f, err := NewFrontend(logic, Config{
+		Addr:           "127.0.0.1:0",
+		AnnounceRoutes: []string{"/announce"},
+		ScrapeRoutes:   []string{"/scrape"},
+		ProxyProtocol:  true,
+		ParseOptions:   ParseOptions{TrustedProxies: []string{"127.0.0.1"}},
+		Listen:         func(string) (net.Listener, error) { return l, nil },
+	})
+	require.Nil(t, err)
+	defer func() { require.Empty(t, f.Stop().Wait()) }()
+
+	for header, expected := range map[string]string{
+		"PROXY TCP4 198.51.100.1 127.0.0.1 6881 80\r\n": "198.51.100.1",
+		"PROXY UNKNOWN\r\n":                             "127.0.0.1",
+		"":                                              "127.0.0.1",
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.Nil(t, err)
+		_, err = c.Write([]byte(header + "GET " + testAnnounceQuery + " HTTP/1.1\r\nHost: tracker\r\n\r\n"))
+		require.Nil(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Nil(t, c.Close())
+		require.Equal(t, expected, (<-logic.ips).String())
+	}
+
+	_, err = NewFrontend(logic, Config{
+		Addr:           "127.0.0.1:0",
+		AnnounceRoutes: []string{"/announce"},
+		ScrapeRoutes:   []string{"/scrape"},
+		ProxyProtocol:  true,
+	})
+	require.NotNil(t, err)
+}
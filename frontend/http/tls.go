@@ -0,0 +1,276 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/pkg/stop"
+)
+
+// TLSCertificate is a PEM encoded certificate chain and its private key.
+type TLSCertificate struct {
+	CertPath string `yaml:"cert_path"`
+	KeyPath  string `yaml:"key_path"`
+}
+
+// tlsVersions maps the values of tls_min_version to TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// http2CipherSuites are the cipher suites of which HTTP/2 requires at least
+// one to be enabled, see RFC 7540, section 9.2.2.
+var http2CipherSuites = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+}
+
+// certificates returns the configured certificates, the one configured by
+// tls_cert_path and tls_key_path first.
+func (cfg Config) certificates() []TLSCertificate {
+	var certs []TLSCertificate
+	if cfg.TLSCertPath != "" && cfg.TLSKeyPath != "" {
+		certs = append(certs, TLSCertificate{CertPath: cfg.TLSCertPath, KeyPath: cfg.TLSKeyPath})
+	}
+	return append(certs, cfg.TLSCertificates...)
+}
+
+// newTLSConfig loads the certificates of a config and returns a TLS config
+// serving them, or nil if no certificate is configured.
+func newTLSConfig(cfg Config) (*tls.Config, *certificateStore, error) {
+	certs := cfg.certificates()
+	if len(certs) == 0 {
+		return nil, nil, nil
+	}
+	for _, c := range certs {
+		if c.CertPath == "" || c.KeyPath == "" {
+			return nil, nil, errors.New("must specify cert_path and key_path for all tls_certificates")
+		}
+	}
+
+	tlsCfg := &tls.Config{}
+	if cfg.TLSMinVersion != "" {
+		v, ok := tlsVersions[cfg.TLSMinVersion]
+		if !ok {
+			return nil, nil, errors.New("unknown tls_min_version " + cfg.TLSMinVersion + ", must be one of 1.0, 1.1, 1.2 and 1.3")
+		}
+		tlsCfg.MinVersion = v
+	}
+
+	if len(cfg.TLSCipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, s := range tls.CipherSuites() {
+			suites[s.Name] = s.ID
+		}
+
+		http2Compatible := false
+		for _, name := range cfg.TLSCipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, nil, errors.New("unknown or insecure cipher suite " + name)
+			}
+			tlsCfg.CipherSuites = append(tlsCfg.CipherSuites, id)
+
+			for _, required := range http2CipherSuites {
+				http2Compatible = http2Compatible || id == required
+			}
+		}
+
+		if cfg.EnableHTTP2 && !http2Compatible {
+			return nil, nil, errors.New("tls_cipher_suites must contain TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 when using enable_http2")
+		}
+	}
+
+	store, err := newCertificateStore(certs)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsCfg.GetCertificate = store.getCertificate
+
+	return tlsCfg, store, nil
+}
+
+// fileState is the state of a file as of the last time it was loaded.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// loadedCertificate is a certificate along with the state of its files.
+type loadedCertificate struct {
+	cert      *tls.Certificate
+	certState fileState
+	keyState  fileState
+}
+
+// certificateStore holds the certificates served over TLS and reloads them
+// when their files change.
+type certificateStore struct {
+	paths []TLSCertificate
+
+	// loaded holds the current []loadedCertificate, in the order of paths.
+	loaded atomic.Value
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newCertificateStore(paths []TLSCertificate) (*certificateStore, error) {
+	s := &certificateStore{
+		paths:  paths,
+		closed: make(chan struct{}),
+	}
+
+	loaded := make([]loadedCertificate, len(paths))
+	for i, p := range paths {
+		var err error
+		if loaded[i], err = loadCertificate(p); err != nil {
+			return nil, err
+		}
+	}
+	s.loaded.Store(loaded)
+
+	return s, nil
+}
+
+// loadCertificate loads a certificate along with the state of its files.
+func loadCertificate(p TLSCertificate) (loadedCertificate, error) {
+	var lc loadedCertificate
+	var err error
+	if lc.certState, err = statFile(p.CertPath); err != nil {
+		return lc, err
+	}
+	if lc.keyState, err = statFile(p.KeyPath); err != nil {
+		return lc, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(p.CertPath, p.KeyPath)
+	if err != nil {
+		return lc, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return lc, err
+		}
+	}
+	lc.cert = &cert
+
+	return lc, nil
+}
+
+func statFile(path string) (fileState, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+//
+// It returns the first certificate supported by the client, which includes
+// matching the server name it indicated, or the first certificate if none is
+// supported.
+func (s *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	loaded := s.loaded.Load().([]loadedCertificate)
+	for _, lc := range loaded {
+		if hello.SupportsCertificate(lc.cert) == nil {
+			return lc.cert, nil
+		}
+	}
+	return loaded[0].cert, nil
+}
+
+// watch records the expiry of the certificates and starts reloading them
+// at the given interval.
+func (s *certificateStore) watch(interval time.Duration) {
+	for i, lc := range s.loaded.Load().([]loadedCertificate) {
+		recordCertificateExpiry(s.paths[i].CertPath, lc.cert)
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			select {
+			case <-s.closed:
+				return
+			case <-time.After(interval):
+				s.reloadIfChanged()
+			}
+		}
+	}()
+}
+
+// reloadIfChanged reloads the certificates whose files changed.
+//
+// A certificate that fails to load is logged and the previous one is kept,
+// so that a certificate and key that are not replaced at once are loaded
+// once both of them are.
+func (s *certificateStore) reloadIfChanged() {
+	loaded := s.loaded.Load().([]loadedCertificate)
+	updated := make([]loadedCertificate, len(loaded))
+	copy(updated, loaded)
+
+	changed := false
+	for i, p := range s.paths {
+		certState, err := statFile(p.CertPath)
+		if err != nil {
+			log.Error("http: failed to check TLS certificate", log.Err(err))
+			continue
+		}
+		keyState, err := statFile(p.KeyPath)
+		if err != nil {
+			log.Error("http: failed to check TLS key", log.Err(err))
+			continue
+		}
+		if certState == loaded[i].certState && keyState == loaded[i].keyState {
+			continue
+		}
+
+		lc, err := loadCertificate(p)
+		if err != nil {
+			log.Error("http: failed to reload TLS certificate, keeping previous one", log.Fields{
+				"certPath": p.CertPath,
+				"error":    err,
+			})
+			continue
+		}
+
+		updated[i] = lc
+		changed = true
+		recordCertificateExpiry(p.CertPath, lc.cert)
+		log.Info("http: reloaded TLS certificate", log.Fields{
+			"certPath": p.CertPath,
+			"notAfter": lc.cert.Leaf.NotAfter,
+		})
+	}
+
+	if changed {
+		s.loaded.Store(updated)
+	}
+}
+
+// Stop stops reloading the certificates.
+func (s *certificateStore) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		close(s.closed)
+		s.wg.Wait()
+		for _, p := range s.paths {
+			promTLSCertificateExpiry.DeleteLabelValues(p.CertPath)
+		}
+		c.Done()
+	}()
+
+	return c.Result()
+}
@@ -0,0 +1,118 @@
+package http
+
+import (
+	"crypto/tls"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// handshake connects to addr and returns the serial number of the
+// certificate presented for serverName.
+func handshake(t *testing.T, addr, serverName string) *big.Int {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	require.Nil(t, err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber
+}
+
+func TestCertificateSNI(t *testing.T) {
+	dir := tempDir(t)
+	aCert, aKey, _ := writeTestCertificate(t, dir, "a", 1, "a.test")
+	bCert, bKey, _ := writeTestCertificate(t, dir, "b", 2, "b.test", "*.b.test")
+
+	_, addrs := startTestFrontend(t, Config{
+		TLSCertPath:     aCert,
+		TLSKeyPath:      aKey,
+		TLSCertificates: []TLSCertificate{{CertPath: bCert, KeyPath: bKey}},
+	})
+	addr := addrs["127.0.0.1:1"]
+
+	require.Equal(t, int64(1), handshake(t, addr, "a.test").Int64())
+	require.Equal(t, int64(2), handshake(t, addr, "b.test").Int64())
+	require.Equal(t, int64(2), handshake(t, addr, "www.b.test").Int64())
+
+	// Clients asking for an unknown name or none get the first certificate.
+	require.Equal(t, int64(1), handshake(t, addr, "c.test").Int64())
+	require.Equal(t, int64(1), handshake(t, addr, "").Int64())
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := tempDir(t)
+	certPath, keyPath, _ := writeTestCertificate(t, dir, "cert", 1)
+
+	f, addrs := startTestFrontend(t, Config{TLSCertPath: certPath, TLSKeyPath: keyPath})
+	addr := addrs["127.0.0.1:1"]
+	require.Equal(t, int64(1), handshake(t, addr, "").Int64())
+
+	// A renewed certificate is served once it is reloaded.
+	newCertPath, newKeyPath, _ := writeTestCertificate(t, dir, "new", 2)
+	require.Nil(t, os.Rename(newCertPath, certPath))
+	require.Nil(t, os.Rename(newKeyPath, keyPath))
+	touch(t, certPath, keyPath)
+	f.certs.reloadIfChanged()
+	require.Equal(t, int64(2), handshake(t, addr, "").Int64())
+
+	// A certificate whose key was not replaced yet is not loaded.
+	newCertPath, _, _ = writeTestCertificate(t, dir, "new", 3)
+	require.Nil(t, os.Rename(newCertPath, certPath))
+	touch(t, certPath)
+	f.certs.reloadIfChanged()
+	require.Equal(t, int64(2), handshake(t, addr, "").Int64())
+}
+
+// touch moves the modification time of files forward, so that replacing them
+// is noticed on file systems with coarse timestamps.
+func touch(t *testing.T, paths ...string) {
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		require.Nil(t, err)
+		mtime := fi.ModTime().Add(time.Second)
+		require.Nil(t, os.Chtimes(path, mtime, mtime))
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	certPath, keyPath, _ := writeTestCertificate(t, tempDir(t), "cert", 1)
+	cfg := Config{
+		HTTPSAddr:      "127.0.0.1:0",
+		TLSCertPath:    certPath,
+		TLSKeyPath:     keyPath,
+		AnnounceRoutes: []string{"/announce"},
+		ScrapeRoutes:   []string{"/scrape"},
+	}
+
+	tlsCfg, _, err := checkConfig(cfg)
+	require.Nil(t, err)
+	require.Equal(t, uint16(0), tlsCfg.MinVersion)
+	require.Nil(t, tlsCfg.CipherSuites)
+
+	withOptions := cfg
+	withOptions.TLSMinVersion = "1.2"
+	withOptions.TLSCipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}
+	tlsCfg, _, err = checkConfig(withOptions)
+	require.Nil(t, err)
+	require.Equal(t, uint16(tls.VersionTLS12), tlsCfg.MinVersion)
+	require.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, tlsCfg.CipherSuites)
+
+	// HTTP/2 requires an AES-128-GCM cipher suite.
+	withOptions.EnableHTTP2 = true
+	_, _, err = checkConfig(withOptions)
+	require.NotNil(t, err)
+
+	for _, invalid := range []func(*Config){
+		func(cfg *Config) { cfg.TLSMinVersion = "1.4" },
+		func(cfg *Config) { cfg.TLSCipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"} },
+		func(cfg *Config) { cfg.TLSCertificates = []TLSCertificate{{CertPath: certPath}} },
+		func(cfg *Config) { cfg.TLSKeyPath = certPath },
+		func(cfg *Config) { cfg.Addr, cfg.HTTPSAddr = "127.0.0.1:0", "" },
+	} {
+		invalidCfg := cfg
+		invalid(&invalidCfg)
+		_, _, err := checkConfig(invalidCfg)
+		require.NotNil(t, err)
+	}
+}
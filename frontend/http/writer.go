@@ -1,7 +1,13 @@
 package http
 
 import (
+	"compress/gzip"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/doujincafe/chihaya/bittorrent"
 	"github.com/doujincafe/chihaya/frontend/http/bencode"
@@ -33,6 +39,19 @@ func WriteAnnounceResponse(w http.ResponseWriter, resp *bittorrent.AnnounceRespo
 		"min interval": resp.MinInterval,
 	}
 
+	// Add the optional keys of BEP 3 and BEP 24.
+	if resp.WarningMessage != "" {
+		bdict["warning message"] = resp.WarningMessage
+	}
+	if resp.TrackerID != "" {
+		bdict["tracker id"] = resp.TrackerID
+	}
+	if ip := resp.ExternalIP.To4(); ip != nil {
+		bdict["external ip"] = []byte(ip)
+	} else if len(resp.ExternalIP) == net.IPv6len {
+		bdict["external ip"] = []byte(resp.ExternalIP)
+	}
+
 	// Add the peers to the dictionary in the compact format.
 	if resp.Compact {
 		var IPv4CompactDict, IPv6CompactDict []byte
@@ -71,13 +90,10 @@ func WriteAnnounceResponse(w http.ResponseWriter, resp *bittorrent.AnnounceRespo
 
 // WriteScrapeResponse communicates the results of a Scrape to a BitTorrent
 // client over HTTP.
-func WriteScrapeResponse(w http.ResponseWriter, resp *bittorrent.ScrapeResponse) error {
+func WriteScrapeResponse(w io.Writer, resp *bittorrent.ScrapeResponse) error {
 	filesDict := bencode.NewDict()
 	for _, scrape := range resp.Files {
-		filesDict[string(scrape.InfoHash[:])] = bencode.Dict{
-			"complete":   scrape.Complete,
-			"incomplete": scrape.Incomplete,
-		}
+		filesDict[string(scrape.InfoHash[:])] = scrapeDict(scrape)
 	}
 
 	return bencode.NewEncoder(w).Encode(bencode.Dict{
@@ -85,6 +101,82 @@ func WriteScrapeResponse(w http.ResponseWriter, resp *bittorrent.ScrapeResponse)
 	})
 }
 
+// scrapeDict returns the dictionary describing a swarm in a scrape response,
+// as described in BEP 48.
+func scrapeDict(scrape bittorrent.Scrape) bencode.Dict {
+	d := bencode.Dict{
+		"complete":   scrape.Complete,
+		"downloaded": scrape.Snatches,
+		"incomplete": scrape.Incomplete,
+	}
+	if scrape.Name != "" {
+		d["name"] = scrape.Name
+	}
+	return d
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// bodyWriter returns a writer for the body of the response to r, which
+// compresses the body with gzip if the client accepts it.
+//
+// The writer must be closed once the body is written.
+func bodyWriter(w http.ResponseWriter, r *http.Request) io.WriteCloser {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		return nopWriteCloser{w}
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzipWriters.Get().(*gzip.Writer)
+	gz.Reset(w)
+	return pooledGzipWriter{gz}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r lists gzip
+// without a quality value of zero.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			params := strings.Split(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+				continue
+			}
+
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if q, err := strconv.ParseFloat(param[2:], 64); err != nil || q == 0 {
+						return false
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// pooledGzipWriter is a gzip.Writer that is returned to gzipWriters once it
+// is closed.
+type pooledGzipWriter struct {
+	*gzip.Writer
+}
+
+func (w pooledGzipWriter) Close() error {
+	err := w.Writer.Close()
+	gzipWriters.Put(w.Writer)
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
 func compact4(peer bittorrent.Peer) (buf []byte) {
 	if ip := peer.IP.To4(); ip == nil {
 		panic("non-IPv4 IP for Peer in IPv4Peers")
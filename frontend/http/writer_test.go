@@ -1,13 +1,16 @@
 package http
 
 import (
+	"bytes"
 	"fmt"
+	"net"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/frontend/http/bencode"
 )
 
 func TestWriteError(t *testing.T) {
@@ -44,3 +47,78 @@ func TestWriteStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteScrapeResponse(t *testing.T) {
+	named := bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa")
+	unnamed := bittorrent.InfoHashFromString("bbbbbbbbbbbbbbbbbbbb")
+	var buf bytes.Buffer
+	err := WriteScrapeResponse(&buf, &bittorrent.ScrapeResponse{Files: []bittorrent.Scrape{
+		{InfoHash: named, Snatches: 3, Complete: 2, Incomplete: 1, Name: "test"},
+		{InfoHash: unnamed, Snatches: 6, Complete: 5, Incomplete: 4},
+	}})
+	require.Nil(t, err)
+
+	// The name is only included if it is known.
+	decoded, err := bencode.Unmarshal(buf.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, bencode.Dict{"files": bencode.Dict{
+		string(named[:]):   bencode.Dict{"complete": int64(2), "downloaded": int64(3), "incomplete": int64(1), "name": "test"},
+		string(unnamed[:]): bencode.Dict{"complete": int64(5), "downloaded": int64(6), "incomplete": int64(4)},
+	}}, decoded)
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	var table = []struct {
+		values   []string
+		expected bool
+	}{
+		{nil, false},
+		{[]string{"identity"}, false},
+		{[]string{"gzip"}, true},
+		{[]string{"deflate, GZIP"}, true},
+		{[]string{"br", "gzip;q=0.5"}, true},
+		{[]string{"gzip; q=0"}, false},
+		{[]string{"gzip;q=0.000"}, false},
+		{[]string{"x-gzip"}, false},
+	}
+
+	for _, tt := range table {
+		r := httptest.NewRequest("GET", "/scrape", nil)
+		for _, v := range tt.values {
+			r.Header.Add("Accept-Encoding", v)
+		}
+		require.Equal(t, tt.expected, acceptsGzip(r), "%v", tt.values)
+	}
+}
+
+func TestWriteAnnounceResponseExtras(t *testing.T) {
+	for ip, expected := range map[string][]byte{
+		"192.0.2.1":   {192, 0, 2, 1},
+		"2001:db8::1": {0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	} {
+		r := httptest.NewRecorder()
+		err := WriteAnnounceResponse(r, &bittorrent.AnnounceResponse{
+			Compact:        true,
+			WarningMessage: "your client is deprecated",
+			TrackerID:      "abc",
+			ExternalIP:     net.ParseIP(ip),
+		})
+		require.Nil(t, err)
+
+		decoded, err := bencode.Unmarshal(r.Body.Bytes())
+		require.Nil(t, err)
+		d := decoded.(bencode.Dict)
+		require.Equal(t, "your client is deprecated", d["warning message"])
+		require.Equal(t, "abc", d["tracker id"])
+		require.Equal(t, string(expected), d["external ip"])
+	}
+
+	// The optional keys are left out if they are not set.
+	r := httptest.NewRecorder()
+	require.Nil(t, WriteAnnounceResponse(r, &bittorrent.AnnounceResponse{}))
+	decoded, err := bencode.Unmarshal(r.Body.Bytes())
+	require.Nil(t, err)
+	require.NotContains(t, decoded, "warning message")
+	require.NotContains(t, decoded, "tracker id")
+	require.NotContains(t, decoded, "external ip")
+}
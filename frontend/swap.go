@@ -0,0 +1,106 @@
+package frontend
+
+import (
+	"context"
+	"sync"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+)
+
+// logicGeneration is a TrackerLogic along with the calls currently running
+// on it.
+type logicGeneration struct {
+	logic TrackerLogic
+	calls sync.WaitGroup
+}
+
+// SwappableLogic is a TrackerLogic that passes every call on to another
+// TrackerLogic, which can be replaced while requests are being handled.
+//
+// Frontends can be given a SwappableLogic to change the TrackerLogic behind
+// them without restarting them.
+type SwappableLogic struct {
+	mu      sync.RWMutex
+	current *logicGeneration
+}
+
+var (
+	_ TrackerLogic = &SwappableLogic{}
+	_ FullScraper  = &SwappableLogic{}
+)
+
+// NewSwappableLogic returns a SwappableLogic passing calls on to l.
+func NewSwappableLogic(l TrackerLogic) *SwappableLogic {
+	return &SwappableLogic{current: &logicGeneration{logic: l}}
+}
+
+// Swap replaces the TrackerLogic calls are passed on to.
+//
+// Calls made after Swap returns use l. Swap returns the previous
+// TrackerLogic once all calls to it returned, so that it can be stopped.
+//
+// A request that is handled while the TrackerLogic is replaced may run its
+// post-hooks on l.
+func (s *SwappableLogic) Swap(l TrackerLogic) TrackerLogic {
+	s.mu.Lock()
+	old := s.current
+	s.current = &logicGeneration{logic: l}
+	s.mu.Unlock()
+
+	old.calls.Wait()
+	return old.logic
+}
+
+// acquire returns the current generation, which must be released by calling
+// Done on its calls.
+func (s *SwappableLogic) acquire() *logicGeneration {
+	s.mu.RLock()
+	g := s.current
+	g.calls.Add(1)
+	s.mu.RUnlock()
+	return g
+}
+
+// HandleAnnounce implements TrackerLogic.
+func (s *SwappableLogic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (context.Context, *bittorrent.AnnounceResponse, error) {
+	g := s.acquire()
+	defer g.calls.Done()
+	return g.logic.HandleAnnounce(ctx, req)
+}
+
+// AfterAnnounce implements TrackerLogic.
+func (s *SwappableLogic) AfterAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	g := s.acquire()
+	defer g.calls.Done()
+	g.logic.AfterAnnounce(ctx, req, resp)
+}
+
+// HandleScrape implements TrackerLogic.
+func (s *SwappableLogic) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (context.Context, *bittorrent.ScrapeResponse, error) {
+	g := s.acquire()
+	defer g.calls.Done()
+	return g.logic.HandleScrape(ctx, req)
+}
+
+// AfterScrape implements TrackerLogic.
+func (s *SwappableLogic) AfterScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) {
+	g := s.acquire()
+	defer g.calls.Done()
+	g.logic.AfterScrape(ctx, req, resp)
+}
+
+// HandleFullScrape implements FullScraper.
+//
+// It returns ErrFullScrapeUnsupported if the current TrackerLogic does not
+// implement FullScraper. The TrackerLogic can be replaced while the returned
+// function runs.
+func (s *SwappableLogic) HandleFullScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (ScrapeSwarmsFunc, error) {
+	g := s.acquire()
+	defer g.calls.Done()
+
+	fs, ok := g.logic.(FullScraper)
+	if !ok {
+		return nil, ErrFullScrapeUnsupported
+	}
+	return fs.HandleFullScrape(ctx, req)
+}
@@ -0,0 +1,88 @@
+package frontend
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+)
+
+// blockingLogic is a TrackerLogic whose announces block until released.
+type blockingLogic struct {
+	TrackerLogic
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (l *blockingLogic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (context.Context, *bittorrent.AnnounceResponse, error) {
+	l.entered <- struct{}{}
+	<-l.release
+	return ctx, &bittorrent.AnnounceResponse{Interval: time.Minute}, nil
+}
+
+func TestSwapWaitsForCalls(t *testing.T) {
+	old := &blockingLogic{entered: make(chan struct{}), release: make(chan struct{})}
+	s := NewSwappableLogic(old)
+
+	done := make(chan *bittorrent.AnnounceResponse)
+	go func() {
+		_, resp, err := s.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{})
+		require.Nil(t, err)
+		done <- resp
+	}()
+	<-old.entered
+
+	swapped := make(chan TrackerLogic)
+	go func() { swapped <- s.Swap(&blockingLogic{}) }()
+
+	select {
+	case <-swapped:
+		t.Fatal("Swap returned while a call was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(old.release)
+	require.Equal(t, time.Minute, (<-done).Interval)
+	require.Equal(t, old, <-swapped)
+}
+
+// fullScrapeLogic is a TrackerLogic whose full scrapes block until released.
+type fullScrapeLogic struct {
+	TrackerLogic
+	release chan struct{}
+}
+
+func (l *fullScrapeLogic) HandleFullScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (ScrapeSwarmsFunc, error) {
+	return func(ctx context.Context, fn func(bittorrent.Scrape) error) error {
+		<-l.release
+		return fn(bittorrent.Scrape{Complete: 1})
+	}, nil
+}
+
+func TestSwapDuringFullScrape(t *testing.T) {
+	old := &fullScrapeLogic{release: make(chan struct{})}
+	s := NewSwappableLogic(old)
+
+	scrapeSwarms, err := s.HandleFullScrape(context.Background(), &bittorrent.ScrapeRequest{})
+	require.Nil(t, err)
+	done := make(chan bittorrent.Scrape, 1)
+	go func() {
+		require.Nil(t, scrapeSwarms(context.Background(), func(scrape bittorrent.Scrape) error {
+			done <- scrape
+			return nil
+		}))
+	}()
+
+	// The TrackerLogic is replaced while the swarms are still being
+	// scraped.
+	require.Equal(t, old, s.Swap(&blockingLogic{}))
+
+	close(old.release)
+	require.Equal(t, uint32(1), (<-done).Complete)
+
+	_, err = s.HandleFullScrape(context.Background(), &bittorrent.ScrapeRequest{})
+	require.Equal(t, ErrFullScrapeUnsupported, err)
+}
@@ -0,0 +1,45 @@
+package udp
+
+import (
+	"net"
+)
+
+// message is a packet read from or written to a socket.
+type message struct {
+	buf  []byte
+	addr *net.UDPAddr
+}
+
+// batchConn reads and writes packets, several at once where the platform
+// supports it.
+type batchConn interface {
+	// ReadBatch reads at least one packet into the buffers of msgs and
+	// returns the number of packets read. The buffers of the messages read
+	// are resliced to the packets and their addresses are set.
+	ReadBatch(msgs []message) (int, error)
+
+	// WriteBatch writes at least the first packet of msgs and returns the
+	// number of packets written.
+	WriteBatch(msgs []message) (int, error)
+}
+
+// singleConn is a batchConn reading and writing one packet at a time.
+type singleConn struct {
+	*net.UDPConn
+}
+
+func (c singleConn) ReadBatch(msgs []message) (int, error) {
+	n, addr, err := c.ReadFromUDP(msgs[0].buf)
+	if err != nil {
+		return 0, err
+	}
+	msgs[0].buf, msgs[0].addr = msgs[0].buf[:n], addr
+	return 1, nil
+}
+
+func (c singleConn) WriteBatch(msgs []message) (int, error) {
+	if _, err := c.WriteToUDP(msgs[0].buf, msgs[0].addr); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
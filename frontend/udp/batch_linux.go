@@ -0,0 +1,192 @@
+// +build linux
+
+package udp
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// batchSupported reports whether packets can be read and written in batches.
+const batchSupported = true
+
+// newBatchConn returns a batchConn for c that reads and writes up to size
+// packets with one system call, using recvmmsg and sendmmsg.
+func newBatchConn(c *net.UDPConn, size int) (batchConn, error) {
+	if size <= 1 {
+		return singleConn{c}, nil
+	}
+
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	// Destination addresses must be of the family of the socket, which
+	// receives IPv4 packets as IPv4-mapped IPv6 addresses if it is an IPv6
+	// socket.
+	var sa unix.Sockaddr
+	var saErr error
+	if err := raw.Control(func(fd uintptr) {
+		sa, saErr = unix.Getsockname(int(fd))
+	}); err != nil {
+		return nil, err
+	}
+	if saErr != nil {
+		return nil, saErr
+	}
+	_, v4 := sa.(*unix.SockaddrInet4)
+
+	return &mmsgConn{
+		raw: raw,
+		v4:  v4,
+		r:   newMmsgBuffers(size),
+		w:   newMmsgBuffers(size),
+	}, nil
+}
+
+// mmsghdr is the struct mmsghdr of recvmmsg and sendmmsg.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// mmsgBuffers holds the headers of the packets of a batch.
+type mmsgBuffers struct {
+	hdrs  []mmsghdr
+	iovs  []unix.Iovec
+	names []unix.RawSockaddrInet6
+}
+
+func newMmsgBuffers(size int) *mmsgBuffers {
+	return &mmsgBuffers{
+		hdrs:  make([]mmsghdr, size),
+		iovs:  make([]unix.Iovec, size),
+		names: make([]unix.RawSockaddrInet6, size),
+	}
+}
+
+// prepare points the headers of the buffers at msgs.
+func (b *mmsgBuffers) prepare(msgs []message) {
+	for i := range msgs {
+		b.iovs[i].Base = &msgs[i].buf[0]
+		b.iovs[i].SetLen(len(msgs[i].buf))
+		b.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		b.hdrs[i].hdr.Namelen = unix.SizeofSockaddrInet6
+		b.hdrs[i].hdr.Iov = &b.iovs[i]
+		b.hdrs[i].hdr.SetIovlen(1)
+		b.hdrs[i].len = 0
+	}
+}
+
+// mmsgConn is a batchConn using recvmmsg and sendmmsg.
+//
+// ReadBatch and WriteBatch may be called concurrently with each other, but
+// not with themselves.
+type mmsgConn struct {
+	raw syscall.RawConn
+	v4  bool
+	r   *mmsgBuffers
+	w   *mmsgBuffers
+}
+
+func (c *mmsgConn) ReadBatch(msgs []message) (int, error) {
+	if len(msgs) > len(c.r.hdrs) {
+		msgs = msgs[:len(c.r.hdrs)]
+	}
+	c.r.prepare(msgs)
+
+	n, err := c.mmsg(c.raw.Read, unix.SYS_RECVMMSG, "recvmmsg", c.r.hdrs[:len(msgs)])
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < n; i++ {
+		msgs[i].buf = msgs[i].buf[:c.r.hdrs[i].len]
+		msgs[i].addr = udpAddr(&c.r.names[i])
+	}
+	return n, nil
+}
+
+func (c *mmsgConn) WriteBatch(msgs []message) (int, error) {
+	if len(msgs) > len(c.w.hdrs) {
+		msgs = msgs[:len(c.w.hdrs)]
+	}
+	c.w.prepare(msgs)
+	for i := range msgs {
+		c.w.hdrs[i].hdr.Namelen = putSockaddr(&c.w.names[i], msgs[i].addr, c.v4)
+	}
+
+	return c.mmsg(c.raw.Write, unix.SYS_SENDMMSG, "sendmmsg", c.w.hdrs[:len(msgs)])
+}
+
+// mmsg makes the system call trap for hdrs once the socket is ready, using
+// wait, which is the Read or Write method of the RawConn of the socket.
+func (c *mmsgConn) mmsg(wait func(func(fd uintptr) bool) error, trap uintptr, name string, hdrs []mmsghdr) (int, error) {
+	var n int
+	var errno syscall.Errno
+	err := wait(func(fd uintptr) bool {
+		for {
+			r, _, e := unix.Syscall6(trap, fd, uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(hdrs)), 0, 0, 0)
+			switch e {
+			case unix.EINTR:
+				continue
+			case unix.EAGAIN:
+				return false
+			}
+			n, errno = int(r), e
+			return true
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, os.NewSyscallError(name, errno)
+	}
+	return n, nil
+}
+
+// udpAddr returns the address of a struct sockaddr_in or sockaddr_in6.
+func udpAddr(sa *unix.RawSockaddrInet6) *net.UDPAddr {
+	// The port is at the same offset in both structs.
+	port := int(binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:]))
+
+	if sa.Family == unix.AF_INET {
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		return &net.UDPAddr{IP: append(net.IP{}, sa4.Addr[:]...), Port: port}
+	}
+
+	addr := &net.UDPAddr{IP: append(net.IP{}, sa.Addr[:]...), Port: port}
+	if sa.Scope_id != 0 {
+		addr.Zone = strconv.Itoa(int(sa.Scope_id))
+	}
+	return addr
+}
+
+// putSockaddr writes addr to sa as a struct sockaddr_in if v4 is set and as a
+// struct sockaddr_in6 otherwise, and returns its length.
+func putSockaddr(sa *unix.RawSockaddrInet6, addr *net.UDPAddr, v4 bool) uint32 {
+	if v4 {
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		*sa4 = unix.RawSockaddrInet4{Family: unix.AF_INET}
+		copy(sa4.Addr[:], addr.IP.To4())
+		binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa4.Port))[:], uint16(addr.Port))
+		return unix.SizeofSockaddrInet4
+	}
+
+	*sa = unix.RawSockaddrInet6{Family: unix.AF_INET6}
+	copy(sa.Addr[:], addr.IP.To16())
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:], uint16(addr.Port))
+	if addr.Zone != "" {
+		scope, _ := strconv.Atoi(addr.Zone)
+		sa.Scope_id = uint32(scope)
+	}
+	return unix.SizeofSockaddrInet6
+}
@@ -0,0 +1,35 @@
+// +build linux
+
+package udp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSockaddr(t *testing.T) {
+	var table = []struct {
+		addr     *net.UDPAddr
+		v4       bool
+		expected *net.UDPAddr
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 6881}, true, &net.UDPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 6881}},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 6881}, false, &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 6881}},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, false, &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 1, Zone: "2"}, false, &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 1, Zone: "2"}},
+	}
+
+	for _, tt := range table {
+		var sa unix.RawSockaddrInet6
+		n := putSockaddr(&sa, tt.addr, tt.v4)
+		if tt.v4 {
+			require.Equal(t, uint32(unix.SizeofSockaddrInet4), n)
+		} else {
+			require.Equal(t, uint32(unix.SizeofSockaddrInet6), n)
+		}
+		require.Equal(t, tt.expected, udpAddr(&sa), tt.addr.String())
+	}
+}
@@ -0,0 +1,14 @@
+// +build !linux
+
+package udp
+
+import "net"
+
+// batchSupported reports whether packets can be read and written in batches.
+const batchSupported = false
+
+// newBatchConn returns a batchConn for c reading and writing one packet at a
+// time, as batches are only supported on Linux.
+func newBatchConn(c *net.UDPConn, size int) (batchConn, error) {
+	return singleConn{c}, nil
+}
@@ -30,6 +30,66 @@ func ValidConnectionID(connectionID []byte, ip net.IP, now time.Time, maxClockSk
 	return NewConnectionIDGenerator(key).Validate(connectionID, ip, now, maxClockSkew)
 }
 
+// A KeySchedule derives the keys connection IDs are signed with from a secret.
+//
+// If the interval of the schedule is zero, the secret itself is the key.
+// Otherwise, the key changes every interval: the key of a period is an HMAC of
+// the number of the period, keyed with the secret. Instances sharing the secret
+// and interval use the same keys, so they accept each other's connection IDs.
+//
+// A connection ID is signed with the key of the period its timestamp falls in,
+// so IDs handed out just before a rotation stay valid with the previous key
+// until they expire.
+type KeySchedule struct {
+	secret   []byte
+	interval int64
+}
+
+// NewKeySchedule creates a KeySchedule for secret, rotating the key every
+// interval, truncated to seconds, or never if it is zero.
+func NewKeySchedule(secret string, interval time.Duration) KeySchedule {
+	return KeySchedule{
+		secret:   []byte(secret),
+		interval: int64(interval / time.Second),
+	}
+}
+
+// period returns the number of the period the unix timestamp ts falls in.
+func (s KeySchedule) period(ts int64) int64 {
+	if s.interval <= 0 {
+		return 0
+	}
+	return ts / s.interval
+}
+
+// key returns the key of the given period.
+func (s KeySchedule) key(period int64) []byte {
+	if s.interval <= 0 {
+		return s.secret
+	}
+
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(period))
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(b[:])
+	return mac.Sum(nil)
+}
+
+// Generator creates a new connection ID generator using the keys of s.
+func (s KeySchedule) Generator() *ConnectionIDGenerator {
+	return &ConnectionIDGenerator{
+		schedule: s,
+		connID:   make([]byte, 8),
+		scratch:  make([]byte, 32),
+	}
+}
+
+// periodMAC is an HMAC keyed with the key of a period.
+type periodMAC struct {
+	period int64
+	mac    hash.Hash
+}
+
 // A ConnectionIDGenerator is a reusable generator and validator for connection
 // IDs as described in BEP 15.
 // It is not thread safe, but is safe to be pooled and reused by other
@@ -38,9 +98,12 @@ func ValidConnectionID(connectionID []byte, ip net.IP, now time.Time, maxClockSk
 // After initial creation, it can generate connection IDs without allocating.
 // See Generate and Validate for usage notes and guarantees.
 type ConnectionIDGenerator struct {
-	// mac is a keyed HMAC that can be reused for subsequent connection ID
-	// generations.
-	mac hash.Hash
+	schedule KeySchedule
+
+	// macs holds keyed HMACs for the two most recently used periods of the
+	// schedule, indexed by the period modulo 2, so that they can be reused
+	// for subsequent connection ID generations while keys are rotated.
+	macs [2]periodMAC
 
 	// connID is an 8-byte slice that holds the generated connection ID after a
 	// call to Generate.
@@ -53,30 +116,41 @@ type ConnectionIDGenerator struct {
 	scratch []byte
 }
 
-// NewConnectionIDGenerator creates a new connection ID generator.
+// NewConnectionIDGenerator creates a new connection ID generator using a
+// static key.
 func NewConnectionIDGenerator(key string) *ConnectionIDGenerator {
-	return &ConnectionIDGenerator{
-		mac:     hmac.New(sha256.New, []byte(key)),
-		connID:  make([]byte, 8),
-		scratch: make([]byte, 32),
-	}
+	return NewKeySchedule(key, 0).Generator()
 }
 
 // reset resets the generator.
 // This is called by other methods of the generator, it's not necessary to call
 // it after getting a generator from a pool.
 func (g *ConnectionIDGenerator) reset() {
-	g.mac.Reset()
 	g.connID = g.connID[:8]
 	g.scratch = g.scratch[:0]
 }
 
+// mac returns a reset HMAC keyed with the key for the unix timestamp ts.
+func (g *ConnectionIDGenerator) mac(ts uint32) hash.Hash {
+	period := g.schedule.period(int64(ts))
+	m := &g.macs[period&1]
+	if m.mac == nil || m.period != period {
+		m.period = period
+		m.mac = hmac.New(sha256.New, g.schedule.key(period))
+		return m.mac
+	}
+
+	m.mac.Reset()
+	return m.mac
+}
+
 // Generate generates an 8-byte connection ID as described in BEP 15 for the
 // given IP and the current time.
 //
 // The first 4 bytes of the connection identifier is a unix timestamp and the
 // last 4 bytes are a truncated HMAC token created from the aforementioned
-// unix timestamp and the source IP address of the UDP packet.
+// unix timestamp and the source IP address of the UDP packet, keyed with the
+// key of the schedule of the generator for the timestamp.
 //
 // Truncated HMAC is known to be safe for 2^(-n) where n is the size in bits
 // of the truncated HMAC token. In this use case we have 32 bits, thus a
@@ -88,11 +162,13 @@ func (g *ConnectionIDGenerator) reset() {
 func (g *ConnectionIDGenerator) Generate(ip net.IP, now time.Time) []byte {
 	g.reset()
 
-	binary.BigEndian.PutUint32(g.connID, uint32(now.Unix()))
+	ts := uint32(now.Unix())
+	binary.BigEndian.PutUint32(g.connID, ts)
 
-	g.mac.Write(g.connID[:4])
-	g.mac.Write(ip)
-	g.scratch = g.mac.Sum(g.scratch)
+	mac := g.mac(ts)
+	mac.Write(g.connID[:4])
+	mac.Write(ip)
+	g.scratch = mac.Sum(g.scratch)
 	copy(g.connID[4:8], g.scratch[:4])
 
 	log.Debug("generated connection ID", log.Fields{"ip": ip, "now": now, "connID": g.connID})
@@ -101,7 +177,8 @@ func (g *ConnectionIDGenerator) Generate(ip net.IP, now time.Time) []byte {
 
 // Validate validates the given connection ID for an IP and the current time.
 func (g *ConnectionIDGenerator) Validate(connectionID []byte, ip net.IP, now time.Time, maxClockSkew time.Duration) bool {
-	ts := time.Unix(int64(binary.BigEndian.Uint32(connectionID[:4])), 0)
+	unix := binary.BigEndian.Uint32(connectionID[:4])
+	ts := time.Unix(int64(unix), 0)
 	log.Debug("validating connection ID", log.Fields{"connID": connectionID, "ip": ip, "ts": ts, "now": now})
 	if now.After(ts.Add(ttl)) || ts.After(now.Add(maxClockSkew)) {
 		return false
@@ -109,8 +186,9 @@ func (g *ConnectionIDGenerator) Validate(connectionID []byte, ip net.IP, now tim
 
 	g.reset()
 
-	g.mac.Write(connectionID[:4])
-	g.mac.Write(ip)
-	g.scratch = g.mac.Sum(g.scratch)
+	mac := g.mac(unix)
+	mac.Write(connectionID[:4])
+	mac.Write(ip)
+	g.scratch = mac.Sum(g.scratch)
 	return hmac.Equal(g.scratch[:4], connectionID[4:])
 }
@@ -1,9 +1,12 @@
 package udp
 
 import (
+	"context"
 	"crypto/hmac"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"sync"
 	"testing"
@@ -12,7 +15,12 @@ import (
 	sha256 "github.com/minio/sha256-simd"
 	"github.com/stretchr/testify/require"
 
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/middleware"
 	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+	"github.com/doujincafe/chihaya/storage"
+	_ "github.com/doujincafe/chihaya/storage/memory"
 )
 
 var golden = []struct {
@@ -98,6 +106,225 @@ func TestReuseGeneratorValidate(t *testing.T) {
 	}
 }
 
+func TestKeyRotation(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	schedule := NewKeySchedule("secret", time.Hour)
+	gen := schedule.Generator()
+
+	// Keys are derived from the secret, not the secret itself.
+	start := time.Unix(1600000000, 0).Truncate(time.Hour)
+	require.NotEqual(t, NewConnectionID(ip, start, "secret"), gen.Generate(ip, start))
+
+	// Connection IDs handed out before a rotation stay valid until they
+	// expire, and IDs of the new period are signed with a new key.
+	before := append([]byte{}, gen.Generate(ip, start.Add(-time.Second))...)
+	after := append([]byte{}, gen.Generate(ip, start)...)
+	require.True(t, gen.Validate(before, ip, start.Add(time.Minute), time.Minute))
+	require.True(t, gen.Validate(after, ip, start.Add(time.Minute), time.Minute))
+	require.False(t, gen.Validate(before, ip, start.Add(ttl), time.Minute))
+
+	forged := append([]byte{}, after...)
+	copy(forged[:4], before[:4])
+	require.False(t, gen.Validate(forged, ip, start, time.Minute))
+
+	// Generators sharing the secret accept each other's connection IDs.
+	require.True(t, NewKeySchedule("secret", time.Hour).Generator().Validate(after, ip, start, time.Minute))
+	require.False(t, NewKeySchedule("other", time.Hour).Generator().Validate(after, ip, start, time.Minute))
+}
+
+func TestPrivateKeyFile(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "key")
+	require.Nil(t, err)
+	_, err = f.WriteString("secret\n")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	key, err := Config{PrivateKeyFile: f.Name()}.privateKey()
+	require.Nil(t, err)
+	require.Equal(t, "secret", key)
+
+	_, err = Config{PrivateKey: "secret", PrivateKeyFile: f.Name()}.privateKey()
+	require.NotNil(t, err)
+
+	require.Nil(t, ioutil.WriteFile(f.Name(), []byte(" \n"), 0600))
+	_, err = Config{PrivateKeyFile: f.Name()}.privateKey()
+	require.NotNil(t, err)
+
+	// Generated keys are not logged.
+	cfg := Config{}.Validate()
+	require.Len(t, cfg.PrivateKey, 64)
+	require.NotContains(t, fmt.Sprint(cfg.LogFields()), cfg.PrivateKey)
+}
+
+// roundTrip sends a request with the given connection ID and action to the
+// frontend and returns the action of the response.
+func roundTrip(t *testing.T, conn net.Conn, connID []byte, action uint32, payload []byte) (uint32, []byte) {
+	packet := make([]byte, 16, 16+len(payload))
+	copy(packet, connID)
+	binary.BigEndian.PutUint32(packet[8:12], action)
+	copy(packet[12:16], "txid")
+	packet = append(packet, payload...)
+
+	_, err := conn.Write(packet)
+	require.Nil(t, err)
+
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	require.Nil(t, err)
+	require.True(t, n >= 8)
+	require.Equal(t, []byte("txid"), buf[4:8])
+
+	return binary.BigEndian.Uint32(buf[:4]), buf[8:n]
+}
+
+func TestConnectionIDExpiry(t *testing.T) {
+	ps, err := storage.NewPeerStore("memory", nil)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, ps.Stop().Wait()) }()
+
+	clock := timecache.NewFakeClock(time.Unix(1600000000, 0))
+	logic := middleware.NewLogic(middleware.ResponseConfig{}, ps, nil, nil)
+	fe, err := NewFrontend(logic, Config{
+		Addr:         "127.0.0.1:0",
+		PrivateKey:   "key",
+		MaxClockSkew: 10 * time.Second,
+		Clock:        clock,
+	})
+	require.Nil(t, err)
+	defer func() { require.Nil(t, fe.Stop().Wait()) }()
+
+	conn, err := net.Dial("udp", fe.sockets[0].conn.LocalAddr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	connect := func() []byte {
+		action, connID := roundTrip(t, conn, initialConnectionID, connectActionID, nil)
+		require.Equal(t, connectActionID, action)
+		require.Len(t, connID, 8)
+		return connID
+	}
+	scrapeAction := func(connID []byte) uint32 {
+		action, _ := roundTrip(t, conn, connID, scrapeActionID, make([]byte, 20))
+		return action
+	}
+
+	connID := connect()
+	require.Equal(t, scrapeActionID, scrapeAction(connID))
+
+	// Still valid right before the TTL runs out.
+	clock.Advance(ttl)
+	require.Equal(t, scrapeActionID, scrapeAction(connID))
+
+	clock.Advance(time.Second)
+	require.Equal(t, errorActionID, scrapeAction(connID))
+
+	// A connection ID from the future is accepted within the clock skew.
+	connID = connect()
+	clock.Advance(-10 * time.Second)
+	require.Equal(t, scrapeActionID, scrapeAction(connID))
+
+	clock.Advance(-time.Second)
+	require.Equal(t, errorActionID, scrapeAction(connID))
+}
+
+func TestProxyProtocol(t *testing.T) {
+	ps, err := storage.NewPeerStore("memory", nil)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, ps.Stop().Wait()) }()
+
+	logic := middleware.NewLogic(middleware.ResponseConfig{}, ps, nil, nil)
+	fe, err := NewFrontend(logic, Config{
+		Addr:           "127.0.0.1:0",
+		PrivateKey:     "key",
+		ProxyProtocol:  true,
+		TrustedProxies: []string{"127.0.0.0/8"},
+	})
+	require.Nil(t, err)
+	defer func() { require.Nil(t, fe.Stop().Wait()) }()
+
+	conn, err := net.Dial("udp", fe.sockets[0].conn.LocalAddr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	// A PROXY protocol version 2 header for a datagram from 198.51.100.1.
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x12\x00\x0c")
+	header = append(header, 198, 51, 100, 1, 127, 0, 0, 1, 0x1a, 0xe1, 0x1a, 0xe1)
+
+	proxied := proxiedConn{conn, header}
+
+	// Connection IDs are bound to the address of the client, not the one
+	// of the proxy.
+	action, connID := roundTrip(t, proxied, initialConnectionID, connectActionID, nil)
+	require.Equal(t, connectActionID, action)
+	action, _ = roundTrip(t, proxied, connID, scrapeActionID, make([]byte, 20))
+	require.Equal(t, scrapeActionID, action)
+	action, _ = roundTrip(t, conn, connID, scrapeActionID, make([]byte, 20))
+	require.Equal(t, errorActionID, action)
+}
+
+// rateLimitedLogic fails every announce with a wrapped ErrRateLimited, like a
+// hook wrapping the error of the rate limit middleware would.
+type rateLimitedLogic struct{}
+
+func (rateLimitedLogic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (context.Context, *bittorrent.AnnounceResponse, error) {
+	return ctx, nil, fmt.Errorf("hook: %w", bittorrent.ErrRateLimited)
+}
+
+func (rateLimitedLogic) AfterAnnounce(context.Context, *bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse) {
+}
+
+func (rateLimitedLogic) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (context.Context, *bittorrent.ScrapeResponse, error) {
+	return ctx, &bittorrent.ScrapeResponse{}, nil
+}
+
+func (rateLimitedLogic) AfterScrape(context.Context, *bittorrent.ScrapeRequest, *bittorrent.ScrapeResponse) {
+}
+
+func TestRateLimitedAnnounce(t *testing.T) {
+	fe, err := NewFrontend(rateLimitedLogic{}, Config{
+		Addr:       "127.0.0.1:0",
+		PrivateKey: "key",
+	})
+	require.Nil(t, err)
+	defer func() { require.Nil(t, fe.Stop().Wait()) }()
+
+	conn, err := net.Dial("udp", fe.sockets[0].conn.LocalAddr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	action, connID := roundTrip(t, conn, initialConnectionID, connectActionID, nil)
+	require.Equal(t, connectActionID, action)
+
+	// Rate limited announces are dropped without a response.
+	packet := make([]byte, 98)
+	copy(packet, connID)
+	binary.BigEndian.PutUint32(packet[8:12], announceActionID)
+	binary.BigEndian.PutUint16(packet[96:98], 6881)
+	_, err = conn.Write(packet)
+	require.Nil(t, err)
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = conn.Read(make([]byte, 2048))
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr) && netErr.Timeout(), "expected no response, got %v", err)
+
+	action, _ = roundTrip(t, conn, connID, scrapeActionID, make([]byte, 20))
+	require.Equal(t, scrapeActionID, action)
+}
+
+// proxiedConn prefixes every packet written with a PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+	header []byte
+}
+
+func (c proxiedConn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write(append(append([]byte{}, c.header...), b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
 func BenchmarkSimpleNewConnectionID(b *testing.B) {
 	ip := net.ParseIP("127.0.0.1")
 	key := "some random string that is hopefully at least this long"
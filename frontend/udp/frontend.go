@@ -5,40 +5,88 @@ package udp
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"math/rand"
+	"io/ioutil"
 	"net"
+	"runtime"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/doujincafe/chihaya/bittorrent"
 	"github.com/doujincafe/chihaya/frontend"
 	"github.com/doujincafe/chihaya/frontend/udp/bytepool"
+	"github.com/doujincafe/chihaya/pkg/iptrie"
+	"github.com/doujincafe/chihaya/pkg/listener"
 	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/pkg/proxyproto"
 	"github.com/doujincafe/chihaya/pkg/stop"
 	"github.com/doujincafe/chihaya/pkg/timecache"
 )
 
-var allowedGeneratedPrivateKeyRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890")
+// frontendContext is the context every request is handled with.
+var frontendContext = context.WithValue(context.Background(), bittorrent.FrontendKey, "udp")
+
+// Default config constants.
+const (
+	// defaultRequestTimeout is the default deadline for handling a request.
+	defaultRequestTimeout = 2 * time.Second
+
+	// minKeyRotationInterval is the shortest interval connection ID keys are
+	// rotated at, so that connection IDs are valid with the current or the
+	// previous key for as long as they are valid at all.
+	minKeyRotationInterval = ttl
+
+	// defaultWorkersPerCPU is the default number of workers handling
+	// packets per CPU. Workers mostly wait for the storage, so there are
+	// many more of them than CPUs.
+	defaultWorkersPerCPU = 64
+)
 
 // Config represents all of the configurable options for a UDP BitTorrent
 // Tracker.
 type Config struct {
 	Addr                string        `yaml:"addr"`
 	PrivateKey          string        `yaml:"private_key"`
+	PrivateKeyFile      string        `yaml:"private_key_file"`
+	KeyRotationInterval time.Duration `yaml:"key_rotation_interval"`
 	MaxClockSkew        time.Duration `yaml:"max_clock_skew"`
 	EnableRequestTiming bool          `yaml:"enable_request_timing"`
+	RequestTimeout      time.Duration `yaml:"request_timeout"`
+	ProxyProtocol       bool          `yaml:"proxy_protocol"`
+	TrustedProxies      []string      `yaml:"trusted_proxies"`
+	Sockets             int           `yaml:"sockets"`
+	Workers             int           `yaml:"workers"`
+	BatchSize           int           `yaml:"batch_size"`
 	ParseOptions        `yaml:",inline"`
+
+	// Clock is used to generate and validate connection IDs.
+	// If it is nil, the global timecache is used.
+	Clock timecache.Clock `yaml:"-"`
+
+	// ListenUDP is used to get the given number of sockets for Addr.
+	// If it is nil, the address is bound with listener.BindUDPGroup.
+	ListenUDP func(addr string, n int) ([]*net.UDPConn, error) `yaml:"-"`
 }
 
 // LogFields renders the current config as a set of Logrus fields.
 func (cfg Config) LogFields() log.Fields {
 	return log.Fields{
 		"addr":                cfg.Addr,
-		"privateKey":          cfg.PrivateKey,
+		"privateKeyFile":      cfg.PrivateKeyFile,
+		"keyRotationInterval": cfg.KeyRotationInterval,
 		"maxClockSkew":        cfg.MaxClockSkew,
 		"enableRequestTiming": cfg.EnableRequestTiming,
+		"requestTimeout":      cfg.RequestTimeout,
+		"proxyProtocol":       cfg.ProxyProtocol,
+		"trustedProxies":      cfg.TrustedProxies,
+		"sockets":             cfg.Sockets,
+		"workers":             cfg.Workers,
+		"batchSize":           cfg.BatchSize,
 		"allowIPSpoofing":     cfg.AllowIPSpoofing,
 		"maxNumWant":          cfg.MaxNumWant,
 		"defaultNumWant":      cfg.DefaultNumWant,
@@ -54,15 +102,68 @@ func (cfg Config) Validate() Config {
 	validcfg := cfg
 
 	// Generate a private key if one isn't provided by the user.
-	if cfg.PrivateKey == "" {
-		rand.Seed(time.Now().UnixNano())
-		pkeyRunes := make([]rune, 64)
-		for i := range pkeyRunes {
-			pkeyRunes[i] = allowedGeneratedPrivateKeyRunes[rand.Intn(len(allowedGeneratedPrivateKeyRunes))]
+	if cfg.PrivateKey == "" && cfg.PrivateKeyFile == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic("unable to generate UDP private key: " + err.Error())
 		}
-		validcfg.PrivateKey = string(pkeyRunes)
+		validcfg.PrivateKey = hex.EncodeToString(key)
+
+		log.Warn("UDP private key was not provided, using generated key")
+	}
 
-		log.Warn("UDP private key was not provided, using generated key", log.Fields{"key": validcfg.PrivateKey})
+	if cfg.KeyRotationInterval < 0 || (cfg.KeyRotationInterval > 0 && cfg.KeyRotationInterval < minKeyRotationInterval) {
+		validcfg.KeyRotationInterval = minKeyRotationInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.KeyRotationInterval",
+			"provided": cfg.KeyRotationInterval,
+			"default":  validcfg.KeyRotationInterval,
+		})
+	}
+
+	if cfg.RequestTimeout <= 0 {
+		validcfg.RequestTimeout = defaultRequestTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.RequestTimeout",
+			"provided": cfg.RequestTimeout,
+			"default":  validcfg.RequestTimeout,
+		})
+	}
+
+	if cfg.Sockets <= 0 {
+		validcfg.Sockets = 1
+
+		if cfg.Sockets < 0 {
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     "udp.Sockets",
+				"provided": cfg.Sockets,
+				"default":  validcfg.Sockets,
+			})
+		}
+	}
+
+	if cfg.Workers <= 0 {
+		validcfg.Workers = defaultWorkersPerCPU * runtime.GOMAXPROCS(0)
+
+		if cfg.Workers < 0 {
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     "udp.Workers",
+				"provided": cfg.Workers,
+				"default":  validcfg.Workers,
+			})
+		}
+	}
+
+	if cfg.BatchSize <= 0 || (cfg.BatchSize > 1 && !batchSupported) {
+		validcfg.BatchSize = 1
+
+		if cfg.BatchSize != 0 {
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     "udp.BatchSize",
+				"provided": cfg.BatchSize,
+				"default":  validcfg.BatchSize,
+			})
+		}
 	}
 
 	if cfg.MaxNumWant <= 0 {
@@ -92,17 +193,31 @@ func (cfg Config) Validate() Config {
 		})
 	}
 
+	if cfg.Clock == nil {
+		validcfg.Clock = timecache.Default()
+	}
+
 	return validcfg
 }
 
 // Frontend holds the state of a UDP BitTorrent Frontend.
 type Frontend struct {
-	socket  *net.UDPConn
+	sockets []*socket
 	closing chan struct{}
-	wg      sync.WaitGroup
+
+	// packets passes the packets read from the sockets to the workers.
+	packets chan received
+	pool    *bytepool.BytePool
+
+	readers sync.WaitGroup
+	workers sync.WaitGroup
+	senders sync.WaitGroup
 
 	genPool *sync.Pool
 
+	// trusted holds the addresses of TrustedProxies.
+	trusted *iptrie.Set
+
 	logic frontend.TrackerLogic
 	Config
 }
@@ -112,31 +227,115 @@ type Frontend struct {
 func NewFrontend(logic frontend.TrackerLogic, provided Config) (*Frontend, error) {
 	cfg := provided.Validate()
 
+	key, err := cfg.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	schedule := NewKeySchedule(key, cfg.KeyRotationInterval)
+
 	f := &Frontend{
 		closing: make(chan struct{}),
+		packets: make(chan received, cfg.Workers),
+		pool:    bytepool.New(2048),
 		logic:   logic,
 		Config:  cfg,
 		genPool: &sync.Pool{
 			New: func() interface{} {
-				return NewConnectionIDGenerator(cfg.PrivateKey)
+				return schedule.Generator()
 			},
 		},
 	}
 
-	err := f.listen()
+	f.trusted, err = cfg.trustedProxies()
 	if err != nil {
 		return nil, err
 	}
 
-	go func() {
-		if err := f.serve(); err != nil {
-			log.Fatal("failed while serving udp", log.Err(err))
+	err = f.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	f.workers.Add(cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go f.work()
+	}
+
+	f.readers.Add(len(f.sockets))
+	for _, s := range f.sockets {
+		if s.out != nil {
+			f.senders.Add(1)
+			go s.send(&f.senders)
 		}
-	}()
+
+		go func(s *socket) {
+			defer f.readers.Done()
+			if err := f.serve(s); err != nil {
+				log.Fatal("failed while serving udp", log.Err(err))
+			}
+		}(s)
+	}
 
 	return f, nil
 }
 
+// Check validates a config like NewFrontend does, without binding the
+// socket.
+func (cfg Config) Check() error {
+	cfg = cfg.Validate()
+
+	if _, err := cfg.trustedProxies(); err != nil {
+		return err
+	}
+
+	if _, err := cfg.privateKey(); err != nil {
+		return err
+	}
+
+	if cfg.Sockets > 1 && !listener.ReusePortSupported {
+		return listener.ErrReusePortUnsupported
+	}
+
+	_, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	return err
+}
+
+// privateKey returns the PrivateKey, or the contents of the PrivateKeyFile
+// without surrounding whitespace.
+func (cfg Config) privateKey() (string, error) {
+	if cfg.PrivateKeyFile == "" {
+		return cfg.PrivateKey, nil
+	}
+	if cfg.PrivateKey != "" {
+		return "", errors.New("must not specify both private_key and private_key_file")
+	}
+
+	b, err := ioutil.ReadFile(cfg.PrivateKeyFile)
+	if err != nil {
+		return "", errors.New("private_key_file: " + err.Error())
+	}
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		return "", errors.New("private_key_file: " + cfg.PrivateKeyFile + " is empty")
+	}
+	return key, nil
+}
+
+// trustedProxies parses the addresses of TrustedProxies.
+func (cfg Config) trustedProxies() (*iptrie.Set, error) {
+	if cfg.ProxyProtocol && len(cfg.TrustedProxies) == 0 {
+		return nil, errors.New("must specify trusted_proxies when using proxy_protocol")
+	}
+
+	trusted := &iptrie.Set{}
+	for _, entry := range cfg.TrustedProxies {
+		if err := trusted.Add(entry); err != nil {
+			return nil, errors.New("trusted_proxies: " + err.Error())
+		}
+	}
+	return trusted, nil
+}
+
 // Stop provides a thread-safe way to shutdown a currently running Frontend.
 func (t *Frontend) Stop() stop.Result {
 	select {
@@ -148,46 +347,98 @@ func (t *Frontend) Stop() stop.Result {
 	c := make(stop.Channel)
 	go func() {
 		close(t.closing)
-		t.socket.SetReadDeadline(time.Now())
-		t.wg.Wait()
-		c.Done(t.socket.Close())
+		for _, s := range t.sockets {
+			s.conn.SetReadDeadline(time.Now())
+		}
+		t.readers.Wait()
+
+		// Once nothing is read anymore, the workers finish the packets
+		// read and the senders the responses written.
+		close(t.packets)
+		t.workers.Wait()
+		for _, s := range t.sockets {
+			if s.out != nil {
+				close(s.out)
+			}
+		}
+		t.senders.Wait()
+
+		var err error
+		for _, s := range t.sockets {
+			if closeErr := s.conn.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+		c.Done(err)
 	}()
 
 	return c.Result()
 }
 
-// listen resolves the address and binds the server socket.
+// listen resolves the address and binds the server sockets.
 func (t *Frontend) listen() error {
-	udpAddr, err := net.ResolveUDPAddr("udp", t.Addr)
+	var conns []*net.UDPConn
+	var err error
+	if t.ListenUDP != nil {
+		conns, err = t.ListenUDP(t.Addr, t.Sockets)
+	} else {
+		conns, err = listener.BindUDPGroup(t.Addr, t.Sockets)
+	}
 	if err != nil {
 		return err
 	}
-	t.socket, err = net.ListenUDP("udp", udpAddr)
-	return err
-}
 
-// serve blocks while listening and serving UDP BitTorrent requests
-// until Stop() is called or an error is returned.
-func (t *Frontend) serve() error {
-	pool := bytepool.New(2048)
+	for _, c := range conns {
+		bc, err := newBatchConn(c, t.BatchSize)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return err
+		}
 
-	t.wg.Add(1)
-	defer t.wg.Done()
+		s := &socket{conn: c, batch: bc, pool: t.pool}
+		if t.BatchSize > 1 {
+			s.out = make(chan message, t.BatchSize)
+		}
+		t.sockets = append(t.sockets, s)
+	}
+	return nil
+}
 
+// received is a packet read from a socket, waiting to be handled.
+type received struct {
+	message
+	socket *socket
+}
+
+// serve blocks while reading packets from a socket and passing them on to
+// the workers until Stop() is called or an error is returned.
+func (t *Frontend) serve(s *socket) error {
+	msgs := make([]message, t.BatchSize)
 	for {
 		// Check to see if we need to shutdown.
 		select {
 		case <-t.closing:
 			log.Debug("udp serve() received shutdown signal")
+			for _, m := range msgs {
+				if m.buf != nil {
+					t.pool.Put(m.buf)
+				}
+			}
 			return nil
 		default:
 		}
 
-		// Read a UDP packet into a reusable buffer.
-		buffer := pool.Get()
-		n, addr, err := t.socket.ReadFromUDP(buffer)
+		// Read UDP packets into reusable buffers.
+		for i := range msgs {
+			if msgs[i].buf == nil {
+				msgs[i].buf = t.pool.Get()
+			}
+			msgs[i].buf = msgs[i].buf[:cap(msgs[i].buf)]
+		}
+		n, err := s.batch.ReadBatch(msgs)
 		if err != nil {
-			pool.Put(buffer)
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
 				// A temporary failure is not fatal; just pretend it never happened.
 				continue
@@ -195,40 +446,86 @@ func (t *Frontend) serve() error {
 			return err
 		}
 
-		// We got nothin'
-		if n == 0 {
-			pool.Put(buffer)
-			continue
+		for i := 0; i < n; i++ {
+			// We got nothin'
+			if len(msgs[i].buf) == 0 {
+				continue
+			}
+
+			// This blocks while all workers are busy, so that packets
+			// queue up in the socket instead of in memory.
+			t.packets <- received{msgs[i], s}
+			msgs[i].buf = nil
 		}
+	}
+}
 
-		t.wg.Add(1)
-		go func() {
-			defer t.wg.Done()
-			defer pool.Put(buffer)
+// work handles the packets read until the Frontend is stopped.
+func (t *Frontend) work() {
+	defer t.workers.Done()
+	for p := range t.packets {
+		t.handlePacket(p)
+	}
+}
 
-			if ip := addr.IP.To4(); ip != nil {
-				addr.IP = ip
-			}
+// handlePacket handles a packet and returns its buffer to the pool.
+func (t *Frontend) handlePacket(p received) {
+	defer t.pool.Put(p.buf)
 
-			// Handle the request.
-			var start time.Time
-			if t.EnableRequestTiming {
-				start = time.Now()
-			}
-			action, af, err := t.handleRequest(
-				// Make sure the IP is copied, not referenced.
-				Request{buffer[:n], append([]byte{}, addr.IP...)},
-				ResponseWriter{t.socket, addr},
-			)
-			if t.EnableRequestTiming {
-				recordResponseDuration(action, af, err, time.Since(start))
-			} else {
-				recordResponseDuration(action, af, err, time.Duration(0))
-			}
-		}()
+	addr := p.addr
+	if ip := addr.IP.To4(); ip != nil {
+		addr.IP = ip
+	}
+
+	// Make sure the IP is copied, not referenced.
+	packet, ip := p.buf, append(net.IP{}, addr.IP...)
+	if t.ProxyProtocol && t.trusted.Contains(ip) {
+		var ok bool
+		if packet, ip, ok = stripProxyHeader(packet, ip); !ok {
+			return
+		}
+	}
+
+	// Handle the request.
+	var start time.Time
+	if t.EnableRequestTiming {
+		start = time.Now()
+	}
+	action, af, err := t.handleRequest(
+		Request{packet, ip},
+		ResponseWriter{p.socket, addr},
+	)
+	if t.EnableRequestTiming {
+		recordResponseDuration(action, af, err, time.Since(start))
+	} else {
+		recordResponseDuration(action, af, err, time.Duration(0))
 	}
 }
 
+// stripProxyHeader removes the PROXY protocol header a packet from a trusted
+// proxy may start with, and returns the rest of the packet along with the IP
+// of the client it was sent by.
+//
+// Responses are still sent to the proxy, which passes them on to the client.
+func stripProxyHeader(packet []byte, ip net.IP) ([]byte, net.IP, bool) {
+	h, n, err := proxyproto.Parse(packet)
+	if err == proxyproto.ErrNoHeader {
+		return packet, ip, true
+	}
+	if err != nil {
+		log.Debug("udp: dropping packet with invalid PROXY protocol header", log.Fields{"proxy": ip}, log.Err(err))
+		return nil, nil, false
+	}
+
+	if src := proxyproto.IP(h.Source); src != nil {
+		if v4 := src.To4(); v4 != nil {
+			src = v4
+		}
+		ip = src
+	}
+	return packet[n:], ip, true
+}
+
 // Request represents a UDP payload received by a Tracker.
 type Request struct {
 	Packet []byte
@@ -238,13 +535,13 @@ type Request struct {
 // ResponseWriter implements the ability to respond to a Request via the
 // io.Writer interface.
 type ResponseWriter struct {
-	socket *net.UDPConn
+	socket *socket
 	addr   *net.UDPAddr
 }
 
 // Write implements the io.Writer interface for a ResponseWriter.
 func (w ResponseWriter) Write(b []byte) (int, error) {
-	w.socket.WriteToUDP(b, w.addr)
+	w.socket.write(b, w.addr)
 	return len(b), nil
 }
 
@@ -268,7 +565,7 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 
 	// If this isn't requesting a new connection ID and the connection ID is
 	// invalid, then fail.
-	if actionID != connectActionID && !gen.Validate(connID, r.IP, timecache.Now(), t.MaxClockSkew) {
+	if actionID != connectActionID && !gen.Validate(connID, r.IP, t.Clock.Now(), t.MaxClockSkew) {
 		err = errBadConnectionID
 		WriteError(w, txID, err)
 		return
@@ -294,7 +591,7 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 			panic(fmt.Sprintf("udp: invalid IP: neither v4 nor v6, IP: %#v", r.IP))
 		}
 
-		WriteConnectionID(w, txID, gen.Generate(r.IP, timecache.Now()))
+		WriteConnectionID(w, txID, gen.Generate(r.IP, t.Clock.Now()))
 
 	case announceActionID, announceV6ActionID:
 		actionName = "announce"
@@ -308,9 +605,15 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 		af = new(bittorrent.AddressFamily)
 		*af = req.IP.AddressFamily
 
-		var ctx context.Context
+		ctx, cancel := context.WithTimeout(frontendContext, t.RequestTimeout)
+		defer cancel()
+		ctx = context.WithValue(ctx, bittorrent.MaxNumWantKey, t.MaxNumWant)
 		var resp *bittorrent.AnnounceResponse
-		ctx, resp, err = t.logic.HandleAnnounce(context.Background(), req)
+		ctx, resp, err = t.logic.HandleAnnounce(ctx, req)
+		if errors.Is(err, bittorrent.ErrRateLimited) {
+			// Drop the request silently.
+			return
+		}
 		if err != nil {
 			WriteError(w, txID, err)
 			return
@@ -318,7 +621,7 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 
 		WriteAnnounce(w, txID, resp, actionID == announceV6ActionID, req.IP.AddressFamily == bittorrent.IPv6)
 
-		go t.logic.AfterAnnounce(ctx, req, resp)
+		t.logic.AfterAnnounce(ctx, req, resp)
 
 	case scrapeActionID:
 		actionName = "scrape"
@@ -330,6 +633,7 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 			return
 		}
 
+		req.IP = r.IP
 		if r.IP.To4() != nil {
 			req.AddressFamily = bittorrent.IPv4
 		} else if len(r.IP) == net.IPv6len { // implies r.IP.To4() == nil
@@ -341,9 +645,10 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 		af = new(bittorrent.AddressFamily)
 		*af = req.AddressFamily
 
-		var ctx context.Context
+		ctx, cancel := context.WithTimeout(frontendContext, t.RequestTimeout)
+		defer cancel()
 		var resp *bittorrent.ScrapeResponse
-		ctx, resp, err = t.logic.HandleScrape(context.Background(), req)
+		ctx, resp, err = t.logic.HandleScrape(ctx, req)
 		if err != nil {
 			WriteError(w, txID, err)
 			return
@@ -351,7 +656,7 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 
 		WriteScrape(w, txID, resp)
 
-		go t.logic.AfterScrape(ctx, req, resp)
+		t.logic.AfterScrape(ctx, req, resp)
 
 	default:
 		err = errUnknownAction
@@ -95,7 +95,9 @@ func ParseAnnounce(r Request, v6Action bool, opts ParseOptions) (*bittorrent.Ann
 	ipProvided := false
 	ipbytes := r.Packet[84:ipEnd]
 	if opts.AllowIPSpoofing {
-		// Make sure the bytes are copied to a new slice.
+		// Make sure the bytes are copied to a new slice, r.IP is the
+		// address the announce was received from.
+		ip = make(net.IP, len(r.IP))
 		copy(ip, net.IP(ipbytes))
 		ipProvided = true
 	}
@@ -120,6 +122,7 @@ func ParseAnnounce(r Request, v6Action bool, opts ParseOptions) (*bittorrent.Ann
 		Downloaded:      downloaded,
 		Uploaded:        uploaded,
 		IPProvided:      ipProvided,
+		RemoteIP:        r.IP,
 		NumWantProvided: true,
 		EventProvided:   true,
 		Peer: bittorrent.Peer{
@@ -1,8 +1,12 @@
 package udp
 
 import (
+	"encoding/binary"
 	"fmt"
+	"net"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 var table = []struct {
@@ -74,3 +78,16 @@ func TestHandleOptionalParameters(t *testing.T) {
 		})
 	}
 }
+
+func TestParseAnnounceRemoteIP(t *testing.T) {
+	packet := make([]byte, 98)
+	copy(packet[84:88], net.IPv4(198, 51, 100, 1).To4())
+	binary.BigEndian.PutUint16(packet[96:98], 6881)
+	r := Request{Packet: packet, IP: net.IPv4(192, 0, 2, 1).To4()}
+
+	req, err := ParseAnnounce(r, false, ParseOptions{AllowIPSpoofing: true, MaxNumWant: 50, DefaultNumWant: 50})
+	require.Nil(t, err)
+	require.True(t, req.IPProvided)
+	require.Equal(t, "198.51.100.1", req.IP.String())
+	require.Equal(t, "192.0.2.1", req.RemoteIP.String())
+}
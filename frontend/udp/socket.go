@@ -0,0 +1,70 @@
+package udp
+
+import (
+	"net"
+	"sync"
+
+	"github.com/doujincafe/chihaya/frontend/udp/bytepool"
+	"github.com/doujincafe/chihaya/pkg/log"
+)
+
+// socket is one of the sockets a Frontend serves on.
+type socket struct {
+	conn  *net.UDPConn
+	batch batchConn
+	pool  *bytepool.BytePool
+
+	// out queues the responses to be written in batches by send.
+	// It is nil if responses are written one at a time.
+	out chan message
+}
+
+// write writes a response to addr, or queues it for send.
+func (s *socket) write(b []byte, addr *net.UDPAddr) {
+	if s.out == nil {
+		s.conn.WriteToUDP(b, addr)
+		return
+	}
+
+	// b is reused once write returns.
+	s.out <- message{append(s.pool.Get()[:0], b...), addr}
+}
+
+// send writes the queued responses in batches until out is closed.
+func (s *socket) send(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	msgs := make([]message, 0, cap(s.out))
+	for m := range s.out {
+		msgs = append(msgs[:0], m)
+
+		// Add the responses that are waiting already, but do not wait for
+		// more to fill the batch.
+	fill:
+		for len(msgs) < cap(msgs) {
+			select {
+			case m, ok := <-s.out:
+				if !ok {
+					break fill
+				}
+				msgs = append(msgs, m)
+			default:
+				break fill
+			}
+		}
+
+		for written := 0; written < len(msgs); {
+			n, err := s.batch.WriteBatch(msgs[written:])
+			if err != nil {
+				// Only the first response failed, skip it.
+				log.Debug("udp: failed to write response", log.Fields{"addr": msgs[written].addr}, log.Err(err))
+				n = 1
+			}
+			written += n
+		}
+
+		for _, m := range msgs {
+			s.pool.Put(m.buf)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/listener"
+	"github.com/doujincafe/chihaya/storage"
+)
+
+// socketConfigs are the ways of reading and writing packets that are tested
+// and benchmarked.
+var socketConfigs = []struct {
+	sockets, batchSize int
+}{
+	{1, 1},
+	{1, 32},
+	{4, 1},
+	{4, 32},
+}
+
+// startSocketsFrontend starts a Frontend with the given number of sockets
+// and batch size on a loopback address, or skips the test if the platform
+// does not support them.
+func startSocketsFrontend(tb testing.TB, sockets, batchSize int) *Frontend {
+	if sockets > 1 && !listener.ReusePortSupported {
+		tb.Skip("SO_REUSEPORT is not supported")
+	}
+	if batchSize > 1 && !batchSupported {
+		tb.Skip("batches are not supported")
+	}
+
+	ps, err := storage.NewPeerStore("memory", nil)
+	require.Nil(tb, err)
+	tb.Cleanup(func() { require.Nil(tb, ps.Stop().Wait()) })
+
+	logic := middleware.NewLogic(middleware.ResponseConfig{}, ps, nil, nil)
+	fe, err := NewFrontend(logic, Config{
+		Addr:       "127.0.0.1:0",
+		PrivateKey: "key",
+		Sockets:    sockets,
+		BatchSize:  batchSize,
+	})
+	require.Nil(tb, err)
+	tb.Cleanup(func() { require.Nil(tb, fe.Stop().Wait()) })
+
+	return fe
+}
+
+func TestSockets(t *testing.T) {
+	for _, sc := range socketConfigs {
+		t.Run(fmt.Sprintf("sockets=%d/batch=%d", sc.sockets, sc.batchSize), func(t *testing.T) {
+			fe := startSocketsFrontend(t, sc.sockets, sc.batchSize)
+			require.Len(t, fe.sockets, sc.sockets)
+			addr := fe.sockets[0].conn.LocalAddr().String()
+			for _, s := range fe.sockets {
+				require.Equal(t, addr, s.conn.LocalAddr().String())
+			}
+
+			// Clients with different ports are spread over the sockets.
+			for i := 0; i < 16; i++ {
+				conn, err := net.Dial("udp", addr)
+				require.Nil(t, err)
+
+				action, connID := roundTrip(t, conn, initialConnectionID, connectActionID, nil)
+				require.Equal(t, connectActionID, action)
+				action, _ = roundTrip(t, conn, connID, scrapeActionID, make([]byte, 20))
+				require.Equal(t, scrapeActionID, action)
+				require.Nil(t, conn.Close())
+			}
+		})
+	}
+}
+
+// BenchmarkServe measures the number of connect requests answered per second
+// over loopback by frontends reading and writing packets in different ways.
+// Requests dropped under load are not counted.
+func BenchmarkServe(b *testing.B) {
+	for _, sc := range socketConfigs {
+		b.Run(fmt.Sprintf("sockets=%d/batch=%d", sc.sockets, sc.batchSize), func(b *testing.B) {
+			fe := startSocketsFrontend(b, sc.sockets, sc.batchSize)
+			addr := fe.sockets[0].conn.LocalAddr().String()
+
+			// Keep many requests in flight, like many clients would.
+			b.SetParallelism(16)
+			var answered int64
+			b.ResetTimer()
+			start := time.Now()
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := net.Dial("udp", addr)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer conn.Close()
+
+				packet := make([]byte, 16)
+				copy(packet, initialConnectionID)
+				buf := make([]byte, 64)
+				for pb.Next() {
+					if _, err := conn.Write(packet); err != nil {
+						b.Error(err)
+						return
+					}
+					conn.SetReadDeadline(time.Now().Add(time.Second))
+					if _, err := conn.Read(buf); err != nil {
+						// Packets may be dropped under load.
+						continue
+					}
+					atomic.AddInt64(&answered, 1)
+				}
+			})
+			b.ReportMetric(float64(answered)/time.Since(start).Seconds(), "packets/s")
+			b.ReportMetric(float64(int64(b.N)-answered)/float64(b.N), "dropped/op")
+		})
+	}
+}
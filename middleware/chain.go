@@ -0,0 +1,256 @@
+package middleware
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+)
+
+// DefaultChainName is the name of the chain of hooks that handles requests
+// not matched by any other chain.
+const DefaultChainName = "default"
+
+// ErrInvalidChainName is returned for chains that have no name, or a name
+// that is already used by another chain.
+var ErrInvalidChainName = errors.New("chain names must be unique and not empty")
+
+type chainKey struct{}
+
+// ChainKey is a key for the context of a request that contains the name of
+// the chain of hooks handling the request.
+var ChainKey = chainKey{}
+
+// MatchConfig holds the conditions a request must satisfy to be handled by a
+// chain or a hook.
+//
+// Every condition that is set must be satisfied. A condition is satisfied if
+// the request matches any of its values.
+type MatchConfig struct {
+	// Frontends are the names of frontends, i.e. "http" or "udp".
+	Frontends []string `yaml:"frontends"`
+
+	// Routes are HTTP routes exactly as they are configured for the HTTP
+	// frontend, e.g. "/announce/:passkey". Requests of other frontends
+	// never match a route.
+	Routes []string `yaml:"routes"`
+
+	// AddressFamilies are "ipv4" or "ipv6".
+	AddressFamilies []string `yaml:"address_families"`
+
+	// InfoHashes are hex-encoded infohashes. A scrape matches only if all
+	// of its infohashes are listed.
+	InfoHashes []string `yaml:"infohashes"`
+}
+
+// Matcher decides whether a request satisfies the conditions of a
+// MatchConfig.
+//
+// A nil Matcher matches every request.
+type Matcher struct {
+	frontends       map[string]struct{}
+	routes          map[string]struct{}
+	addressFamilies map[bittorrent.AddressFamily]struct{}
+	infoHashes      map[bittorrent.InfoHash]struct{}
+}
+
+// NewMatcher creates a Matcher for the given conditions.
+func NewMatcher(cfg MatchConfig) (*Matcher, error) {
+	m := &Matcher{}
+
+	if len(cfg.Frontends) > 0 {
+		m.frontends = make(map[string]struct{}, len(cfg.Frontends))
+		for _, f := range cfg.Frontends {
+			f = strings.ToLower(f)
+			if f != "http" && f != "udp" {
+				return nil, fmt.Errorf("invalid frontend %q", f)
+			}
+			m.frontends[f] = struct{}{}
+		}
+	}
+
+	if len(cfg.Routes) > 0 {
+		m.routes = make(map[string]struct{}, len(cfg.Routes))
+		for _, r := range cfg.Routes {
+			m.routes[r] = struct{}{}
+		}
+	}
+
+	if len(cfg.AddressFamilies) > 0 {
+		m.addressFamilies = make(map[bittorrent.AddressFamily]struct{}, 2)
+		for _, af := range cfg.AddressFamilies {
+			switch strings.ToLower(af) {
+			case "ipv4":
+				m.addressFamilies[bittorrent.IPv4] = struct{}{}
+			case "ipv6":
+				m.addressFamilies[bittorrent.IPv6] = struct{}{}
+			default:
+				return nil, fmt.Errorf("invalid address family %q", af)
+			}
+		}
+	}
+
+	if len(cfg.InfoHashes) > 0 {
+		m.infoHashes = make(map[bittorrent.InfoHash]struct{}, len(cfg.InfoHashes))
+		for _, s := range cfg.InfoHashes {
+			b, err := hex.DecodeString(s)
+			if err != nil || len(b) != 20 {
+				return nil, fmt.Errorf("invalid infohash %q", s)
+			}
+			m.infoHashes[bittorrent.InfoHashFromBytes(b)] = struct{}{}
+		}
+	}
+
+	return m, nil
+}
+
+// MatchAnnounce reports whether an announce satisfies the conditions of the
+// Matcher.
+func (m *Matcher) MatchAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) bool {
+	if m == nil {
+		return true
+	}
+	if !m.matchContext(ctx) || !m.matchAddressFamily(req.IP.AddressFamily) {
+		return false
+	}
+	if m.infoHashes != nil {
+		if _, ok := m.infoHashes[req.InfoHash]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchScrape reports whether a scrape satisfies the conditions of the
+// Matcher.
+func (m *Matcher) MatchScrape(ctx context.Context, req *bittorrent.ScrapeRequest) bool {
+	if m == nil {
+		return true
+	}
+	if !m.matchContext(ctx) || !m.matchAddressFamily(req.AddressFamily) {
+		return false
+	}
+	if m.infoHashes != nil {
+		if len(req.InfoHashes) == 0 {
+			return false
+		}
+		for _, ih := range req.InfoHashes {
+			if _, ok := m.infoHashes[ih]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (m *Matcher) matchContext(ctx context.Context) bool {
+	if m.frontends != nil {
+		f, _ := ctx.Value(bittorrent.FrontendKey).(string)
+		if _, ok := m.frontends[f]; !ok {
+			return false
+		}
+	}
+	if m.routes != nil {
+		r, ok := ctx.Value(bittorrent.RouteKey).(string)
+		if !ok {
+			return false
+		}
+		if _, ok := m.routes[r]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Matcher) matchAddressFamily(af bittorrent.AddressFamily) bool {
+	if m.addressFamilies == nil {
+		return true
+	}
+	_, ok := m.addressFamilies[af]
+	return ok
+}
+
+// ChainConfig is the configuration of a named chain of hooks that handles
+// the requests matching its conditions instead of the default chain.
+type ChainConfig struct {
+	Name      string       `yaml:"name"`
+	Match     MatchConfig  `yaml:"match"`
+	PreHooks  []HookConfig `yaml:"prehooks"`
+	PostHooks []HookConfig `yaml:"posthooks"`
+}
+
+// Chain is a named chain of hooks that handles the requests matched by its
+// Matcher.
+type Chain struct {
+	Name      string
+	Matcher   *Matcher
+	PreHooks  []Hook
+	PostHooks []Hook
+}
+
+// ChainsFromChainConfigs is a utility function for initializing Chains in
+// bulk.
+func ChainsFromChainConfigs(cfgs []ChainConfig) ([]Chain, error) {
+	names := map[string]bool{DefaultChainName: true}
+	chains := make([]Chain, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		if cfg.Name == "" || names[cfg.Name] {
+			return nil, ErrInvalidChainName
+		}
+		names[cfg.Name] = true
+
+		matcher, err := NewMatcher(cfg.Match)
+		if err != nil {
+			return nil, fmt.Errorf("chain %s: %s", cfg.Name, err)
+		}
+
+		preHooks, err := HooksFromHookConfigs(cfg.PreHooks)
+		if err != nil {
+			return nil, fmt.Errorf("chain %s: %s", cfg.Name, err)
+		}
+		postHooks, err := HooksFromHookConfigs(cfg.PostHooks)
+		if err != nil {
+			return nil, fmt.Errorf("chain %s: %s", cfg.Name, err)
+		}
+
+		chains = append(chains, Chain{
+			Name:      cfg.Name,
+			Matcher:   matcher,
+			PreHooks:  preHooks,
+			PostHooks: postHooks,
+		})
+	}
+
+	return chains, nil
+}
+
+// CheckChainConfigs checks ChainConfigs without creating the Hooks of the
+// chains.
+//
+// The errors of all chains are returned at once.
+func CheckChainConfigs(cfgs []ChainConfig) error {
+	var errs []error
+	names := map[string]bool{DefaultChainName: true}
+	for _, cfg := range cfgs {
+		if cfg.Name == "" || names[cfg.Name] {
+			errs = append(errs, ErrInvalidChainName)
+			continue
+		}
+		names[cfg.Name] = true
+
+		if _, err := NewMatcher(cfg.Match); err != nil {
+			errs = append(errs, fmt.Errorf("chain %s: %s", cfg.Name, err))
+		}
+		if err := CheckHookConfigs(cfg.PreHooks); err != nil {
+			errs = append(errs, fmt.Errorf("chain %s: %s", cfg.Name, err))
+		}
+		if err := CheckHookConfigs(cfg.PostHooks); err != nil {
+			errs = append(errs, fmt.Errorf("chain %s: %s", cfg.Name, err))
+		}
+	}
+
+	return joinErrors(errs)
+}
@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/storage/memory"
+)
+
+var (
+	matchedIH = bittorrent.InfoHashFromString("01234567890123456789")
+	otherIH   = bittorrent.InfoHashFromString("98765432109876543210")
+)
+
+func requestContext(frontend, route string) context.Context {
+	ctx := context.WithValue(context.Background(), bittorrent.FrontendKey, frontend)
+	if route != "" {
+		ctx = context.WithValue(ctx, bittorrent.RouteKey, route)
+	}
+	return ctx
+}
+
+func announceFor(ih bittorrent.InfoHash, af bittorrent.AddressFamily) *bittorrent.AnnounceRequest {
+	ip := net.ParseIP("1.2.3.4")
+	if af == bittorrent.IPv6 {
+		ip = net.ParseIP("fc00::1")
+	}
+	return &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		Peer:     bittorrent.Peer{IP: bittorrent.IP{IP: ip, AddressFamily: af}},
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	m, err := NewMatcher(MatchConfig{
+		Frontends:       []string{"HTTP"},
+		Routes:          []string{"/announce/:passkey", "/scrape/:passkey"},
+		AddressFamilies: []string{"ipv4"},
+		InfoHashes:      []string{matchedIH.String()},
+	})
+	require.Nil(t, err)
+
+	var table = []struct {
+		name     string
+		ctx      context.Context
+		req      *bittorrent.AnnounceRequest
+		expected bool
+	}{
+		{"match", requestContext("http", "/announce/:passkey"), announceFor(matchedIH, bittorrent.IPv4), true},
+		{"frontend", requestContext("udp", ""), announceFor(matchedIH, bittorrent.IPv4), false},
+		{"route", requestContext("http", "/announce"), announceFor(matchedIH, bittorrent.IPv4), false},
+		{"address family", requestContext("http", "/announce/:passkey"), announceFor(matchedIH, bittorrent.IPv6), false},
+		{"infohash", requestContext("http", "/announce/:passkey"), announceFor(otherIH, bittorrent.IPv4), false},
+		{"no context", context.Background(), announceFor(matchedIH, bittorrent.IPv4), false},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, m.MatchAnnounce(tt.ctx, tt.req))
+		})
+	}
+
+	t.Run("scrape", func(t *testing.T) {
+		ctx := requestContext("http", "/scrape/:passkey")
+		req := &bittorrent.ScrapeRequest{AddressFamily: bittorrent.IPv4, InfoHashes: []bittorrent.InfoHash{matchedIH}}
+		require.True(t, m.MatchScrape(ctx, req))
+
+		req.InfoHashes = append(req.InfoHashes, otherIH)
+		require.False(t, m.MatchScrape(ctx, req))
+
+		req.InfoHashes = nil
+		require.False(t, m.MatchScrape(ctx, req))
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var m *Matcher
+		require.True(t, m.MatchAnnounce(context.Background(), announceFor(otherIH, bittorrent.IPv6)))
+	})
+}
+
+func TestNewMatcherInvalid(t *testing.T) {
+	for _, cfg := range []MatchConfig{
+		{Frontends: []string{"websocket"}},
+		{AddressFamilies: []string{"ipv5"}},
+		{InfoHashes: []string{"abc"}},
+	} {
+		_, err := NewMatcher(cfg)
+		require.NotNil(t, err)
+	}
+}
+
+// recordingHook records the name of the chain it ran in.
+type recordingHook struct {
+	ran *[]string
+}
+
+func (h recordingHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	*h.ran = append(*h.ran, ctx.Value(ChainKey).(string))
+	return ctx, nil
+}
+
+func (h recordingHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	*h.ran = append(*h.ran, ctx.Value(ChainKey).(string))
+	return ctx, nil
+}
+
+func TestLogicChains(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Empty(t, ps.Stop().Wait()) })
+
+	private, err := NewMatcher(MatchConfig{Routes: []string{"/announce/:passkey"}})
+	require.Nil(t, err)
+	open, err := NewMatcher(MatchConfig{InfoHashes: []string{matchedIH.String()}})
+	require.Nil(t, err)
+
+	var pre, post []string
+	l := NewLogic(ResponseConfig{}, ps,
+		[]Hook{recordingHook{&pre}}, []Hook{recordingHook{&post}},
+		Chain{Name: "private", Matcher: private, PreHooks: []Hook{recordingHook{&pre}}, PostHooks: []Hook{recordingHook{&post}}},
+		Chain{Name: "open", Matcher: open, PreHooks: []Hook{recordingHook{&pre}}},
+	)
+	t.Cleanup(func() { require.Empty(t, l.Stop().Wait()) })
+
+	var table = []struct {
+		ctx      context.Context
+		req      *bittorrent.AnnounceRequest
+		expected string
+	}{
+		{requestContext("http", "/announce/:passkey"), announceFor(matchedIH, bittorrent.IPv4), "private"},
+		{requestContext("http", "/announce"), announceFor(matchedIH, bittorrent.IPv4), "open"},
+		{requestContext("udp", ""), announceFor(matchedIH, bittorrent.IPv6), "open"},
+		{requestContext("http", "/announce"), announceFor(otherIH, bittorrent.IPv4), DefaultChainName},
+	}
+
+	for _, tt := range table {
+		pre, post = nil, nil
+		ctx, _, err := l.HandleAnnounce(tt.ctx, tt.req)
+		require.Nil(t, err)
+		require.Equal(t, []string{tt.expected}, pre)
+
+		l.afterAnnounce(ctx, tt.req, &bittorrent.AnnounceResponse{})
+		if tt.expected == "open" {
+			require.Empty(t, post)
+		} else {
+			require.Equal(t, []string{tt.expected}, post)
+		}
+	}
+}
+
+// rejectingHook rejects every request.
+type rejectingHook struct{}
+
+var errRejected = bittorrent.ClientError("rejected")
+
+func (rejectingHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	return ctx, errRejected
+}
+
+func (rejectingHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	return ctx, errRejected
+}
+
+func TestHandleFullScrape(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Empty(t, ps.Stop().Wait()) })
+	require.Nil(t, ps.PutSeeder(context.Background(), matchedIH, announceFor(matchedIH, bittorrent.IPv4).Peer))
+
+	private, err := NewMatcher(MatchConfig{Routes: []string{"/scrape/:passkey"}})
+	require.Nil(t, err)
+
+	var pre []string
+	l := NewLogic(ResponseConfig{}, ps, []Hook{recordingHook{&pre}}, nil,
+		Chain{Name: "private", Matcher: private, PreHooks: []Hook{rejectingHook{}}},
+	)
+
+	// The pre-hooks of a chain can refuse full scrapes.
+	req := &bittorrent.ScrapeRequest{AddressFamily: bittorrent.IPv4}
+	_, err = l.HandleFullScrape(requestContext("http", "/scrape/:passkey"), req)
+	require.Equal(t, errRejected, err)
+
+	scrapeSwarms, err := l.HandleFullScrape(requestContext("http", "/scrape"), req)
+	require.Nil(t, err)
+	require.Equal(t, []string{DefaultChainName}, pre)
+
+	// The swarms are scraped after the Logic was stopped.
+	require.Empty(t, l.Stop().Wait())
+	var scrapes []bittorrent.Scrape
+	require.Nil(t, scrapeSwarms(context.Background(), func(s bittorrent.Scrape) error {
+		scrapes = append(scrapes, s)
+		return nil
+	}))
+	require.Equal(t, []bittorrent.Scrape{{InfoHash: matchedIH, Complete: 1}}, scrapes)
+}
+
+func TestConfiguredHookMatch(t *testing.T) {
+	m, err := NewMatcher(MatchConfig{Frontends: []string{"udp"}})
+	require.Nil(t, err)
+
+	var ran []string
+	h := &configuredHook{Hook: recordingHook{&ran}, name: "recording", matcher: m}
+	ctx := context.WithValue(requestContext("http", "/announce"), ChainKey, DefaultChainName)
+
+	_, err = h.HandleAnnounce(ctx, announceFor(matchedIH, bittorrent.IPv4), nil)
+	require.Nil(t, err)
+	require.Empty(t, ran)
+
+	ctx = context.WithValue(requestContext("udp", ""), ChainKey, DefaultChainName)
+	_, err = h.HandleAnnounce(ctx, announceFor(matchedIH, bittorrent.IPv4), nil)
+	require.Nil(t, err)
+	require.Equal(t, []string{DefaultChainName}, ran)
+}
+
+func TestChainsFromChainConfigs(t *testing.T) {
+	_, err := ChainsFromChainConfigs([]ChainConfig{{Name: DefaultChainName}})
+	require.Equal(t, ErrInvalidChainName, err)
+
+	_, err = ChainsFromChainConfigs([]ChainConfig{{Name: "a"}, {Name: "a"}})
+	require.Equal(t, ErrInvalidChainName, err)
+
+	chains, err := ChainsFromChainConfigs([]ChainConfig{{Name: "a"}, {Name: "b"}})
+	require.Nil(t, err)
+	require.Len(t, chains, 2)
+}
@@ -1,5 +1,6 @@
 // Package clientapproval implements a Hook that fails an Announce based on a
-// whitelist or blacklist of BitTorrent client IDs.
+// whitelist or blacklist of BitTorrent client IDs, or on rules matching the
+// client name and version decoded from the PeerID.
 package clientapproval
 
 import (
@@ -20,7 +21,10 @@ func init() {
 	middleware.RegisterDriver(Name, driver{})
 }
 
-var _ middleware.Driver = driver{}
+var (
+	_ middleware.Driver  = driver{}
+	_ middleware.Checker = driver{}
+)
 
 type driver struct{}
 
@@ -34,6 +38,18 @@ func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
 	return NewHook(cfg)
 }
 
+// CheckOptions checks options without creating a Hook.
+func (d driver) CheckOptions(optionBytes []byte) error {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	_, err = NewHook(cfg)
+	return err
+}
+
 // ErrClientUnapproved is the error returned when a client's PeerID is invalid.
 var ErrClientUnapproved = bittorrent.ClientError("unapproved client")
 
@@ -42,11 +58,17 @@ var ErrClientUnapproved = bittorrent.ClientError("unapproved client")
 type Config struct {
 	Whitelist []string `yaml:"whitelist"`
 	Blacklist []string `yaml:"blacklist"`
+
+	// Rules are evaluated in order after the whitelist and blacklist.
+	// The first matching rule decides, clients matching no rule are
+	// approved.
+	Rules []RuleConfig `yaml:"rules"`
 }
 
 type hook struct {
 	approved   map[bittorrent.ClientID]struct{}
 	unapproved map[bittorrent.ClientID]struct{}
+	rules      []rule
 }
 
 // NewHook returns an instance of the client approval middleware.
@@ -80,6 +102,14 @@ func NewHook(cfg Config) (middleware.Hook, error) {
 		h.unapproved[cid] = struct{}{}
 	}
 
+	for i, rc := range cfg.Rules {
+		r, err := parseRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i+1, err)
+		}
+		h.rules = append(h.rules, r)
+	}
+
 	return h, nil
 }
 
@@ -98,6 +128,18 @@ func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceReque
 		}
 	}
 
+	if len(h.rules) > 0 {
+		info, ok := bittorrent.IdentifyClient(req.Peer.ID)
+		for _, r := range h.rules {
+			if r.matches(info, ok) {
+				if !r.allow {
+					return ctx, ErrClientUnapproved
+				}
+				break
+			}
+		}
+	}
+
 	return ctx, nil
 }
 
@@ -47,6 +47,92 @@ var cases = []struct {
 		"12345678900000000000",
 		false,
 	},
+	// Client version is in the allowed range
+	{
+		Config{
+			Rules: []RuleConfig{
+				{Action: "allow", Client: "qBittorrent", Version: ">=4.3"},
+				{Action: "deny"},
+			},
+		},
+		"-qB4350-000000000000",
+		true,
+	},
+	// Client version is below the allowed range
+	{
+		Config{
+			Rules: []RuleConfig{
+				{Action: "allow", Client: "qBittorrent", Version: ">=4.3"},
+				{Action: "deny"},
+			},
+		},
+		"-qB4250-000000000000",
+		false,
+	},
+	// Client version is in a denied range, matched by code
+	{
+		Config{
+			Rules: []RuleConfig{
+				{Action: "deny", Client: "TR", Version: ">=2.90, <2.94"},
+			},
+		},
+		"-TR2920-000000000000",
+		false,
+	},
+	// Client version is outside of the denied range
+	{
+		Config{
+			Rules: []RuleConfig{
+				{Action: "deny", Client: "TR", Version: ">=2.90, <2.94"},
+			},
+		},
+		"-TR2940-000000000000",
+		true,
+	},
+	// Client version matches a wildcard
+	{
+		Config{
+			Rules: []RuleConfig{
+				{Action: "deny", Client: "bittorrent mainline", Version: "4.20.x"},
+			},
+		},
+		"M4-20-8-000000000000",
+		false,
+	},
+	// Shadow-style client is not denied
+	{
+		Config{
+			Rules: []RuleConfig{
+				{Action: "deny", Client: "unknown"},
+				{Action: "deny", Client: "BitTornado", Version: "<0.3"},
+			},
+		},
+		"T03A0---000000000000",
+		true,
+	},
+	// Unidentified client is denied
+	{
+		Config{
+			Rules: []RuleConfig{
+				{Action: "deny", Client: "unknown"},
+			},
+		},
+		"12345678900000000000",
+		false,
+	},
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, rc := range []RuleConfig{
+		{Action: "block"},
+		{Action: "deny", Version: "4.x.1"},
+		{Action: "deny", Version: ">=4.x"},
+		{Action: "deny", Version: ">=4,"},
+		{Action: "deny", Client: "unknown", Version: "1"},
+	} {
+		_, err := NewHook(Config{Rules: []RuleConfig{rc}})
+		require.NotNil(t, err, "%#v", rc)
+	}
 }
 
 func TestHandleAnnounce(t *testing.T) {
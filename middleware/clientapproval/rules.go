@@ -0,0 +1,149 @@
+package clientapproval
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+)
+
+// RuleConfig is a rule approving or rejecting clients by name and version.
+type RuleConfig struct {
+	// Action is either "allow" or "deny".
+	Action string `yaml:"action"`
+
+	// Client is matched against the name (case-insensitive) or the code
+	// (case-sensitive) of the client as identified from the PeerID.
+	// "*" or an empty string match every peer, "unknown" matches peers
+	// whose client can not be identified.
+	Client string `yaml:"client"`
+
+	// Version is a comma-separated list of constraints that must all be
+	// satisfied, e.g. ">=4.3, <5" or "4.2.x".
+	Version string `yaml:"version"`
+}
+
+// A rule is a parsed RuleConfig.
+type rule struct {
+	allow       bool
+	client      string
+	constraints []constraint
+}
+
+func parseRule(cfg RuleConfig) (rule, error) {
+	var r rule
+	switch cfg.Action {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return rule{}, fmt.Errorf("invalid action %q", cfg.Action)
+	}
+
+	r.client = strings.TrimSpace(cfg.Client)
+	if r.client == "" {
+		r.client = "*"
+	}
+
+	if strings.TrimSpace(cfg.Version) != "" {
+		if r.client == "unknown" {
+			return rule{}, fmt.Errorf("version given for unknown clients")
+		}
+		for _, s := range strings.Split(cfg.Version, ",") {
+			c, err := parseConstraint(strings.TrimSpace(s))
+			if err != nil {
+				return rule{}, err
+			}
+			r.constraints = append(r.constraints, c)
+		}
+	}
+
+	return r, nil
+}
+
+// matches reports whether the rule applies to a client.
+// ok is false if the client could not be identified.
+func (r rule) matches(info bittorrent.ClientInfo, ok bool) bool {
+	if r.client == "unknown" {
+		return !ok
+	}
+	if !ok {
+		return r.client == "*" && len(r.constraints) == 0
+	}
+	if r.client != "*" && info.Code != r.client && !strings.EqualFold(info.Name, r.client) {
+		return false
+	}
+
+	for _, c := range r.constraints {
+		if !c.matches(info.Version) {
+			return false
+		}
+	}
+	return true
+}
+
+// A constraint restricts the version of a client.
+type constraint struct {
+	op      string
+	version bittorrent.ClientVersion
+
+	// wildcard is the number of leading components that are compared if
+	// the version ended in ".x", or zero.
+	wildcard int
+}
+
+var constraintOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+func parseConstraint(s string) (constraint, error) {
+	c := constraint{op: "="}
+	for _, op := range constraintOps {
+		if strings.HasPrefix(s, op) {
+			c.op = op
+			s = strings.TrimSpace(s[len(op):])
+			break
+		}
+	}
+
+	if strings.HasSuffix(s, ".x") {
+		if c.op != "=" && c.op != "!=" {
+			return constraint{}, fmt.Errorf("invalid constraint %q: wildcards are only allowed with = and !=", c.op+s)
+		}
+		s = strings.TrimSuffix(s, ".x")
+		c.wildcard = strings.Count(s, ".") + 1
+	}
+
+	v, err := bittorrent.ParseClientVersion(s)
+	if err != nil {
+		return constraint{}, err
+	}
+	c.version = v
+	return c, nil
+}
+
+func (c constraint) matches(v bittorrent.ClientVersion) bool {
+	if c.wildcard > 0 {
+		equal := true
+		for i, d := range [3][2]int{{v.Major, c.version.Major}, {v.Minor, c.version.Minor}, {v.Patch, c.version.Patch}} {
+			if i < c.wildcard && d[0] != d[1] {
+				equal = false
+			}
+		}
+		return equal == (c.op == "=")
+	}
+
+	cmp := v.Compare(c.version)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	default:
+		return cmp == 0
+	}
+}
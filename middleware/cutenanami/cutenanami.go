@@ -25,7 +25,10 @@ func init() {
 	middleware.RegisterDriver(Name, driver{})
 }
 
-var _ middleware.Driver = driver{}
+var (
+	_ middleware.Driver  = driver{}
+	_ middleware.Checker = driver{}
+)
 
 type driver struct{}
 
@@ -39,27 +42,51 @@ func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
 	return NewHook(cfg)
 }
 
+// CheckOptions checks options without creating a Hook.
+func (d driver) CheckOptions(optionBytes []byte) error {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	if len(cfg.NanamiAddress) <= 0 {
+		return fmt.Errorf("nanami address not configured")
+	}
+	return nil
+}
+
 var ErrTorrentUnapproved = bittorrent.ClientError("unapproved torrent")
 var ErrClientUnapproved = bittorrent.ClientError("unapproved client")
 var ErrUserUnapproved = bittorrent.ClientError("unapproved user")
 
+// WarningClientUnapproved is the warning message sent to unapproved clients
+// if WarnUnapprovedClients is set.
+const WarningClientUnapproved = "your client is deprecated, please upgrade"
+
 type Config struct {
 	NanamiAddress string `yaml:"nanami_address"`
+
+	// WarnUnapprovedClients lets unapproved clients announce with a warning
+	// message instead of rejecting them.
+	WarnUnapprovedClients bool `yaml:"warn_unapproved_clients"`
 }
 
 type hook struct {
-	approvedTorrents map[bittorrent.InfoHash]struct{}
-	approvedClients  map[string]struct{}
-	approvedUsers    map[string]struct{}
-	communication    NanamiCommunication
+	approvedTorrents      map[bittorrent.InfoHash]struct{}
+	approvedClients       map[string]struct{}
+	approvedUsers         map[string]struct{}
+	communication         NanamiCommunication
+	warnUnapprovedClients bool
 }
 
 func NewHook(cfg Config) (middleware.Hook, error) {
 	h := &hook{
-		approvedTorrents: make(map[bittorrent.InfoHash]struct{}),
-		approvedClients:  make(map[string]struct{}),
-		approvedUsers:    make(map[string]struct{}),
-		communication:    NewNanamiCommunication(cfg),
+		approvedTorrents:      make(map[bittorrent.InfoHash]struct{}),
+		approvedClients:       make(map[string]struct{}),
+		approvedUsers:         make(map[string]struct{}),
+		communication:         NewNanamiCommunication(cfg),
+		warnUnapprovedClients: cfg.WarnUnapprovedClients,
 	}
 
 	if len(cfg.NanamiAddress) <= 0 {
@@ -98,7 +125,10 @@ func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceReque
 	}
 
 	if _, found := h.approvedClients[clientSoftwareId]; !found {
-		return ctx, ErrClientUnapproved
+		if !h.warnUnapprovedClients {
+			return ctx, ErrClientUnapproved
+		}
+		resp.WarningMessage = WarningClientUnapproved
 	}
 
 	info := SingleUserAnnounce{
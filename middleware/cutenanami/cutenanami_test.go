@@ -0,0 +1,78 @@
+package cutenanami
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+)
+
+var (
+	approvedIH = bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa")
+	otherIH    = bittorrent.InfoHashFromString("bbbbbbbbbbbbbbbbbbbb")
+)
+
+// newTestHook returns a hook approving approvedIH, the client -TR2940- and
+// the user "user", without talking to nanami.
+func newTestHook(warnUnapprovedClients bool) *hook {
+	return &hook{
+		approvedTorrents:      map[bittorrent.InfoHash]struct{}{approvedIH: {}},
+		approvedClients:       map[string]struct{}{"-TR2940-": {}},
+		approvedUsers:         map[string]struct{}{"user": {}},
+		communication:         NanamiCommunication{announceChannelInbound: make(chan SingleUserAnnounce, 1)},
+		warnUnapprovedClients: warnUnapprovedClients,
+	}
+}
+
+func announce(t *testing.T, h *hook, ih bittorrent.InfoHash, peerID string) (*bittorrent.AnnounceResponse, error) {
+	params, err := bittorrent.ParseURLData("/announce/user?port=6881")
+	require.Nil(t, err)
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		Peer:     bittorrent.Peer{ID: bittorrent.PeerIDFromString(peerID)},
+		Params:   params,
+	}
+
+	resp := &bittorrent.AnnounceResponse{}
+	_, err = h.HandleAnnounce(context.Background(), req, resp)
+	return resp, err
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h := newTestHook(false)
+
+	resp, err := announce(t, h, approvedIH, "-TR2940-000000000000")
+	require.Nil(t, err)
+	require.Empty(t, resp.WarningMessage)
+	require.Equal(t, "user", (<-h.communication.announceChannelInbound).UserToken)
+
+	_, err = announce(t, h, otherIH, "-TR2940-000000000000")
+	require.Equal(t, ErrTorrentUnapproved, err)
+
+	_, err = announce(t, h, approvedIH, "-UT3550-000000000000")
+	require.Equal(t, ErrClientUnapproved, err)
+	require.Empty(t, h.communication.announceChannelInbound)
+}
+
+func TestWarnUnapprovedClients(t *testing.T) {
+	h := newTestHook(true)
+
+	// Unapproved clients announce with a warning.
+	resp, err := announce(t, h, approvedIH, "-UT3550-000000000000")
+	require.Nil(t, err)
+	require.Equal(t, WarningClientUnapproved, resp.WarningMessage)
+	require.Equal(t, "user", (<-h.communication.announceChannelInbound).UserToken)
+
+	// Approved clients get no warning.
+	resp, err = announce(t, h, approvedIH, "-TR2940-000000000000")
+	require.Nil(t, err)
+	require.Empty(t, resp.WarningMessage)
+	<-h.communication.announceChannelInbound
+
+	// Unapproved torrents are still rejected.
+	_, err = announce(t, h, otherIH, "-UT3550-000000000000")
+	require.Equal(t, ErrTorrentUnapproved, err)
+	require.Empty(t, h.communication.announceChannelInbound)
+}
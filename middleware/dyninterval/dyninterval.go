@@ -0,0 +1,298 @@
+// Package dyninterval implements a Hook that computes the announce interval
+// of every response from the size of the swarm and the request rate of the
+// tracker.
+package dyninterval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/pkg/stop"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "dynamic interval"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var (
+	_ middleware.Driver  = driver{}
+	_ middleware.Checker = driver{}
+)
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// CheckOptions checks options without creating a Hook.
+func (d driver) CheckOptions(optionBytes []byte) error {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	if err := checkConfig(cfg); err != nil {
+		return err
+	}
+	cfg.Validate()
+	return nil
+}
+
+// ErrInvalidBounds is returned for a config whose LowerBound is not positive
+// or greater than its UpperBound.
+var ErrInvalidBounds = errors.New("invalid lower_bound or upper_bound")
+
+// ErrInvalidSwarmExponent is returned for a config with a SwarmExponent
+// outside of [0, 1].
+var ErrInvalidSwarmExponent = errors.New("invalid swarm_exponent")
+
+// ErrInvalidTargetRate is returned for a config with a negative TargetRate.
+var ErrInvalidTargetRate = errors.New("invalid target_rate")
+
+// Default config constants.
+const (
+	defaultReferenceSwarmSize = 100
+	defaultRateWindow         = 10 * time.Second
+)
+
+// Config represents all the values required by this middleware to compute
+// announce intervals.
+type Config struct {
+	// LowerBound and UpperBound limit the computed interval.
+	LowerBound time.Duration `yaml:"lower_bound"`
+	UpperBound time.Duration `yaml:"upper_bound"`
+
+	// ReferenceSwarmSize is the number of peers of a swarm that gets the
+	// configured announce interval.
+	ReferenceSwarmSize int `yaml:"reference_swarm_size"`
+
+	// SwarmExponent is the exponent applied to the ratio of the size of a
+	// swarm to ReferenceSwarmSize. With 0.5, a swarm four times as large
+	// announces half as often, so announces of a swarm grow with the square
+	// root of its size.
+	SwarmExponent float64 `yaml:"swarm_exponent"`
+
+	// TargetRate is the number of requests per second above which intervals
+	// are increased proportionally to the request rate. Zero disables
+	// scaling by load.
+	TargetRate float64 `yaml:"target_rate"`
+
+	// RateWindow is the interval over which the request rate is measured.
+	RateWindow time.Duration `yaml:"rate_window"`
+
+	// ModifyMinInterval specifies whether min_interval should be scaled like
+	// interval.
+	ModifyMinInterval bool `yaml:"modify_min_interval"`
+
+	// Clock is used to measure the request rate.
+	// If it is nil, the global timecache is used.
+	Clock timecache.Clock `yaml:"-"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"name":               Name,
+		"lowerBound":         cfg.LowerBound,
+		"upperBound":         cfg.UpperBound,
+		"referenceSwarmSize": cfg.ReferenceSwarmSize,
+		"swarmExponent":      cfg.SwarmExponent,
+		"targetRate":         cfg.TargetRate,
+		"rateWindow":         cfg.RateWindow,
+		"modifyMinInterval":  cfg.ModifyMinInterval,
+	}
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.ReferenceSwarmSize <= 0 {
+		validcfg.ReferenceSwarmSize = defaultReferenceSwarmSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ReferenceSwarmSize",
+			"provided": cfg.ReferenceSwarmSize,
+			"default":  validcfg.ReferenceSwarmSize,
+		})
+	}
+
+	if cfg.RateWindow <= 0 {
+		validcfg.RateWindow = defaultRateWindow
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".RateWindow",
+			"provided": cfg.RateWindow,
+			"default":  validcfg.RateWindow,
+		})
+	}
+
+	if cfg.Clock == nil {
+		validcfg.Clock = timecache.Default()
+	}
+
+	return validcfg
+}
+
+func checkConfig(cfg Config) error {
+	if cfg.LowerBound <= 0 || cfg.UpperBound < cfg.LowerBound {
+		return ErrInvalidBounds
+	}
+
+	if cfg.SwarmExponent < 0 || cfg.SwarmExponent > 1 {
+		return ErrInvalidSwarmExponent
+	}
+
+	if cfg.TargetRate < 0 {
+		return ErrInvalidTargetRate
+	}
+
+	return nil
+}
+
+type hook struct {
+	cfg Config
+
+	// requests counts the requests of the current window.
+	requests uint64
+
+	// rate holds the bits of the float64 request rate of the last window.
+	rate uint64
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewHook returns an instance of the dynamic interval middleware.
+//
+// The returned Hook implements middleware.AnnounceFinalizer to compute the
+// interval once the size of the swarm is known, and stop.Stopper to stop
+// measuring the request rate.
+func NewHook(provided Config) (middleware.Hook, error) {
+	if err := checkConfig(provided); err != nil {
+		return nil, err
+	}
+	cfg := provided.Validate()
+
+	h := &hook{
+		cfg:    cfg,
+		closed: make(chan struct{}),
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		for {
+			select {
+			case <-h.closed:
+				return
+			case <-cfg.Clock.After(cfg.RateWindow):
+				h.measureRate()
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// measureRate computes the request rate of the window that just ended.
+func (h *hook) measureRate() {
+	n := atomic.SwapUint64(&h.requests, 0)
+	rate := float64(n) / h.cfg.RateWindow.Seconds()
+	atomic.StoreUint64(&h.rate, math.Float64bits(rate))
+	recordRate(rate)
+}
+
+func (h *hook) requestRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.rate))
+}
+
+// factor returns the factor the configured intervals are scaled by for a
+// swarm of the given size.
+func (h *hook) factor(peers uint32) float64 {
+	f := 1.0
+	if peers > 0 && h.cfg.SwarmExponent > 0 {
+		f = math.Pow(float64(peers)/float64(h.cfg.ReferenceSwarmSize), h.cfg.SwarmExponent)
+	}
+
+	if h.cfg.TargetRate > 0 {
+		if rate := h.requestRate(); rate > h.cfg.TargetRate {
+			f *= rate / h.cfg.TargetRate
+		}
+	}
+	return f
+}
+
+// scale scales d by f, rounds it to seconds and bounds it.
+func scale(d time.Duration, f float64, lower, upper time.Duration) time.Duration {
+	scaled := time.Duration(float64(d) * f).Round(time.Second)
+	if scaled < lower {
+		return lower
+	}
+	if scaled > upper {
+		return upper
+	}
+	return scaled
+}
+
+// HandleAnnounce counts the announce for the request rate.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	atomic.AddUint64(&h.requests, 1)
+	return ctx, nil
+}
+
+// FinalizeAnnounce computes the interval of the response.
+func (h *hook) FinalizeAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	f := h.factor(resp.Complete + resp.Incomplete)
+
+	resp.Interval = scale(resp.Interval, f, h.cfg.LowerBound, h.cfg.UpperBound)
+	if h.cfg.ModifyMinInterval {
+		resp.MinInterval = scale(resp.MinInterval, f, 0, resp.Interval)
+	} else if resp.MinInterval > resp.Interval {
+		resp.MinInterval = resp.Interval
+	}
+
+	recordInterval(resp.Interval)
+	return ctx, nil
+}
+
+// HandleScrape counts the scrape for the request rate.
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	atomic.AddUint64(&h.requests, 1)
+	return ctx, nil
+}
+
+// Stop stops measuring the request rate.
+func (h *hook) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		close(h.closed)
+		h.wg.Wait()
+		c.Done()
+	}()
+
+	return c.Result()
+}
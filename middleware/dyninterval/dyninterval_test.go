@@ -0,0 +1,132 @@
+package dyninterval
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+)
+
+var _ middleware.AnnounceFinalizer = &hook{}
+
+func TestCheckConfig(t *testing.T) {
+	valid := Config{LowerBound: time.Minute, UpperBound: time.Hour, SwarmExponent: 0.5}
+	require.Nil(t, checkConfig(valid))
+
+	var table = []struct {
+		modify   func(*Config)
+		expected error
+	}{
+		{func(cfg *Config) { cfg.LowerBound = 0 }, ErrInvalidBounds},
+		{func(cfg *Config) { cfg.UpperBound = time.Second }, ErrInvalidBounds},
+		{func(cfg *Config) { cfg.SwarmExponent = -0.5 }, ErrInvalidSwarmExponent},
+		{func(cfg *Config) { cfg.SwarmExponent = 1.5 }, ErrInvalidSwarmExponent},
+		{func(cfg *Config) { cfg.TargetRate = -1 }, ErrInvalidTargetRate},
+	}
+
+	for _, tt := range table {
+		cfg := valid
+		tt.modify(&cfg)
+		require.Equal(t, tt.expected, checkConfig(cfg))
+	}
+}
+
+func finalize(t *testing.T, h middleware.Hook, peers uint32) *bittorrent.AnnounceResponse {
+	resp := &bittorrent.AnnounceResponse{
+		Interval:    30 * time.Minute,
+		MinInterval: 15 * time.Minute,
+		Incomplete:  peers,
+	}
+	_, err := h.(middleware.AnnounceFinalizer).FinalizeAnnounce(context.Background(), &bittorrent.AnnounceRequest{}, resp)
+	require.Nil(t, err)
+	return resp
+}
+
+func TestSwarmSize(t *testing.T) {
+	h, err := NewHook(Config{
+		LowerBound:         5 * time.Minute,
+		UpperBound:         2 * time.Hour,
+		ReferenceSwarmSize: 100,
+		SwarmExponent:      0.5,
+	})
+	require.Nil(t, err)
+	defer func() { require.Empty(t, h.(*hook).Stop().Wait()) }()
+
+	var table = []struct {
+		peers       uint32
+		interval    time.Duration
+		minInterval time.Duration
+	}{
+		{100, 30 * time.Minute, 15 * time.Minute},
+		{400, time.Hour, 15 * time.Minute},
+		{25, 15 * time.Minute, 15 * time.Minute},
+		{4, 6 * time.Minute, 6 * time.Minute},
+		{1, 5 * time.Minute, 5 * time.Minute},
+		{100000, 2 * time.Hour, 15 * time.Minute},
+	}
+
+	for _, tt := range table {
+		resp := finalize(t, h, tt.peers)
+		require.Equal(t, tt.interval, resp.Interval, "%d peers", tt.peers)
+		require.Equal(t, tt.minInterval, resp.MinInterval, "%d peers", tt.peers)
+	}
+}
+
+func TestModifyMinInterval(t *testing.T) {
+	h, err := NewHook(Config{
+		LowerBound:        time.Minute,
+		UpperBound:        2 * time.Hour,
+		SwarmExponent:     1,
+		ModifyMinInterval: true,
+	})
+	require.Nil(t, err)
+	defer func() { require.Empty(t, h.(*hook).Stop().Wait()) }()
+
+	resp := finalize(t, h, 200)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, 30*time.Minute, resp.MinInterval)
+}
+
+func TestRequestRate(t *testing.T) {
+	clock := timecache.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	h, err := NewHook(Config{
+		LowerBound: time.Minute,
+		UpperBound: 2 * time.Hour,
+		TargetRate: 1,
+		RateWindow: 10 * time.Second,
+		Clock:      clock,
+	})
+	require.Nil(t, err)
+	defer func() { require.Empty(t, h.(*hook).Stop().Wait()) }()
+
+	// 20 requests in 10 seconds are twice the target rate.
+	for i := 0; i < 10; i++ {
+		_, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{}, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+		_, err = h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{}, &bittorrent.ScrapeResponse{})
+		require.Nil(t, err)
+	}
+	require.Equal(t, 30*time.Minute, finalize(t, h, 10).Interval)
+
+	clock.BlockUntil(1)
+	clock.Advance(10 * time.Second)
+	clock.BlockUntil(1)
+	require.Equal(t, 2.0, h.(*hook).requestRate())
+	require.Equal(t, time.Hour, finalize(t, h, 10).Interval)
+
+	// The rate drops with the requests.
+	clock.Advance(10 * time.Second)
+	clock.BlockUntil(1)
+	require.Equal(t, 30*time.Minute, finalize(t, h, 10).Interval)
+}
+
+func TestCheckOptions(t *testing.T) {
+	require.Nil(t, driver{}.CheckOptions([]byte("lower_bound: 5m\nupper_bound: 2h")))
+	require.Equal(t, ErrInvalidBounds, driver{}.CheckOptions([]byte("lower_bound: 5m")))
+	require.NotNil(t, driver{}.CheckOptions([]byte("lower_bound: 5m\nupper_bound: 2h\nswarm_exponnt: 0.5")))
+}
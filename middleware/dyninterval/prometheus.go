@@ -0,0 +1,36 @@
+package dyninterval
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(promIntervalSeconds, promRequestRate)
+}
+
+var promIntervalSeconds = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "chihaya_dyninterval_interval_seconds",
+		Help:    "The announce intervals computed by the dynamic interval middleware",
+		Buckets: prometheus.ExponentialBuckets(60, 2, 10),
+	},
+)
+
+var promRequestRate = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "chihaya_dyninterval_request_rate",
+		Help: "The requests per second measured by the dynamic interval middleware",
+	},
+)
+
+// recordInterval records a computed announce interval.
+func recordInterval(interval time.Duration) {
+	promIntervalSeconds.Observe(interval.Seconds())
+}
+
+// recordRate records the measured request rate.
+func recordRate(rate float64) {
+	promRequestRate.Set(rate)
+}
@@ -0,0 +1,252 @@
+package eventsink
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/middleware"
+)
+
+// Formats events can be encoded in.
+const (
+	FormatJSON     = "json"
+	FormatProtobuf = "protobuf"
+)
+
+// Event is an announce or scrape handled by the tracker.
+//
+// The protobuf encoding is described in events.proto.
+type Event struct {
+	Time        time.Time         `json:"time"`
+	Action      string            `json:"action"`
+	Frontend    string            `json:"frontend,omitempty"`
+	Route       string            `json:"route,omitempty"`
+	Chain       string            `json:"chain,omitempty"`
+	RouteParams map[string]string `json:"route_params,omitempty"`
+
+	// IP is the IP of the peer for announces and the address a scrape was
+	// received from for scrapes.
+	IP string `json:"ip,omitempty"`
+
+	Announce *AnnounceEvent `json:"announce,omitempty"`
+	Scrape   *ScrapeEvent   `json:"scrape,omitempty"`
+}
+
+// AnnounceEvent holds the fields of an announce and its response.
+type AnnounceEvent struct {
+	InfoHash   string `json:"infohash"`
+	Event      string `json:"event"`
+	PeerID     string `json:"peer_id"`
+	Port       uint16 `json:"port"`
+	Uploaded   uint64 `json:"uploaded"`
+	Downloaded uint64 `json:"downloaded"`
+	Left       uint64 `json:"left"`
+	NumWant    uint32 `json:"numwant"`
+
+	// Complete, Incomplete and Peers are the number of seeders, leechers
+	// and peers returned in the response.
+	Complete   uint32 `json:"complete"`
+	Incomplete uint32 `json:"incomplete"`
+	Peers      uint32 `json:"peers"`
+
+	// Interval and MinInterval are in seconds.
+	Interval    int64 `json:"interval"`
+	MinInterval int64 `json:"min_interval"`
+}
+
+// ScrapeEvent holds the swarms returned for a scrape.
+type ScrapeEvent struct {
+	Files []ScrapeFile `json:"files"`
+}
+
+// ScrapeFile is the state of one swarm returned for a scrape.
+type ScrapeFile struct {
+	InfoHash   string `json:"infohash"`
+	Complete   uint32 `json:"complete"`
+	Incomplete uint32 `json:"incomplete"`
+	Snatches   uint32 `json:"snatches"`
+}
+
+// newEvent returns an Event with the fields taken from the context of a
+// request.
+func newEvent(ctx context.Context, now time.Time, action string) *Event {
+	e := &Event{Time: now, Action: action}
+	e.Frontend, _ = ctx.Value(bittorrent.FrontendKey).(string)
+	e.Route, _ = ctx.Value(bittorrent.RouteKey).(string)
+	e.Chain, _ = ctx.Value(middleware.ChainKey).(string)
+
+	if rp, ok := ctx.Value(bittorrent.RouteParamsKey).(bittorrent.RouteParams); ok && len(rp) > 0 {
+		e.RouteParams = make(map[string]string, len(rp))
+		for _, p := range rp {
+			e.RouteParams[p.Key] = p.Value
+		}
+	}
+	return e
+}
+
+// announceEvent returns the Event for an announce.
+func announceEvent(ctx context.Context, now time.Time, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) *Event {
+	e := newEvent(ctx, now, "announce")
+	e.IP = req.Peer.IP.String()
+	e.Announce = &AnnounceEvent{
+		InfoHash:    req.InfoHash.String(),
+		Event:       req.Event.String(),
+		PeerID:      hex.EncodeToString(req.Peer.ID[:]),
+		Port:        req.Peer.Port,
+		Uploaded:    req.Uploaded,
+		Downloaded:  req.Downloaded,
+		Left:        req.Left,
+		NumWant:     req.NumWant,
+		Complete:    resp.Complete,
+		Incomplete:  resp.Incomplete,
+		Peers:       uint32(len(resp.IPv4Peers) + len(resp.IPv6Peers)),
+		Interval:    int64(resp.Interval / time.Second),
+		MinInterval: int64(resp.MinInterval / time.Second),
+	}
+	return e
+}
+
+// scrapeEvent returns the Event for a scrape.
+func scrapeEvent(ctx context.Context, now time.Time, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) *Event {
+	e := newEvent(ctx, now, "scrape")
+	if req.IP != nil {
+		e.IP = req.IP.String()
+	}
+	e.Scrape = &ScrapeEvent{Files: make([]ScrapeFile, 0, len(resp.Files))}
+	for _, f := range resp.Files {
+		e.Scrape.Files = append(e.Scrape.Files, ScrapeFile{
+			InfoHash:   f.InfoHash.String(),
+			Complete:   f.Complete,
+			Incomplete: f.Incomplete,
+			Snatches:   f.Snatches,
+		})
+	}
+	return e
+}
+
+// encode encodes an event in the given format.
+func encode(format string, e *Event) ([]byte, error) {
+	if format == FormatProtobuf {
+		return e.appendProto(nil), nil
+	}
+	return json.Marshal(e)
+}
+
+// appendStream appends an encoded event to a stream of events.
+//
+// JSON events are separated by newlines, protobuf events are prefixed with
+// their length as a varint.
+func appendStream(dst []byte, format string, msg []byte) []byte {
+	if format == FormatProtobuf {
+		return protowire.AppendBytes(dst, msg)
+	}
+	return append(append(dst, msg...), '\n')
+}
+
+// appendBatch appends an encoded event to the body of a batch sent to a
+// webhook.
+//
+// JSON batches are streams of events, protobuf batches are EventBatch
+// messages.
+func appendBatch(dst []byte, format string, msg []byte) []byte {
+	if format == FormatProtobuf {
+		dst = protowire.AppendTag(dst, 1, protowire.BytesType)
+		return protowire.AppendBytes(dst, msg)
+	}
+	return appendStream(dst, format, msg)
+}
+
+// contentType returns the content type of a batch.
+func contentType(format string) string {
+	if format == FormatProtobuf {
+		return "application/x-protobuf"
+	}
+	return "application/x-ndjson"
+}
+
+// Helpers appending proto3 fields, which are omitted if they are zero.
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func (e *Event) appendProto(b []byte) []byte {
+	b = appendVarint(b, 1, uint64(e.Time.UnixNano()))
+	b = appendString(b, 2, e.Action)
+	b = appendString(b, 3, e.Frontend)
+	b = appendString(b, 4, e.Route)
+	b = appendString(b, 5, e.Chain)
+
+	keys := make([]string, 0, len(e.RouteParams))
+	for k := range e.RouteParams {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = appendString(entry, 1, k)
+		entry = appendString(entry, 2, e.RouteParams[k])
+		b = appendMessage(b, 6, entry)
+	}
+
+	b = appendString(b, 7, e.IP)
+	if e.Announce != nil {
+		b = appendMessage(b, 8, e.Announce.appendProto(nil))
+	}
+	if e.Scrape != nil {
+		b = appendMessage(b, 9, e.Scrape.appendProto(nil))
+	}
+	return b
+}
+
+func (a *AnnounceEvent) appendProto(b []byte) []byte {
+	b = appendString(b, 1, a.InfoHash)
+	b = appendString(b, 2, a.Event)
+	b = appendString(b, 3, a.PeerID)
+	b = appendVarint(b, 4, uint64(a.Port))
+	b = appendVarint(b, 5, a.Uploaded)
+	b = appendVarint(b, 6, a.Downloaded)
+	b = appendVarint(b, 7, a.Left)
+	b = appendVarint(b, 8, uint64(a.NumWant))
+	b = appendVarint(b, 9, uint64(a.Complete))
+	b = appendVarint(b, 10, uint64(a.Incomplete))
+	b = appendVarint(b, 11, uint64(a.Peers))
+	b = appendVarint(b, 12, uint64(a.Interval))
+	b = appendVarint(b, 13, uint64(a.MinInterval))
+	return b
+}
+
+func (s *ScrapeEvent) appendProto(b []byte) []byte {
+	for _, f := range s.Files {
+		var file []byte
+		file = appendString(file, 1, f.InfoHash)
+		file = appendVarint(file, 2, uint64(f.Complete))
+		file = appendVarint(file, 3, uint64(f.Incomplete))
+		file = appendVarint(file, 4, uint64(f.Snatches))
+		b = appendMessage(b, 1, file)
+	}
+	return b
+}
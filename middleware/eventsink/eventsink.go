@@ -0,0 +1,291 @@
+// Package eventsink implements a Hook that delivers announce and scrape
+// events to webhooks, files and unix sockets.
+//
+// The hook is meant to be used as a posthook: it queues an event for every
+// request and delivers the events in the background, so it never delays a
+// response. Events are dropped if the queue of a sink is full.
+package eventsink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/pkg/stop"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "event sink"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var (
+	_ middleware.Driver  = driver{}
+	_ middleware.Checker = driver{}
+)
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// CheckOptions checks options without creating a Hook or opening the sinks.
+func (d driver) CheckOptions(optionBytes []byte) error {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	_, err = validConfig(cfg)
+	return err
+}
+
+var (
+	// ErrInvalidFormat is returned for a config with an unknown format.
+	ErrInvalidFormat = errors.New("invalid format")
+
+	// ErrNoSinks is returned for a config without sinks.
+	ErrNoSinks = errors.New("no sinks configured")
+
+	// ErrDuplicateSinkName is returned for a config with two sinks with the
+	// same name.
+	ErrDuplicateSinkName = errors.New("duplicate sink name")
+)
+
+// Default config constants.
+const (
+	defaultQueueSize     = 4096
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+)
+
+// Config represents all the values required by this middleware to deliver
+// events.
+type Config struct {
+	// Format is the encoding of events, json or protobuf.
+	Format string `yaml:"format"`
+
+	// QueueSize is the number of events queued per sink.
+	QueueSize int `yaml:"queue_size"`
+
+	// BatchSize is the maximum number of events delivered at once.
+	BatchSize int `yaml:"batch_size"`
+
+	// FlushInterval is the maximum time an event waits for a batch to fill.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+
+	Sinks []SinkConfig `yaml:"sinks"`
+
+	// Clock is used to time batches.
+	// If it is nil, the global timecache is used.
+	Clock timecache.Clock `yaml:"-"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	sinks := make([]string, 0, len(cfg.Sinks))
+	for _, s := range cfg.Sinks {
+		sinks = append(sinks, s.Name)
+	}
+
+	return log.Fields{
+		"name":          Name,
+		"format":        cfg.Format,
+		"queueSize":     cfg.QueueSize,
+		"batchSize":     cfg.BatchSize,
+		"flushInterval": cfg.FlushInterval,
+		"sinks":         sinks,
+	}
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.Format == "" {
+		validcfg.Format = FormatJSON
+	}
+
+	if cfg.QueueSize <= 0 {
+		validcfg.QueueSize = defaultQueueSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".QueueSize",
+			"provided": cfg.QueueSize,
+			"default":  validcfg.QueueSize,
+		})
+	}
+
+	if cfg.BatchSize <= 0 {
+		validcfg.BatchSize = defaultBatchSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".BatchSize",
+			"provided": cfg.BatchSize,
+			"default":  validcfg.BatchSize,
+		})
+	}
+
+	if cfg.FlushInterval <= 0 {
+		validcfg.FlushInterval = defaultFlushInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".FlushInterval",
+			"provided": cfg.FlushInterval,
+			"default":  validcfg.FlushInterval,
+		})
+	}
+
+	validcfg.Sinks = make([]SinkConfig, 0, len(cfg.Sinks))
+	for _, s := range cfg.Sinks {
+		validcfg.Sinks = append(validcfg.Sinks, s.validate())
+	}
+
+	if cfg.Clock == nil {
+		validcfg.Clock = timecache.Default()
+	}
+
+	return validcfg
+}
+
+type hook struct {
+	cfg     Config
+	workers []*worker
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewHook returns an instance of the event sink middleware.
+//
+// The returned Hook implements stop.Stopper and must be stopped to deliver
+// the queued events and close the sinks.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg, err := validConfig(provided)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &hook{
+		cfg:     cfg,
+		closing: make(chan struct{}),
+	}
+
+	for _, s := range cfg.Sinks {
+		snk, err := newSink(s, cfg.Format)
+		if err != nil {
+			for _, w := range h.workers {
+				w.sink.close()
+			}
+			return nil, fmt.Errorf("sink %s: %s", s.Name, err)
+		}
+		h.workers = append(h.workers, &worker{
+			name:          s.Name,
+			sink:          snk,
+			queue:         make(chan []byte, cfg.QueueSize),
+			batchSize:     cfg.BatchSize,
+			flushInterval: cfg.FlushInterval,
+			clock:         cfg.Clock,
+			closing:       h.closing,
+		})
+	}
+
+	for _, w := range h.workers {
+		h.wg.Add(1)
+		go func(w *worker) {
+			defer h.wg.Done()
+			w.run()
+		}(w)
+	}
+
+	return h, nil
+}
+
+// validConfig checks a config and returns it with default values replacing
+// anything that is invalid.
+func validConfig(provided Config) (Config, error) {
+	if provided.Format != "" && provided.Format != FormatJSON && provided.Format != FormatProtobuf {
+		return Config{}, ErrInvalidFormat
+	}
+	if len(provided.Sinks) == 0 {
+		return Config{}, ErrNoSinks
+	}
+	for i, s := range provided.Sinks {
+		if err := s.check(); err != nil {
+			return Config{}, fmt.Errorf("sink %d: %s", i, err)
+		}
+	}
+	cfg := provided.Validate()
+
+	names := make(map[string]bool)
+	for _, s := range cfg.Sinks {
+		if names[s.Name] {
+			return Config{}, ErrDuplicateSinkName
+		}
+		names[s.Name] = true
+	}
+
+	return cfg, nil
+}
+
+// enqueue encodes an event and queues it for every sink.
+func (h *hook) enqueue(e *Event) {
+	msg, err := encode(h.cfg.Format, e)
+	if err != nil {
+		log.Error("event sink: failed to encode event", log.Err(err))
+		return
+	}
+
+	for _, w := range h.workers {
+		w.enqueue(msg)
+	}
+}
+
+// HandleAnnounce queues an event for an announce.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	h.enqueue(announceEvent(ctx, h.cfg.Clock.Now(), req, resp))
+	return ctx, nil
+}
+
+// HandleScrape queues an event for a scrape.
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	h.enqueue(scrapeEvent(ctx, h.cfg.Clock.Now(), req, resp))
+	return ctx, nil
+}
+
+// Stop delivers the queued events and closes the sinks.
+func (h *hook) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		h.wg.Wait()
+
+		var errs []error
+		for _, w := range h.workers {
+			if err := w.sink.close(); err != nil {
+				errs = append(errs, fmt.Errorf("sink %s: %s", w.name, err))
+			}
+		}
+		c.Done(errs...)
+	}()
+
+	return c.Result()
+}
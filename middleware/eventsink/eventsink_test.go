@@ -0,0 +1,265 @@
+package eventsink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+)
+
+var now = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func announce() (*bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse) {
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa"),
+		Event:    bittorrent.Started,
+		Left:     100,
+		NumWant:  50,
+		Peer: bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString("-TR2940-000000000000"),
+			IP:   bittorrent.IP{IP: net.ParseIP("192.0.2.1").To4(), AddressFamily: bittorrent.IPv4},
+			Port: 6881,
+		},
+	}
+	resp := &bittorrent.AnnounceResponse{
+		Complete:   1,
+		Incomplete: 2,
+		Interval:   30 * time.Minute,
+		IPv4Peers:  []bittorrent.Peer{{}, {}},
+	}
+	return req, resp
+}
+
+func requestContext() context.Context {
+	ctx := context.WithValue(context.Background(), bittorrent.FrontendKey, "http")
+	ctx = context.WithValue(ctx, bittorrent.RouteKey, "/:passkey/announce")
+	ctx = context.WithValue(ctx, middleware.ChainKey, "default")
+	return context.WithValue(ctx, bittorrent.RouteParamsKey, bittorrent.RouteParams{{Key: "passkey", Value: "abc"}})
+}
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{})
+	require.Equal(t, ErrNoSinks, err)
+
+	_, err = NewHook(Config{Format: "xml", Sinks: []SinkConfig{{File: &FileConfig{Path: "events"}}}})
+	require.Equal(t, ErrInvalidFormat, err)
+
+	_, err = NewHook(Config{Sinks: []SinkConfig{{}}})
+	require.EqualError(t, err, "sink 0: "+ErrInvalidSink.Error())
+
+	_, err = NewHook(Config{Sinks: []SinkConfig{{HTTP: &HTTPConfig{}}}})
+	require.EqualError(t, err, "sink 0: http sink requires url")
+
+	_, err = NewHook(Config{Sinks: []SinkConfig{
+		{UnixSocket: &UnixSocketConfig{Path: "a"}},
+		{UnixSocket: &UnixSocketConfig{Path: "b"}},
+	}})
+	require.Equal(t, ErrDuplicateSinkName, err)
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	h, err := NewHook(Config{
+		Sinks: []SinkConfig{{File: &FileConfig{Path: path}}},
+		Clock: timecache.NewFakeClock(now),
+	})
+	require.Nil(t, err)
+
+	req, resp := announce()
+	_, err = h.HandleAnnounce(requestContext(), req, resp)
+	require.Nil(t, err)
+
+	scrape := &bittorrent.ScrapeRequest{IP: net.ParseIP("192.0.2.1")}
+	_, err = h.HandleScrape(context.Background(), scrape, &bittorrent.ScrapeResponse{Files: []bittorrent.Scrape{
+		{InfoHash: req.InfoHash, Complete: 1, Incomplete: 2, Snatches: 3},
+	}})
+	require.Nil(t, err)
+
+	// Stopping delivers the queued events.
+	require.Empty(t, h.(*hook).Stop().Wait())
+
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, e)
+	}
+	require.Len(t, events, 2)
+
+	require.Equal(t, Event{
+		Time:        now,
+		Action:      "announce",
+		Frontend:    "http",
+		Route:       "/:passkey/announce",
+		Chain:       "default",
+		RouteParams: map[string]string{"passkey": "abc"},
+		IP:          "192.0.2.1",
+		Announce: &AnnounceEvent{
+			InfoHash:   "6161616161616161616161616161616161616161",
+			Event:      "started",
+			PeerID:     "2d5452323934302d303030303030303030303030",
+			Port:       6881,
+			Left:       100,
+			NumWant:    50,
+			Complete:   1,
+			Incomplete: 2,
+			Peers:      2,
+			Interval:   1800,
+		},
+	}, events[0])
+
+	require.Equal(t, &ScrapeEvent{Files: []ScrapeFile{
+		{InfoHash: "6161616161616161616161616161616161616161", Complete: 1, Incomplete: 2, Snatches: 3},
+	}}, events[1].Scrape)
+	require.Equal(t, "192.0.2.1", events[1].IP)
+}
+
+func TestFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events")
+	s := &fileSink{cfg: FileConfig{Path: path, MaxSize: 10, MaxBackups: 2}, format: FormatJSON}
+	require.Nil(t, s.open())
+
+	for _, msg := range []string{"first", "second", "third", "fourth"} {
+		require.Nil(t, s.write([][]byte{[]byte(msg)}))
+	}
+	require.Nil(t, s.close())
+
+	for suffix, expected := range map[string]string{
+		"":   "fourth\n",
+		".1": "third\n",
+		".2": "second\n",
+	} {
+		b, err := ioutil.ReadFile(path + suffix)
+		require.Nil(t, err)
+		require.Equal(t, expected, string(b))
+	}
+	_, err := os.Stat(path + ".3")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestHTTPBatches(t *testing.T) {
+	bodies := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		require.Equal(t, "secret", r.Header.Get("Authorization"))
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(b)
+	}))
+	defer srv.Close()
+
+	clock := timecache.NewFakeClock(now)
+	h, err := NewHook(Config{
+		BatchSize:     2,
+		FlushInterval: time.Second,
+		Sinks: []SinkConfig{{Name: "webhook", HTTP: &HTTPConfig{
+			URL:     srv.URL,
+			Headers: map[string]string{"Authorization": "secret"},
+		}}},
+		Clock: clock,
+	})
+	require.Nil(t, err)
+	defer func() { require.Empty(t, h.(*hook).Stop().Wait()) }()
+
+	req, resp := announce()
+	_, err = h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+
+	// An incomplete batch is delivered after the flush interval.
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	require.Equal(t, 1, strings.Count(<-bodies, "\n"))
+
+	// A full batch is delivered immediately.
+	for i := 0; i < 2; i++ {
+		_, err = h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+	}
+	require.Equal(t, 2, strings.Count(<-bodies, "\n"))
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	l, err := net.Listen("unix", path)
+	require.Nil(t, err)
+	defer l.Close()
+
+	h, err := NewHook(Config{
+		Format: FormatProtobuf,
+		Sinks:  []SinkConfig{{UnixSocket: &UnixSocketConfig{Path: path}}},
+		Clock:  timecache.NewFakeClock(now),
+	})
+	require.Nil(t, err)
+
+	req, resp := announce()
+	_, err = h.HandleAnnounce(requestContext(), req, resp)
+	require.Nil(t, err)
+	require.Empty(t, h.(*hook).Stop().Wait())
+
+	conn, err := l.Accept()
+	require.Nil(t, err)
+	b, err := ioutil.ReadAll(conn)
+	require.Nil(t, err)
+
+	msg, n := protowire.ConsumeBytes(b)
+	require.Equal(t, len(b), n)
+
+	// Check the action and the infohash of the announce.
+	fields := make(map[protowire.Number][]byte)
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		require.True(t, n > 0)
+		msg = msg[n:]
+		n = protowire.ConsumeFieldValue(num, typ, msg)
+		require.True(t, n > 0)
+		if typ == protowire.BytesType {
+			fields[num], _ = protowire.ConsumeBytes(msg[:n])
+		}
+		msg = msg[n:]
+	}
+	require.Equal(t, "announce", string(fields[2]))
+
+	infoHash, _ := protowire.ConsumeBytes(fields[8][1:])
+	require.Equal(t, "6161616161616161616161616161616161616161", string(infoHash))
+}
+
+func TestQueueFull(t *testing.T) {
+	dropped := promEventsTotal.WithLabelValues("full", resultDropped)
+	before := testutil.ToFloat64(dropped)
+
+	w := &worker{name: "full", queue: make(chan []byte, 1), closing: make(chan struct{})}
+	w.enqueue([]byte("first"))
+	w.enqueue([]byte("second"))
+	require.Equal(t, before+1, testutil.ToFloat64(dropped))
+	require.Len(t, w.queue, 1)
+}
+
+func TestCheckOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events")
+	require.Nil(t, driver{}.CheckOptions([]byte("sinks:\n  - file:\n      path: "+path)))
+	_, err := os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	require.Equal(t, ErrNoSinks, driver{}.CheckOptions([]byte("format: json")))
+	require.NotNil(t, driver{}.CheckOptions([]byte("sinks:\n  - file:\n      pth: "+path)))
+}
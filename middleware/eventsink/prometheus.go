@@ -0,0 +1,55 @@
+package eventsink
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(promEventsTotal, promBatchDurationMilliseconds, promQueueLength)
+}
+
+// Results of handling an event, used as label values.
+const (
+	resultDelivered = "delivered"
+	resultFailed    = "failed"
+	resultDropped   = "dropped"
+)
+
+var promEventsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_eventsink_events_total",
+		Help: "The number of events handled by the event sink middleware",
+	},
+	[]string{"sink", "result"},
+)
+
+var promBatchDurationMilliseconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "chihaya_eventsink_batch_duration_milliseconds",
+		Help:    "The time it takes to deliver a batch of events",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	},
+	[]string{"sink"},
+)
+
+var promQueueLength = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chihaya_eventsink_queue_length",
+		Help: "The number of events waiting to be delivered",
+	},
+	[]string{"sink"},
+)
+
+// recordEvents increments the number of events of a sink with result by n.
+func recordEvents(sink, result string, n int) {
+	promEventsTotal.WithLabelValues(sink, result).Add(float64(n))
+}
+
+// recordBatch records the delivery of a batch and the number of events still
+// queued.
+func recordBatch(sink string, duration time.Duration, queued int) {
+	promBatchDurationMilliseconds.WithLabelValues(sink).Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
+	promQueueLength.WithLabelValues(sink).Set(float64(queued))
+}
@@ -0,0 +1,427 @@
+package eventsink
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+)
+
+// ErrInvalidSink is returned for a SinkConfig that does not set exactly one
+// of its destinations.
+var ErrInvalidSink = errors.New("exactly one of http, file and unix_socket must be set")
+
+// SinkConfig configures a destination for events.
+//
+// Exactly one of HTTP, File and UnixSocket must be set.
+type SinkConfig struct {
+	// Name identifies the sink in metrics and logs. It defaults to the type
+	// of the sink.
+	Name string `yaml:"name"`
+
+	HTTP       *HTTPConfig       `yaml:"http"`
+	File       *FileConfig       `yaml:"file"`
+	UnixSocket *UnixSocketConfig `yaml:"unix_socket"`
+}
+
+// HTTPConfig configures a webhook receiving batches of events in POST
+// requests.
+type HTTPConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"`
+}
+
+// FileConfig configures a file events are appended to.
+type FileConfig struct {
+	Path string `yaml:"path"`
+
+	// MaxSize is the size in bytes at which the file is rotated.
+	MaxSize int64 `yaml:"max_size"`
+
+	// MaxBackups is the number of rotated files kept.
+	MaxBackups int `yaml:"max_backups"`
+}
+
+// UnixSocketConfig configures a unix stream socket events are written to.
+type UnixSocketConfig struct {
+	Path    string        `yaml:"path"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Default sink config constants.
+const (
+	defaultHTTPTimeout   = 10 * time.Second
+	defaultMaxSize       = 100 << 20
+	defaultMaxBackups    = 5
+	defaultSocketTimeout = time.Second
+)
+
+// kind returns the type of the sink.
+func (cfg SinkConfig) kind() string {
+	switch {
+	case cfg.HTTP != nil:
+		return "http"
+	case cfg.File != nil:
+		return "file"
+	default:
+		return "unix_socket"
+	}
+}
+
+// check returns an error if the destination of the sink is not configured
+// correctly.
+func (cfg SinkConfig) check() error {
+	var set int
+	for _, s := range []bool{cfg.HTTP != nil, cfg.File != nil, cfg.UnixSocket != nil} {
+		if s {
+			set++
+		}
+	}
+	if set != 1 {
+		return ErrInvalidSink
+	}
+
+	switch {
+	case cfg.HTTP != nil && cfg.HTTP.URL == "":
+		return errors.New("http sink requires url")
+	case cfg.File != nil && cfg.File.Path == "":
+		return errors.New("file sink requires path")
+	case cfg.UnixSocket != nil && cfg.UnixSocket.Path == "":
+		return errors.New("unix_socket sink requires path")
+	}
+	return nil
+}
+
+// validate returns a copy of the config with default values replacing
+// anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg SinkConfig) validate() SinkConfig {
+	validcfg := cfg
+	if validcfg.Name == "" {
+		validcfg.Name = cfg.kind()
+	}
+
+	warn := func(field string, provided, def interface{}) {
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + "." + validcfg.Name + "." + field,
+			"provided": provided,
+			"default":  def,
+		})
+	}
+
+	switch {
+	case cfg.HTTP != nil:
+		c := *cfg.HTTP
+		if c.Timeout <= 0 {
+			c.Timeout = defaultHTTPTimeout
+			warn("Timeout", cfg.HTTP.Timeout, c.Timeout)
+		}
+		validcfg.HTTP = &c
+	case cfg.File != nil:
+		c := *cfg.File
+		if c.MaxSize <= 0 {
+			c.MaxSize = defaultMaxSize
+			warn("MaxSize", cfg.File.MaxSize, c.MaxSize)
+		}
+		if c.MaxBackups <= 0 {
+			c.MaxBackups = defaultMaxBackups
+			warn("MaxBackups", cfg.File.MaxBackups, c.MaxBackups)
+		}
+		validcfg.File = &c
+	case cfg.UnixSocket != nil:
+		c := *cfg.UnixSocket
+		if c.Timeout <= 0 {
+			c.Timeout = defaultSocketTimeout
+			warn("Timeout", cfg.UnixSocket.Timeout, c.Timeout)
+		}
+		validcfg.UnixSocket = &c
+	}
+
+	return validcfg
+}
+
+// A sink delivers batches of encoded events.
+type sink interface {
+	write(batch [][]byte) error
+	close() error
+}
+
+func newSink(cfg SinkConfig, format string) (sink, error) {
+	switch {
+	case cfg.HTTP != nil:
+		return &httpSink{
+			cfg:    *cfg.HTTP,
+			format: format,
+			client: &http.Client{Timeout: cfg.HTTP.Timeout},
+		}, nil
+	case cfg.File != nil:
+		s := &fileSink{cfg: *cfg.File, format: format}
+		return s, s.open()
+	default:
+		return &unixSink{cfg: *cfg.UnixSocket, format: format}, nil
+	}
+}
+
+// httpSink POSTs every batch to a webhook.
+type httpSink struct {
+	cfg    HTTPConfig
+	format string
+	client *http.Client
+}
+
+func (s *httpSink) write(batch [][]byte) error {
+	var body []byte
+	for _, msg := range batch {
+		body = appendBatch(body, s.format, msg)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType(s.format))
+	for k, v := range s.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// fileSink appends events to a file and rotates it when it grows too large.
+//
+// Rotated files are named like the file with a suffix of .1 for the newest
+// one up to .MaxBackups for the oldest one.
+type fileSink struct {
+	cfg    FileConfig
+	format string
+
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.f = f
+	s.w = bufio.NewWriter(f)
+	s.size = fi.Size()
+	return nil
+}
+
+func (s *fileSink) rotate() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+
+	for i := s.cfg.MaxBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.cfg.Path, i), fmt.Sprintf("%s.%d", s.cfg.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(s.cfg.Path, s.cfg.Path+".1"); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+func (s *fileSink) write(batch [][]byte) error {
+	var buf []byte
+	for _, msg := range batch {
+		buf = appendStream(buf[:0], s.format, msg)
+		if s.size > 0 && s.size+int64(len(buf)) > s.cfg.MaxSize {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+
+		n, err := s.w.Write(buf)
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+func (s *fileSink) close() error {
+	if err := s.w.Flush(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+// unixSink writes events to a unix stream socket.
+//
+// The socket is connected when the first batch is written and reconnected
+// after a failed write.
+type unixSink struct {
+	cfg    UnixSocketConfig
+	format string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (s *unixSink) write(batch [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout("unix", s.cfg.Path, s.cfg.Timeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	var buf []byte
+	for _, msg := range batch {
+		buf = appendStream(buf, s.format, msg)
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(s.cfg.Timeout))
+	if _, err := s.conn.Write(buf); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *unixSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// worker batches the events queued for a sink and delivers them.
+type worker struct {
+	name          string
+	sink          sink
+	queue         chan []byte
+	batchSize     int
+	flushInterval time.Duration
+	clock         timecache.Clock
+	closing       chan struct{}
+}
+
+// enqueue queues an encoded event without blocking.
+func (w *worker) enqueue(msg []byte) {
+	select {
+	case <-w.closing:
+		recordEvents(w.name, resultDropped, 1)
+		return
+	default:
+	}
+
+	select {
+	case w.queue <- msg:
+	default:
+		recordEvents(w.name, resultDropped, 1)
+	}
+}
+
+func (w *worker) flush(batch [][]byte) [][]byte {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	start := time.Now()
+	err := w.sink.write(batch)
+	recordBatch(w.name, time.Since(start), len(w.queue))
+	if err != nil {
+		log.Error("event sink: failed to deliver events", log.Fields{
+			"sink":   w.name,
+			"events": len(batch),
+		}, log.Err(err))
+		recordEvents(w.name, resultFailed, len(batch))
+	} else {
+		recordEvents(w.name, resultDelivered, len(batch))
+	}
+	return batch[:0]
+}
+
+// run delivers events until the worker is closing and then delivers the
+// events still queued.
+func (w *worker) run() {
+	batch := make([][]byte, 0, w.batchSize)
+	var timeout <-chan time.Time
+
+	for {
+		select {
+		case msg := <-w.queue:
+			batch = append(batch, msg)
+			if len(batch) == 1 {
+				timeout = w.clock.After(w.flushInterval)
+			}
+			if len(batch) >= w.batchSize {
+				batch = w.flush(batch)
+				timeout = nil
+			}
+		case <-timeout:
+			batch = w.flush(batch)
+			timeout = nil
+		case <-w.closing:
+			for {
+				select {
+				case msg := <-w.queue:
+					batch = append(batch, msg)
+					if len(batch) >= w.batchSize {
+						batch = w.flush(batch)
+					}
+				default:
+					w.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
@@ -17,6 +17,16 @@ type Hook interface {
 	HandleScrape(context.Context, *bittorrent.ScrapeRequest, *bittorrent.ScrapeResponse) (context.Context, error)
 }
 
+// AnnounceFinalizer can be implemented by a PreHook that needs the complete
+// response of an announce, including the swarm statistics and the peers.
+//
+// FinalizeAnnounce is called after the response has been generated, once all
+// PreHooks ran HandleAnnounce. Finalizers are called in the order of the
+// PreHooks.
+type AnnounceFinalizer interface {
+	FinalizeAnnounce(context.Context, *bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse) (context.Context, error)
+}
+
 type skipSwarmInteraction struct{}
 
 // SkipSwarmInteractionKey is a key for the context of an Announce to control
@@ -34,33 +44,43 @@ func (h *swarmInteractionHook) HandleAnnounce(ctx context.Context, req *bittorre
 		return ctx, nil
 	}
 
+	if err = h.interact(ctx, req, req.Peer); err != nil {
+		return ctx, err
+	}
+
+	// Dual-stack clients are in the swarms of both address families.
+	if req.AltPeer != nil {
+		err = h.interact(ctx, req, *req.AltPeer)
+	}
+	return ctx, err
+}
+
+// interact records the announce of a peer in the swarm of its address family.
+func (h *swarmInteractionHook) interact(ctx context.Context, req *bittorrent.AnnounceRequest, peer bittorrent.Peer) (err error) {
 	switch {
 	case req.Event == bittorrent.Stopped:
-		err = h.store.DeleteSeeder(req.InfoHash, req.Peer)
+		err = h.store.DeleteSeeder(ctx, req.InfoHash, peer)
 		if err != nil && err != storage.ErrResourceDoesNotExist {
-			return ctx, err
+			return err
 		}
 
-		err = h.store.DeleteLeecher(req.InfoHash, req.Peer)
+		err = h.store.DeleteLeecher(ctx, req.InfoHash, peer)
 		if err != nil && err != storage.ErrResourceDoesNotExist {
-			return ctx, err
+			return err
 		}
 	case req.Event == bittorrent.Completed:
-		err = h.store.GraduateLeecher(req.InfoHash, req.Peer)
-		return ctx, err
+		return h.store.GraduateLeecher(ctx, req.InfoHash, peer)
 	case req.Left == 0:
 		// Completed events will also have Left == 0, but by making this
 		// an extra case we can treat "old" seeders differently from
 		// graduating leechers. (Calling PutSeeder is probably faster
 		// than calling GraduateLeecher.)
-		err = h.store.PutSeeder(req.InfoHash, req.Peer)
-		return ctx, err
+		return h.store.PutSeeder(ctx, req.InfoHash, peer)
 	default:
-		err = h.store.PutLeecher(req.InfoHash, req.Peer)
-		return ctx, err
+		return h.store.PutLeecher(ctx, req.InfoHash, peer)
 	}
 
-	return ctx, nil
+	return nil
 }
 
 func (h *swarmInteractionHook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
@@ -87,6 +107,11 @@ var ScrapeIsIPv6Key = scrapeAddressType{}
 
 type responseHook struct {
 	store storage.PeerStore
+
+	// ipv4PeerWeight and ipv6PeerWeight are the shares of the address
+	// families in the peers returned to dual-stack clients.
+	ipv4PeerWeight int
+	ipv6PeerWeight int
 }
 
 func (h *responseHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (_ context.Context, err error) {
@@ -95,17 +120,32 @@ func (h *responseHook) HandleAnnounce(ctx context.Context, req *bittorrent.Annou
 	}
 
 	// Add the Scrape data to the response.
-	s := h.store.ScrapeSwarm(req.InfoHash, req.IP.AddressFamily)
+	s := h.store.ScrapeSwarm(ctx, req.InfoHash, req.IP.AddressFamily)
+	if err = ctx.Err(); err != nil {
+		return ctx, err
+	}
 	resp.Incomplete = s.Incomplete
 	resp.Complete = s.Complete
 
-	err = h.appendPeers(req, resp)
+	// Tell the client the address its announce was received from, even if
+	// it provided another one, and keep the tracker id it sends back unless
+	// a hook gave it a new one.
+	resp.ExternalIP = req.RemoteIP
+	if resp.TrackerID == "" {
+		resp.TrackerID = req.TrackerID
+	}
+
+	err = h.appendPeers(ctx, req, resp)
 	return ctx, err
 }
 
-func (h *responseHook) appendPeers(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error {
+func (h *responseHook) appendPeers(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error {
+	if req.AltPeer != nil {
+		return h.appendDualStackPeers(ctx, req, resp)
+	}
+
 	seeding := req.Left == 0
-	peers, err := h.store.AnnouncePeers(req.InfoHash, seeding, int(req.NumWant), req.Peer)
+	peers, err := h.store.AnnouncePeers(ctx, req.InfoHash, seeding, int(req.NumWant), req.Peer)
 	if err != nil && err != storage.ErrResourceDoesNotExist {
 		return err
 	}
@@ -133,14 +173,73 @@ func (h *responseHook) appendPeers(req *bittorrent.AnnounceRequest, resp *bittor
 	return nil
 }
 
+// appendDualStackPeers adds the peers for a client that announced a peer in
+// both address families to the response, shared between the address families
+// by their weights.
+func (h *responseHook) appendDualStackPeers(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (err error) {
+	peer4, peer6 := req.Peer, *req.AltPeer
+	if req.IP.AddressFamily == bittorrent.IPv6 {
+		peer4, peer6 = peer6, peer4
+	}
+
+	seeding := req.Left == 0
+	numWant := int(req.NumWant)
+	want4 := numWant * h.ipv4PeerWeight / (h.ipv4PeerWeight + h.ipv6PeerWeight)
+
+	if resp.IPv4Peers, err = h.announcePeers(ctx, req.InfoHash, seeding, want4, peer4); err != nil {
+		return err
+	}
+	if resp.IPv6Peers, err = h.announcePeers(ctx, req.InfoHash, seeding, numWant-len(resp.IPv4Peers), peer6); err != nil {
+		return err
+	}
+	if len(resp.IPv4Peers) == want4 && len(resp.IPv4Peers)+len(resp.IPv6Peers) < numWant {
+		// There are too few IPv6 peers, more IPv4 peers make up for them.
+		if resp.IPv4Peers, err = h.announcePeers(ctx, req.InfoHash, seeding, numWant-len(resp.IPv6Peers), peer4); err != nil {
+			return err
+		}
+	}
+
+	// Some clients expect a minimum of their own peer representation returned to
+	// them if they are the only peer in a swarm.
+	if len(resp.IPv4Peers)+len(resp.IPv6Peers) == 0 {
+		if seeding {
+			resp.Complete++
+		} else {
+			resp.Incomplete++
+		}
+		if req.IP.AddressFamily == bittorrent.IPv4 {
+			resp.IPv4Peers = append(resp.IPv4Peers, req.Peer)
+		} else {
+			resp.IPv6Peers = append(resp.IPv6Peers, req.Peer)
+		}
+	}
+
+	return nil
+}
+
+// announcePeers returns up to numWant peers of the swarm of the address family
+// of announcer, treating a swarm that does not exist as empty.
+func (h *responseHook) announcePeers(ctx context.Context, ih bittorrent.InfoHash, seeding bool, numWant int, announcer bittorrent.Peer) ([]bittorrent.Peer, error) {
+	if numWant <= 0 {
+		return nil, nil
+	}
+
+	peers, err := h.store.AnnouncePeers(ctx, ih, seeding, numWant, announcer)
+	if err == storage.ErrResourceDoesNotExist {
+		return nil, nil
+	}
+	return peers, err
+}
+
 func (h *responseHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
 	if ctx.Value(SkipResponseHookKey) != nil {
 		return ctx, nil
 	}
 
 	for _, infoHash := range req.InfoHashes {
-		resp.Files = append(resp.Files, h.store.ScrapeSwarm(infoHash, req.AddressFamily))
+		resp.Files = append(resp.Files, h.store.ScrapeSwarm(ctx, infoHash, req.AddressFamily))
 	}
 
-	return ctx, nil
+	// The scrapes may be incomplete if the context is done.
+	return ctx, ctx.Err()
 }
@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/storage/memory"
+)
+
+var dualStackIH = bittorrent.InfoHashFromString("01234567890123456789")
+
+func testPeer(n int, ip string) bittorrent.Peer {
+	p := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString(fmt.Sprintf("%020d", n)),
+		IP:   bittorrent.IP{IP: net.ParseIP(ip), AddressFamily: bittorrent.IPv6},
+		Port: 6881,
+	}
+	if ip := p.IP.To4(); ip != nil {
+		p.IP = bittorrent.IP{IP: ip, AddressFamily: bittorrent.IPv4}
+	}
+	return p
+}
+
+func TestDualStackPeers(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { require.Empty(t, ps.Stop().Wait()) }()
+
+	for i := 1; i <= 4; i++ {
+		require.Nil(t, ps.PutSeeder(context.Background(), dualStackIH, testPeer(i, fmt.Sprintf("192.0.2.%d", i))))
+	}
+	require.Nil(t, ps.PutSeeder(context.Background(), dualStackIH, testPeer(5, "2001:db8::5")))
+
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: dualStackIH,
+		NumWant:  4,
+		Left:     1,
+		Peer:     testPeer(6, "198.51.100.6"),
+	}
+	alt := testPeer(6, "2001:db8::6")
+	req.AltPeer = &alt
+
+	var table = []struct {
+		ipv4Weight, ipv6Weight int
+		numWant                uint32
+		ipv4Peers, ipv6Peers   int
+	}{
+		{1, 1, 4, 3, 1},
+		{1, 1, 2, 1, 1},
+		{1, 0, 4, 4, 0},
+		{0, 1, 4, 3, 1},
+		{1, 1, 10, 4, 1},
+	}
+
+	for _, tt := range table {
+		h := &responseHook{store: ps, ipv4PeerWeight: tt.ipv4Weight, ipv6PeerWeight: tt.ipv6Weight}
+		req.NumWant = tt.numWant
+		resp := &bittorrent.AnnounceResponse{}
+		_, err := h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.Len(t, resp.IPv4Peers, tt.ipv4Peers, "%+v", tt)
+		require.Len(t, resp.IPv6Peers, tt.ipv6Peers, "%+v", tt)
+	}
+
+	// Dual-stack peers join the swarms of both address families.
+	_, err = (&swarmInteractionHook{store: ps}).HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(context.Background(), dualStackIH, bittorrent.IPv4).Incomplete)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(context.Background(), dualStackIH, bittorrent.IPv6).Incomplete)
+}
+
+func TestResponseExtras(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { require.Empty(t, ps.Stop().Wait()) }()
+	h := &responseHook{store: ps, ipv4PeerWeight: 1, ipv6PeerWeight: 1}
+
+	req := &bittorrent.AnnounceRequest{
+		InfoHash:  dualStackIH,
+		NumWant:   1,
+		Peer:      testPeer(1, "192.0.2.1"),
+		TrackerID: "abc",
+		RemoteIP:  net.ParseIP("192.0.2.1"),
+	}
+	resp := &bittorrent.AnnounceResponse{}
+	_, err = h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Equal(t, "192.0.2.1", resp.ExternalIP.String())
+	require.Equal(t, "abc", resp.TrackerID)
+
+	// Tracker ids set by hooks replace the one of the client, and the
+	// address the announce was received from is reported back even if the
+	// client provided another one.
+	req.Peer, req.IPProvided = testPeer(1, "198.51.100.1"), true
+	resp = &bittorrent.AnnounceResponse{TrackerID: "def"}
+	_, err = h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Equal(t, "192.0.2.1", resp.ExternalIP.String())
+	require.Equal(t, "def", resp.TrackerID)
+}
@@ -0,0 +1,189 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/pkg/stop"
+)
+
+// Phases in which hooks run.
+const (
+	prePhase      = "pre"
+	finalizePhase = "finalize"
+	postPhase     = "post"
+)
+
+// configuredHook is a Hook created from a HookConfig.
+//
+// Used on its own it applies the match conditions and the timeout of its
+// configuration. Logic unwraps it to also record the duration and errors of
+// the Hook under its name.
+type configuredHook struct {
+	Hook
+	name    string
+	matcher *Matcher
+	timeout time.Duration
+}
+
+func (h *configuredHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if !h.matcher.MatchAnnounce(ctx, req) {
+		return ctx, nil
+	}
+	return callAnnounce(ctx, h.Hook, h.timeout, req, resp)
+}
+
+func (h *configuredHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if !h.matcher.MatchScrape(ctx, req) {
+		return ctx, nil
+	}
+	return callScrape(ctx, h.Hook, h.timeout, req, resp)
+}
+
+// Stop stops the wrapped Hook if it implements stop.Stopper.
+func (h *configuredHook) Stop() stop.Result {
+	if stopper, ok := h.Hook.(stop.Stopper); ok {
+		return stopper.Stop()
+	}
+	return stop.AlreadyStopped
+}
+
+// A stage is a Hook as it is run by Logic.
+type stage struct {
+	hook    Hook
+	name    string
+	matcher *Matcher
+	timeout time.Duration
+
+	// disabled is set to 1 while the Hook is disabled. It is nil for the
+	// Hooks that generate the response and record the swarm interaction,
+	// which can not be disabled.
+	disabled *int32
+}
+
+func newStage(h Hook) stage {
+	switch h := h.(type) {
+	case *configuredHook:
+		return stage{hook: h.Hook, name: h.name, matcher: h.matcher, timeout: h.timeout, disabled: new(int32)}
+	case *responseHook:
+		return stage{hook: h, name: "response"}
+	case *swarmInteractionHook:
+		return stage{hook: h, name: "swarm interaction"}
+	default:
+		return stage{hook: h, name: fmt.Sprintf("%T", h), disabled: new(int32)}
+	}
+}
+
+// skip reports whether the stage is disabled.
+func (s stage) skip() bool {
+	return s.disabled != nil && atomic.LoadInt32(s.disabled) == 1
+}
+
+func newStages(hooks []Hook) []stage {
+	stages := make([]stage, 0, len(hooks))
+	for _, h := range hooks {
+		stages = append(stages, newStage(h))
+	}
+	return stages
+}
+
+// finalizerStages returns stages calling FinalizeAnnounce of the stages whose
+// Hook implements AnnounceFinalizer.
+func finalizerStages(stages []stage) []stage {
+	var finalizers []stage
+	for _, s := range stages {
+		if f, ok := s.hook.(AnnounceFinalizer); ok {
+			s.hook = finalizerHook{f}
+			finalizers = append(finalizers, s)
+		}
+	}
+	return finalizers
+}
+
+// finalizerHook is a Hook that calls FinalizeAnnounce for announces.
+type finalizerHook struct {
+	AnnounceFinalizer
+}
+
+func (h finalizerHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	return h.FinalizeAnnounce(ctx, req, resp)
+}
+
+func (h finalizerHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	return ctx, nil
+}
+
+func (s stage) handleAnnounce(ctx context.Context, chain, phase string, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if s.skip() || !s.matcher.MatchAnnounce(ctx, req) {
+		return ctx, nil
+	}
+
+	start := time.Now()
+	ctx, err := callAnnounce(ctx, s.hook, s.timeout, req, resp)
+	recordHook(chain, s.name, phase, "announce", err, time.Since(start))
+	return ctx, err
+}
+
+func (s stage) handleScrape(ctx context.Context, chain, phase string, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if s.skip() || !s.matcher.MatchScrape(ctx, req) {
+		return ctx, nil
+	}
+
+	start := time.Now()
+	ctx, err := callScrape(ctx, s.hook, s.timeout, req, resp)
+	recordHook(chain, s.name, phase, "scrape", err, time.Since(start))
+	return ctx, err
+}
+
+// callAnnounce runs a Hook with the deadline of its context shortened to
+// timeout, if timeout is positive.
+func callAnnounce(ctx context.Context, h Hook, timeout time.Duration, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if timeout <= 0 {
+		return h.HandleAnnounce(ctx, req, resp)
+	}
+
+	hookCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	returned, err := h.HandleAnnounce(hookCtx, req, resp)
+	return detachTimeout(ctx, hookCtx, returned), err
+}
+
+// callScrape runs a Hook with the deadline of its context shortened to
+// timeout, if timeout is positive.
+func callScrape(ctx context.Context, h Hook, timeout time.Duration, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if timeout <= 0 {
+		return h.HandleScrape(ctx, req, resp)
+	}
+
+	hookCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	returned, err := h.HandleScrape(hookCtx, req, resp)
+	return detachTimeout(ctx, hookCtx, returned), err
+}
+
+// detachTimeout removes the timeout of a single Hook from the context the
+// Hook returned, keeping the values the Hook added to it.
+func detachTimeout(ctx, hookCtx, returned context.Context) context.Context {
+	switch returned {
+	case nil:
+		return nil
+	case hookCtx:
+		return ctx
+	default:
+		return valueContext{Context: ctx, values: returned}
+	}
+}
+
+// valueContext is a context that is cancelled with Context, but looks up
+// values in another context.
+type valueContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c valueContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/storage/memory"
+)
+
+type testKey struct{}
+
+// deadlineHook fails with the error of its context if it has a deadline and
+// adds a value to its context otherwise.
+type deadlineHook struct {
+	nopHook
+	hadDeadline bool
+}
+
+func (h *deadlineHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	_, h.hadDeadline = ctx.Deadline()
+	if h.hadDeadline {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return context.WithValue(ctx, testKey{}, "value"), nil
+}
+
+func TestStageTimeout(t *testing.T) {
+	h := &deadlineHook{}
+	s := stage{hook: h, name: "deadline", timeout: time.Millisecond}
+
+	_, err := s.handleAnnounce(context.Background(), "test", prePhase, announceFor(matchedIH, bittorrent.IPv4), nil)
+	require.True(t, h.hadDeadline)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.Equal(t, 1.0, testutil.ToFloat64(promHookErrorsTotal.WithLabelValues("test", "deadline", prePhase, "announce", "timeout")))
+
+	s.timeout = 0
+	ctx, err := s.handleAnnounce(context.Background(), "test", prePhase, announceFor(matchedIH, bittorrent.IPv4), nil)
+	require.Nil(t, err)
+	require.False(t, h.hadDeadline)
+	require.Equal(t, "value", ctx.Value(testKey{}))
+}
+
+func TestDetachTimeout(t *testing.T) {
+	ctx := context.WithValue(context.Background(), ChainKey, "test")
+	hookCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	returned := context.WithValue(hookCtx, testKey{}, "value")
+	cancel()
+
+	detached := detachTimeout(ctx, hookCtx, returned)
+	require.Nil(t, detached.Err())
+	_, ok := detached.Deadline()
+	require.False(t, ok)
+	require.Equal(t, "value", detached.Value(testKey{}))
+	require.Equal(t, "test", detached.Value(ChainKey))
+
+	require.Equal(t, ctx, detachTimeout(ctx, hookCtx, hookCtx))
+	require.Nil(t, detachTimeout(ctx, hookCtx, nil))
+}
+
+func TestNewStage(t *testing.T) {
+	s := newStage(&configuredHook{Hook: &nopHook{}, name: "nop", timeout: time.Second})
+	require.Equal(t, "nop", s.name)
+	require.Equal(t, time.Second, s.timeout)
+	require.IsType(t, &nopHook{}, s.hook)
+
+	require.Equal(t, "response", newStage(&responseHook{}).name)
+	require.Equal(t, "*middleware.nopHook", newStage(&nopHook{}).name)
+}
+
+// finalizingHook records the swarm statistics it sees in both phases.
+type finalizingHook struct {
+	nopHook
+	seen []uint32
+}
+
+func (h *finalizingHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	h.seen = append(h.seen, resp.Incomplete)
+	return ctx, nil
+}
+
+func (h *finalizingHook) FinalizeAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	h.seen = append(h.seen, resp.Incomplete)
+	return ctx, nil
+}
+
+func TestAnnounceFinalizer(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Empty(t, ps.Stop().Wait()) })
+
+	h := &finalizingHook{}
+	l := NewLogic(ResponseConfig{}, ps, []Hook{&configuredHook{Hook: h, name: "finalizing"}}, nil)
+	t.Cleanup(func() { require.Empty(t, l.Stop().Wait()) })
+
+	req := announceFor(matchedIH, bittorrent.IPv4)
+	req.Left = 1
+	_, _, err = l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, []uint32{0, 1}, h.seen)
+}
+
+func TestSetHookEnabled(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Empty(t, ps.Stop().Wait()) })
+
+	h := &finalizingHook{}
+	l := NewLogic(ResponseConfig{}, ps, []Hook{&configuredHook{Hook: h, name: "finalizing"}}, nil)
+	t.Cleanup(func() { require.Empty(t, l.Stop().Wait()) })
+
+	require.Equal(t, []HookStatus{{Chain: DefaultChainName, Phase: "pre", Index: 0, Name: "finalizing", Enabled: true}}, l.Hooks())
+
+	require.Equal(t, ErrHookDoesNotExist, l.SetHookEnabled("missing", "pre", 0, false))
+	require.Equal(t, ErrHookDoesNotExist, l.SetHookEnabled(DefaultChainName, "post", 0, false))
+	// The response hook can not be disabled.
+	require.Equal(t, ErrHookDoesNotExist, l.SetHookEnabled(DefaultChainName, "pre", 1, false))
+
+	// A disabled hook is skipped in all phases.
+	require.Nil(t, l.SetHookEnabled(DefaultChainName, "pre", 0, false))
+	require.False(t, l.Hooks()[0].Enabled)
+	_, _, err = l.HandleAnnounce(context.Background(), announceFor(matchedIH, bittorrent.IPv4))
+	require.Nil(t, err)
+	require.Empty(t, h.seen)
+
+	require.Nil(t, l.SetHookEnabled(DefaultChainName, "pre", 0, true))
+	_, _, err = l.HandleAnnounce(context.Background(), announceFor(matchedIH, bittorrent.IPv4))
+	require.Nil(t, err)
+	require.Len(t, h.seen, 2)
+}
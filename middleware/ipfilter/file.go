@@ -0,0 +1,87 @@
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/doujincafe/chihaya/pkg/iptrie"
+)
+
+// fileState is used to detect changes to a file.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// statFiles returns the current state of all configured files.
+func (h *hook) statFiles() (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	for _, paths := range [][]string{h.cfg.DenyFiles, h.cfg.AllowFiles} {
+		for _, path := range paths {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			files[path] = fileState{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return files, nil
+}
+
+func filesChanged(old, new map[string]fileState) bool {
+	for path, state := range new {
+		if old[path] != state {
+			return true
+		}
+	}
+	return false
+}
+
+// loadFile adds the entries of the file at path to s.
+//
+// Empty lines and lines starting with '#' are ignored. All other lines
+// contain either a plain entry or a range in the P2P blocklist format, which
+// is a description followed by a colon and the range:
+//
+//	Some Organization:192.0.2.0-192.0.2.255
+func loadFile(s *iptrie.Set, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if err := addLine(s, line); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func addLine(s *iptrie.Set, line string) error {
+	err := s.Add(line)
+	if err == nil {
+		return nil
+	}
+
+	// The description of the P2P format may contain colons itself, but the
+	// IPv4 range does not.
+	if i := strings.LastIndexByte(line, ':'); i >= 0 && strings.IndexByte(line[i:], '-') >= 0 {
+		if s.Add(line[i+1:]) == nil {
+			return nil
+		}
+	}
+
+	return err
+}
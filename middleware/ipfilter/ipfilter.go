@@ -0,0 +1,282 @@
+// Package ipfilter implements a Hook that fails Announces and Scrapes based on
+// lists of denied and allowed IP addresses.
+package ipfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/iptrie"
+	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/pkg/stop"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "ip filter"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var (
+	_ middleware.Driver  = driver{}
+	_ middleware.Checker = driver{}
+)
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// CheckOptions checks options and the entries of all lists without creating
+// a Hook.
+func (d driver) CheckOptions(optionBytes []byte) error {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	if cfg.ReloadInterval < 0 {
+		return ErrInvalidReloadInterval
+	}
+	_, err = (&hook{cfg: cfg}).load()
+	return err
+}
+
+// ErrBannedIP is the error returned when a request is sent from or for a
+// denied IP address.
+var ErrBannedIP = bittorrent.ClientError("banned IP")
+
+// ErrInvalidReloadInterval is returned for a config with a negative
+// ReloadInterval.
+var ErrInvalidReloadInterval = errors.New("invalid reload_interval")
+
+// Config represents all the values required by this middleware to filter
+// requests based on IP addresses.
+//
+// Entries are addresses, networks in CIDR notation or ranges of addresses
+// separated by a hyphen.
+type Config struct {
+	// Deny and Allow contain entries inline.
+	Deny  []string `yaml:"deny"`
+	Allow []string `yaml:"allow"`
+
+	// DenyFiles and AllowFiles are paths of files containing one entry per
+	// line, either plain or in the P2P blocklist format.
+	DenyFiles  []string `yaml:"deny_files"`
+	AllowFiles []string `yaml:"allow_files"`
+
+	// DefaultDeny specifies whether addresses that match neither list are
+	// denied.
+	DefaultDeny bool `yaml:"default_deny"`
+
+	// ReloadInterval is the interval at which the files are checked for
+	// changes. Zero disables reloading.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// Clock is used to schedule reloading.
+	// If it is nil, the global timecache is used.
+	Clock timecache.Clock `yaml:"-"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"name":           Name,
+		"deny":           len(cfg.Deny),
+		"allow":          len(cfg.Allow),
+		"denyFiles":      cfg.DenyFiles,
+		"allowFiles":     cfg.AllowFiles,
+		"defaultDeny":    cfg.DefaultDeny,
+		"reloadInterval": cfg.ReloadInterval,
+	}
+}
+
+// filter is an immutable snapshot of the lists.
+type filter struct {
+	deny  iptrie.Set
+	allow iptrie.Set
+}
+
+func (f *filter) permits(ip net.IP, defaultDeny bool) bool {
+	if f.allow.Contains(ip) {
+		return true
+	}
+	if f.deny.Contains(ip) {
+		return false
+	}
+	return !defaultDeny
+}
+
+type hook struct {
+	cfg Config
+
+	// filter holds the current *filter.
+	filter atomic.Value
+
+	// files holds the state of all files as of the last load.
+	files map[string]fileState
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewHook returns an instance of the IP filter middleware.
+//
+// The returned Hook implements stop.Stopper and must be stopped to stop
+// reloading the files.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.ReloadInterval < 0 {
+		return nil, ErrInvalidReloadInterval
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = timecache.Default()
+	}
+
+	h := &hook{
+		cfg:    cfg,
+		closed: make(chan struct{}),
+	}
+
+	files, err := h.statFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+	h.filter.Store(f)
+	h.files = files
+
+	if cfg.ReloadInterval > 0 && len(files) > 0 {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			for {
+				select {
+				case <-h.closed:
+					return
+				case <-cfg.Clock.After(cfg.ReloadInterval):
+					h.reloadIfChanged()
+				}
+			}
+		}()
+	}
+
+	return h, nil
+}
+
+// load builds a filter from the inline entries and the files.
+func (h *hook) load() (*filter, error) {
+	f := &filter{}
+
+	for _, entry := range h.cfg.Deny {
+		if err := f.deny.Add(entry); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range h.cfg.Allow {
+		if err := f.allow.Add(entry); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range h.cfg.DenyFiles {
+		if err := loadFile(&f.deny, path); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range h.cfg.AllowFiles {
+		if err := loadFile(&f.allow, path); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// reloadIfChanged reloads the filter if any of the files changed.
+// If reloading fails, the previous filter stays in use.
+func (h *hook) reloadIfChanged() {
+	files, err := h.statFiles()
+	if err != nil {
+		log.Error("ipfilter: failed to check files", log.Err(err))
+		return
+	}
+	if !filesChanged(h.files, files) {
+		return
+	}
+
+	f, err := h.load()
+	if err != nil {
+		log.Error("ipfilter: failed to reload files, keeping previous lists", log.Err(err))
+		return
+	}
+
+	h.filter.Store(f)
+	h.files = files
+	log.Info("ipfilter: reloaded files", h.cfg)
+}
+
+func (h *hook) permits(ip net.IP) bool {
+	return h.filter.Load().(*filter).permits(ip, h.cfg.DefaultDeny)
+}
+
+// HandleAnnounce fails the announce if the peer's IP or the IP the announce
+// was received from is denied, so that clients can not get around the filter
+// by providing another IP. A denied alternative peer is removed from the
+// announce.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if !h.permits(req.Peer.IP.IP) {
+		return ctx, ErrBannedIP
+	}
+	if req.RemoteIP != nil && !h.permits(req.RemoteIP) {
+		return ctx, ErrBannedIP
+	}
+
+	if req.AltPeer != nil && !h.permits(req.AltPeer.IP.IP) {
+		req.AltPeer = nil
+	}
+
+	return ctx, nil
+}
+
+// HandleScrape fails the scrape if the IP it was sent from is denied.
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if req.IP != nil && !h.permits(req.IP) {
+		return ctx, ErrBannedIP
+	}
+
+	return ctx, nil
+}
+
+// Stop stops reloading the files.
+func (h *hook) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		close(h.closed)
+		h.wg.Wait()
+		c.Done()
+	}()
+
+	return c.Result()
+}
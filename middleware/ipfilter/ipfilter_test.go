@@ -0,0 +1,164 @@
+package ipfilter
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+)
+
+func announce(ip string) *bittorrent.AnnounceRequest {
+	req := &bittorrent.AnnounceRequest{}
+	req.Peer.IP.IP = net.ParseIP(ip)
+	return req
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		ip       string
+		expected error
+	}{
+		{Config{}, "192.0.2.1", nil},
+		{Config{Deny: []string{"192.0.2.0/24"}}, "192.0.2.1", ErrBannedIP},
+		{Config{Deny: []string{"192.0.2.0/24"}}, "192.0.3.1", nil},
+		{Config{Deny: []string{"192.0.2.0/24"}, Allow: []string{"192.0.2.1"}}, "192.0.2.1", nil},
+		{Config{Deny: []string{"192.0.2.0/24"}, Allow: []string{"192.0.2.1"}}, "192.0.2.2", ErrBannedIP},
+		{Config{Allow: []string{"2001:db8::/32"}, DefaultDeny: true}, "2001:db8::1", nil},
+		{Config{Allow: []string{"2001:db8::/32"}, DefaultDeny: true}, "2001:db9::1", ErrBannedIP},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg)
+		require.Nil(t, err)
+
+		_, err = h.HandleAnnounce(context.Background(), announce(tt.ip), &bittorrent.AnnounceResponse{})
+		require.Equal(t, tt.expected, err, "%s %#v", tt.ip, tt.cfg)
+	}
+}
+
+func TestHandleAnnounceProvidedIP(t *testing.T) {
+	h, err := NewHook(Config{Deny: []string{"192.0.2.0/24"}})
+	require.Nil(t, err)
+
+	var table = []struct {
+		remoteIP, ip string
+		expected     error
+	}{
+		{"198.51.100.1", "198.51.100.2", nil},
+		{"192.0.2.1", "198.51.100.2", ErrBannedIP},
+		{"198.51.100.1", "192.0.2.1", ErrBannedIP},
+	}
+
+	for _, tt := range table {
+		req := announce(tt.ip)
+		req.RemoteIP, req.IPProvided = net.ParseIP(tt.remoteIP), true
+		_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		require.Equal(t, tt.expected, err, "%s %s", tt.remoteIP, tt.ip)
+	}
+}
+
+func TestHandleAnnounceAltPeer(t *testing.T) {
+	h, err := NewHook(Config{Deny: []string{"2001:db8::/32"}})
+	require.Nil(t, err)
+
+	for ip, permitted := range map[string]bool{"2001:db8::1": false, "2001:db9::1": true} {
+		req := announce("192.0.2.1")
+		req.AltPeer = &bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP(ip)}}
+		_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+		require.Equal(t, permitted, req.AltPeer != nil, ip)
+	}
+}
+
+func TestHandleScrape(t *testing.T) {
+	h, err := NewHook(Config{Deny: []string{"192.0.2.0/24"}})
+	require.Nil(t, err)
+
+	_, err = h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{IP: net.ParseIP("192.0.2.1")}, &bittorrent.ScrapeResponse{})
+	require.Equal(t, ErrBannedIP, err)
+
+	_, err = h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{IP: net.ParseIP("192.0.3.1")}, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+}
+
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "deny.txt")
+	require.Nil(t, ioutil.WriteFile(path, []byte(`# A comment.
+
+198.51.100.0/24
+2001:db8::1
+Some Org: Inc.:203.0.113.10-203.0.113.20
+`), 0o644))
+
+	h, err := NewHook(Config{DenyFiles: []string{path}})
+	require.Nil(t, err)
+
+	for ip, expected := range map[string]error{
+		"198.51.100.7": ErrBannedIP,
+		"2001:db8::1":  ErrBannedIP,
+		"2001:db8::2":  nil,
+		"203.0.113.9":  nil,
+		"203.0.113.10": ErrBannedIP,
+		"203.0.113.20": ErrBannedIP,
+		"203.0.113.21": nil,
+	} {
+		_, err = h.HandleAnnounce(context.Background(), announce(ip), &bittorrent.AnnounceResponse{})
+		require.Equal(t, expected, err, ip)
+	}
+
+	require.Nil(t, ioutil.WriteFile(path, []byte("192.0.2.0/24\nnot an address\n"), 0o644))
+	_, err = NewHook(Config{DenyFiles: []string{path}})
+	require.EqualError(t, err, path+`:2: iptrie: invalid address "not an address"`)
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "deny.txt")
+	require.Nil(t, ioutil.WriteFile(path, []byte("192.0.2.0/24\n"), 0o644))
+
+	clock := timecache.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	h, err := NewHook(Config{
+		DenyFiles:      []string{path},
+		ReloadInterval: time.Minute,
+		Clock:          clock,
+	})
+	require.Nil(t, err)
+	defer func() { require.Empty(t, h.(*hook).Stop().Wait()) }()
+
+	check := func(ip string, expected error) {
+		_, err := h.HandleAnnounce(context.Background(), announce(ip), &bittorrent.AnnounceResponse{})
+		require.Equal(t, expected, err, ip)
+	}
+	check("192.0.2.1", ErrBannedIP)
+	check("198.51.100.1", nil)
+
+	// Change the file and make sure its modification time changes, too.
+	require.Nil(t, ioutil.WriteFile(path, []byte("198.51.100.0/24\n"), 0o644))
+	later := time.Now().Add(time.Hour)
+	require.Nil(t, os.Chtimes(path, later, later))
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+	check("192.0.2.1", nil)
+	check("198.51.100.1", ErrBannedIP)
+
+	// An invalid file keeps the previous lists.
+	require.Nil(t, ioutil.WriteFile(path, []byte("garbage\n"), 0o644))
+	later = later.Add(time.Hour)
+	require.Nil(t, os.Chtimes(path, later, later))
+
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+	check("198.51.100.1", ErrBannedIP)
+}
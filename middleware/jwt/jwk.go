@@ -0,0 +1,207 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+)
+
+// maxJWKSetSize is the maximum size of a JWK set document that is read.
+const maxJWKSetSize = 1 << 20
+
+// A jwk is a JSON Web Key as defined in RFC 7517, limited to the parameters
+// of public keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// A key is a parsed public key of a JWK set.
+type key struct {
+	kid    string
+	alg    string
+	public crypto.PublicKey
+}
+
+// A keySet is an immutable set of public keys.
+type keySet struct {
+	keys []key
+}
+
+// parseKeySet parses a JWK set as defined in RFC 7517, section 5.
+//
+// Keys that are not meant for signatures or have an unsupported type are
+// skipped.
+func parseKeySet(r io.Reader) (*keySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode JWK set: %s", err)
+	}
+
+	ks := &keySet{}
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		public, err := k.publicKey()
+		if err == errUnsupportedKey {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid key %q in JWK set: %s", k.Kid, err)
+		}
+
+		ks.keys = append(ks.keys, key{kid: k.Kid, alg: k.Alg, public: public})
+	}
+
+	return ks, nil
+}
+
+var errUnsupportedKey = errors.New("unsupported key")
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 || e.Int64() < 3 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errUnsupportedKey
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errUnsupportedKey
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, errUnsupportedKey
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// candidates returns the keys that may have been used to sign a token with
+// the given key ID and algorithm.
+func (ks *keySet) candidates(kid, alg string) []key {
+	var keys []key
+	for _, k := range ks.keys {
+		if kid != "" && k.kid != kid {
+			continue
+		}
+		if k.alg != "" && k.alg != alg {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// fetchKeySet fetches the JWK set at url.
+//
+// If etag is not empty, it is sent along with the request and notModified is
+// true if the server responded that the set did not change.
+func fetchKeySet(client *http.Client, url, etag string) (ks *keySet, newETag string, notModified bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", false, err
+	}
+	defer func() {
+		// Drain the body so that the connection can be reused.
+		_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxJWKSetSize))
+		resp.Body.Close()
+	}()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && etag != "":
+		return nil, etag, true, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, "", false, fmt.Errorf("unexpected status fetching JWK set: %s", resp.Status)
+	}
+
+	ks, err = parseKeySet(io.LimitReader(resp.Body, maxJWKSetSize))
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	return ks, resp.Header.Get("ETag"), false, nil
+}
@@ -0,0 +1,166 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256" // Register the hash functions used by the algorithms.
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// A token is a parsed, but not yet verified, JSON Web Token in the JWS
+// compact serialization.
+type token struct {
+	header       header
+	claims       claims
+	signingInput string
+	signature    []byte
+}
+
+type header struct {
+	Alg  string   `json:"alg"`
+	Kid  string   `json:"kid"`
+	Crit []string `json:"crit"`
+}
+
+type claims struct {
+	Issuer    string      `json:"iss"`
+	Audience  stringOrSet `json:"aud"`
+	Expiry    *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+	InfoHash  stringOrSet `json:"infohash"`
+}
+
+// stringOrSet is a claim that is either a single string or an array of
+// strings.
+type stringOrSet []string
+
+func (s *stringOrSet) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*s = stringOrSet{single}
+		return nil
+	}
+
+	var set []string
+	if err := json.Unmarshal(b, &set); err != nil {
+		return err
+	}
+	*s = set
+	return nil
+}
+
+func (s stringOrSet) contains(v string, equal func(a, b string) bool) bool {
+	for _, x := range s {
+		if equal(x, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// ecdsaCurveBits maps the ECDSA algorithms to the bit size of their curve.
+var ecdsaCurveBits = map[string]int{
+	"ES256": 256,
+	"ES384": 384,
+	"ES512": 521,
+}
+
+var errMalformedToken = errors.New("malformed token")
+
+// parseToken parses a JWT in the JWS compact serialization.
+func parseToken(s string) (*token, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedToken
+	}
+
+	t := &token{signingInput: parts[0] + "." + parts[1]}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	if err := json.Unmarshal(b, &t.header); err != nil {
+		return nil, errMalformedToken
+	}
+
+	// We do not understand any extensions.
+	if len(t.header.Crit) > 0 {
+		return nil, errors.New("unsupported critical header parameters")
+	}
+
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	if err := json.Unmarshal(b, &t.claims); err != nil {
+		return nil, errMalformedToken
+	}
+
+	t.signature, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+
+	return t, nil
+}
+
+// verifySignature reports whether the signature of the token was created by
+// the private key belonging to public.
+func (t *token) verifySignature(public crypto.PublicKey) bool {
+	var h crypto.Hash
+	switch t.header.Alg {
+	case "RS256", "PS256", "ES256":
+		h = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		h = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		h = crypto.SHA512
+	case "EdDSA":
+		k, ok := public.(ed25519.PublicKey)
+		return ok && ed25519.Verify(k, []byte(t.signingInput), t.signature)
+	default:
+		// In particular, "none" and symmetric algorithms are rejected.
+		return false
+	}
+
+	hasher := h.New()
+	hasher.Write([]byte(t.signingInput))
+	digest := hasher.Sum(nil)
+
+	switch t.header.Alg[0] {
+	case 'R':
+		k, ok := public.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(k, h, digest, t.signature) == nil
+	case 'P':
+		k, ok := public.(*rsa.PublicKey)
+		opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+		return ok && rsa.VerifyPSS(k, h, digest, t.signature, opts) == nil
+	case 'E':
+		k, ok := public.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+
+		// The curve must match the algorithm, e.g. P-256 for ES256.
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if k.Curve.Params().BitSize != ecdsaCurveBits[t.header.Alg] {
+			return false
+		}
+		if len(t.signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+
+	return false
+}
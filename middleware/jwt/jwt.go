@@ -0,0 +1,283 @@
+// Package jwt implements a Hook that fails an Announce if the client's request
+// is missing a valid JSON Web Token.
+//
+// JWTs are validated against the standard claims in RFC7519 along with an
+// extra "infohash" claim that verifies the client has access to the Swarm.
+// RS256, RS384, RS512, PS256, PS384, PS512, ES256, ES384, ES512 and EdDSA
+// signatures are supported; the public keys are fetched from a JSON Web Key
+// Set that is refreshed periodically.
+package jwt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/pkg/stop"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "jwt"
+
+// Default config constants.
+const (
+	defaultJWKUpdateInterval = 5 * time.Minute
+	defaultJWKFetchTimeout   = 10 * time.Second
+)
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var (
+	_ middleware.Driver  = driver{}
+	_ middleware.Checker = driver{}
+)
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// CheckOptions checks options without creating a Hook or fetching the JWK
+// set.
+func (d driver) CheckOptions(optionBytes []byte) error {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	if cfg.JWKSetURL == "" {
+		return ErrMissingJWKSetURL
+	}
+	cfg.Validate()
+	return nil
+}
+
+var (
+	// ErrMissingJWT is returned when a JWT is missing from a request.
+	ErrMissingJWT = bittorrent.ClientError("unapproved request: missing jwt")
+
+	// ErrInvalidJWT is returned when a JWT fails to verify.
+	ErrInvalidJWT = bittorrent.ClientError("unapproved request: invalid jwt")
+)
+
+// ErrMissingJWKSetURL is returned for a config without a JWKSetURL.
+var ErrMissingJWKSetURL = errors.New("missing jwk_set_url")
+
+// Config represents all the values required by this middleware to fetch JWKs
+// and verify JWTs.
+type Config struct {
+	Issuer            string        `yaml:"issuer"`
+	Audience          string        `yaml:"audience"`
+	JWKSetURL         string        `yaml:"jwk_set_url"`
+	JWKUpdateInterval time.Duration `yaml:"jwk_set_update_interval"`
+
+	// Clock is used to validate the time based claims and to schedule
+	// updates of the JWK set.
+	// If it is nil, the global timecache is used.
+	Clock timecache.Clock `yaml:"-"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"issuer":            cfg.Issuer,
+		"audience":          cfg.Audience,
+		"JWKSetURL":         cfg.JWKSetURL,
+		"JWKUpdateInterval": cfg.JWKUpdateInterval,
+	}
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.JWKUpdateInterval <= 0 {
+		validcfg.JWKUpdateInterval = defaultJWKUpdateInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".JWKUpdateInterval",
+			"provided": cfg.JWKUpdateInterval,
+			"default":  validcfg.JWKUpdateInterval,
+		})
+	}
+
+	if cfg.Clock == nil {
+		validcfg.Clock = timecache.Default()
+	}
+
+	return validcfg
+}
+
+type hook struct {
+	cfg    Config
+	client *http.Client
+
+	// keys holds the current *keySet.
+	keys atomic.Value
+	etag string
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewHook returns an instance of the JWT middleware.
+//
+// The JWK set is fetched once before NewHook returns, failing to do so is an
+// error. Afterwards it is refreshed every JWKUpdateInterval; if refreshing
+// fails, the previously fetched keys stay in use.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.JWKSetURL == "" {
+		return nil, ErrMissingJWKSetURL
+	}
+	cfg = cfg.Validate()
+
+	log.Debug("creating new JWT middleware", cfg)
+	h := &hook{
+		cfg:    cfg,
+		client: &http.Client{Timeout: defaultJWKFetchTimeout},
+		closed: make(chan struct{}),
+	}
+
+	if err := h.updateKeys(); err != nil {
+		return nil, fmt.Errorf("failed to fetch initial JWK set: %s", err)
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		for {
+			select {
+			case <-h.closed:
+				return
+			case <-cfg.Clock.After(cfg.JWKUpdateInterval):
+				if err := h.updateKeys(); err != nil {
+					log.Error("jwt: failed to update JWK set, keeping previous keys", log.Err(err))
+				}
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// updateKeys fetches the JWK set and replaces the current keys.
+func (h *hook) updateKeys() error {
+	ks, etag, notModified, err := fetchKeySet(h.client, h.cfg.JWKSetURL, h.etag)
+	if err != nil {
+		return err
+	}
+	if notModified {
+		log.Debug("jwt: JWK set not modified")
+		return nil
+	}
+
+	h.keys.Store(ks)
+	h.etag = etag
+	log.Debug("jwt: updated JWK set", log.Fields{"keys": len(ks.keys)})
+	return nil
+}
+
+func (h *hook) Stop() stop.Result {
+	log.Debug("attempting to shutdown JWT middleware")
+	c := make(stop.Channel)
+	go func() {
+		close(h.closed)
+		h.wg.Wait()
+		c.Done()
+	}()
+	return c.Result()
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if req.Params == nil {
+		return ctx, ErrMissingJWT
+	}
+
+	jwtParam, ok := req.Params.String("jwt")
+	if !ok {
+		return ctx, ErrMissingJWT
+	}
+
+	if err := h.validateJWT(req.InfoHash, jwtParam); err != nil {
+		log.Debug("jwt: rejected token", log.Fields{"infoHash": req.InfoHash}, log.Err(err))
+		return ctx, ErrInvalidJWT
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't require any protection.
+	return ctx, nil
+}
+
+// validateJWT verifies the signature and the claims of a JWT.
+func (h *hook) validateJWT(ih bittorrent.InfoHash, jwtBytes string) error {
+	t, err := parseToken(jwtBytes)
+	if err != nil {
+		return err
+	}
+
+	ks := h.keys.Load().(*keySet)
+	var verified bool
+	for _, k := range ks.candidates(t.header.Kid, t.header.Alg) {
+		if t.verifySignature(k.public) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.New("failed to verify signature")
+	}
+
+	claims := t.claims
+	now := float64(h.cfg.Clock.NowUnix())
+
+	if claims.Expiry == nil {
+		return errors.New("missing exp claim")
+	}
+	if now >= math.Floor(*claims.Expiry) {
+		return errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now < math.Floor(*claims.NotBefore) {
+		return errors.New("token not yet valid")
+	}
+
+	if claims.Issuer != h.cfg.Issuer {
+		return fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+
+	if !claims.Audience.contains(h.cfg.Audience, func(a, b string) bool { return a == b }) {
+		return fmt.Errorf("unexpected audience %q", claims.Audience)
+	}
+
+	if !claims.InfoHash.contains(ih.String(), strings.EqualFold) {
+		return errors.New("infohash claim does not match request")
+	}
+
+	return nil
+}
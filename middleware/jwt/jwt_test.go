@@ -0,0 +1,296 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+)
+
+var (
+	epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ih    = bittorrent.InfoHashFromString("01234567890123456789")
+)
+
+// jwkServer serves a JWK set and counts the requests it receives.
+type jwkServer struct {
+	*httptest.Server
+
+	m        sync.Mutex
+	keys     []jwk
+	fail     bool
+	requests int
+	notMod   int
+}
+
+func newJWKServer(t *testing.T, keys ...jwk) *jwkServer {
+	s := &jwkServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.m.Lock()
+		defer s.m.Unlock()
+		s.requests++
+
+		if s.fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		body, err := json.Marshal(map[string][]jwk{"keys": s.keys})
+		require.Nil(t, err)
+		etag := `"` + base64.RawURLEncoding.EncodeToString(sha256Sum(body)) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			s.notMod++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwkServer) set(fail bool, keys ...jwk) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.fail = fail
+	if keys != nil {
+		s.keys = keys
+	}
+}
+
+func (s *jwkServer) counts() (requests, notModified int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.requests, s.notMod
+}
+
+func sha256Sum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func rsaJWK(kid string, k *rsa.PrivateKey) jwk {
+	return jwk{
+		Kty: "RSA",
+		Kid: kid,
+		N:   b64(k.N.Bytes()),
+		E:   b64(big.NewInt(int64(k.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, k *ecdsa.PrivateKey) jwk {
+	return jwk{
+		Kty: "EC",
+		Kid: kid,
+		Crv: "P-256",
+		X:   b64(k.X.Bytes()),
+		Y:   b64(k.Y.Bytes()),
+	}
+}
+
+func ed25519JWK(kid string, k ed25519.PrivateKey) jwk {
+	return jwk{
+		Kty: "OKP",
+		Kid: kid,
+		Crv: "Ed25519",
+		X:   b64(k.Public().(ed25519.PublicKey)),
+	}
+}
+
+// sign creates a JWT with the given header and claims.
+func sign(t *testing.T, k crypto.Signer, hdr map[string]interface{}, claims map[string]interface{}) string {
+	h, err := json.Marshal(hdr)
+	require.Nil(t, err)
+	c, err := json.Marshal(claims)
+	require.Nil(t, err)
+	input := b64(h) + "." + b64(c)
+
+	var sig []byte
+	switch k := k.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256Sum([]byte(input))
+		if hdr["alg"] == "PS256" {
+			sig, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, sha256Sum([]byte(input)))
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(input))
+	}
+	require.Nil(t, err)
+
+	return input + "." + b64(sig)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":      "https://issuer.example",
+		"aud":      []string{"other", "https://tracker.example"},
+		"exp":      epoch.Add(time.Hour).Unix(),
+		"nbf":      epoch.Add(-time.Hour).Unix(),
+		"infohash": ih.String(),
+	}
+}
+
+func newTestHook(t *testing.T, url string) (*hook, *timecache.FakeClock) {
+	clock := timecache.NewFakeClock(epoch)
+	h, err := NewHook(Config{
+		Issuer:            "https://issuer.example",
+		Audience:          "https://tracker.example",
+		JWKSetURL:         url,
+		JWKUpdateInterval: time.Minute,
+		Clock:             clock,
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Empty(t, h.(*hook).Stop().Wait()) })
+	return h.(*hook), clock
+}
+
+func announce(jwt string) *bittorrent.AnnounceRequest {
+	params, err := bittorrent.ParseURLData("/announce?jwt=" + jwt)
+	if err != nil {
+		panic(err)
+	}
+	return &bittorrent.AnnounceRequest{InfoHash: ih, Params: params}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	srv := newJWKServer(t, rsaJWK("rsa", rsaKey), ecJWK("ec", ecKey), ed25519JWK("ed", edKey))
+	h, _ := newTestHook(t, srv.URL)
+
+	with := func(key string, value interface{}) map[string]interface{} {
+		c := validClaims()
+		if value == nil {
+			delete(c, key)
+		} else {
+			c[key] = value
+		}
+		return c
+	}
+
+	var table = []struct {
+		name     string
+		jwt      string
+		expected error
+	}{
+		{"RS256", sign(t, rsaKey, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, validClaims()), nil},
+		{"PS256", sign(t, rsaKey, map[string]interface{}{"alg": "PS256", "kid": "rsa"}, validClaims()), nil},
+		{"ES256", sign(t, ecKey, map[string]interface{}{"alg": "ES256", "kid": "ec"}, validClaims()), nil},
+		{"EdDSA", sign(t, edKey, map[string]interface{}{"alg": "EdDSA", "kid": "ed"}, validClaims()), nil},
+		{"no kid", sign(t, ecKey, map[string]interface{}{"alg": "ES256"}, validClaims()), nil},
+		{"infohash set", sign(t, ecKey, map[string]interface{}{"alg": "ES256"}, with("infohash", []string{"ff", ih.String()})), nil},
+		{"wrong kid", sign(t, ecKey, map[string]interface{}{"alg": "ES256", "kid": "rsa"}, validClaims()), ErrInvalidJWT},
+		{"unknown key", sign(t, otherKey, map[string]interface{}{"alg": "ES256"}, validClaims()), ErrInvalidJWT},
+		{"alg none", b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{}`)) + ".", ErrInvalidJWT},
+		{"malformed", "abc", ErrInvalidJWT},
+		{"expired", sign(t, ecKey, map[string]interface{}{"alg": "ES256"}, with("exp", epoch.Unix())), ErrInvalidJWT},
+		{"no exp", sign(t, ecKey, map[string]interface{}{"alg": "ES256"}, with("exp", nil)), ErrInvalidJWT},
+		{"not before", sign(t, ecKey, map[string]interface{}{"alg": "ES256"}, with("nbf", epoch.Add(time.Second).Unix())), ErrInvalidJWT},
+		{"issuer", sign(t, ecKey, map[string]interface{}{"alg": "ES256"}, with("iss", "https://evil.example")), ErrInvalidJWT},
+		{"audience", sign(t, ecKey, map[string]interface{}{"alg": "ES256"}, with("aud", "other")), ErrInvalidJWT},
+		{"infohash", sign(t, ecKey, map[string]interface{}{"alg": "ES256"}, with("infohash", "ff")), ErrInvalidJWT},
+		{"no infohash", sign(t, ecKey, map[string]interface{}{"alg": "ES256"}, with("infohash", nil)), ErrInvalidJWT},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := h.HandleAnnounce(context.Background(), announce(tt.jwt), &bittorrent.AnnounceResponse{})
+			require.Equal(t, tt.expected, err)
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih}, &bittorrent.AnnounceResponse{})
+		require.Equal(t, ErrMissingJWT, err)
+	})
+}
+
+func TestKeyUpdates(t *testing.T) {
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	srv := newJWKServer(t, ecJWK("old", oldKey))
+	h, clock := newTestHook(t, srv.URL)
+
+	check := func(key *ecdsa.PrivateKey, expected error) {
+		jwt := sign(t, key, map[string]interface{}{"alg": "ES256"}, validClaims())
+		_, err := h.HandleAnnounce(context.Background(), announce(jwt), &bittorrent.AnnounceResponse{})
+		require.Equal(t, expected, err)
+	}
+	advance := func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Minute)
+		clock.BlockUntil(1)
+	}
+
+	check(oldKey, nil)
+	check(newKey, ErrInvalidJWT)
+
+	// An unchanged set is not downloaded again.
+	advance()
+	requests, notModified := srv.counts()
+	require.Equal(t, 2, requests)
+	require.Equal(t, 1, notModified)
+
+	// The set is rotated.
+	srv.set(false, ecJWK("new", newKey))
+	advance()
+	check(oldKey, ErrInvalidJWT)
+	check(newKey, nil)
+
+	// Failures keep the previous set.
+	srv.set(true)
+	advance()
+	requests, _ = srv.counts()
+	require.Equal(t, 4, requests)
+	check(newKey, nil)
+}
+
+func TestNewHookFetchFailure(t *testing.T) {
+	srv := newJWKServer(t)
+	srv.set(true)
+
+	_, err := NewHook(Config{JWKSetURL: srv.URL})
+	require.NotNil(t, err)
+
+	_, err = NewHook(Config{})
+	require.Equal(t, ErrMissingJWKSetURL, err)
+}
@@ -2,6 +2,8 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"sync/atomic"
 	"time"
 
 	"github.com/doujincafe/chihaya/bittorrent"
@@ -20,20 +22,152 @@ import (
 type ResponseConfig struct {
 	AnnounceInterval    time.Duration `yaml:"announce_interval"`
 	MinAnnounceInterval time.Duration `yaml:"min_announce_interval"`
+
+	// PostHookWorkers is the number of goroutines running post-hooks.
+	PostHookWorkers int `yaml:"posthook_workers"`
+
+	// PostHookQueueSize is the number of requests waiting for a worker
+	// before frontends are slowed down. Requests that still find the queue
+	// full when their deadline expires skip the post-hooks, except for the
+	// one storing the peer of an announce.
+	PostHookQueueSize int `yaml:"posthook_queue_size"`
+
+	// PostHookTimeout is the deadline for running the post-hooks of a
+	// request, starting when a worker picks it up.
+	PostHookTimeout time.Duration `yaml:"posthook_timeout"`
+
+	// IPv4PeerWeight and IPv6PeerWeight are the shares of IPv4 and IPv6
+	// peers in the peers returned to clients announcing both an IPv4 and an
+	// IPv6 address. If one address family has too few peers, the other one
+	// makes up for them.
+	IPv4PeerWeight int `yaml:"ipv4_peer_weight"`
+	IPv6PeerWeight int `yaml:"ipv6_peer_weight"`
+}
+
+// Default config constants.
+const (
+	defaultPostHookWorkers   = 64
+	defaultPostHookQueueSize = 1024
+	defaultPostHookTimeout   = 5 * time.Second
+	defaultPeerWeight        = 1
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg ResponseConfig) Validate() ResponseConfig {
+	validcfg := cfg
+
+	if cfg.PostHookWorkers <= 0 {
+		validcfg.PostHookWorkers = defaultPostHookWorkers
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "PostHookWorkers",
+			"provided": cfg.PostHookWorkers,
+			"default":  validcfg.PostHookWorkers,
+		})
+	}
+
+	if cfg.PostHookQueueSize <= 0 {
+		validcfg.PostHookQueueSize = defaultPostHookQueueSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "PostHookQueueSize",
+			"provided": cfg.PostHookQueueSize,
+			"default":  validcfg.PostHookQueueSize,
+		})
+	}
+
+	if cfg.PostHookTimeout <= 0 {
+		validcfg.PostHookTimeout = defaultPostHookTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "PostHookTimeout",
+			"provided": cfg.PostHookTimeout,
+			"default":  validcfg.PostHookTimeout,
+		})
+	}
+
+	if cfg.IPv4PeerWeight < 0 || cfg.IPv6PeerWeight < 0 || cfg.IPv4PeerWeight+cfg.IPv6PeerWeight == 0 {
+		validcfg.IPv4PeerWeight = defaultPeerWeight
+		validcfg.IPv6PeerWeight = defaultPeerWeight
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "IPv4PeerWeight",
+			"provided": cfg.IPv4PeerWeight,
+			"default":  validcfg.IPv4PeerWeight,
+		})
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "IPv6PeerWeight",
+			"provided": cfg.IPv6PeerWeight,
+			"default":  validcfg.IPv6PeerWeight,
+		})
+	}
+
+	return validcfg
 }
 
-var _ frontend.TrackerLogic = &Logic{}
+var (
+	_ frontend.TrackerLogic = &Logic{}
+	_ frontend.FullScraper  = &Logic{}
+)
 
 // NewLogic creates a new instance of a TrackerLogic that executes the provided
 // middleware hooks.
-func NewLogic(cfg ResponseConfig, peerStore storage.PeerStore, preHooks, postHooks []Hook) *Logic {
-	return &Logic{
+//
+// Requests matching one of the chains are handled by the first matching
+// chain, all other requests by the default chain made of preHooks and
+// postHooks.
+func NewLogic(provided ResponseConfig, peerStore storage.PeerStore, preHooks, postHooks []Hook, chains ...Chain) *Logic {
+	cfg := provided.Validate()
+	l := &Logic{
 		announceInterval:    cfg.AnnounceInterval,
 		minAnnounceInterval: cfg.MinAnnounceInterval,
+		postHookTimeout:     cfg.PostHookTimeout,
+		ipv4PeerWeight:      cfg.IPv4PeerWeight,
+		ipv6PeerWeight:      cfg.IPv6PeerWeight,
 		peerStore:           peerStore,
-		preHooks:            append(preHooks, &responseHook{store: peerStore}),
-		postHooks:           append(postHooks, &swarmInteractionHook{store: peerStore}),
+		chainsByName:        make(map[string]*chain, len(chains)+1),
+		pool:                newPostHookPool(cfg.PostHookWorkers, cfg.PostHookQueueSize),
+	}
+
+	for _, c := range chains {
+		l.addChain(c.Name, c.Matcher, c.PreHooks, c.PostHooks)
 	}
+	l.addChain(DefaultChainName, nil, preHooks, postHooks)
+
+	return l
+}
+
+// chain is a Chain with the hooks that generate the response and record the
+// swarm interaction appended.
+type chain struct {
+	name      string
+	matcher   *Matcher
+	preHooks  []stage
+	postHooks []stage
+
+	// finalizers are the PreHooks implementing AnnounceFinalizer.
+	finalizers []stage
+
+	// swarmInteraction is the last post-hook, which stores the peer of an
+	// announce.
+	swarmInteraction stage
+}
+
+func (l *Logic) addChain(name string, matcher *Matcher, preHooks, postHooks []Hook) {
+	respHook := &responseHook{
+		store:          l.peerStore,
+		ipv4PeerWeight: l.ipv4PeerWeight,
+		ipv6PeerWeight: l.ipv6PeerWeight,
+	}
+	c := &chain{
+		name:      name,
+		matcher:   matcher,
+		preHooks:  newStages(append(preHooks[:len(preHooks):len(preHooks)], respHook)),
+		postHooks: newStages(append(postHooks[:len(postHooks):len(postHooks)], &swarmInteractionHook{store: l.peerStore})),
+	}
+	c.finalizers = finalizerStages(c.preHooks)
+	c.swarmInteraction = c.postHooks[len(c.postHooks)-1]
+	l.chains = append(l.chains, c)
+	l.chainsByName[name] = c
 }
 
 // Logic is an implementation of the TrackerLogic that functions by
@@ -41,85 +175,306 @@ func NewLogic(cfg ResponseConfig, peerStore storage.PeerStore, preHooks, postHoo
 type Logic struct {
 	announceInterval    time.Duration
 	minAnnounceInterval time.Duration
+	postHookTimeout     time.Duration
+	ipv4PeerWeight      int
+	ipv6PeerWeight      int
 	peerStore           storage.PeerStore
-	preHooks            []Hook
-	postHooks           []Hook
+	pool                *postHookPool
+
+	// chains are tried in order, the last one is the default chain.
+	chains       []*chain
+	chainsByName map[string]*chain
+}
+
+// announceChain returns the chain that handles an announce.
+// Post-hooks run on the chain recorded in the context by HandleAnnounce.
+func (l *Logic) announceChain(ctx context.Context, req *bittorrent.AnnounceRequest) *chain {
+	if c, ok := l.chainsByName[chainName(ctx)]; ok {
+		return c
+	}
+	for _, c := range l.chains {
+		if c.matcher.MatchAnnounce(ctx, req) {
+			return c
+		}
+	}
+	return l.chains[len(l.chains)-1]
+}
+
+// scrapeChain returns the chain that handles a scrape.
+func (l *Logic) scrapeChain(ctx context.Context, req *bittorrent.ScrapeRequest) *chain {
+	if c, ok := l.chainsByName[chainName(ctx)]; ok {
+		return c
+	}
+	for _, c := range l.chains {
+		if c.matcher.MatchScrape(ctx, req) {
+			return c
+		}
+	}
+	return l.chains[len(l.chains)-1]
+}
+
+func chainName(ctx context.Context) string {
+	name, _ := ctx.Value(ChainKey).(string)
+	return name
 }
 
 // HandleAnnounce generates a response for an Announce.
 func (l *Logic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (_ context.Context, resp *bittorrent.AnnounceResponse, err error) {
+	c := l.announceChain(ctx, req)
+	ctx = context.WithValue(ctx, ChainKey, c.name)
+	recordChainRequest(c.name, "announce")
+
 	resp = &bittorrent.AnnounceResponse{
 		Interval:    l.announceInterval,
 		MinInterval: l.minAnnounceInterval,
 		Compact:     req.Compact,
 	}
-	for _, h := range l.preHooks {
-		if ctx, err = h.HandleAnnounce(ctx, req, resp); err != nil {
+	for _, s := range c.preHooks {
+		if ctx, err = s.handleAnnounce(ctx, c.name, prePhase, req, resp); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, s := range c.finalizers {
+		if ctx, err = s.handleAnnounce(ctx, c.name, finalizePhase, req, resp); err != nil {
 			return nil, nil, err
 		}
 	}
 
-	log.Debug("generated announce response", resp)
+	log.Debug("generated announce response", resp, log.Fields{"chain": c.name})
 	return ctx, resp, nil
 }
 
 // AfterAnnounce does something with the results of an Announce after it has
 // been completed.
+//
+// The post-hooks run on a worker once one is available. AfterAnnounce waits
+// for space in the queue of the workers until ctx is done. If the post-hooks
+// are dropped then, or because the Logic was stopped, the peer is still
+// stored, but the other post-hooks do not run.
 func (l *Logic) AfterAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	l.pool.submit(ctx, "announce", func() {
+		ctx, cancel := l.postHookContext(ctx)
+		defer cancel()
+		l.afterAnnounce(ctx, req, resp)
+	}, func() {
+		ctx, cancel := l.postHookContext(ctx)
+		defer cancel()
+		l.storeAnnounce(ctx, req, resp)
+	})
+}
+
+func (l *Logic) afterAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	c := l.announceChain(ctx, req)
+
 	var err error
-	for _, h := range l.postHooks {
-		if ctx, err = h.HandleAnnounce(ctx, req, resp); err != nil {
-			log.Error("post-announce hooks failed", log.Err(err))
+	for _, s := range c.postHooks {
+		if ctx, err = s.handleAnnounce(ctx, c.name, postPhase, req, resp); err != nil {
+			log.Error("post-announce hooks failed", log.Fields{"chain": c.name, "hook": s.name}, log.Err(err))
 			return
 		}
 	}
 }
 
+// storeAnnounce runs only the post-hook storing the peer of an announce whose
+// other post-hooks were dropped.
+func (l *Logic) storeAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	c := l.announceChain(ctx, req)
+	if _, err := c.swarmInteraction.handleAnnounce(ctx, c.name, postPhase, req, resp); err != nil {
+		log.Error("storing announce failed", log.Fields{"chain": c.name}, log.Err(err))
+	}
+}
+
 // HandleScrape generates a response for a Scrape.
 func (l *Logic) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (_ context.Context, resp *bittorrent.ScrapeResponse, err error) {
+	c := l.scrapeChain(ctx, req)
+	ctx = context.WithValue(ctx, ChainKey, c.name)
+	recordChainRequest(c.name, "scrape")
+
 	resp = &bittorrent.ScrapeResponse{
 		Files: make([]bittorrent.Scrape, 0, len(req.InfoHashes)),
 	}
-	for _, h := range l.preHooks {
-		if ctx, err = h.HandleScrape(ctx, req, resp); err != nil {
+	for _, s := range c.preHooks {
+		if ctx, err = s.handleScrape(ctx, c.name, prePhase, req, resp); err != nil {
 			return nil, nil, err
 		}
 	}
 
-	log.Debug("generated scrape response", resp)
+	log.Debug("generated scrape response", resp, log.Fields{"chain": c.name})
 	return ctx, resp, nil
 }
 
 // AfterScrape does something with the results of a Scrape after it has been
 // completed.
+//
+// The post-hooks run like those of AfterAnnounce. Scrapes store nothing, so
+// all of their post-hooks may be dropped.
 func (l *Logic) AfterScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) {
+	l.pool.submit(ctx, "scrape", func() {
+		ctx, cancel := l.postHookContext(ctx)
+		defer cancel()
+		l.afterScrape(ctx, req, resp)
+	}, nil)
+}
+
+func (l *Logic) afterScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) {
+	c := l.scrapeChain(ctx, req)
+
 	var err error
-	for _, h := range l.postHooks {
-		if ctx, err = h.HandleScrape(ctx, req, resp); err != nil {
-			log.Error("post-scrape hooks failed", log.Err(err))
+	for _, s := range c.postHooks {
+		if ctx, err = s.handleScrape(ctx, c.name, postPhase, req, resp); err != nil {
+			log.Error("post-scrape hooks failed", log.Fields{"chain": c.name, "hook": s.name}, log.Err(err))
 			return
 		}
 	}
 }
 
+// HandleFullScrape runs the pre-hooks of the chain handling req, a scrape
+// without infohashes, and returns the function scraping all swarms of its
+// address family from the PeerStore.
+//
+// The response is not generated by the chain and no post-hooks run.
+// It returns frontend.ErrFullScrapeUnsupported if the PeerStore does not
+// implement storage.FullScraper.
+func (l *Logic) HandleFullScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (frontend.ScrapeSwarmsFunc, error) {
+	fs, ok := l.peerStore.(storage.FullScraper)
+	if !ok {
+		return nil, frontend.ErrFullScrapeUnsupported
+	}
+
+	c := l.scrapeChain(ctx, req)
+	ctx = context.WithValue(ctx, ChainKey, c.name)
+	recordChainRequest(c.name, "full_scrape")
+
+	resp := &bittorrent.ScrapeResponse{}
+	var err error
+	for _, s := range c.preHooks {
+		if _, ok := s.hook.(*responseHook); ok {
+			continue
+		}
+		if ctx, err = s.handleScrape(ctx, c.name, prePhase, req, resp); err != nil {
+			return nil, err
+		}
+	}
+
+	af := req.AddressFamily
+	return func(ctx context.Context, fn func(bittorrent.Scrape) error) error {
+		return fs.ScrapeSwarms(ctx, af, fn)
+	}, nil
+}
+
+// postHookContext returns a context for running post-hooks that keeps the
+// values of the request's context, but not its deadline, as the request is
+// done by the time the post-hooks run.
+func (l *Logic) postHookContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, cancel := context.WithTimeout(context.Background(), l.postHookTimeout)
+	return valueContext{Context: deadline, values: ctx}, cancel
+}
+
 // Stop stops the Logic.
 //
-// This stops any hooks that implement stop.Stopper.
+// This waits for queued post-hooks to run and then stops any hooks that
+// implement stop.Stopper.
 func (l *Logic) Stop() stop.Result {
 	stopGroup := stop.NewGroup()
-	for _, hook := range l.preHooks {
-		stoppable, ok := hook.(stop.Stopper)
-		if ok {
-			stopGroup.Add(stoppable)
+	for _, c := range l.chains {
+		for _, s := range c.preHooks {
+			stoppable, ok := s.hook.(stop.Stopper)
+			if ok {
+				stopGroup.Add(stoppable)
+			}
+		}
+
+		for _, s := range c.postHooks {
+			stoppable, ok := s.hook.(stop.Stopper)
+			if ok {
+				stopGroup.Add(stoppable)
+			}
 		}
 	}
 
-	for _, hook := range l.postHooks {
-		stoppable, ok := hook.(stop.Stopper)
-		if ok {
-			stopGroup.Add(stoppable)
+	c := make(stop.Channel)
+	go func() {
+		l.pool.stop()
+		c.Done(stopGroup.Stop().Wait()...)
+	}()
+	return c.Result()
+}
+
+// ErrHookDoesNotExist is the error returned by SetHookEnabled for a hook that
+// does not exist or can not be disabled.
+var ErrHookDoesNotExist = errors.New("hook does not exist")
+
+// HookStatus describes a configured hook of a chain.
+type HookStatus struct {
+	Chain string `json:"chain"`
+
+	// Phase is "pre" for PreHooks and "post" for PostHooks.
+	Phase string `json:"phase"`
+
+	// Index is the position of the hook in its chain and phase.
+	Index int `json:"index"`
+
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// Hooks returns the status of the configured hooks of all chains.
+//
+// The hooks that generate the response and record the swarm interaction are
+// not included.
+func (l *Logic) Hooks() []HookStatus {
+	var hooks []HookStatus
+	for _, c := range l.chains {
+		for _, phase := range []string{prePhase, postPhase} {
+			for i, s := range c.stages(phase) {
+				if s.disabled == nil {
+					continue
+				}
+				hooks = append(hooks, HookStatus{
+					Chain:   c.name,
+					Phase:   phase,
+					Index:   i,
+					Name:    s.name,
+					Enabled: !s.skip(),
+				})
+			}
 		}
 	}
+	return hooks
+}
+
+// SetHookEnabled enables or disables the hook at the given index of a chain
+// and phase, as listed by Hooks.
+//
+// Disabled hooks are skipped by all requests until they are enabled again or
+// the Logic is replaced.
+func (l *Logic) SetHookEnabled(chain, phase string, index int, enabled bool) error {
+	c, ok := l.chainsByName[chain]
+	if !ok {
+		return ErrHookDoesNotExist
+	}
 
-	return stopGroup.Stop()
+	stages := c.stages(phase)
+	if index < 0 || index >= len(stages) || stages[index].disabled == nil {
+		return ErrHookDoesNotExist
+	}
+
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+	atomic.StoreInt32(stages[index].disabled, disabled)
+	return nil
+}
+
+// stages returns the stages of a phase of the chain.
+func (c *chain) stages(phase string) []stage {
+	switch phase {
+	case prePhase:
+		return c.preHooks
+	case postPhase:
+		return c.postHooks
+	default:
+		return nil
+	}
 }
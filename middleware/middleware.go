@@ -4,7 +4,10 @@ package middleware
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -16,6 +19,10 @@ var (
 	// ErrDriverDoesNotExist is the error returned by NewMiddleware when a
 	// middleware driver with that name does not exist.
 	ErrDriverDoesNotExist = errors.New("middleware driver with that name does not exist")
+
+	// ErrCheckUnsupported is the error returned by Check when a middleware
+	// driver does not implement Checker.
+	ErrCheckUnsupported = errors.New("middleware driver does not support checking options")
 )
 
 // Driver is the interface used to initialize a new type of middleware.
@@ -26,6 +33,17 @@ type Driver interface {
 	NewHook(options []byte) (Hook, error)
 }
 
+// Checker can be implemented by a Driver to check options without creating a
+// Hook.
+//
+// CheckOptions parses the options strictly, so that unknown keys are errors,
+// and validates them like NewHook does, but without starting goroutines or
+// accessing the network. Values replaced by defaults are logged like NewHook
+// logs them.
+type Checker interface {
+	CheckOptions(options []byte) error
+}
+
 // RegisterDriver makes a Driver available by the provided name.
 //
 // If called twice with the same name, the name is blank, or if the provided
@@ -65,13 +83,44 @@ func New(name string, optionBytes []byte) (Hook, error) {
 	return d.NewHook(optionBytes)
 }
 
+// Check checks options for the registered Driver with the given name.
+//
+// If a driver does not exist, returns ErrDriverDoesNotExist. If it does not
+// implement Checker, returns ErrCheckUnsupported.
+func Check(name string, optionBytes []byte) error {
+	driversM.RLock()
+	defer driversM.RUnlock()
+
+	d, ok := drivers[name]
+	if !ok {
+		return ErrDriverDoesNotExist
+	}
+
+	c, ok := d.(Checker)
+	if !ok {
+		return ErrCheckUnsupported
+	}
+	return c.CheckOptions(optionBytes)
+}
+
 // HookConfig is the generic configuration format used for all registered Hooks.
 type HookConfig struct {
 	Name    string                 `yaml:"name"`
 	Options map[string]interface{} `yaml:"options"`
+
+	// Match optionally restricts the Hook to requests satisfying its
+	// conditions. Other requests skip the Hook.
+	Match *MatchConfig `yaml:"match"`
+
+	// Timeout optionally limits the time the Hook may spend on a request.
+	// It is passed to the Hook as the deadline of the request's context.
+	Timeout time.Duration `yaml:"timeout"`
 }
 
 // HooksFromHookConfigs is a utility function for initializing Hooks in bulk.
+//
+// The returned Hooks retain the name, match conditions and timeout of their
+// configuration, which are used by Logic to run and instrument them.
 func HooksFromHookConfigs(cfgs []HookConfig) (hooks []Hook, err error) {
 	for _, cfg := range cfgs {
 		// Marshal the options back into bytes.
@@ -81,14 +130,71 @@ func HooksFromHookConfigs(cfgs []HookConfig) (hooks []Hook, err error) {
 			return
 		}
 
+		var m *Matcher
+		if cfg.Match != nil {
+			m, err = NewMatcher(*cfg.Match)
+			if err != nil {
+				return
+			}
+		}
+
 		var h Hook
 		h, err = New(cfg.Name, optionBytes)
 		if err != nil {
 			return
 		}
 
-		hooks = append(hooks, h)
+		hooks = append(hooks, &configuredHook{
+			Hook:    h,
+			name:    cfg.Name,
+			matcher: m,
+			timeout: cfg.Timeout,
+		})
 	}
 
 	return
 }
+
+// CheckHookConfigs checks HookConfigs without creating Hooks.
+//
+// Errors are prefixed with the name of the Hook they belong to. The errors
+// of all Hooks are returned at once.
+func CheckHookConfigs(cfgs []HookConfig) error {
+	var errs []error
+	for _, cfg := range cfgs {
+		optionBytes, err := yaml.Marshal(cfg.Options)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", cfg.Name, err))
+			continue
+		}
+
+		if cfg.Match != nil {
+			if _, err := NewMatcher(*cfg.Match); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s", cfg.Name, err))
+			}
+		}
+
+		if err := Check(cfg.Name, optionBytes); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", cfg.Name, err))
+		}
+	}
+
+	return joinErrors(errs)
+}
+
+// joinErrors returns nil for no errors, the error itself for a single error,
+// and otherwise an error listing all errors separated by semicolons.
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+
+	errStrs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		errStrs = append(errStrs, err.Error())
+	}
+	return errors.New(strings.Join(errStrs, "; "))
+}
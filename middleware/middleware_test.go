@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var errCheckTest = errors.New("invalid option")
+
+type uncheckedDriver struct{}
+
+func (d uncheckedDriver) NewHook(optionBytes []byte) (Hook, error) {
+	return &nopHook{}, nil
+}
+
+type checkedDriver struct{ uncheckedDriver }
+
+func (d checkedDriver) CheckOptions(optionBytes []byte) error {
+	var options struct {
+		Valid bool `yaml:"valid"`
+	}
+	if err := yaml.UnmarshalStrict(optionBytes, &options); err != nil {
+		return err
+	}
+	if !options.Valid {
+		return errCheckTest
+	}
+	return nil
+}
+
+func init() {
+	RegisterDriver("unchecked test", uncheckedDriver{})
+	RegisterDriver("checked test", checkedDriver{})
+}
+
+func TestCheck(t *testing.T) {
+	require.Equal(t, ErrDriverDoesNotExist, Check("missing test", nil))
+	require.Equal(t, ErrCheckUnsupported, Check("unchecked test", nil))
+	require.Equal(t, errCheckTest, Check("checked test", []byte("valid: false")))
+	require.NotNil(t, Check("checked test", []byte("vaild: true")))
+	require.Nil(t, Check("checked test", []byte("valid: true")))
+}
+
+func TestCheckHookConfigs(t *testing.T) {
+	valid := HookConfig{Name: "checked test", Options: map[string]interface{}{"valid": true}}
+	require.Nil(t, CheckHookConfigs([]HookConfig{valid, valid}))
+
+	invalid := HookConfig{Name: "checked test", Options: map[string]interface{}{"valid": false}}
+	require.EqualError(t, CheckHookConfigs([]HookConfig{valid, invalid}), "checked test: invalid option")
+	require.EqualError(t, CheckHookConfigs([]HookConfig{invalid, valid, {Name: "missing test"}}), "checked test: invalid option; missing test: "+ErrDriverDoesNotExist.Error())
+
+	badMatch := valid
+	badMatch.Match = &MatchConfig{Frontends: []string{"gopher"}}
+	require.NotNil(t, CheckHookConfigs([]HookConfig{badMatch}))
+
+	require.Nil(t, CheckChainConfigs([]ChainConfig{{Name: "a", PreHooks: []HookConfig{valid}}}))
+	require.Equal(t, ErrInvalidChainName, CheckChainConfigs([]ChainConfig{{Name: "a"}, {Name: "a"}}))
+	require.EqualError(t, CheckChainConfigs([]ChainConfig{{Name: "a", PostHooks: []HookConfig{invalid}}}), "chain a: checked test: invalid option")
+	require.EqualError(t, CheckChainConfigs([]ChainConfig{{Name: "a", PreHooks: []HookConfig{invalid}}, {Name: "a"}, {Name: "b", PostHooks: []HookConfig{invalid}}}),
+		"chain a: checked test: invalid option; "+ErrInvalidChainName.Error()+"; chain b: checked test: invalid option")
+}
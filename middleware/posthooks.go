@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+)
+
+// postHookPool runs the post-hooks of requests on a fixed number of
+// goroutines.
+type postHookPool struct {
+	jobs    chan func()
+	closing chan struct{}
+	wg      sync.WaitGroup
+
+	// mu is held for reading while jobs are queued and for writing while
+	// setting stopped, so that no job is queued once the workers exit.
+	mu      sync.RWMutex
+	stopped bool
+}
+
+func newPostHookPool(workers, queueSize int) *postHookPool {
+	p := &postHookPool{
+		jobs:    make(chan func(), queueSize),
+		closing: make(chan struct{}),
+	}
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+func (p *postHookPool) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case job := <-p.jobs:
+			job()
+		case <-p.closing:
+			// Run what is left in the queue.
+			for {
+				select {
+				case job := <-p.jobs:
+					job()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// submit queues a job, waiting for space in the queue until ctx is done.
+// Jobs that can not be queued, because the queue stayed full or the pool was
+// stopped, are dropped and required, if it is not nil, runs in their place on
+// the calling goroutine.
+func (p *postHookPool) submit(ctx context.Context, action string, job, required func()) {
+	if !p.queue(ctx, action, job) && required != nil {
+		required()
+	}
+}
+
+// queue queues a job like submit and returns whether it was queued.
+func (p *postHookPool) queue(ctx context.Context, action string, job func()) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopped {
+		recordPostHookDrop(action, "stopped")
+		return false
+	}
+
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+	}
+
+	select {
+	case p.jobs <- job:
+		return true
+	case <-ctx.Done():
+		recordPostHookDrop(action, "queue full")
+		return false
+	}
+}
+
+// stop waits for the workers to run all queued jobs and exit.
+// Jobs submitted afterwards are dropped.
+func (p *postHookPool) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+
+	close(p.closing)
+	p.wg.Wait()
+}
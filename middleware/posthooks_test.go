@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/storage/memory"
+)
+
+func TestPostHookPool(t *testing.T) {
+	p := newPostHookPool(1, 1)
+
+	// Block the only worker.
+	started, release := make(chan struct{}), make(chan struct{})
+	p.submit(context.Background(), "announce", func() {
+		close(started)
+		<-release
+	}, nil)
+	<-started
+
+	ran := make(chan int, 3)
+	p.submit(context.Background(), "announce", func() { ran <- 1 }, nil)
+
+	// The queue is full, so the job is dropped once the context is done and
+	// the required part runs instead.
+	dropped := testutil.ToFloat64(promPostHookDroppedTotal.WithLabelValues("announce", "queue full"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.submit(ctx, "announce", func() { ran <- 2 }, func() { ran <- 3 })
+	require.Equal(t, dropped+1, testutil.ToFloat64(promPostHookDroppedTotal.WithLabelValues("announce", "queue full")))
+
+	// Stopping runs the queued job.
+	close(release)
+	p.stop()
+	close(ran)
+	var jobs []int
+	for job := range ran {
+		jobs = append(jobs, job)
+	}
+	require.Equal(t, []int{3, 1}, jobs)
+
+	// Jobs submitted after stopping are dropped instead of being queued
+	// without a worker.
+	dropped = testutil.ToFloat64(promPostHookDroppedTotal.WithLabelValues("announce", "stopped"))
+	var required bool
+	p.submit(context.Background(), "announce", func() { t.Error("job submitted after stop ran") }, func() { required = true })
+	require.Equal(t, dropped+1, testutil.ToFloat64(promPostHookDroppedTotal.WithLabelValues("announce", "stopped")))
+	require.Empty(t, p.jobs)
+	require.True(t, required)
+}
+
+func TestAfterAnnounceStoresDroppedPeers(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Empty(t, ps.Stop().Wait()) })
+
+	var post []string
+	l := NewLogic(ResponseConfig{}, ps, nil, []Hook{recordingHook{&post}})
+	require.Empty(t, l.Stop().Wait())
+
+	// The post-hooks of an announce handled while the Logic stops are
+	// dropped, but the peer is stored.
+	req := announceFor(matchedIH, bittorrent.IPv4)
+	l.AfterAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Empty(t, post)
+	scrape := ps.ScrapeSwarm(context.Background(), matchedIH, bittorrent.IPv4)
+	require.Equal(t, uint32(1), scrape.Complete)
+}
+
+func TestPostHookContext(t *testing.T) {
+	l := &Logic{postHookTimeout: defaultPostHookTimeout}
+
+	reqCtx, cancel := context.WithCancel(context.WithValue(context.Background(), ChainKey, "test"))
+	cancel()
+
+	ctx, cancel := l.postHookContext(reqCtx)
+	defer cancel()
+	require.Nil(t, ctx.Err())
+	require.Equal(t, "test", ctx.Value(ChainKey))
+	_, ok := ctx.Deadline()
+	require.True(t, ok)
+}
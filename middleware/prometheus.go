@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+)
+
+func init() {
+	prometheus.MustRegister(
+		promChainRequestsTotal,
+		promHookDurationMilliseconds,
+		promHookErrorsTotal,
+		promPostHookDroppedTotal,
+	)
+}
+
+var (
+	promChainRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chihaya_middleware_chain_requests_total",
+			Help: "The number of requests handled by each chain of hooks",
+		},
+		[]string{"chain", "action"},
+	)
+
+	promHookDurationMilliseconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "chihaya_middleware_hook_duration_milliseconds",
+			Help:    "The duration of time it takes a hook to handle a request",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 16),
+		},
+		[]string{"chain", "hook", "phase", "action"},
+	)
+
+	promHookErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chihaya_middleware_hook_errors_total",
+			Help: "The number of requests a hook failed to handle",
+		},
+		[]string{"chain", "hook", "phase", "action", "type"},
+	)
+
+	promPostHookDroppedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chihaya_middleware_posthook_dropped_total",
+			Help: "The number of requests whose post-hooks were skipped",
+		},
+		[]string{"action", "reason"},
+	)
+)
+
+// recordChainRequest records that a chain handled a request.
+func recordChainRequest(chain, action string) {
+	promChainRequestsTotal.WithLabelValues(chain, action).Inc()
+}
+
+// recordHook records the duration and the error of a hook handling a request.
+func recordHook(chain, hook, phase, action string, err error, duration time.Duration) {
+	promHookDurationMilliseconds.
+		WithLabelValues(chain, hook, phase, action).
+		Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
+
+	if err == nil {
+		return
+	}
+
+	var errType string
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		errType = "timeout"
+	case errors.Is(err, context.Canceled):
+		errType = "canceled"
+	default:
+		if _, ok := err.(bittorrent.ClientError); ok {
+			errType = "client error"
+		} else {
+			errType = "internal error"
+		}
+	}
+	promHookErrorsTotal.WithLabelValues(chain, hook, phase, action, errType).Inc()
+}
+
+// recordPostHookDrop records that the post-hooks of a request were skipped.
+func recordPostHookDrop(action, reason string) {
+	promPostHookDroppedTotal.WithLabelValues(action, reason).Inc()
+}
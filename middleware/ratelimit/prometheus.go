@@ -0,0 +1,44 @@
+package ratelimit
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(promThrottledTotal, promEntries)
+}
+
+// Reasons for throttling an announce, used as label values.
+const (
+	reasonMinInterval = "min_interval"
+	reasonIP          = "ip"
+	reasonIPv6Prefix  = "ipv6_prefix"
+)
+
+var promThrottledTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_ratelimit_throttled_total",
+		Help: "The number of announces rejected by the rate limit middleware",
+	},
+	[]string{"reason"},
+)
+
+var promEntries = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chihaya_ratelimit_entries",
+		Help: "The number of entries tracked by the rate limit middleware",
+	},
+	[]string{"limit"},
+)
+
+// recordThrottled increments the number of announces throttled for reason.
+func recordThrottled(reason string) {
+	promThrottledTotal.WithLabelValues(reason).Inc()
+}
+
+// recordEntries records the number of entries of each limit.
+func recordEntries(peers, ips, ipv6Prefixes int) {
+	promEntries.WithLabelValues(reasonMinInterval).Set(float64(peers))
+	promEntries.WithLabelValues(reasonIP).Set(float64(ips))
+	promEntries.WithLabelValues(reasonIPv6Prefix).Set(float64(ipv6Prefixes))
+}
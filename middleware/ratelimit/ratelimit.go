@@ -0,0 +1,339 @@
+// Package ratelimit implements a Hook that limits how often clients may
+// announce.
+//
+// Three independent limits are provided: the min interval of the response
+// is enforced per infohash and peer, and token buckets limit the announces
+// per source IP and per IPv6 prefix.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/pkg/stop"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "rate limit"
+
+// Default config constants.
+const (
+	defaultIPv6PrefixLength = 64
+	defaultMaxEntries       = 1 << 20
+	defaultSweepInterval    = time.Minute
+)
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var (
+	_ middleware.Driver  = driver{}
+	_ middleware.Checker = driver{}
+)
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// CheckOptions checks options without creating a Hook.
+func (d driver) CheckOptions(optionBytes []byte) error {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	if err := checkConfig(cfg); err != nil {
+		return err
+	}
+	cfg.Validate()
+	return nil
+}
+
+// ErrAnnounceTooFrequent is returned for an announce that was sent before the
+// min interval of the previous announce of the same peer has elapsed.
+var ErrAnnounceTooFrequent = bittorrent.ClientError("announced before min interval elapsed")
+
+// ErrInvalidRate is returned for a config with a negative rate.
+var ErrInvalidRate = errors.New("invalid rate")
+
+// ErrInvalidBurst is returned for a config with a rate but no positive burst.
+var ErrInvalidBurst = errors.New("invalid burst")
+
+// ErrInvalidIPv6PrefixLength is returned for a config with an
+// IPv6PrefixLength outside of [1, 128].
+var ErrInvalidIPv6PrefixLength = errors.New("invalid ipv6_prefix_length")
+
+// LimitConfig is the configuration of a token bucket.
+type LimitConfig struct {
+	// Rate is the number of announces per second the bucket is refilled
+	// with.
+	// A rate of zero disables the limit.
+	Rate float64 `yaml:"rate"`
+
+	// Burst is the size of the bucket, i.e. the number of announces that
+	// are allowed in quick succession.
+	Burst int `yaml:"burst"`
+}
+
+func (l LimitConfig) enabled() bool { return l.Rate > 0 }
+
+func (l LimitConfig) check() error {
+	if l.Rate < 0 {
+		return ErrInvalidRate
+	}
+	if l.enabled() && l.Burst <= 0 {
+		return ErrInvalidBurst
+	}
+	return nil
+}
+
+// Config represents the configuration for the ratelimit middleware.
+type Config struct {
+	// EnforceMinInterval specifies whether announces of a peer for an
+	// infohash that arrive before the min interval has elapsed are
+	// rejected.
+	EnforceMinInterval bool `yaml:"enforce_min_interval"`
+
+	// MinIntervalLeeway is subtracted from the min interval to tolerate
+	// clients announcing slightly early.
+	MinIntervalLeeway time.Duration `yaml:"min_interval_leeway"`
+
+	// PerIP limits the announces per source IP.
+	PerIP LimitConfig `yaml:"per_ip"`
+
+	// PerIPv6Prefix limits the announces per IPv6 prefix of length
+	// IPv6PrefixLength.
+	PerIPv6Prefix    LimitConfig `yaml:"per_ipv6_prefix"`
+	IPv6PrefixLength int         `yaml:"ipv6_prefix_length"`
+
+	// MaxEntries is the maximum number of entries kept per limit.
+	MaxEntries int `yaml:"max_entries"`
+
+	// SweepInterval is the interval at which expired entries are removed.
+	SweepInterval time.Duration `yaml:"sweep_interval"`
+
+	// Clock is used to measure the time between announces.
+	// If it is nil, the global timecache is used.
+	Clock timecache.Clock `yaml:"-"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"name":               Name,
+		"enforceMinInterval": cfg.EnforceMinInterval,
+		"minIntervalLeeway":  cfg.MinIntervalLeeway,
+		"perIPRate":          cfg.PerIP.Rate,
+		"perIPBurst":         cfg.PerIP.Burst,
+		"perIPv6PrefixRate":  cfg.PerIPv6Prefix.Rate,
+		"perIPv6PrefixBurst": cfg.PerIPv6Prefix.Burst,
+		"ipv6PrefixLength":   cfg.IPv6PrefixLength,
+		"maxEntries":         cfg.MaxEntries,
+		"sweepInterval":      cfg.SweepInterval,
+	}
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.IPv6PrefixLength == 0 {
+		validcfg.IPv6PrefixLength = defaultIPv6PrefixLength
+		if cfg.PerIPv6Prefix.enabled() {
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     Name + ".IPv6PrefixLength",
+				"provided": cfg.IPv6PrefixLength,
+				"default":  validcfg.IPv6PrefixLength,
+			})
+		}
+	}
+
+	if cfg.MaxEntries <= 0 {
+		validcfg.MaxEntries = defaultMaxEntries
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MaxEntries",
+			"provided": cfg.MaxEntries,
+			"default":  validcfg.MaxEntries,
+		})
+	}
+
+	if cfg.SweepInterval <= 0 {
+		validcfg.SweepInterval = defaultSweepInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".SweepInterval",
+			"provided": cfg.SweepInterval,
+			"default":  validcfg.SweepInterval,
+		})
+	}
+
+	if cfg.Clock == nil {
+		validcfg.Clock = timecache.Default()
+	}
+
+	return validcfg
+}
+
+func checkConfig(cfg Config) error {
+	if err := cfg.PerIP.check(); err != nil {
+		return fmt.Errorf("per_ip: %w", err)
+	}
+
+	if err := cfg.PerIPv6Prefix.check(); err != nil {
+		return fmt.Errorf("per_ipv6_prefix: %w", err)
+	}
+
+	if cfg.IPv6PrefixLength < 0 || cfg.IPv6PrefixLength > 128 {
+		return ErrInvalidIPv6PrefixLength
+	}
+
+	return nil
+}
+
+type hook struct {
+	cfg        Config
+	ipv6Mask   net.IPMask
+	peers      *table
+	ips        *table
+	ipv6Prefix *table
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewHook creates a middleware that limits the rate of announces from the
+// given config.
+//
+// The returned Hook implements stop.Stopper and must be stopped to release
+// its resources.
+func NewHook(provided Config) (middleware.Hook, error) {
+	err := checkConfig(provided)
+	if err != nil {
+		return nil, err
+	}
+	cfg := provided.Validate()
+
+	h := &hook{
+		cfg:        cfg,
+		ipv6Mask:   net.CIDRMask(cfg.IPv6PrefixLength, 128),
+		peers:      newTable(cfg.MaxEntries),
+		ips:        newTable(cfg.MaxEntries),
+		ipv6Prefix: newTable(cfg.MaxEntries),
+		closed:     make(chan struct{}),
+	}
+
+	// Start a goroutine to remove expired entries.
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		for {
+			select {
+			case <-h.closed:
+				return
+			case <-cfg.Clock.After(cfg.SweepInterval):
+				now := cfg.Clock.NowUnixNano()
+				h.peers.sweep(now)
+				h.ips.sweep(now)
+				h.ipv6Prefix.sweep(now)
+				recordEntries(h.peers.len(), h.ips.len(), h.ipv6Prefix.len())
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// HandleAnnounce checks the announce against all configured limits.
+//
+// The token buckets are consulted first, so that a peer is not charged with
+// an announce for its min interval if its IP was limited.
+// Announces exceeding a token bucket fail with bittorrent.ErrRateLimited,
+// announces sent before the min interval elapsed with ErrAnnounceTooFrequent.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	now := h.cfg.Clock.NowUnixNano()
+
+	if h.cfg.PerIP.enabled() {
+		if !h.ips.take(string(req.IP.IP), now, h.cfg.PerIP.Rate, h.cfg.PerIP.Burst) {
+			recordThrottled(reasonIP)
+			return ctx, bittorrent.ErrRateLimited
+		}
+	}
+
+	if h.cfg.PerIPv6Prefix.enabled() && req.IP.AddressFamily == bittorrent.IPv6 {
+		prefix := req.IP.IP.Mask(h.ipv6Mask)
+		if !h.ipv6Prefix.take(string(prefix), now, h.cfg.PerIPv6Prefix.Rate, h.cfg.PerIPv6Prefix.Burst) {
+			recordThrottled(reasonIPv6Prefix)
+			return ctx, bittorrent.ErrRateLimited
+		}
+	}
+
+	if h.cfg.EnforceMinInterval {
+		key := peerKey(req.InfoHash, req.Peer)
+		switch req.Event {
+		case bittorrent.Stopped:
+			// A stopped peer may start again right away.
+			h.peers.forget(key)
+		case bittorrent.Completed:
+			// Completed events are sent whenever a download finishes
+			// and must not be rejected.
+		default:
+			gap := resp.MinInterval - h.cfg.MinIntervalLeeway
+			if gap > 0 && !h.peers.touch(key, now, gap) {
+				recordThrottled(reasonMinInterval)
+				return ctx, ErrAnnounceTooFrequent
+			}
+		}
+	}
+
+	return ctx, nil
+}
+
+// HandleScrape does not limit scrapes.
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not limited.
+	return ctx, nil
+}
+
+// Stop stops the goroutine removing expired entries.
+func (h *hook) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		close(h.closed)
+		h.wg.Wait()
+		c.Done()
+	}()
+
+	return c.Result()
+}
+
+// peerKey identifies a peer in a swarm.
+func peerKey(ih bittorrent.InfoHash, p bittorrent.Peer) string {
+	b := make([]byte, 0, 20+20+2+len(p.IP.IP))
+	b = append(b, ih[:]...)
+	b = append(b, p.ID[:]...)
+	b = append(b, byte(p.Port>>8), byte(p.Port))
+	b = append(b, p.IP.IP...)
+	return string(b)
+}
@@ -0,0 +1,191 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+)
+
+var configTests = []struct {
+	cfg      Config
+	expected error
+}{
+	{
+		cfg:      Config{},
+		expected: nil,
+	}, {
+		cfg:      Config{PerIP: LimitConfig{Rate: 1, Burst: 5}},
+		expected: nil,
+	}, {
+		cfg:      Config{PerIP: LimitConfig{Rate: -1, Burst: 5}},
+		expected: ErrInvalidRate,
+	}, {
+		cfg:      Config{PerIPv6Prefix: LimitConfig{Rate: 1}},
+		expected: ErrInvalidBurst,
+	}, {
+		cfg:      Config{IPv6PrefixLength: 129},
+		expected: ErrInvalidIPv6PrefixLength,
+	},
+}
+
+func TestCheckConfig(t *testing.T) {
+	for _, tt := range configTests {
+		t.Run(fmt.Sprintf("%#v", tt.cfg), func(t *testing.T) {
+			err := checkConfig(tt.cfg)
+			require.ErrorIs(t, err, tt.expected)
+		})
+	}
+}
+
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestHook(t *testing.T, cfg Config) (*hook, *timecache.FakeClock) {
+	clock := timecache.NewFakeClock(epoch)
+	cfg.Clock = clock
+	h, err := NewHook(cfg)
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Empty(t, h.(*hook).Stop().Wait()) })
+	return h.(*hook), clock
+}
+
+func announce(ip string, peerID byte, event bittorrent.Event) *bittorrent.AnnounceRequest {
+	req := &bittorrent.AnnounceRequest{Event: event}
+	req.Peer.ID[0] = peerID
+	req.Peer.Port = 6881
+	req.Peer.IP.IP = net.ParseIP(ip)
+	if v4 := req.Peer.IP.IP.To4(); v4 != nil {
+		req.Peer.IP.IP = v4
+		req.Peer.IP.AddressFamily = bittorrent.IPv4
+	} else {
+		req.Peer.IP.AddressFamily = bittorrent.IPv6
+	}
+	return req
+}
+
+func TestMinInterval(t *testing.T) {
+	h, clock := newTestHook(t, Config{
+		EnforceMinInterval: true,
+		MinIntervalLeeway:  time.Minute,
+	})
+	resp := &bittorrent.AnnounceResponse{MinInterval: 15 * time.Minute}
+	ctx := context.Background()
+
+	_, err := h.HandleAnnounce(ctx, announce("1.2.3.4", 1, bittorrent.Started), resp)
+	require.Nil(t, err)
+
+	// Too early.
+	clock.Advance(10 * time.Minute)
+	_, err = h.HandleAnnounce(ctx, announce("1.2.3.4", 1, bittorrent.None), resp)
+	require.Equal(t, ErrAnnounceTooFrequent, err)
+
+	// Other peers are not affected.
+	_, err = h.HandleAnnounce(ctx, announce("1.2.3.4", 2, bittorrent.None), resp)
+	require.Nil(t, err)
+
+	// Completed events are always accepted.
+	_, err = h.HandleAnnounce(ctx, announce("1.2.3.4", 1, bittorrent.Completed), resp)
+	require.Nil(t, err)
+
+	// Within the leeway.
+	clock.Advance(4 * time.Minute)
+	_, err = h.HandleAnnounce(ctx, announce("1.2.3.4", 1, bittorrent.None), resp)
+	require.Nil(t, err)
+
+	// Stopped events are accepted and reset the interval.
+	_, err = h.HandleAnnounce(ctx, announce("1.2.3.4", 1, bittorrent.Stopped), resp)
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(ctx, announce("1.2.3.4", 1, bittorrent.Started), resp)
+	require.Nil(t, err)
+}
+
+func TestPerIP(t *testing.T) {
+	h, clock := newTestHook(t, Config{
+		PerIP: LimitConfig{Rate: 0.5, Burst: 2},
+	})
+	resp := &bittorrent.AnnounceResponse{}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := h.HandleAnnounce(ctx, announce("1.2.3.4", byte(i), bittorrent.None), resp)
+		require.Nil(t, err)
+	}
+	_, err := h.HandleAnnounce(ctx, announce("1.2.3.4", 3, bittorrent.None), resp)
+	require.Equal(t, bittorrent.ErrRateLimited, err)
+
+	// Other IPs are not affected.
+	_, err = h.HandleAnnounce(ctx, announce("1.2.3.5", 3, bittorrent.None), resp)
+	require.Nil(t, err)
+
+	// The bucket refills with one token every two seconds.
+	clock.Advance(2 * time.Second)
+	_, err = h.HandleAnnounce(ctx, announce("1.2.3.4", 3, bittorrent.None), resp)
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(ctx, announce("1.2.3.4", 3, bittorrent.None), resp)
+	require.Equal(t, bittorrent.ErrRateLimited, err)
+}
+
+func TestPerIPv6Prefix(t *testing.T) {
+	h, _ := newTestHook(t, Config{
+		PerIPv6Prefix: LimitConfig{Rate: 1, Burst: 1},
+	})
+	resp := &bittorrent.AnnounceResponse{}
+	ctx := context.Background()
+
+	_, err := h.HandleAnnounce(ctx, announce("2001:db8::1", 1, bittorrent.None), resp)
+	require.Nil(t, err)
+
+	// Same /64.
+	_, err = h.HandleAnnounce(ctx, announce("2001:db8::ffff:1", 1, bittorrent.None), resp)
+	require.Equal(t, bittorrent.ErrRateLimited, err)
+
+	// Different /64.
+	_, err = h.HandleAnnounce(ctx, announce("2001:db8:0:1::1", 1, bittorrent.None), resp)
+	require.Nil(t, err)
+
+	// IPv4 is not affected.
+	for i := 0; i < 3; i++ {
+		_, err = h.HandleAnnounce(ctx, announce("1.2.3.4", 1, bittorrent.None), resp)
+		require.Nil(t, err)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	h, clock := newTestHook(t, Config{
+		EnforceMinInterval: true,
+		PerIP:              LimitConfig{Rate: 1, Burst: 10},
+		SweepInterval:      time.Minute,
+	})
+	resp := &bittorrent.AnnounceResponse{MinInterval: 5 * time.Minute}
+
+	_, err := h.HandleAnnounce(context.Background(), announce("1.2.3.4", 1, bittorrent.None), resp)
+	require.Nil(t, err)
+	require.Equal(t, 1, h.peers.len())
+	require.Equal(t, 1, h.ips.len())
+
+	// The bucket is full again after one second, the min interval entry
+	// expires after five minutes.
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+	require.Equal(t, 1, h.peers.len())
+	require.Equal(t, 0, h.ips.len())
+
+	clock.Advance(4 * time.Minute)
+	clock.BlockUntil(1)
+	require.Equal(t, 0, h.peers.len())
+}
+
+func TestTableMaxEntries(t *testing.T) {
+	tbl := newTable(shardCount * 2)
+	for i := 0; i < 10000; i++ {
+		require.True(t, tbl.touch(fmt.Sprint(i), 0, time.Second))
+	}
+	require.LessOrEqual(t, tbl.len(), shardCount*2)
+}
@@ -0,0 +1,160 @@
+package ratelimit
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// shardCount is the number of shards a table is divided into.
+const shardCount = 64
+
+// An entry holds the state for a single key of a table.
+type entry struct {
+	// tokens is the number of tokens left in a token bucket.
+	tokens float64
+
+	// last is the time of the last update, as nanoseconds since the Unix
+	// Epoch.
+	last int64
+
+	// expires is the time after which the entry carries no state that could
+	// not be recreated, as nanoseconds since the Unix Epoch.
+	expires int64
+}
+
+type shard struct {
+	entries map[string]*entry
+	sync.Mutex
+}
+
+// A table is a sharded map of entries holding at most maxEntries entries.
+//
+// If a shard is full, an arbitrary entry of it is evicted to make room for a
+// new one.
+type table struct {
+	shards      []shard
+	maxPerShard int
+}
+
+func newTable(maxEntries int) *table {
+	t := &table{
+		shards:      make([]shard, shardCount),
+		maxPerShard: maxEntries / shardCount,
+	}
+	if t.maxPerShard < 1 {
+		t.maxPerShard = 1
+	}
+	for i := range t.shards {
+		t.shards[i].entries = make(map[string]*entry)
+	}
+	return t
+}
+
+func (t *table) shardFor(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &t.shards[h.Sum32()%shardCount]
+}
+
+// getOrCreate returns the entry for key, creating it if necessary.
+// It must be called with s locked.
+func (t *table) getOrCreate(s *shard, key string) (e *entry, created bool) {
+	if e, ok := s.entries[key]; ok {
+		return e, false
+	}
+
+	if len(s.entries) >= t.maxPerShard {
+		for k := range s.entries {
+			delete(s.entries, k)
+			break
+		}
+	}
+
+	e = &entry{}
+	s.entries[key] = e
+	return e, true
+}
+
+// take takes a token from the bucket identified by key, refilling it at rate
+// tokens per second up to burst tokens.
+// It returns false if the bucket is empty.
+func (t *table) take(key string, now int64, rate float64, burst int) bool {
+	s := t.shardFor(key)
+	s.Lock()
+	defer s.Unlock()
+
+	e, created := t.getOrCreate(s, key)
+	if created {
+		e.tokens = float64(burst)
+	} else {
+		elapsed := time.Duration(now - e.last).Seconds()
+		if elapsed > 0 {
+			e.tokens += elapsed * rate
+		}
+		if e.tokens > float64(burst) {
+			e.tokens = float64(burst)
+		}
+	}
+	e.last = now
+
+	if e.tokens < 1 {
+		return false
+	}
+	e.tokens--
+
+	// Once the bucket would be full again, it is indistinguishable from a
+	// new one.
+	e.expires = now + int64((float64(burst)-e.tokens)/rate*float64(time.Second))
+	return true
+}
+
+// touch records an event for key if at least gap has elapsed since the last
+// recorded event.
+// It returns false if the event came too early and was not recorded.
+func (t *table) touch(key string, now int64, gap time.Duration) bool {
+	s := t.shardFor(key)
+	s.Lock()
+	defer s.Unlock()
+
+	e, created := t.getOrCreate(s, key)
+	if !created && now-e.last < int64(gap) {
+		return false
+	}
+	e.last = now
+	e.expires = now + int64(gap)
+	return true
+}
+
+// forget removes the entry for key.
+func (t *table) forget(key string) {
+	s := t.shardFor(key)
+	s.Lock()
+	delete(s.entries, key)
+	s.Unlock()
+}
+
+// sweep removes all entries that expired before now.
+func (t *table) sweep(now int64) {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		for k, e := range s.entries {
+			if e.expires <= now {
+				delete(s.entries, k)
+			}
+		}
+		s.Unlock()
+	}
+}
+
+// len returns the number of entries in the table.
+func (t *table) len() (n int) {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		n += len(s.entries)
+		s.Unlock()
+	}
+	return n
+}
@@ -0,0 +1,383 @@
+// Package script implements a Hook that applies a policy written in Starlark
+// to Announces and Scrapes.
+//
+// Scripts can read the fields of a request, reject it with a reason, adjust
+// the announce interval and the number of peers returned, and store values
+// in the request's context for later hooks. See docs/middleware/script.md
+// for the functions and variables available to scripts.
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/pkg/stop"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "script"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var (
+	_ middleware.Driver  = driver{}
+	_ middleware.Checker = driver{}
+)
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.Unmarshal(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// CheckOptions checks options and parses the script without creating a
+// Hook.
+func (d driver) CheckOptions(optionBytes []byte) error {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	if (cfg.Script == "") == (cfg.Path == "") {
+		return ErrInvalidSource
+	}
+	if cfg.ReloadInterval < 0 {
+		return ErrInvalidReloadInterval
+	}
+	cfg.Validate()
+
+	if cfg.Script != "" {
+		_, err = compile(Name, cfg.Script)
+	} else {
+		_, _, err = loadFile(cfg.Path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", Name, err)
+	}
+	return nil
+}
+
+// ErrInvalidSource is returned for a Config that does not set exactly one of
+// Script and Path.
+var ErrInvalidSource = errors.New("exactly one of script and path must be set")
+
+// ErrInvalidReloadInterval is returned for a config with a negative
+// ReloadInterval.
+var ErrInvalidReloadInterval = errors.New("invalid reload_interval")
+
+// ContextKey is the type of the keys under which values stored by a script
+// are put into the context of a request.
+//
+// A value stored with `store("tier", "gold")` can be read by later hooks with
+// ctx.Value(script.ContextKey("tier")). Values are of type bool, int64,
+// string, time.Duration or []interface{}.
+type ContextKey string
+
+// Default config constants.
+const defaultMaxSteps = 100000
+
+// Config represents all the values required by this middleware to run a
+// script.
+type Config struct {
+	// Script is the source of the script.
+	Script string `yaml:"script"`
+
+	// Path is the path of a file containing the script.
+	Path string `yaml:"path"`
+
+	// ReloadInterval is the interval at which the file is checked for
+	// changes. Zero disables reloading.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// MaxSteps limits the number of Starlark computation steps of a single
+	// request.
+	MaxSteps int `yaml:"max_steps"`
+
+	// FailOpen specifies whether requests are handled as if there was no
+	// script if the script fails, instead of failing them.
+	FailOpen bool `yaml:"fail_open"`
+
+	// Clock is used to schedule reloading.
+	// If it is nil, the global timecache is used.
+	Clock timecache.Clock `yaml:"-"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"name":           Name,
+		"path":           cfg.Path,
+		"reloadInterval": cfg.ReloadInterval,
+		"maxSteps":       cfg.MaxSteps,
+		"failOpen":       cfg.FailOpen,
+	}
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.MaxSteps <= 0 {
+		validcfg.MaxSteps = defaultMaxSteps
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MaxSteps",
+			"provided": cfg.MaxSteps,
+			"default":  validcfg.MaxSteps,
+		})
+	}
+
+	if cfg.Clock == nil {
+		validcfg.Clock = timecache.Default()
+	}
+
+	return validcfg
+}
+
+// fileState is used to detect changes to the script file.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+type hook struct {
+	cfg Config
+
+	// program holds the current *starlark.Program.
+	program atomic.Value
+	state   fileState
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewHook returns an instance of the script middleware.
+//
+// The returned Hook implements stop.Stopper and must be stopped to stop
+// reloading the script.
+func NewHook(provided Config) (middleware.Hook, error) {
+	if (provided.Script == "") == (provided.Path == "") {
+		return nil, ErrInvalidSource
+	}
+	if provided.ReloadInterval < 0 {
+		return nil, ErrInvalidReloadInterval
+	}
+	cfg := provided.Validate()
+
+	h := &hook{
+		cfg:    cfg,
+		closed: make(chan struct{}),
+	}
+
+	if cfg.Script != "" {
+		p, err := compile(Name, cfg.Script)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", Name, err)
+		}
+		h.program.Store(p)
+		return h, nil
+	}
+
+	p, state, err := loadFile(cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", Name, err)
+	}
+	h.program.Store(p)
+	h.state = state
+
+	if cfg.ReloadInterval > 0 {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			for {
+				select {
+				case <-h.closed:
+					return
+				case <-cfg.Clock.After(cfg.ReloadInterval):
+					h.reloadIfChanged()
+				}
+			}
+		}()
+	}
+
+	return h, nil
+}
+
+func loadFile(path string) (*starlark.Program, fileState, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fileState{}, err
+	}
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fileState{}, err
+	}
+	p, err := compile(path, string(src))
+	if err != nil {
+		return nil, fileState{}, err
+	}
+	return p, fileState{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// reloadIfChanged reloads the script if its file changed.
+// If reloading fails, the previous script stays in use.
+func (h *hook) reloadIfChanged() {
+	fi, err := os.Stat(h.cfg.Path)
+	if err != nil {
+		log.Error("script: failed to check script file", log.Err(err))
+		return
+	}
+	if (fileState{modTime: fi.ModTime(), size: fi.Size()}) == h.state {
+		return
+	}
+
+	p, state, err := loadFile(h.cfg.Path)
+	if err != nil {
+		log.Error("script: failed to reload script, keeping previous version", log.Err(err))
+		return
+	}
+
+	h.program.Store(p)
+	h.state = state
+	log.Info("script: reloaded script", h.cfg)
+}
+
+func (h *hook) newEnv(ctx context.Context, params bittorrent.Params) (*env, starlark.StringDict) {
+	e := &env{
+		params: params,
+		stores: make(map[string]interface{}),
+	}
+	e.routeParams, _ = ctx.Value(bittorrent.RouteParamsKey).(bittorrent.RouteParams)
+
+	frontend, _ := ctx.Value(bittorrent.FrontendKey).(string)
+	route, _ := ctx.Value(bittorrent.RouteKey).(string)
+	chain, _ := ctx.Value(middleware.ChainKey).(string)
+	vars := starlark.StringDict{
+		"frontend": starlark.String(frontend),
+		"route":    starlark.String(route),
+		"chain":    starlark.String(chain),
+	}
+	return e, vars
+}
+
+// run runs the current program and applies the stored values to the context.
+// It returns whether the script succeeded and the error to fail the request
+// with.
+func (h *hook) run(ctx context.Context, e *env, vars starlark.StringDict) (context.Context, bool, error) {
+	err := e.run(ctx, h.program.Load().(*starlark.Program), h.cfg.MaxSteps, vars)
+	if err != nil {
+		if h.cfg.FailOpen {
+			log.Warn("script: failed, ignoring the script", log.Err(err))
+			return ctx, false, nil
+		}
+		return ctx, false, fmt.Errorf("%s: %s", Name, err)
+	}
+	if e.rejected != nil {
+		return ctx, false, bittorrent.ClientError(*e.rejected)
+	}
+
+	for key, v := range e.stores {
+		ctx = context.WithValue(ctx, ContextKey(key), v)
+	}
+	return ctx, true, nil
+}
+
+func addressFamily(af bittorrent.AddressFamily) starlark.String {
+	if af == bittorrent.IPv6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// HandleAnnounce runs the script for an announce.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	e, vars := h.newEnv(ctx, req.Params)
+	vars["action"] = starlark.String("announce")
+	vars["infohash"] = starlark.String(req.InfoHash.String())
+	vars["peer_id"] = starlark.String(req.Peer.ID[:])
+	vars["ip"] = starlark.String(req.Peer.IP.String())
+	vars["address_family"] = addressFamily(req.Peer.IP.AddressFamily)
+	vars["port"] = starlark.MakeUint(uint(req.Peer.Port))
+	vars["event"] = starlark.String(req.Event.String())
+	vars["uploaded"] = starlark.MakeUint64(req.Uploaded)
+	vars["downloaded"] = starlark.MakeUint64(req.Downloaded)
+	vars["left"] = starlark.MakeUint64(req.Left)
+	vars["compact"] = starlark.Bool(req.Compact)
+
+	info, known := bittorrent.IdentifyClient(req.Peer.ID)
+	clientVersion := ""
+	if known {
+		clientVersion = info.Version.String()
+	}
+	vars["client"] = starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"known":   starlark.Bool(known),
+		"name":    starlark.String(info.Name),
+		"code":    starlark.String(info.Code),
+		"version": starlark.String(clientVersion),
+	})
+
+	r := newResponse(ctx, req, resp)
+	vars["response"] = r
+
+	ctx, ok, err := h.run(ctx, e, vars)
+	if ok {
+		r.apply(req, resp)
+	}
+	return ctx, err
+}
+
+// HandleScrape runs the script for a scrape.
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	e, vars := h.newEnv(ctx, req.Params)
+	infoHashes := make(starlark.Tuple, 0, len(req.InfoHashes))
+	for _, ih := range req.InfoHashes {
+		infoHashes = append(infoHashes, starlark.String(ih.String()))
+	}
+	vars["action"] = starlark.String("scrape")
+	vars["infohashes"] = infoHashes
+	vars["ip"] = starlark.String("")
+	if req.IP != nil {
+		vars["ip"] = starlark.String(req.IP.String())
+	}
+	vars["address_family"] = addressFamily(req.AddressFamily)
+
+	ctx, _, err := h.run(ctx, e, vars)
+	return ctx, err
+}
+
+// Stop stops reloading the script.
+func (h *hook) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		close(h.closed)
+		h.wg.Wait()
+		c.Done()
+	}()
+
+	return c.Result()
+}
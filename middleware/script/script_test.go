@@ -0,0 +1,271 @@
+package script
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+)
+
+func announce(ip string, peerID string) *bittorrent.AnnounceRequest {
+	req := &bittorrent.AnnounceRequest{NumWant: 50}
+	req.Peer.IP.IP = net.ParseIP(ip)
+	if req.Peer.IP.IP.To4() != nil {
+		req.Peer.IP.AddressFamily = bittorrent.IPv4
+	} else {
+		req.Peer.IP.AddressFamily = bittorrent.IPv6
+	}
+	req.Peer.ID = bittorrent.PeerIDFromString(peerID)
+	return req
+}
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{})
+	require.Equal(t, ErrInvalidSource, err)
+
+	_, err = NewHook(Config{Script: "pass", Path: "policy.star"})
+	require.Equal(t, ErrInvalidSource, err)
+
+	_, err = NewHook(Config{Script: "pass", ReloadInterval: -time.Second})
+	require.Equal(t, ErrInvalidReloadInterval, err)
+
+	_, err = NewHook(Config{Script: "if {"})
+	require.EqualError(t, err, "script: script:1:5: got end of file, want primary expression")
+
+	_, err = NewHook(Config{Script: `reject(clinet.name)`})
+	require.EqualError(t, err, "script: script:1:8: undefined: clinet")
+
+	_, err = NewHook(Config{Script: "while True:\n\tpass"})
+	require.EqualError(t, err, "script: script:1:1: this Starlark dialect does not support while loops")
+
+	_, err = NewHook(Config{Script: `load("os.star", "os")`})
+	require.Nil(t, err)
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := NewHook(Config{Script: `
+# Old clients are not welcome.
+if client.name == "Transmission" and version(client.version) < version("2.90"):
+	reject("please upgrade " + client.name)
+
+if in_cidr(ip, "192.0.2.0/24"):
+	response.interval = max(response.interval, time.hour)
+	response.numwant = min(response.numwant, 10)
+	store("tier", "slow")
+
+if client.name == "Transmission" and version(client.version) < version("3.00"):
+	response.warning_message = "your client is deprecated"
+
+if response.tracker_id == "":
+	response.tracker_id = "t1"
+
+if param("key") == "secret" and route_param("passkey") != "":
+	store("tier", "gold")
+`})
+	require.Nil(t, err)
+
+	resp := &bittorrent.AnnounceResponse{Interval: 30 * time.Minute, MinInterval: 10 * time.Minute}
+	_, err = h.HandleAnnounce(context.Background(), announce("198.51.100.1", "-TR2840-000000000000"), resp)
+	require.Equal(t, bittorrent.ClientError("please upgrade Transmission"), err)
+
+	req := announce("192.0.2.1", "-TR2940-000000000000")
+	ctx, err := h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, 10*time.Minute, resp.MinInterval)
+	require.Equal(t, uint32(10), req.NumWant)
+	require.Equal(t, "slow", ctx.Value(ContextKey("tier")))
+	require.Equal(t, "your client is deprecated", resp.WarningMessage)
+	require.Equal(t, "t1", resp.TrackerID)
+
+	req = announce("198.51.100.1", "-TR2940-000000000000")
+	req.Params = mockParams{"key": "secret"}
+	req.TrackerID = "t0"
+	ctx = context.WithValue(context.Background(), bittorrent.RouteParamsKey, bittorrent.RouteParams{{Key: "passkey", Value: "abc"}})
+	resp = &bittorrent.AnnounceResponse{}
+	ctx, err = h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+	require.Equal(t, uint32(50), req.NumWant)
+	require.Equal(t, "your client is deprecated", resp.WarningMessage)
+	require.Equal(t, "", resp.TrackerID)
+	require.Equal(t, "gold", ctx.Value(ContextKey("tier")))
+}
+
+func TestHandleScrape(t *testing.T) {
+	h, err := NewHook(Config{Script: `
+if action == "scrape" and len(infohashes) > 1 and frontend == "udp":
+	reject("one infohash at a time")
+`})
+	require.Nil(t, err)
+
+	req := &bittorrent.ScrapeRequest{
+		IP:         net.ParseIP("192.0.2.1"),
+		InfoHashes: []bittorrent.InfoHash{bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa"), bittorrent.InfoHashFromString("bbbbbbbbbbbbbbbbbbbb")},
+	}
+	_, err = h.HandleScrape(context.Background(), req, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+
+	ctx := context.WithValue(context.Background(), bittorrent.FrontendKey, "udp")
+	_, err = h.HandleScrape(ctx, req, &bittorrent.ScrapeResponse{})
+	require.Equal(t, bittorrent.ClientError("one infohash at a time"), err)
+}
+
+func TestFailures(t *testing.T) {
+	src := `response.numwant = 1; response.interval = response.numwant`
+	req := announce("192.0.2.1", "-TR2940-000000000000")
+
+	h, err := NewHook(Config{Script: src})
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.EqualError(t, err, "script: response.interval can not be set to int")
+	require.Equal(t, uint32(50), req.NumWant)
+
+	h, err = NewHook(Config{Script: src, FailOpen: true})
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, uint32(50), req.NumWant)
+
+	h, err = NewHook(Config{Script: "for i in range(1000000):\n\tpass", MaxSteps: 1000})
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.EqualError(t, err, "script: Starlark computation cancelled: too many steps")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h, err = NewHook(Config{Script: "for i in range(1000000):\n\tpass", MaxSteps: 1 << 30})
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(ctx, req, &bittorrent.AnnounceResponse{})
+	require.EqualError(t, err, "script: Starlark computation cancelled: context canceled")
+
+	h, err = NewHook(Config{Script: `load("os.star", "os")`})
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.EqualError(t, err, "script: load not implemented by this application")
+
+	h, err = NewHook(Config{Script: `now = time.now()`})
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.EqualError(t, err, "script: module has no .now field or method")
+}
+
+func TestNumWant(t *testing.T) {
+	h, err := NewHook(Config{Script: `response.numwant = int(param("numwant"))`})
+	require.Nil(t, err)
+
+	for _, tt := range []struct {
+		numwant  string
+		max      interface{}
+		expected uint32
+	}{
+		{"-1", nil, 0},
+		{"20", nil, 20},
+		{"4294967297", nil, 4294967295},
+		{"4294967297", uint32(100), 100},
+		{"99", uint32(100), 99},
+		{"1000", uint32(100), 100},
+	} {
+		req := announce("192.0.2.1", "-TR2940-000000000000")
+		req.Params = mockParams{"numwant": tt.numwant}
+		ctx := context.Background()
+		if tt.max != nil {
+			ctx = context.WithValue(ctx, bittorrent.MaxNumWantKey, tt.max)
+		}
+		_, err = h.HandleAnnounce(ctx, req, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, req.NumWant, "numwant %s, max %v", tt.numwant, tt.max)
+	}
+}
+
+func TestStore(t *testing.T) {
+	h, err := NewHook(Config{Script: `
+store("flag", True)
+store("count", port)
+store("wait", 90 * time.second)
+store("list", [event, infohash == None, time.parse_duration("1m30s")])
+`})
+	require.Nil(t, err)
+
+	req := announce("192.0.2.1", "-TR2940-000000000000")
+	req.Port = 6881
+	req.Event = bittorrent.Started
+	ctx, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, true, ctx.Value(ContextKey("flag")))
+	require.Equal(t, int64(6881), ctx.Value(ContextKey("count")))
+	require.Equal(t, 90*time.Second, ctx.Value(ContextKey("wait")))
+	require.Equal(t, []interface{}{"started", false, 90 * time.Second}, ctx.Value(ContextKey("list")))
+
+	h, err = NewHook(Config{Script: `store("response", response)`})
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.EqualError(t, err, "script: store: can not store response")
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policy.star")
+	require.Nil(t, ioutil.WriteFile(path, []byte(`reject("first")`), 0o644))
+
+	clock := timecache.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	h, err := NewHook(Config{
+		Path:           path,
+		ReloadInterval: time.Minute,
+		Clock:          clock,
+	})
+	require.Nil(t, err)
+	defer func() { require.Empty(t, h.(*hook).Stop().Wait()) }()
+
+	check := func(expected error) {
+		_, err := h.HandleAnnounce(context.Background(), announce("192.0.2.1", "-TR2940-000000000000"), &bittorrent.AnnounceResponse{})
+		require.Equal(t, expected, err)
+	}
+	check(bittorrent.ClientError("first"))
+
+	// Change the file and make sure its modification time changes, too.
+	require.Nil(t, ioutil.WriteFile(path, []byte(`reject("second")`), 0o644))
+	later := time.Now().Add(time.Hour)
+	require.Nil(t, os.Chtimes(path, later, later))
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+	check(bittorrent.ClientError("second"))
+
+	// An invalid script keeps the previous one.
+	require.Nil(t, ioutil.WriteFile(path, []byte(`reject(`), 0o644))
+	later = later.Add(time.Hour)
+	require.Nil(t, os.Chtimes(path, later, later))
+
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+	check(bittorrent.ClientError("second"))
+}
+
+func TestChainContext(t *testing.T) {
+	h, err := NewHook(Config{Script: `if chain == "private": reject("private")`})
+	require.Nil(t, err)
+
+	ctx := context.WithValue(context.Background(), middleware.ChainKey, "private")
+	_, err = h.HandleAnnounce(ctx, announce("192.0.2.1", "-TR2940-000000000000"), &bittorrent.AnnounceResponse{})
+	require.Equal(t, bittorrent.ClientError("private"), err)
+}
+
+type mockParams map[string]string
+
+func (p mockParams) String(key string) (string, bool) {
+	v, ok := p[key]
+	return v, ok
+}
+
+func (p mockParams) RawPath() string  { return "" }
+func (p mockParams) RawQuery() string { return "" }
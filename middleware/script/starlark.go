@@ -0,0 +1,367 @@
+package script
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	startime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+)
+
+// fileOptions are the Starlark dialect scripts are written in.
+//
+// Top-level if statements and for loops are allowed, because scripts have no
+// other entry point. While loops and recursion stay disabled.
+var fileOptions = &syntax.FileOptions{
+	Set:             true,
+	TopLevelControl: true,
+}
+
+// requestNames are the variables describing a request.
+// Names that do not apply to a request are None.
+var requestNames = []string{
+	"action",
+	"frontend",
+	"route",
+	"chain",
+	"ip",
+	"address_family",
+	"infohash",
+	"infohashes",
+	"peer_id",
+	"port",
+	"event",
+	"uploaded",
+	"downloaded",
+	"left",
+	"compact",
+	"client",
+	"response",
+}
+
+// builtins are the functions and modules scripts can use in addition to the
+// Starlark universe.
+var builtins = starlark.StringDict{
+	"reject":      starlark.NewBuiltin("reject", reject),
+	"store":       starlark.NewBuiltin("store", store),
+	"param":       starlark.NewBuiltin("param", param),
+	"route_param": starlark.NewBuiltin("route_param", routeParam),
+	"version":     starlark.NewBuiltin("version", version),
+	"in_cidr":     starlark.NewBuiltin("in_cidr", inCIDR),
+
+	// The time module without the functions depending on the clock or the
+	// time zone database.
+	"time": &starlarkstruct.Module{
+		Name: "time",
+		Members: starlark.StringDict{
+			"parse_duration": startime.Module.Members["parse_duration"],
+			"millisecond":    startime.Module.Members["millisecond"],
+			"second":         startime.Module.Members["second"],
+			"minute":         startime.Module.Members["minute"],
+			"hour":           startime.Module.Members["hour"],
+		},
+	},
+}
+
+func init() {
+	builtins.Freeze()
+}
+
+func isPredeclared(name string) bool {
+	if builtins.Has(name) {
+		return true
+	}
+	for _, n := range requestNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// compile parses and resolves a script.
+func compile(filename, src string) (*starlark.Program, error) {
+	_, p, err := starlark.SourceProgramOptions(fileOptions, filename, src, isPredeclared)
+	return p, err
+}
+
+// envKey is the key of the *env of a thread.
+const envKey = "chihaya.env"
+
+// env holds the state of a script running for a request.
+type env struct {
+	params      bittorrent.Params
+	routeParams bittorrent.RouteParams
+
+	rejected *string
+	stores   map[string]interface{}
+}
+
+// rejection is the error ending a script that rejected a request.
+type rejection struct{}
+
+func (rejection) Error() string { return "rejected" }
+
+// run runs p for a request described by vars.
+func (e *env) run(ctx context.Context, p *starlark.Program, maxSteps int, vars starlark.StringDict) error {
+	thread := &starlark.Thread{Name: Name}
+	thread.SetLocal(envKey, e)
+	thread.SetMaxExecutionSteps(uint64(maxSteps))
+	defer context.AfterFunc(ctx, func() { thread.Cancel(ctx.Err().Error()) })()
+
+	predeclared := make(starlark.StringDict, len(builtins)+len(vars))
+	for name, v := range builtins {
+		predeclared[name] = v
+	}
+	for _, name := range requestNames {
+		predeclared[name] = starlark.None
+	}
+	for name, v := range vars {
+		predeclared[name] = v
+	}
+
+	_, err := p.Init(thread, predeclared)
+	if e.rejected != nil {
+		return nil
+	}
+	return err
+}
+
+func threadEnv(thread *starlark.Thread) *env {
+	return thread.Local(envKey).(*env)
+}
+
+func reject(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var reason string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &reason); err != nil {
+		return nil, err
+	}
+	threadEnv(thread).rejected = &reason
+	return nil, rejection{}
+}
+
+func store(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key string
+	var value starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &key, &value); err != nil {
+		return nil, err
+	}
+	v, err := toGo(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", b.Name(), err)
+	}
+	threadEnv(thread).stores[key] = v
+	return starlark.None, nil
+}
+
+// toGo converts a Starlark value to the Go value stored in the context.
+func toGo(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.Int:
+		i, ok := v.Int64()
+		if !ok {
+			return nil, fmt.Errorf("integer %s out of range", v)
+		}
+		return i, nil
+	case starlark.String:
+		return string(v), nil
+	case startime.Duration:
+		return time.Duration(v), nil
+	case starlark.Indexable:
+		l := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			e, err := toGo(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, e)
+		}
+		return l, nil
+	}
+	return nil, fmt.Errorf("can not store %s", v.Type())
+}
+
+func param(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name); err != nil {
+		return nil, err
+	}
+	e := threadEnv(thread)
+	if e.params == nil {
+		return starlark.String(""), nil
+	}
+	v, _ := e.params.String(name)
+	return starlark.String(v), nil
+}
+
+func routeParam(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name); err != nil {
+		return nil, err
+	}
+	return starlark.String(threadEnv(thread).routeParams.ByName(name)), nil
+}
+
+func version(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &s); err != nil {
+		return nil, err
+	}
+	v, err := bittorrent.ParseClientVersion(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", b.Name(), err)
+	}
+	return starlark.MakeInt64(int64(v.Major)*1000000 + int64(v.Minor)*1000 + int64(v.Patch)), nil
+}
+
+func inCIDR(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var ip, cidr string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &ip, &cidr); err != nil {
+		return nil, err
+	}
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", b.Name(), err)
+	}
+	parsed := net.ParseIP(ip)
+	return starlark.Bool(parsed != nil && n.Contains(parsed)), nil
+}
+
+// response is the part of an announce response a script can change.
+//
+// Changes are applied to the response after the script succeeded.
+type response struct {
+	interval       startime.Duration
+	minInterval    startime.Duration
+	numWant        uint32
+	maxNumWant     uint32
+	warningMessage string
+	trackerID      string
+	trackerIDSet   bool
+	frozen         bool
+}
+
+var (
+	_ starlark.HasAttrs    = (*response)(nil)
+	_ starlark.HasSetField = (*response)(nil)
+)
+
+var responseFields = []string{"interval", "min_interval", "numwant", "warning_message", "tracker_id"}
+
+func (r *response) String() string        { return "response" }
+func (r *response) Type() string          { return "response" }
+func (r *response) Freeze()               { r.frozen = true }
+func (r *response) Truth() starlark.Bool  { return true }
+func (r *response) AttrNames() []string   { return responseFields }
+func (r *response) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: %s", r.Type()) }
+
+func (r *response) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "interval":
+		return r.interval, nil
+	case "min_interval":
+		return r.minInterval, nil
+	case "numwant":
+		return starlark.MakeUint(uint(r.numWant)), nil
+	case "warning_message":
+		return starlark.String(r.warningMessage), nil
+	case "tracker_id":
+		return starlark.String(r.trackerID), nil
+	}
+	return nil, nil
+}
+
+func (r *response) SetField(name string, v starlark.Value) error {
+	if r.frozen {
+		return fmt.Errorf("cannot set %s of frozen response", name)
+	}
+
+	var ok bool
+	switch name {
+	case "interval", "min_interval":
+		var d startime.Duration
+		d, ok = v.(startime.Duration)
+		if ok && d < 0 {
+			return fmt.Errorf("response.%s must not be negative", name)
+		}
+		if ok && name == "interval" {
+			r.interval = d
+		} else if ok {
+			r.minInterval = d
+		}
+	case "numwant":
+		var n starlark.Int
+		n, ok = v.(starlark.Int)
+		if ok {
+			r.numWant = clampNumWant(n, r.maxNumWant)
+		}
+	case "warning_message", "tracker_id":
+		var s starlark.String
+		s, ok = v.(starlark.String)
+		if ok && name == "warning_message" {
+			r.warningMessage = string(s)
+		} else if ok {
+			r.trackerID = string(s)
+			r.trackerIDSet = true
+		}
+	default:
+		return starlark.NoSuchAttrError(fmt.Sprintf("response has no field %s", name))
+	}
+
+	if !ok {
+		return fmt.Errorf("response.%s can not be set to %s", name, v.Type())
+	}
+	return nil
+}
+
+// clampNumWant clamps n to the range from zero to max.
+func clampNumWant(n starlark.Int, max uint32) uint32 {
+	if n.Sign() < 0 {
+		return 0
+	}
+	if i, ok := n.Uint64(); ok && i < uint64(max) {
+		return uint32(i)
+	}
+	return max
+}
+
+// newResponse returns the response for an announce with the limit for numwant
+// of the frontend in ctx, or no limit but the range of uint32 if there is no
+// frontend.
+func newResponse(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) *response {
+	r := &response{
+		interval:       startime.Duration(resp.Interval),
+		minInterval:    startime.Duration(resp.MinInterval),
+		numWant:        req.NumWant,
+		maxNumWant:     math.MaxUint32,
+		warningMessage: resp.WarningMessage,
+		trackerID:      req.TrackerID,
+	}
+	if max, ok := ctx.Value(bittorrent.MaxNumWantKey).(uint32); ok {
+		r.maxNumWant = max
+	}
+	if resp.TrackerID != "" {
+		r.trackerID = resp.TrackerID
+	}
+	return r
+}
+
+// apply applies the changes made by a script.
+func (r *response) apply(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	resp.Interval = time.Duration(r.interval)
+	resp.MinInterval = time.Duration(r.minInterval)
+	req.NumWant = r.numWant
+	resp.WarningMessage = r.warningMessage
+	if r.trackerIDSet {
+		resp.TrackerID = r.trackerID
+	}
+}
@@ -0,0 +1,283 @@
+package torrentapproval
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/frontend/http/bencode"
+	"github.com/doujincafe/chihaya/pkg/log"
+)
+
+// Constants for loading sources.
+const (
+	maxListSize    = 64 << 20
+	maxTorrentSize = 64 << 20
+	fetchTimeout   = 30 * time.Second
+)
+
+// ErrInvalidSource is returned for a SourceConfig that does not set exactly
+// one of its fields.
+var ErrInvalidSource = errors.New("exactly one of file, directory and url must be set")
+
+// SourceConfig configures a source of infohashes.
+//
+// Exactly one of the fields must be set.
+type SourceConfig struct {
+	// File is the path of a file containing one hex-encoded infohash per
+	// line.
+	File string `yaml:"file"`
+
+	// Directory is the path of a directory containing .torrent files.
+	Directory string `yaml:"directory"`
+
+	// URL is the URL of a document in the same format as File.
+	URL string `yaml:"url"`
+}
+
+func (cfg SourceConfig) String() string {
+	switch {
+	case cfg.File != "":
+		return "file " + cfg.File
+	case cfg.Directory != "":
+		return "directory " + cfg.Directory
+	default:
+		return "url " + cfg.URL
+	}
+}
+
+// A source loads infohashes and remembers enough state to detect changes.
+type source interface {
+	// load returns the infohashes of the source.
+	// If the source did not change since the last successful call, load
+	// returns changed == false and no infohashes.
+	load() (hashes []bittorrent.InfoHash, changed bool, err error)
+}
+
+func newSource(cfg SourceConfig) (source, error) {
+	var set int
+	for _, s := range []string{cfg.File, cfg.Directory, cfg.URL} {
+		if s != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, ErrInvalidSource
+	}
+
+	switch {
+	case cfg.File != "":
+		return &fileSource{path: cfg.File}, nil
+	case cfg.Directory != "":
+		return &dirSource{path: cfg.Directory, files: make(map[string]torrentFile)}, nil
+	default:
+		return &urlSource{url: cfg.URL, client: &http.Client{Timeout: fetchTimeout}}, nil
+	}
+}
+
+// fileState is used to detect changes to a file.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func stateOf(fi os.FileInfo) fileState {
+	return fileState{modTime: fi.ModTime(), size: fi.Size()}
+}
+
+type fileSource struct {
+	path  string
+	state fileState
+}
+
+func (s *fileSource) load() ([]bittorrent.InfoHash, bool, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return nil, false, err
+	}
+	state := stateOf(fi)
+	if state == s.state {
+		return nil, false, nil
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	hashes, err := parseList(f)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %s", s.path, err)
+	}
+
+	s.state = state
+	return hashes, true, nil
+}
+
+type torrentFile struct {
+	state    fileState
+	infoHash bittorrent.InfoHash
+	valid    bool
+}
+
+type dirSource struct {
+	path  string
+	files map[string]torrentFile
+}
+
+func (s *dirSource) load() ([]bittorrent.InfoHash, bool, error) {
+	entries, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	changed := false
+	files := make(map[string]torrentFile, len(entries))
+	for _, fi := range entries {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".torrent") {
+			continue
+		}
+
+		state := stateOf(fi)
+		if prev, ok := s.files[fi.Name()]; ok && prev.state == state {
+			files[fi.Name()] = prev
+			continue
+		}
+		changed = true
+
+		path := filepath.Join(s.path, fi.Name())
+		ih, err := infoHashFromTorrent(path)
+		if err != nil {
+			// The file may still be written to, it is tried again once
+			// it changes.
+			log.Warn("torrentapproval: skipping invalid torrent file", log.Fields{"path": path}, log.Err(err))
+		}
+		files[fi.Name()] = torrentFile{state: state, infoHash: ih, valid: err == nil}
+	}
+	if len(files) != len(s.files) {
+		changed = true
+	}
+	if !changed {
+		return nil, false, nil
+	}
+
+	s.files = files
+	hashes := make([]bittorrent.InfoHash, 0, len(files))
+	for _, f := range files {
+		if f.valid {
+			hashes = append(hashes, f.infoHash)
+		}
+	}
+	return hashes, true, nil
+}
+
+// infoHashFromTorrent computes the infohash of the metainfo file at path.
+func infoHashFromTorrent(path string) (bittorrent.InfoHash, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return bittorrent.InfoHash{}, err
+	}
+	defer f.Close()
+
+	buf, err := ioutil.ReadAll(io.LimitReader(f, maxTorrentSize))
+	if err != nil {
+		return bittorrent.InfoHash{}, err
+	}
+
+	values, err := bencode.RawDictValues(buf)
+	if err != nil {
+		return bittorrent.InfoHash{}, err
+	}
+
+	info, ok := values["info"]
+	if !ok || len(info) == 0 || info[0] != 'd' {
+		return bittorrent.InfoHash{}, errors.New("missing info dictionary")
+	}
+
+	return bittorrent.InfoHash(sha1.Sum(info)), nil
+}
+
+type urlSource struct {
+	url          string
+	client       *http.Client
+	etag         string
+	lastModified string
+}
+
+func (s *urlSource) load() ([]bittorrent.InfoHash, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	if s.lastModified != "" {
+		req.Header.Set("If-Modified-Since", s.lastModified)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil, false, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("%s: unexpected status %s", s.url, resp.Status)
+	}
+
+	hashes, err := parseList(io.LimitReader(resp.Body, maxListSize))
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %s", s.url, err)
+	}
+
+	s.etag = resp.Header.Get("ETag")
+	s.lastModified = resp.Header.Get("Last-Modified")
+	return hashes, true, nil
+}
+
+// parseList parses a list of hex-encoded infohashes, one per line.
+// Empty lines and lines starting with '#' are ignored.
+func parseList(r io.Reader) ([]bittorrent.InfoHash, error) {
+	var hashes []bittorrent.InfoHash
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		ih, err := parseInfoHash(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		hashes = append(hashes, ih)
+	}
+
+	return hashes, scanner.Err()
+}
+
+func parseInfoHash(s string) (bittorrent.InfoHash, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return bittorrent.InfoHash{}, fmt.Errorf("invalid hash %s", s)
+	}
+	if len(b) != 20 {
+		return bittorrent.InfoHash{}, fmt.Errorf("hash %s is not 20 bytes", s)
+	}
+	return bittorrent.InfoHashFromBytes(b), nil
+}
@@ -1,16 +1,24 @@
 // Package torrentapproval implements a Hook that fails an Announce based on a
 // whitelist or blacklist of torrent hash.
+//
+// The lists can be given inline or loaded from files, directories of .torrent
+// files or URLs, which are reloaded when they change.
 package torrentapproval
 
 import (
 	"context"
-	"encoding/hex"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/doujincafe/chihaya/bittorrent"
 	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/pkg/stop"
+	"github.com/doujincafe/chihaya/pkg/timecache"
 )
 
 // Name is the name by which this middleware is registered with Chihaya.
@@ -20,7 +28,10 @@ func init() {
 	middleware.RegisterDriver(Name, driver{})
 }
 
-var _ middleware.Driver = driver{}
+var (
+	_ middleware.Driver  = driver{}
+	_ middleware.Checker = driver{}
+)
 
 type driver struct{}
 
@@ -34,6 +45,51 @@ func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
 	return NewHook(cfg)
 }
 
+// CheckOptions checks options without creating a Hook.
+//
+// Inline infohashes and local sources are loaded, URLs are not fetched.
+func (d driver) CheckOptions(optionBytes []byte) error {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	whitelisting := len(cfg.Whitelist) > 0 || len(cfg.WhitelistSources) > 0
+	blacklisting := len(cfg.Blacklist) > 0 || len(cfg.BlacklistSources) > 0
+	if whitelisting && blacklisting {
+		return fmt.Errorf("using both whitelist and blacklist is invalid")
+	}
+
+	for _, hashString := range cfg.Whitelist {
+		if _, err := parseInfoHash(hashString); err != nil {
+			return fmt.Errorf("whitelist : %s", err)
+		}
+	}
+
+	for _, hashString := range cfg.Blacklist {
+		if _, err := parseInfoHash(hashString); err != nil {
+			return fmt.Errorf("blacklist : %s", err)
+		}
+	}
+
+	for _, srcCfg := range append(cfg.WhitelistSources, cfg.BlacklistSources...) {
+		src, err := newSource(srcCfg)
+		if err != nil {
+			return err
+		}
+		if srcCfg.URL != "" {
+			continue
+		}
+
+		if _, _, err := src.load(); err != nil {
+			return fmt.Errorf("failed to load %s: %s", srcCfg, err)
+		}
+	}
+
+	return nil
+}
+
 // ErrTorrentUnapproved is the error returned when a torrent hash is invalid.
 var ErrTorrentUnapproved = bittorrent.ClientError("unapproved torrent")
 
@@ -42,62 +98,171 @@ var ErrTorrentUnapproved = bittorrent.ClientError("unapproved torrent")
 type Config struct {
 	Whitelist []string `yaml:"whitelist"`
 	Blacklist []string `yaml:"blacklist"`
+
+	// WhitelistSources and BlacklistSources are loaded in addition to the
+	// inline lists.
+	WhitelistSources []SourceConfig `yaml:"whitelist_sources"`
+	BlacklistSources []SourceConfig `yaml:"blacklist_sources"`
+
+	// ReloadInterval is the interval at which the sources are checked for
+	// changes. Zero disables reloading.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// Clock is used to schedule reloading.
+	// If it is nil, the global timecache is used.
+	Clock timecache.Clock `yaml:"-"`
 }
 
-type hook struct {
+// lists is an immutable snapshot of the approved and unapproved infohashes.
+type lists struct {
 	approved   map[bittorrent.InfoHash]struct{}
 	unapproved map[bittorrent.InfoHash]struct{}
 }
 
+// loadedSource is a source along with the infohashes it provided last.
+type loadedSource struct {
+	cfg    SourceConfig
+	src    source
+	hashes []bittorrent.InfoHash
+}
+
+type hook struct {
+	cfg       Config
+	whitelist bool
+
+	inline  []bittorrent.InfoHash
+	sources []*loadedSource
+
+	// lists holds the current *lists.
+	lists atomic.Value
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
 // NewHook returns an instance of the torrent approval middleware.
+//
+// If sources are configured and ReloadInterval is set, the returned Hook
+// implements stop.Stopper and must be stopped to stop reloading.
 func NewHook(cfg Config) (middleware.Hook, error) {
-	h := &hook{
-		approved:   make(map[bittorrent.InfoHash]struct{}),
-		unapproved: make(map[bittorrent.InfoHash]struct{}),
+	whitelisting := len(cfg.Whitelist) > 0 || len(cfg.WhitelistSources) > 0
+	blacklisting := len(cfg.Blacklist) > 0 || len(cfg.BlacklistSources) > 0
+	if whitelisting && blacklisting {
+		return nil, fmt.Errorf("using both whitelist and blacklist is invalid")
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = timecache.Default()
 	}
 
-	if len(cfg.Whitelist) > 0 && len(cfg.Blacklist) > 0 {
-		return nil, fmt.Errorf("using both whitelist and blacklist is invalid")
+	h := &hook{
+		cfg:       cfg,
+		whitelist: whitelisting,
+		closed:    make(chan struct{}),
 	}
 
 	for _, hashString := range cfg.Whitelist {
-		hashinfo, err := hex.DecodeString(hashString)
+		ih, err := parseInfoHash(hashString)
 		if err != nil {
-			return nil, fmt.Errorf("whitelist : invalid hash %s", hashString)
+			return nil, fmt.Errorf("whitelist : %s", err)
 		}
-		if len(hashinfo) != 20 {
-			return nil, fmt.Errorf("whitelist : hash %s is not 20 byes", hashString)
-		}
-		h.approved[bittorrent.InfoHashFromBytes(hashinfo)] = struct{}{}
+		h.inline = append(h.inline, ih)
 	}
 
 	for _, hashString := range cfg.Blacklist {
-		hashinfo, err := hex.DecodeString(hashString)
+		ih, err := parseInfoHash(hashString)
+		if err != nil {
+			return nil, fmt.Errorf("blacklist : %s", err)
+		}
+		h.inline = append(h.inline, ih)
+	}
+
+	for _, srcCfg := range append(cfg.WhitelistSources, cfg.BlacklistSources...) {
+		src, err := newSource(srcCfg)
 		if err != nil {
-			return nil, fmt.Errorf("blacklist : invalid hash %s", hashString)
+			return nil, err
 		}
-		if len(hashinfo) != 20 {
-			return nil, fmt.Errorf("blacklist : hash %s is not 20 byes", hashString)
+
+		hashes, _, err := src.load()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %s", srcCfg, err)
 		}
-		h.unapproved[bittorrent.InfoHashFromBytes(hashinfo)] = struct{}{}
+		h.sources = append(h.sources, &loadedSource{cfg: srcCfg, src: src, hashes: hashes})
+	}
+
+	h.update()
+
+	if cfg.ReloadInterval > 0 && len(h.sources) > 0 {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			for {
+				select {
+				case <-h.closed:
+					return
+				case <-cfg.Clock.After(cfg.ReloadInterval):
+					h.reload()
+				}
+			}
+		}()
 	}
 
 	return h, nil
 }
 
-func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
-	infohash := req.InfoHash
+// reload reloads all sources and updates the lists if any of them changed.
+// Sources that fail to load keep their previous infohashes.
+func (h *hook) reload() {
+	changed := false
+	for _, s := range h.sources {
+		hashes, sourceChanged, err := s.src.load()
+		if err != nil {
+			log.Error("torrentapproval: failed to reload source, keeping previous infohashes", log.Fields{"source": s.cfg.String()}, log.Err(err))
+			continue
+		}
+		if sourceChanged {
+			s.hashes = hashes
+			changed = true
+		}
+	}
 
-	if len(h.approved) > 0 {
-		if _, found := h.approved[infohash]; !found {
-			return ctx, ErrTorrentUnapproved
+	if changed {
+		h.update()
+	}
+}
+
+// update builds new lists from the inline infohashes and all sources and
+// swaps them in.
+func (h *hook) update() {
+	set := make(map[bittorrent.InfoHash]struct{}, len(h.inline))
+	for _, ih := range h.inline {
+		set[ih] = struct{}{}
+	}
+	for _, s := range h.sources {
+		for _, ih := range s.hashes {
+			set[ih] = struct{}{}
 		}
 	}
 
-	if len(h.unapproved) > 0 {
-		if _, found := h.unapproved[infohash]; found {
+	l := &lists{}
+	if h.whitelist {
+		l.approved = set
+	} else {
+		l.unapproved = set
+	}
+	h.lists.Store(l)
+	log.Debug("torrentapproval: updated lists", log.Fields{"whitelist": h.whitelist, "infoHashes": len(set)})
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	infohash := req.InfoHash
+	l := h.lists.Load().(*lists)
+
+	if h.whitelist {
+		if _, found := l.approved[infohash]; !found {
 			return ctx, ErrTorrentUnapproved
 		}
+	} else if _, found := l.unapproved[infohash]; found {
+		return ctx, ErrTorrentUnapproved
 	}
 
 	return ctx, nil
@@ -107,3 +272,15 @@ func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest,
 	// Scrapes don't require any protection.
 	return ctx, nil
 }
+
+// Stop stops reloading the sources.
+func (h *hook) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		close(h.closed)
+		h.wg.Wait()
+		c.Done()
+	}()
+
+	return c.Result()
+}
@@ -2,13 +2,26 @@ package torrentapproval
 
 import (
 	"context"
+	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/stop"
+	"github.com/doujincafe/chihaya/pkg/timecache"
 )
 
 var cases = []struct {
@@ -77,3 +90,159 @@ func TestHandleAnnounce(t *testing.T) {
 		})
 	}
 }
+
+// torrent returns a minimal metainfo file and its infohash.
+func torrent(name string) ([]byte, bittorrent.InfoHash) {
+	info := fmt.Sprintf("d6:lengthi42e4:name%d:%s12:piece lengthi16384e6:pieces20:%se", len(name), name, strings.Repeat("x", 20))
+	return []byte("d8:announce9:http://tr4:info" + info + "e"), bittorrent.InfoHash(sha1.Sum([]byte(info)))
+}
+
+func announce(t *testing.T, h middleware.Hook, ih bittorrent.InfoHash) error {
+	_, err := h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih}, &bittorrent.AnnounceResponse{})
+	return err
+}
+
+// touch sets the modification time of path into the future, so that changes
+// are detected even if they happen within the resolution of the file system.
+func touch(t *testing.T, path string, offset time.Duration) {
+	mtime := time.Now().Add(offset)
+	require.Nil(t, os.Chtimes(path, mtime, mtime))
+}
+
+func TestFileSource(t *testing.T) {
+	ih1 := bittorrent.InfoHashFromString("01234567890123456789")
+	ih2 := bittorrent.InfoHashFromString("98765432109876543210")
+
+	path := filepath.Join(t.TempDir(), "blacklist.txt")
+	require.Nil(t, ioutil.WriteFile(path, []byte("# comment\n\n"+ih1.String()+"\n"), 0o644))
+
+	clock := timecache.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	h, err := NewHook(Config{
+		BlacklistSources: []SourceConfig{{File: path}},
+		ReloadInterval:   time.Minute,
+		Clock:            clock,
+	})
+	require.Nil(t, err)
+	defer func() { require.Empty(t, h.(stop.Stopper).Stop().Wait()) }()
+
+	require.Equal(t, ErrTorrentUnapproved, announce(t, h, ih1))
+	require.Nil(t, announce(t, h, ih2))
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(ih2.String()+"\n"), 0o644))
+	touch(t, path, time.Hour)
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+	require.Nil(t, announce(t, h, ih1))
+	require.Equal(t, ErrTorrentUnapproved, announce(t, h, ih2))
+
+	// Invalid files keep the previous list.
+	require.Nil(t, ioutil.WriteFile(path, []byte("nope\n"), 0o644))
+	touch(t, path, 2*time.Hour)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+	require.Equal(t, ErrTorrentUnapproved, announce(t, h, ih2))
+
+	_, err = NewHook(Config{BlacklistSources: []SourceConfig{{File: path}}})
+	require.EqualError(t, err, "failed to load file "+path+": "+path+": line 1: invalid hash nope")
+}
+
+func TestDirectorySource(t *testing.T) {
+	dir := t.TempDir()
+	t1, ih1 := torrent("one")
+	t2, ih2 := torrent("two")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "one.torrent"), t1, 0o644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "broken.torrent"), []byte("d4:info"), 0o644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a torrent"), 0o644))
+
+	clock := timecache.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	h, err := NewHook(Config{
+		WhitelistSources: []SourceConfig{{Directory: dir}},
+		ReloadInterval:   time.Minute,
+		Clock:            clock,
+	})
+	require.Nil(t, err)
+	defer func() { require.Empty(t, h.(stop.Stopper).Stop().Wait()) }()
+
+	require.Nil(t, announce(t, h, ih1))
+	require.Equal(t, ErrTorrentUnapproved, announce(t, h, ih2))
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "two.torrent"), t2, 0o644))
+	require.Nil(t, os.Remove(filepath.Join(dir, "one.torrent")))
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+	require.Equal(t, ErrTorrentUnapproved, announce(t, h, ih1))
+	require.Nil(t, announce(t, h, ih2))
+}
+
+func TestURLSource(t *testing.T) {
+	ih1 := bittorrent.InfoHashFromString("01234567890123456789")
+	ih2 := bittorrent.InfoHashFromString("98765432109876543210")
+
+	var m sync.Mutex
+	body, status := ih1.String()+"\n", http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		if r.Header.Get("If-None-Match") == `"`+body+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"`+body+`"`)
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	set := func(b string, s int) {
+		m.Lock()
+		defer m.Unlock()
+		body, status = b, s
+	}
+
+	clock := timecache.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	h, err := NewHook(Config{
+		WhitelistSources: []SourceConfig{{URL: srv.URL}},
+		ReloadInterval:   time.Minute,
+		Clock:            clock,
+	})
+	require.Nil(t, err)
+	defer func() { require.Empty(t, h.(stop.Stopper).Stop().Wait()) }()
+
+	advance := func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Minute)
+		clock.BlockUntil(1)
+	}
+
+	require.Nil(t, announce(t, h, ih1))
+	require.Equal(t, ErrTorrentUnapproved, announce(t, h, ih2))
+
+	// Not modified.
+	advance()
+	require.Nil(t, announce(t, h, ih1))
+
+	set(ih2.String()+"\n", http.StatusOK)
+	advance()
+	require.Equal(t, ErrTorrentUnapproved, announce(t, h, ih1))
+	require.Nil(t, announce(t, h, ih2))
+
+	// Errors keep the previous list.
+	set("", http.StatusInternalServerError)
+	advance()
+	require.Nil(t, announce(t, h, ih2))
+}
+
+func TestInvalidConfig(t *testing.T) {
+	_, err := NewHook(Config{WhitelistSources: []SourceConfig{{}}})
+	require.Equal(t, ErrInvalidSource, err)
+
+	_, err = NewHook(Config{WhitelistSources: []SourceConfig{{File: "a", URL: "b"}}})
+	require.Equal(t, ErrInvalidSource, err)
+
+	_, err = NewHook(Config{
+		Whitelist:        []string{"3532cf2d327fad8448c075b4cb42c8136964a435"},
+		BlacklistSources: []SourceConfig{{File: "a"}},
+	})
+	require.NotNil(t, err)
+}
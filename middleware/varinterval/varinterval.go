@@ -21,7 +21,10 @@ func init() {
 	middleware.RegisterDriver(Name, driver{})
 }
 
-var _ middleware.Driver = driver{}
+var (
+	_ middleware.Driver  = driver{}
+	_ middleware.Checker = driver{}
+)
 
 type driver struct{}
 
@@ -35,6 +38,17 @@ func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
 	return NewHook(cfg)
 }
 
+// CheckOptions checks options without creating a Hook.
+func (d driver) CheckOptions(optionBytes []byte) error {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return checkConfig(cfg)
+}
+
 // ErrInvalidModifyResponseProbability is returned for a config with an invalid
 // ModifyResponseProbability.
 var ErrInvalidModifyResponseProbability = errors.New("invalid modify_response_probability")
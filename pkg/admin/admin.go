@@ -0,0 +1,406 @@
+// Package admin implements an authenticated HTTP API for inspecting and
+// operating a running tracker.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/pkg/log"
+	"github.com/doujincafe/chihaya/pkg/stop"
+	"github.com/doujincafe/chihaya/storage"
+)
+
+// ErrMissingToken is returned for a Config with an Addr but no Token.
+var ErrMissingToken = errors.New("admin: token must be set")
+
+// processStart is the time the process started, approximately.
+var processStart = time.Now()
+
+// Config represents all of the configurable options of the admin API.
+type Config struct {
+	// Addr is the address the admin API listens on. It should not be
+	// reachable from the internet.
+	Addr string `yaml:"addr"`
+
+	// Token authenticates requests, which must carry it in an
+	// "Authorization: Bearer <token>" header.
+	Token string `yaml:"token"`
+
+	// Listen is used to get the listener for Addr.
+	// If it is nil, the address is bound with net.Listen.
+	Listen func(addr string) (net.Listener, error) `yaml:"-"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"addr": cfg.Addr,
+	}
+}
+
+// Check validates a config like NewServer does, without binding any ports.
+func (cfg Config) Check() error {
+	if cfg.Token == "" {
+		return ErrMissingToken
+	}
+
+	_, err := net.ResolveTCPAddr("tcp", cfg.Addr)
+	return err
+}
+
+// Tracker holds the parts of a running tracker the admin API operates on.
+type Tracker struct {
+	// Config is the effective configuration of the tracker. It is rendered
+	// as YAML.
+	Config interface{}
+
+	Logic     *middleware.Logic
+	PeerStore storage.PeerStore
+
+	// Reload requests the tracker to reload its configuration. It must not
+	// wait for the reload, as the reload stops the Server.
+	Reload func()
+
+	// Started is the time the tracker was started or last reloaded.
+	Started time.Time
+}
+
+// Server is an HTTP server serving the admin API.
+type Server struct {
+	mu  sync.RWMutex
+	cfg Config
+	t   Tracker
+
+	srv *http.Server
+}
+
+// NewServer creates a new instance of the admin API that asynchronously
+// serves requests.
+func NewServer(cfg Config, t Tracker) (*Server, error) {
+	if cfg.Token == "" {
+		return nil, ErrMissingToken
+	}
+
+	s := &Server{cfg: cfg, t: t}
+	s.srv = &http.Server{
+		Handler:      s.handler(),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: time.Minute,
+	}
+
+	listen := cfg.Listen
+	if listen == nil {
+		listen = func(addr string) (net.Listener, error) { return net.Listen("tcp", addr) }
+	}
+	l, err := listen(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := s.srv.Serve(l); err != http.ErrServerClosed {
+			log.Fatal("failed while serving admin API", log.Err(err))
+		}
+	}()
+
+	return s, nil
+}
+
+// Update replaces the Config and Tracker of a running Server.
+//
+// cfg must pass Check. Its address is ignored: the Server keeps listening on
+// the address it was created with.
+func (s *Server) Update(cfg Config, t Tracker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+	s.t = t
+}
+
+// tracker returns the current Tracker.
+func (s *Server) tracker() Tracker {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t
+}
+
+// Stop shuts down the server.
+func (s *Server) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		c.Done(s.srv.Shutdown(context.Background()))
+	}()
+
+	return c.Result()
+}
+
+func (s *Server) handler() http.Handler {
+	r := httprouter.New()
+	r.GET("/config", s.authenticated(s.getConfig))
+	r.GET("/version", s.authenticated(s.getVersion))
+	r.GET("/hooks", s.authenticated(s.getHooks))
+	r.POST("/hooks/:chain/:phase/:index/:action", s.authenticated(s.toggleHook))
+	r.DELETE("/swarms/:infohash", s.authenticated(s.deleteSwarm))
+	r.DELETE("/swarms/:infohash/peers/:peerid", s.authenticated(s.deletePeer))
+	r.POST("/gc", s.authenticated(s.collectGarbage))
+	r.POST("/reload", s.authenticated(s.reload))
+	return r
+}
+
+// authenticated wraps a handler to reject requests without the token.
+func (s *Server) authenticated(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		s.mu.RLock()
+		expected := []byte("Bearer " + s.cfg.Token)
+		s.mu.RUnlock()
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("admin: failed to write response", log.Err(err))
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (s *Server) getConfig(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	b, err := yaml.Marshal(render(s.tracker().Config))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(b)
+}
+
+// versionInfo describes the build and uptime of the tracker.
+type versionInfo struct {
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	Sum       string `json:"sum,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+
+	Started       time.Time `json:"started"`
+	Uptime        string    `json:"uptime"`
+	Reloaded      time.Time `json:"reloaded"`
+	SinceReloaded string    `json:"since_reloaded"`
+}
+
+func (s *Server) getVersion(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	now := time.Now()
+	started := s.tracker().Started
+	info := versionInfo{
+		GoVersion:     runtime.Version(),
+		Platform:      runtime.GOOS + "/" + runtime.GOARCH,
+		Started:       processStart,
+		Uptime:        now.Sub(processStart).Round(time.Second).String(),
+		Reloaded:      started,
+		SinceReloaded: now.Sub(started).Round(time.Second).String(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.Module = bi.Main.Path
+		info.Version = bi.Main.Version
+		info.Sum = bi.Main.Sum
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (s *Server) getHooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	hooks := s.tracker().Logic.Hooks()
+	if hooks == nil {
+		hooks = []middleware.HookStatus{}
+	}
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+func (s *Server) toggleHook(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var enabled bool
+	switch ps.ByName("action") {
+	case "enable":
+		enabled = true
+	case "disable":
+	default:
+		writeError(w, http.StatusNotFound, errors.New("action must be enable or disable"))
+		return
+	}
+
+	index, err := strconv.Atoi(ps.ByName("index"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid index"))
+		return
+	}
+
+	err = s.tracker().Logic.SetHookEnabled(ps.ByName("chain"), ps.ByName("phase"), index, enabled)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	log.Info("admin: toggled hook", log.Fields{
+		"chain":   ps.ByName("chain"),
+		"phase":   ps.ByName("phase"),
+		"index":   index,
+		"enabled": enabled,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseInfoHash(s string) (bittorrent.InfoHash, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 20 {
+		return bittorrent.InfoHash{}, errors.New("infohash must be 40 hexadecimal characters")
+	}
+	return bittorrent.InfoHashFromBytes(b), nil
+}
+
+func (s *Server) deleteSwarm(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ih, err := parseInfoHash(ps.ByName("infohash"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	d, ok := s.tracker().PeerStore.(storage.SwarmDeleter)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("storage does not support deleting swarms"))
+		return
+	}
+
+	deleted := false
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		err := d.DeleteSwarm(r.Context(), ih, af)
+		switch err {
+		case nil:
+			deleted = true
+		case storage.ErrResourceDoesNotExist:
+		default:
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, storage.ErrResourceDoesNotExist)
+		return
+	}
+
+	log.Info("admin: deleted swarm", log.Fields{"infohash": ih.String()})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deletePeer(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ih, err := parseInfoHash(ps.ByName("infohash"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id, err := hex.DecodeString(ps.ByName("peerid"))
+	if err != nil || len(id) != 20 {
+		writeError(w, http.StatusBadRequest, errors.New("peer ID must be 40 hexadecimal characters"))
+		return
+	}
+
+	ip := net.ParseIP(r.URL.Query().Get("ip"))
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid ip"))
+		return
+	}
+	port, err := strconv.ParseUint(r.URL.Query().Get("port"), 10, 16)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid port"))
+		return
+	}
+
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromBytes(id),
+		Port: uint16(port),
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		peer.IP = bittorrent.IP{IP: ip4, AddressFamily: bittorrent.IPv4}
+	} else {
+		peer.IP = bittorrent.IP{IP: ip, AddressFamily: bittorrent.IPv6}
+	}
+
+	peers := s.tracker().PeerStore
+	deleted := false
+	for _, del := range []func(context.Context, bittorrent.InfoHash, bittorrent.Peer) error{
+		peers.DeleteSeeder,
+		peers.DeleteLeecher,
+	} {
+		err := del(r.Context(), ih, peer)
+		switch err {
+		case nil:
+			deleted = true
+		case storage.ErrResourceDoesNotExist:
+		default:
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, storage.ErrResourceDoesNotExist)
+		return
+	}
+
+	log.Info("admin: deleted peer", log.Fields{"infohash": ih.String(), "peer": peer.String()})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) collectGarbage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	maxAge, err := time.ParseDuration(r.URL.Query().Get("max_age"))
+	if err != nil || maxAge < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("max_age must be a duration"))
+		return
+	}
+
+	gc, ok := s.tracker().PeerStore.(storage.GarbageCollector)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("storage does not support garbage collection"))
+		return
+	}
+
+	start := time.Now()
+	if err := gc.CollectGarbage(start.Add(-maxAge)); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Info("admin: collected garbage", log.Fields{"maxAge": maxAge, "timeTaken": time.Since(start)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) reload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Info("admin: reload requested")
+	s.tracker().Reload()
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,156 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/middleware"
+	"github.com/doujincafe/chihaya/storage"
+	"github.com/doujincafe/chihaya/storage/memory"
+)
+
+var (
+	testIH   = bittorrent.InfoHashFromString("01234567890123456789")
+	testPeer = bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("abcdefghijklmnopqrst"),
+		IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+		Port: 6881,
+	}
+)
+
+type testConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Inline   struct {
+		Name string `yaml:"name"`
+	} `yaml:",inline"`
+	Hidden string `yaml:"-"`
+}
+
+func newTestServer(t *testing.T) (*Server, storage.PeerStore, *int) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Empty(t, ps.Stop().Wait()) })
+
+	l := middleware.NewLogic(middleware.ResponseConfig{}, ps, nil, nil)
+	t.Cleanup(func() { require.Empty(t, l.Stop().Wait()) })
+
+	cfg := testConfig{Interval: 30 * time.Minute, Hidden: "secret"}
+	cfg.Inline.Name = "test"
+
+	reloads := new(int)
+	return &Server{
+		cfg: Config{Token: "token"},
+		t: Tracker{
+			Config:    cfg,
+			Logic:     l,
+			PeerStore: ps,
+			Reload:    func() { *reloads++ },
+			Started:   time.Now(),
+		},
+	}, ps, reloads
+}
+
+func do(s *Server, method, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	s.handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestAuthentication(t *testing.T) {
+	s, _, _ := newTestServer(t)
+
+	for _, header := range []string{"", "Bearer", "Bearer wrong", "token"} {
+		r := httptest.NewRequest("GET", "/version", nil)
+		r.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		s.handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusUnauthorized, w.Code, header)
+	}
+
+	require.Equal(t, http.StatusOK, do(s, "GET", "/version").Code)
+	_, err := NewServer(Config{Addr: "127.0.0.1:0"}, Tracker{})
+	require.Equal(t, ErrMissingToken, err)
+}
+
+func TestConfig(t *testing.T) {
+	s, _, _ := newTestServer(t)
+
+	w := do(s, "GET", "/config")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "interval: 30m0s\nname: test\n", w.Body.String())
+}
+
+func TestHooks(t *testing.T) {
+	s, _, _ := newTestServer(t)
+
+	w := do(s, "GET", "/hooks")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "[]\n", w.Body.String())
+
+	require.Equal(t, http.StatusNotFound, do(s, "POST", "/hooks/default/pre/0/disable").Code)
+	require.Equal(t, http.StatusNotFound, do(s, "POST", "/hooks/default/pre/0/toggle").Code)
+	require.Equal(t, http.StatusBadRequest, do(s, "POST", "/hooks/default/pre/first/disable").Code)
+}
+
+func TestDeletePeer(t *testing.T) {
+	s, ps, _ := newTestServer(t)
+	require.Nil(t, ps.PutSeeder(context.Background(), testIH, testPeer))
+
+	path := "/swarms/" + testIH.String() + "/peers/" + testPeer.ID.String() + "?ip=10.0.0.1&port=6881"
+	require.Equal(t, http.StatusBadRequest, do(s, "DELETE", strings.Replace(path, "port=6881", "port=x", 1)).Code)
+	require.Equal(t, http.StatusNoContent, do(s, "DELETE", path).Code)
+	require.Equal(t, http.StatusNotFound, do(s, "DELETE", path).Code)
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(context.Background(), testIH, bittorrent.IPv4).Complete)
+}
+
+func TestDeleteSwarm(t *testing.T) {
+	s, ps, _ := newTestServer(t)
+	require.Nil(t, ps.PutLeecher(context.Background(), testIH, testPeer))
+
+	require.Equal(t, http.StatusBadRequest, do(s, "DELETE", "/swarms/abc").Code)
+	require.Equal(t, http.StatusNoContent, do(s, "DELETE", "/swarms/"+testIH.String()).Code)
+	require.Equal(t, http.StatusNotFound, do(s, "DELETE", "/swarms/"+testIH.String()).Code)
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(context.Background(), testIH, bittorrent.IPv4).Incomplete)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	s, ps, _ := newTestServer(t)
+	require.Nil(t, ps.PutLeecher(context.Background(), testIH, testPeer))
+
+	require.Equal(t, http.StatusBadRequest, do(s, "POST", "/gc").Code)
+	require.Equal(t, http.StatusNoContent, do(s, "POST", "/gc?max_age=1h").Code)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(context.Background(), testIH, bittorrent.IPv4).Incomplete)
+	require.Equal(t, http.StatusNoContent, do(s, "POST", "/gc?max_age=0s").Code)
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(context.Background(), testIH, bittorrent.IPv4).Incomplete)
+}
+
+func TestReloadAndVersion(t *testing.T) {
+	s, _, reloads := newTestServer(t)
+
+	require.Equal(t, http.StatusAccepted, do(s, "POST", "/reload").Code)
+	require.Equal(t, 1, *reloads)
+
+	var info versionInfo
+	w := do(s, "GET", "/version")
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&info))
+	require.NotEmpty(t, info.GoVersion)
+	require.Equal(t, processStart.Unix(), info.Started.Unix())
+}
+
+func TestUpdate(t *testing.T) {
+	s, _, _ := newTestServer(t)
+
+	s.Update(Config{Token: "other"}, s.tracker())
+	require.Equal(t, http.StatusUnauthorized, do(s, "GET", "/version").Code)
+}
@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// render converts a configuration into values that marshal to YAML like the
+// configuration file they were parsed from.
+//
+// Struct fields are rendered in order under the names of their yaml tags,
+// fields tagged "-" and unexported fields are left out, and durations are
+// rendered like "30m0s" rather than as nanoseconds.
+func render(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return renderValue(reflect.ValueOf(v))
+}
+
+func renderValue(v reflect.Value) interface{} {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return renderValue(v.Elem())
+	case reflect.Struct:
+		var out yaml.MapSlice
+		renderStruct(v, &out)
+		return out
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		out := make(yaml.MapSlice, 0, len(keys))
+		for _, k := range keys {
+			out = append(out, yaml.MapItem{Key: renderValue(k), Value: renderValue(v.MapIndex(k))})
+		}
+		return out
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = renderValue(v.Index(i))
+		}
+		return out
+	default:
+		return v.Interface()
+	}
+}
+
+func renderStruct(v reflect.Value, out *yaml.MapSlice) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag := f.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if idx := strings.Index(tag, ","); idx >= 0 {
+			name, opts = tag[:idx], tag[idx+1:]
+		}
+
+		fv := v.Field(i)
+		if strings.Contains(opts, "inline") {
+			for fv.Kind() == reflect.Ptr && !fv.IsNil() {
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				renderStruct(fv, out)
+			}
+			continue
+		}
+		if strings.Contains(opts, "omitempty") && fv.IsZero() {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+
+		*out = append(*out, yaml.MapItem{Key: name, Value: renderValue(fv)})
+	}
+}
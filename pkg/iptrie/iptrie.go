@@ -0,0 +1,206 @@
+// Package iptrie implements a set of IP addresses backed by binary prefix
+// tries.
+//
+// Networks and arbitrary address ranges can be added to a Set. Ranges are
+// stored as the minimal set of prefixes covering them, and prefixes covered
+// by others are merged, so lookups take at most one step per bit of the
+// address.
+package iptrie
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// A Set is a set of IPv4 and IPv6 addresses.
+//
+// IPv4 and IPv4-mapped IPv6 addresses are treated as the same address.
+//
+// The zero value is an empty Set.
+// A Set is not safe for concurrent modification, but can be read
+// concurrently once it is not modified anymore.
+type Set struct {
+	v4 node
+	v6 node
+}
+
+type node struct {
+	children [2]*node
+
+	// full is set if all addresses below this node are in the set.
+	full bool
+}
+
+// normalize returns the 4-byte form of IPv4 addresses and the 16-byte form of
+// IPv6 addresses, or nil for invalid addresses.
+func normalize(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	if len(ip) == net.IPv6len {
+		return ip
+	}
+	return nil
+}
+
+func (s *Set) root(ip net.IP) *node {
+	if len(ip) == net.IPv4len {
+		return &s.v4
+	}
+	return &s.v6
+}
+
+// Contains reports whether ip is in the set.
+func (s *Set) Contains(ip net.IP) bool {
+	ip = normalize(ip)
+	if ip == nil {
+		return false
+	}
+
+	n := s.root(ip)
+	for i := 0; i < len(ip)*8; i++ {
+		if n.full {
+			return true
+		}
+		n = n.children[bit(ip, i)]
+		if n == nil {
+			return false
+		}
+	}
+	return n.full
+}
+
+// AddNet adds all addresses of the network to the set.
+func (s *Set) AddNet(network *net.IPNet) error {
+	first := normalize(network.IP)
+	if first == nil || len(network.Mask) != len(first) {
+		return fmt.Errorf("iptrie: invalid network %s", network)
+	}
+
+	first = first.Mask(network.Mask)
+	last := make(net.IP, len(first))
+	for i := range first {
+		last[i] = first[i] | ^network.Mask[i]
+	}
+
+	return s.AddRange(first, last)
+}
+
+// AddRange adds all addresses from first to last, inclusive, to the set.
+// Both addresses must be of the same address family.
+func (s *Set) AddRange(first, last net.IP) error {
+	lo, hi := normalize(first), normalize(last)
+	switch {
+	case lo == nil || hi == nil:
+		return fmt.Errorf("iptrie: invalid range %s-%s", first, last)
+	case len(lo) != len(hi):
+		return fmt.Errorf("iptrie: range %s-%s mixes address families", first, last)
+	case bytes.Compare(lo, hi) > 0:
+		return fmt.Errorf("iptrie: range %s-%s is reversed", first, last)
+	}
+
+	insertRange(s.root(lo), 0, make(net.IP, len(lo)), lo, hi)
+	return nil
+}
+
+// Add parses an entry and adds it to the set.
+//
+// An entry is either a single address, a network in CIDR notation or a range
+// of addresses given as two addresses separated by a hyphen.
+func (s *Set) Add(entry string) error {
+	entry = strings.TrimSpace(entry)
+
+	if i := strings.IndexByte(entry, '-'); i >= 0 {
+		first := net.ParseIP(strings.TrimSpace(entry[:i]))
+		last := net.ParseIP(strings.TrimSpace(entry[i+1:]))
+		if first == nil || last == nil {
+			return fmt.Errorf("iptrie: invalid range %q", entry)
+		}
+		return s.AddRange(first, last)
+	}
+
+	if strings.IndexByte(entry, '/') >= 0 {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("iptrie: invalid network %q", entry)
+		}
+		return s.AddNet(network)
+	}
+
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return fmt.Errorf("iptrie: invalid address %q", entry)
+	}
+	return s.AddRange(ip, ip)
+}
+
+// insertRange marks all nodes below n that lie within [lo, hi].
+// n is at the given depth and represents all addresses starting with prefix.
+func insertRange(n *node, depth int, prefix, lo, hi net.IP) {
+	if n.full {
+		return
+	}
+
+	first, last := bounds(prefix, depth)
+	if bytes.Compare(lo, first) <= 0 && bytes.Compare(last, hi) <= 0 {
+		n.full = true
+		n.children = [2]*node{}
+		return
+	}
+
+	for b := 0; b < 2; b++ {
+		childPrefix := withBit(prefix, depth, b)
+		first, last := bounds(childPrefix, depth+1)
+		if bytes.Compare(last, lo) < 0 || bytes.Compare(first, hi) > 0 {
+			continue
+		}
+		if n.children[b] == nil {
+			n.children[b] = &node{}
+		}
+		insertRange(n.children[b], depth+1, childPrefix, lo, hi)
+	}
+
+	// Merge two full children into their parent.
+	if n.children[0] != nil && n.children[0].full && n.children[1] != nil && n.children[1].full {
+		n.full = true
+		n.children = [2]*node{}
+	}
+}
+
+// bounds returns the first and last address starting with the first depth
+// bits of prefix.
+func bounds(prefix net.IP, depth int) (first, last net.IP) {
+	first = make(net.IP, len(prefix))
+	last = make(net.IP, len(prefix))
+	for i := range prefix {
+		var mask byte
+		switch {
+		case depth >= (i+1)*8:
+			mask = 0xff
+		case depth > i*8:
+			mask = ^byte(0xff >> uint(depth-i*8))
+		}
+		first[i] = prefix[i] & mask
+		last[i] = prefix[i] | ^mask
+	}
+	return first, last
+}
+
+// withBit returns a copy of ip with bit i set to b.
+func withBit(ip net.IP, i, b int) net.IP {
+	c := make(net.IP, len(ip))
+	copy(c, ip)
+	if b == 1 {
+		c[i/8] |= 0x80 >> uint(i%8)
+	} else {
+		c[i/8] &^= 0x80 >> uint(i%8)
+	}
+	return c
+}
+
+// bit returns bit i of ip, counting from the most significant bit.
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>uint(7-i%8)) & 1
+}
@@ -0,0 +1,121 @@
+package iptrie
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSet(t *testing.T) {
+	var s Set
+	require.Nil(t, s.Add("10.0.0.0/8"))
+	require.Nil(t, s.Add("192.168.1.10 - 192.168.1.20"))
+	require.Nil(t, s.Add("203.0.113.7"))
+	require.Nil(t, s.Add("2001:db8::/32"))
+
+	var table = []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.0.0.0", true},
+		{"10.255.255.255", true},
+		{"11.0.0.0", false},
+		{"9.255.255.255", false},
+		{"192.168.1.9", false},
+		{"192.168.1.10", true},
+		{"192.168.1.15", true},
+		{"192.168.1.20", true},
+		{"192.168.1.21", false},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"::ffff:10.1.2.3", true},
+		{"2001:db8:1::1", true},
+		{"2001:db9::1", false},
+		{"::a00:1", false},
+	}
+
+	for _, tt := range table {
+		require.Equal(t, tt.expected, s.Contains(net.ParseIP(tt.ip)), tt.ip)
+	}
+}
+
+func TestSetInvalid(t *testing.T) {
+	var s Set
+	for _, entry := range []string{
+		"",
+		"10.0.0.0/33",
+		"10.0.0.1 - 10.0.0.0",
+		"10.0.0.1 - ::1",
+		"example.com",
+	} {
+		require.NotNil(t, s.Add(entry), entry)
+	}
+}
+
+func TestSetMerge(t *testing.T) {
+	var s Set
+	require.Nil(t, s.Add("10.0.0.0/25"))
+	require.Nil(t, s.Add("10.0.0.128/25"))
+	require.Nil(t, s.Add("10.0.0.0/24"))
+
+	// The two halves are merged, so the root of the /24 is full.
+	n := &s.v4
+	for i := 0; i < 24; i++ {
+		require.False(t, n.full)
+		n = n.children[bit(net.IPv4(10, 0, 0, 0).To4(), i)]
+	}
+	require.True(t, n.full)
+	require.Nil(t, n.children[0])
+	require.Nil(t, n.children[1])
+}
+
+func TestSetRandomRanges(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+
+	// Ranges are confined to 10.0.0.0/20 so that random addresses hit them.
+	type ipRange struct{ lo, hi uint32 }
+	var ranges []ipRange
+	var s Set
+	for i := 0; i < 50; i++ {
+		lo := 0x0a000000 + uint32(r.Intn(1<<12))
+		hi := lo + uint32(r.Intn(64))
+		ranges = append(ranges, ipRange{lo, hi})
+		require.Nil(t, s.AddRange(u32ToIP(lo), u32ToIP(hi)))
+	}
+
+	for i := 0; i < 1<<13; i++ {
+		ip := 0x0a000000 + uint32(i)
+		var expected bool
+		for _, rg := range ranges {
+			if rg.lo <= ip && ip <= rg.hi {
+				expected = true
+				break
+			}
+		}
+		require.Equal(t, expected, s.Contains(u32ToIP(ip)), u32ToIP(ip).String())
+	}
+}
+
+func u32ToIP(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+func BenchmarkContains(b *testing.B) {
+	var s Set
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 100000; i++ {
+		lo := r.Uint32()
+		_ = s.AddRange(u32ToIP(lo), u32ToIP(lo+uint32(r.Intn(1024))))
+	}
+	ip := u32ToIP(r.Uint32())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Contains(ip)
+	}
+}
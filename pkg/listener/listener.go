@@ -0,0 +1,355 @@
+// Package listener implements a set of sockets that stay bound while the
+// servers using them are restarted.
+package listener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrReusePortUnsupported is returned when sockets are to be bound with
+// SO_REUSEPORT on a platform that does not support distributing packets among
+// them.
+var ErrReusePortUnsupported = errors.New("listener: SO_REUSEPORT is not supported on this platform")
+
+// Set holds sockets by the address they are bound to.
+//
+// Servers get duplicates of the sockets of a Set, which they may close
+// without closing the sockets themselves. A server restarted on the same
+// address gets a duplicate of the same socket, so that no connection is
+// refused and no packet is dropped in between: they queue up in the kernel
+// until the new server serves them.
+//
+// On platforms that can not duplicate sockets, the sockets are handed out
+// directly and not kept by the Set.
+type Set struct {
+	mu  sync.Mutex
+	tcp map[string]*net.TCPListener
+	udp map[string]*net.UDPConn
+}
+
+// NewSet returns an empty Set.
+func NewSet() *Set {
+	return &Set{
+		tcp: make(map[string]*net.TCPListener),
+		udp: make(map[string]*net.UDPConn),
+	}
+}
+
+// NewSetFromFiles returns a Set holding the sockets of the given files, keyed
+// by the addresses they were bound for, like the ones returned by Files.
+//
+// The files are not used after NewSetFromFiles returns and may be closed.
+func NewSetFromFiles(tcp, udp map[string]*os.File) (*Set, error) {
+	s := NewSet()
+
+	for addr, f := range tcp {
+		l, err := net.FileListener(f)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			l.Close()
+			s.Close()
+			return nil, errors.New("listener: not a TCP socket: " + addr)
+		}
+		s.tcp[addr] = tl
+	}
+
+	for addr, f := range udp {
+		c, err := net.FilePacketConn(f)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		uc, ok := c.(*net.UDPConn)
+		if !ok {
+			c.Close()
+			s.Close()
+			return nil, errors.New("listener: not a UDP socket: " + addr)
+		}
+		s.udp[addr] = uc
+	}
+
+	return s, nil
+}
+
+// Files returns duplicates of the sockets of the Set as files, keyed by the
+// addresses they were bound for.
+//
+// They can be passed on to another process, which gets a Set holding the
+// same sockets from NewSetFromFiles. The caller must close the files.
+func (s *Set) Files() (tcp, udp map[string]*os.File, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tcp = make(map[string]*os.File, len(s.tcp))
+	udp = make(map[string]*os.File, len(s.udp))
+	closeAll := func() {
+		for _, f := range tcp {
+			f.Close()
+		}
+		for _, f := range udp {
+			f.Close()
+		}
+	}
+
+	for addr, l := range s.tcp {
+		f, err := l.File()
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		tcp[addr] = f
+	}
+
+	for addr, c := range s.udp {
+		f, err := c.File()
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		udp[addr] = f
+	}
+
+	return tcp, udp, nil
+}
+
+// Listen returns a TCP listener for the given address, binding it if no
+// socket of the Set is bound to it.
+func (s *Set) Listen(addr string) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.tcp[addr]
+	if !ok {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		l, err = net.ListenTCP("tcp", tcpAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := l.File()
+	if err != nil {
+		if !ok {
+			return l, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	dup, err := net.FileListener(f)
+	if err != nil {
+		if !ok {
+			l.Close()
+		}
+		return nil, err
+	}
+
+	s.tcp[addr] = l
+	return dup, nil
+}
+
+// ListenUDP returns a UDP socket for the given address, binding it if no
+// socket of the Set is bound to it.
+func (s *Set) ListenUDP(addr string) (*net.UDPConn, error) {
+	conns, err := s.ListenUDPGroup(addr, 1)
+	if err != nil {
+		return nil, err
+	}
+	return conns[0], nil
+}
+
+// ListenUDPGroup returns n UDP sockets for the given address, binding those
+// the Set does not hold yet.
+//
+// If n is larger than one, the sockets are bound with SO_REUSEPORT, so that
+// the kernel distributes the packets sent to the address among them. Sockets
+// bound without it can not join them, so a socket the Set holds for a single
+// address can not be extended to a group.
+//
+// The Set holds the first socket under the address and the others under the
+// address followed by "#" and their index. Sockets of the group beyond n are
+// closed.
+func (s *Set) ListenUDPGroup(addr string, n int) ([]*net.UDPConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dups := make([]*net.UDPConn, 0, n)
+	closeAll := func() {
+		for _, c := range dups {
+			c.Close()
+		}
+	}
+
+	bindAddr := addr
+	for i := 0; i < n; i++ {
+		key := groupKey(addr, i)
+		c, ok := s.udp[key]
+		if !ok {
+			var err error
+			c, err = BindUDP(bindAddr, n > 1)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+		}
+		if i == 0 {
+			// Sockets bound to port 0 get a random port, which the others
+			// must share.
+			bindAddr = c.LocalAddr().String()
+		}
+
+		f, err := c.File()
+		if err != nil {
+			if !ok && n == 1 {
+				// The socket can not be duplicated, hand it out directly.
+				return []*net.UDPConn{c}, nil
+			}
+			if !ok {
+				c.Close()
+			}
+			closeAll()
+			return nil, err
+		}
+		dup, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			if !ok {
+				c.Close()
+			}
+			closeAll()
+			return nil, err
+		}
+
+		s.udp[key] = c
+		dups = append(dups, dup.(*net.UDPConn))
+	}
+
+	for key, c := range s.udp {
+		if base, i := splitGroupKey(key); base == addr && i >= n {
+			c.Close()
+			delete(s.udp, key)
+		}
+	}
+
+	return dups, nil
+}
+
+// groupKey returns the key the Set holds the socket with index i of the group
+// bound to addr under.
+func groupKey(addr string, i int) string {
+	if i == 0 {
+		return addr
+	}
+	return addr + "#" + strconv.Itoa(i)
+}
+
+// splitGroupKey returns the address and index of a key returned by groupKey.
+func splitGroupKey(key string) (addr string, i int) {
+	sep := strings.LastIndexByte(key, '#')
+	if sep < 0 {
+		return key, 0
+	}
+	i, err := strconv.Atoi(key[sep+1:])
+	if err != nil {
+		return key, 0
+	}
+	return key[:sep], i
+}
+
+// BindUDP binds a UDP socket to addr.
+//
+// If reusePort is set, the socket is bound with SO_REUSEPORT, so that more
+// sockets can be bound to the same address, sharing its packets.
+func BindUDP(addr string, reusePort bool) (*net.UDPConn, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		if !ReusePortSupported {
+			return nil, ErrReusePortUnsupported
+		}
+		lc.Control = controlReusePort
+	}
+
+	c, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// BindUDPGroup binds n UDP sockets to addr.
+//
+// If n is larger than one, the sockets are bound with SO_REUSEPORT, so that
+// the kernel distributes the packets sent to addr among them.
+func BindUDPGroup(addr string, n int) ([]*net.UDPConn, error) {
+	conns := make([]*net.UDPConn, 0, n)
+	for i := 0; i < n; i++ {
+		c, err := BindUDP(addr, n > 1)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		if i == 0 {
+			addr = c.LocalAddr().String()
+		}
+		conns = append(conns, c)
+	}
+	return conns, nil
+}
+
+// Retain closes the sockets of the Set that are not bound to one of the
+// given addresses.
+//
+// Duplicates handed out for them stay usable until they are closed.
+func (s *Set) Retain(tcpAddrs, udpAddrs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	keepTCP := make(map[string]bool, len(tcpAddrs))
+	for _, addr := range tcpAddrs {
+		keepTCP[addr] = true
+	}
+	for addr, l := range s.tcp {
+		if !keepTCP[addr] {
+			if err := l.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			delete(s.tcp, addr)
+		}
+	}
+
+	keepUDP := make(map[string]bool, len(udpAddrs))
+	for _, addr := range udpAddrs {
+		keepUDP[addr] = true
+	}
+	for key, c := range s.udp {
+		if addr, _ := splitGroupKey(key); !keepUDP[addr] {
+			if err := c.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			delete(s.udp, key)
+		}
+	}
+
+	return firstErr
+}
+
+// Close closes all sockets of the Set.
+func (s *Set) Close() error {
+	return s.Retain(nil, nil)
+}
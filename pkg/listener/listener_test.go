@@ -0,0 +1,174 @@
+package listener
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenKeepsSocket(t *testing.T) {
+	s := NewSet()
+	defer s.Close()
+
+	l, err := s.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	addr := l.Addr().String()
+	require.Nil(t, l.Close())
+
+	// The socket stays bound after the listener handed out was closed.
+	conn, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	l, err = s.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	accepted, err := l.Accept()
+	require.Nil(t, err)
+	require.Nil(t, accepted.Close())
+}
+
+func TestListenUDPKeepsSocket(t *testing.T) {
+	s := NewSet()
+	defer s.Close()
+
+	c, err := s.ListenUDP("127.0.0.1:0")
+	require.Nil(t, err)
+	addr := c.LocalAddr().String()
+	require.Nil(t, c.Close())
+
+	conn, err := net.Dial("udp", addr)
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.Nil(t, err)
+
+	c, err = s.ListenUDP("127.0.0.1:0")
+	require.Nil(t, err)
+	defer c.Close()
+	buf := make([]byte, 4)
+	n, err := c.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, "ping", string(buf[:n]))
+}
+
+func TestRetain(t *testing.T) {
+	s := NewSet()
+	defer s.Close()
+
+	kept, err := s.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	require.Nil(t, kept.Close())
+	dropped, err := s.Listen("localhost:0")
+	require.Nil(t, err)
+	require.Nil(t, dropped.Close())
+
+	require.Nil(t, s.Retain([]string{"127.0.0.1:0"}, nil))
+	require.Len(t, s.tcp, 1)
+	require.Contains(t, s.tcp, "127.0.0.1:0")
+
+	require.Nil(t, s.Close())
+	require.Empty(t, s.tcp)
+	require.Empty(t, s.udp)
+}
+
+func TestFiles(t *testing.T) {
+	s := NewSet()
+	defer s.Close()
+
+	l, err := s.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	c, err := s.ListenUDP("127.0.0.1:0")
+	require.Nil(t, err)
+	defer c.Close()
+
+	tcp, udp, err := s.Files()
+	require.Nil(t, err)
+	other, err := NewSetFromFiles(tcp, udp)
+	require.Nil(t, err)
+	defer other.Close()
+	for _, f := range tcp {
+		require.Nil(t, f.Close())
+	}
+	for _, f := range udp {
+		require.Nil(t, f.Close())
+	}
+
+	// The other Set holds the same sockets under the same addresses.
+	l2, err := other.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer l2.Close()
+	require.Equal(t, l.Addr().String(), l2.Addr().String())
+
+	c2, err := other.ListenUDP("127.0.0.1:0")
+	require.Nil(t, err)
+	defer c2.Close()
+	require.Equal(t, c.LocalAddr().String(), c2.LocalAddr().String())
+}
+
+func TestListenUDPGroup(t *testing.T) {
+	if !ReusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+
+	s := NewSet()
+	defer s.Close()
+
+	conns, err := s.ListenUDPGroup("127.0.0.1:0", 3)
+	require.Nil(t, err)
+	require.Len(t, conns, 3)
+	for _, c := range conns {
+		require.Equal(t, conns[0].LocalAddr().String(), c.LocalAddr().String())
+		require.Nil(t, c.Close())
+	}
+	require.Len(t, s.udp, 3)
+
+	// Groups keep their sockets across Files.
+	_, udp, err := s.Files()
+	require.Nil(t, err)
+	for key, f := range udp {
+		require.Contains(t, s.udp, key)
+		require.Nil(t, f.Close())
+	}
+
+	require.Nil(t, s.Retain(nil, []string{"127.0.0.1:0"}))
+	require.Len(t, s.udp, 3)
+
+	// Shrinking a group closes the sockets no longer used.
+	conns, err = s.ListenUDPGroup("127.0.0.1:0", 2)
+	require.Nil(t, err)
+	require.Len(t, conns, 2)
+	for _, c := range conns {
+		require.Nil(t, c.Close())
+	}
+	require.Len(t, s.udp, 2)
+	require.Contains(t, s.udp, "127.0.0.1:0#1")
+
+	require.Nil(t, s.Retain(nil, nil))
+	require.Empty(t, s.udp)
+}
+
+func TestBindUDPGroup(t *testing.T) {
+	if !ReusePortSupported {
+		_, err := BindUDPGroup("127.0.0.1:0", 2)
+		require.Equal(t, ErrReusePortUnsupported, err)
+		return
+	}
+
+	conns, err := BindUDPGroup("127.0.0.1:0", 2)
+	require.Nil(t, err)
+	require.Len(t, conns, 2)
+	require.Equal(t, conns[0].LocalAddr().String(), conns[1].LocalAddr().String())
+	for _, c := range conns {
+		require.Nil(t, c.Close())
+	}
+
+	// Sockets bound without SO_REUSEPORT can not be joined.
+	single, err := BindUDPGroup("127.0.0.1:0", 1)
+	require.Nil(t, err)
+	defer single[0].Close()
+	_, err = BindUDP(single[0].LocalAddr().String(), true)
+	require.NotNil(t, err)
+}
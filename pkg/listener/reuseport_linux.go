@@ -0,0 +1,24 @@
+// +build linux
+
+package listener
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReusePortSupported reports whether sockets can be bound with SO_REUSEPORT
+// to share the packets sent to an address.
+const ReusePortSupported = true
+
+// controlReusePort sets SO_REUSEPORT on a socket before it is bound.
+func controlReusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if ctrlErr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
@@ -0,0 +1,16 @@
+// +build !linux
+
+package listener
+
+import "syscall"
+
+// ReusePortSupported reports whether sockets can be bound with SO_REUSEPORT
+// to share the packets sent to an address.
+//
+// Other platforms either lack SO_REUSEPORT or deliver all packets to one of
+// the sockets bound with it.
+const ReusePortSupported = false
+
+func controlReusePort(network, address string, c syscall.RawConn) error {
+	return ErrReusePortUnsupported
+}
@@ -30,6 +30,11 @@ func SetOutput(to io.Writer) {
 	l.Out = to
 }
 
+// AddHook adds a hook that is fired for every entry logged.
+func AddHook(h logrus.Hook) {
+	l.AddHook(h)
+}
+
 // Fields is a map of logging fields.
 type Fields map[string]interface{}
 
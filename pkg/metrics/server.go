@@ -4,6 +4,7 @@ package metrics
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"net/http/pprof"
 
@@ -32,6 +33,34 @@ func (s *Server) Stop() stop.Result {
 // NewServer creates a new instance of a Prometheus server that asynchronously
 // serves requests.
 func NewServer(addr string) *Server {
+	s := newServer(addr)
+
+	go func() {
+		if err := s.srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal("failed while serving prometheus", log.Err(err))
+		}
+	}()
+
+	return s
+}
+
+// NewServerWithListener creates a new instance of a Prometheus server that
+// asynchronously serves requests accepted by l.
+//
+// l is closed when the server is stopped.
+func NewServerWithListener(l net.Listener) *Server {
+	s := newServer(l.Addr().String())
+
+	go func() {
+		if err := s.srv.Serve(l); err != http.ErrServerClosed {
+			log.Fatal("failed while serving prometheus", log.Err(err))
+		}
+	}()
+
+	return s
+}
+
+func newServer(addr string) *Server {
 	mux := http.NewServeMux()
 
 	mux.Handle("/metrics", promhttp.Handler())
@@ -41,18 +70,10 @@ func NewServer(addr string) *Server {
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
-	s := &Server{
+	return &Server{
 		srv: &http.Server{
 			Addr:    addr,
 			Handler: mux,
 		},
 	}
-
-	go func() {
-		if err := s.srv.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatal("failed while serving prometheus", log.Err(err))
-		}
-	}()
-
-	return s
 }
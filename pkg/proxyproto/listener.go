@@ -0,0 +1,113 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// Listener is a net.Listener whose connections report the addresses given by
+// the PROXY protocol headers their data starts with.
+//
+// Headers are only read from connections coming from trusted addresses.
+// The data of all other connections, and of connections from trusted
+// addresses not starting with a header, is passed on unchanged.
+type Listener struct {
+	net.Listener
+
+	// Trusted reports whether headers of connections from an address are
+	// read. If it is nil, no header is read.
+	Trusted func(net.IP) bool
+
+	// Timeout is the time a header must be received in.
+	// If it is zero, there is no timeout.
+	Timeout time.Duration
+}
+
+// Accept waits for and returns the next connection to the listener.
+//
+// The header of a connection is read when its data or its remote address is
+// first requested, so that a slow client does not block Accept.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if l.Trusted == nil || !l.Trusted(IP(c.RemoteAddr())) {
+		return c, nil
+	}
+	return &Conn{Conn: c, r: bufio.NewReader(c), timeout: l.Timeout}, nil
+}
+
+// Conn is a connection whose data may start with a PROXY protocol header.
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *Header
+	err    error
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+// Header returns the PROXY protocol header of the connection, reading it if
+// it was not read yet.
+//
+// If the connection did not start with a header, nil is returned.
+func (c *Conn) Header() (*Header, error) {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+
+		c.header, c.err = Read(c.r)
+		if c.err == ErrNoHeader {
+			c.err = nil
+		}
+
+		if c.timeout > 0 {
+			c.mu.Lock()
+			c.Conn.SetReadDeadline(c.deadline)
+			c.mu.Unlock()
+		}
+	})
+	return c.header, c.err
+}
+
+// Read reads data from the connection after its header.
+func (c *Conn) Read(b []byte) (int, error) {
+	if _, err := c.Header(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the source address of the header of the connection, or
+// the address of its peer if it has no header.
+func (c *Conn) RemoteAddr() net.Addr {
+	if h, _ := c.Header(); h != nil && h.Source != nil {
+		return h.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the connection.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
@@ -0,0 +1,224 @@
+// Package proxyproto implements the receiving side of the PROXY protocol,
+// versions 1 and 2, which load balancers use to pass on the addresses of the
+// connections they forward.
+//
+// See https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNoHeader is returned if data does not start with a PROXY protocol
+	// header.
+	ErrNoHeader = errors.New("proxyproto: no PROXY protocol header")
+
+	// ErrInvalidHeader is returned if a PROXY protocol header is malformed.
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY protocol header")
+)
+
+var (
+	signatureV1 = []byte("PROXY ")
+	signatureV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// maxLengthV1 is the maximum length of a version 1 header, including the
+	// trailing CRLF.
+	maxLengthV1 = 107
+
+	// headerLengthV2 is the length of a version 2 header without addresses.
+	headerLengthV2 = 16
+)
+
+// Header is a PROXY protocol header.
+type Header struct {
+	Version int
+
+	// Source and Destination are the addresses of the connection the proxy
+	// forwards, as *net.TCPAddr or *net.UDPAddr.
+	// They are nil if the proxy did not provide them, for example for
+	// connections it makes to check that the server is up.
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// Parse parses the PROXY protocol header at the start of b and returns it
+// along with its length.
+//
+// If b does not start with a header, ErrNoHeader is returned.
+func Parse(b []byte) (*Header, int, error) {
+	switch {
+	case bytes.HasPrefix(b, signatureV2):
+		if len(b) < headerLengthV2 {
+			return nil, 0, ErrInvalidHeader
+		}
+		n := headerLengthV2 + int(binary.BigEndian.Uint16(b[14:16]))
+		if len(b) < n {
+			return nil, 0, ErrInvalidHeader
+		}
+		h, err := parseV2(b[:n])
+		if err != nil {
+			return nil, 0, err
+		}
+		return h, n, nil
+	case bytes.HasPrefix(b, signatureV1):
+		n := bytes.Index(b, []byte("\r\n")) + 2
+		if n < 2 || n > maxLengthV1 {
+			return nil, 0, ErrInvalidHeader
+		}
+		h, err := parseV1(b[:n-2])
+		if err != nil {
+			return nil, 0, err
+		}
+		return h, n, nil
+	default:
+		return nil, 0, ErrNoHeader
+	}
+}
+
+// Read reads a PROXY protocol header from r.
+//
+// If the data read from r does not start with a header, ErrNoHeader is
+// returned and nothing is consumed from r.
+func Read(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	switch first[0] {
+	case signatureV1[0]:
+		if prefix, err := r.Peek(len(signatureV1)); err != nil || !bytes.Equal(prefix, signatureV1) {
+			return nil, ErrNoHeader
+		}
+		line, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		b = line
+	case signatureV2[0]:
+		prefix, err := r.Peek(headerLengthV2)
+		if err != nil || !bytes.HasPrefix(prefix, signatureV2) {
+			return nil, ErrNoHeader
+		}
+		b = make([]byte, headerLengthV2+int(binary.BigEndian.Uint16(prefix[14:16])))
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrNoHeader
+	}
+
+	h, n, err := Parse(b)
+	if err == nil && n != len(b) {
+		err = ErrInvalidHeader
+	}
+	return h, err
+}
+
+// parseV1 parses a version 1 header without its trailing CRLF.
+func parseV1(line []byte) (*Header, error) {
+	fields := strings.Split(string(line), " ")
+	if len(fields) < 2 {
+		return nil, ErrInvalidHeader
+	}
+
+	h := &Header{Version: 1}
+	if fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	v4 := fields[1] == "TCP4"
+	if (srcIP.To4() != nil) != v4 || (dstIP.To4() != nil) != v4 {
+		return nil, ErrInvalidHeader
+	}
+	if v4 {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	}
+
+	h.Source = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	h.Destination = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return h, nil
+}
+
+// parseV2 parses a complete version 2 header.
+func parseV2(b []byte) (*Header, error) {
+	if b[12]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+
+	h := &Header{Version: 2}
+	switch b[12] & 0xf {
+	case 0: // LOCAL
+		return h, nil
+	case 1: // PROXY
+	default:
+		return nil, ErrInvalidHeader
+	}
+
+	var ipLen int
+	switch b[13] >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default:
+		// Unspecified and UNIX addresses are not used; the receiver
+		// must keep the addresses of the connection instead.
+		return h, nil
+	}
+
+	addrs := b[headerLengthV2:]
+	if len(addrs) < 2*ipLen+4 {
+		return nil, ErrInvalidHeader
+	}
+	srcIP := net.IP(append([]byte{}, addrs[:ipLen]...))
+	dstIP := net.IP(append([]byte{}, addrs[ipLen:2*ipLen]...))
+	srcPort := int(binary.BigEndian.Uint16(addrs[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(addrs[2*ipLen+2:]))
+
+	switch b[13] & 0xf {
+	case 1: // STREAM
+		h.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+		h.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	case 2: // DGRAM
+		h.Source = &net.UDPAddr{IP: srcIP, Port: srcPort}
+		h.Destination = &net.UDPAddr{IP: dstIP, Port: dstPort}
+	default:
+		return nil, ErrInvalidHeader
+	}
+	return h, nil
+}
+
+// IP returns the IP address of addr, which must be a *net.TCPAddr or a
+// *net.UDPAddr, or nil.
+func IP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
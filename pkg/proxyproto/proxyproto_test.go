@@ -0,0 +1,141 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func v2Header(cmd, fam byte, addrs []byte) []byte {
+	b := append([]byte{}, signatureV2...)
+	b = append(b, 0x20|cmd, fam, byte(len(addrs)>>8), byte(len(addrs)))
+	return append(b, addrs...)
+}
+
+var v4Addrs = []byte{
+	192, 0, 2, 1, // source
+	198, 51, 100, 1, // destination
+	0x1a, 0xe1, // 6881
+	0x00, 0x50, // 80
+}
+
+func TestParse(t *testing.T) {
+	var table = []struct {
+		data   []byte
+		header *Header
+		n      int
+		err    error
+	}{
+		{
+			[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 6881 80\r\nGET /"),
+			&Header{
+				Version:     1,
+				Source:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 6881},
+				Destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 80},
+			},
+			43, nil,
+		},
+		{
+			[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 6881 443\r\n"),
+			&Header{
+				Version:     1,
+				Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+				Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			},
+			45, nil,
+		},
+		{[]byte("PROXY UNKNOWN\r\n"), &Header{Version: 1}, 15, nil},
+		{[]byte("PROXY TCP4 2001:db8::1 198.51.100.1 6881 80\r\n"), nil, 0, ErrInvalidHeader},
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 80\r\n"), nil, 0, ErrInvalidHeader},
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 6881 80"), nil, 0, ErrInvalidHeader},
+		{[]byte("PROXY " + strings.Repeat("x", 110) + "\r\n"), nil, 0, ErrInvalidHeader},
+		{
+			append(v2Header(1, 0x12, v4Addrs), 0, 0, 4, 0x17),
+			&Header{
+				Version:     2,
+				Source:      &net.UDPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 6881},
+				Destination: &net.UDPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 80},
+			},
+			28, nil,
+		},
+		{
+			v2Header(1, 0x11, append(v4Addrs, 0x04, 0x00, 0x01, 0x00)),
+			&Header{
+				Version:     2,
+				Source:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 6881},
+				Destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 80},
+			},
+			32, nil,
+		},
+		{v2Header(0, 0x00, nil), &Header{Version: 2}, 16, nil},
+		{v2Header(1, 0x31, make([]byte, 216)), &Header{Version: 2}, 232, nil},
+		{v2Header(2, 0x11, v4Addrs), nil, 0, ErrInvalidHeader},
+		{v2Header(1, 0x21, v4Addrs), nil, 0, ErrInvalidHeader},
+		{v2Header(1, 0x11, v4Addrs)[:20], nil, 0, ErrInvalidHeader},
+		{[]byte("GET / HTTP/1.1\r\n"), nil, 0, ErrNoHeader},
+		{[]byte{0, 0, 4, 0x17, 0x27, 0x10, 0x19, 0x80}, nil, 0, ErrNoHeader},
+	}
+
+	for _, tt := range table {
+		h, n, err := Parse(tt.data)
+		require.Equal(t, tt.err, err, "%q", tt.data)
+		require.Equal(t, tt.header, h, "%q", tt.data)
+		require.Equal(t, tt.n, n, "%q", tt.data)
+	}
+}
+
+func TestRead(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte("PROXY UNKNOWN\r\nrest")))
+	h, err := Read(r)
+	require.Nil(t, err)
+	require.Equal(t, &Header{Version: 1}, h)
+	rest, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, "rest", string(rest))
+
+	// Data without a header is left unread.
+	r = bufio.NewReader(bytes.NewReader([]byte("PUT /")))
+	_, err = Read(r)
+	require.Equal(t, ErrNoHeader, err)
+	rest, err = ioutil.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, "PUT /", string(rest))
+}
+
+func TestListener(t *testing.T) {
+	for _, trusted := range []bool{true, false} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		l := &Listener{Listener: ln, Trusted: func(net.IP) bool { return trusted }}
+
+		go func() {
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return
+			}
+			c.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 6881 80\r\nhello"))
+			c.Close()
+		}()
+
+		c, err := l.Accept()
+		require.Nil(t, err)
+		data, err := ioutil.ReadAll(c)
+		require.Nil(t, err)
+
+		if trusted {
+			require.Equal(t, "192.0.2.1:6881", c.RemoteAddr().String())
+			require.Equal(t, "hello", string(data))
+		} else {
+			require.Equal(t, "127.0.0.1", IP(c.RemoteAddr()).String())
+			require.Equal(t, "PROXY TCP4 192.0.2.1 198.51.100.1 6881 80\r\nhello", string(data))
+		}
+
+		require.Nil(t, c.Close())
+		require.Nil(t, l.Close())
+	}
+}
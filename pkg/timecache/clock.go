@@ -0,0 +1,163 @@
+package timecache
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Clock provides the current time and timers based on it.
+//
+// TimeCache implements Clock using the system clock, FakeClock implements it
+// with a time that is advanced manually.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NowUnixNano returns the current time as nanoseconds since the Unix
+	// Epoch.
+	NowUnixNano() int64
+
+	// NowUnix returns the current time as seconds since the Unix Epoch.
+	NowUnix() int64
+
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+var (
+	_ Clock = &TimeCache{}
+	_ Clock = &FakeClock{}
+)
+
+// Default returns the global TimeCache as a Clock.
+func Default() Clock {
+	return t
+}
+
+// After waits for the duration to elapse and then sends the current system
+// time on the returned channel.
+func (t *TimeCache) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// A FakeClock is a Clock whose time only changes when Advance or Set are
+// called.
+// It is meant to be used in tests of time-dependent code.
+//
+// A FakeClock is safe for concurrent use.
+type FakeClock struct {
+	now     time.Time
+	waiters []fakeWaiter
+	changed chan struct{}
+	m       sync.Mutex
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// NewFakeClock returns a new FakeClock set to the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now:     now,
+		changed: make(chan struct{}),
+	}
+}
+
+// Now returns the time of the FakeClock.
+func (c *FakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+// NowUnixNano returns the time of the FakeClock as nanoseconds since the Unix
+// Epoch.
+func (c *FakeClock) NowUnixNano() int64 {
+	return c.Now().UnixNano()
+}
+
+// NowUnix returns the time of the FakeClock as seconds since the Unix Epoch.
+func (c *FakeClock) NowUnix() int64 {
+	return c.Now().Unix()
+}
+
+// After returns a channel that receives the time of the FakeClock once it has
+// been advanced by at least d.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	c.waiters = append(c.waiters, fakeWaiter{deadline: c.now.Add(d), c: ch})
+	c.notify()
+	return ch
+}
+
+// Advance moves the time of the FakeClock forward by d and fires all timers
+// that expire until then.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.set(c.now.Add(d))
+}
+
+// Set sets the time of the FakeClock and fires all timers that expire until
+// then.
+func (c *FakeClock) Set(now time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.set(now)
+}
+
+func (c *FakeClock) set(now time.Time) {
+	c.now = now
+
+	sort.Slice(c.waiters, func(i, j int) bool {
+		return c.waiters[i].deadline.Before(c.waiters[j].deadline)
+	})
+
+	remaining := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(now) {
+			remaining = append(remaining, w)
+			continue
+		}
+		w.c <- now
+	}
+	c.waiters = remaining
+	c.notify()
+}
+
+// notify wakes up everyone blocked in BlockUntil.
+// It must be called with c.m held.
+func (c *FakeClock) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// BlockUntil blocks until at least n timers created by After are waiting for
+// the FakeClock to be advanced.
+//
+// This allows tests to make sure that a background goroutine is waiting on
+// the clock before advancing it.
+func (c *FakeClock) BlockUntil(n int) {
+	for {
+		c.m.Lock()
+		waiting, changed := len(c.waiters), c.changed
+		c.m.Unlock()
+
+		if waiting >= n {
+			return
+		}
+		<-changed
+	}
+}
@@ -5,6 +5,8 @@
 // locking.
 // The package runs a global singleton TimeCache that is is updated every
 // second.
+// Code that needs to be tested deterministically should depend on the Clock
+// interface, which is implemented by TimeCache and FakeClock.
 package timecache
 
 import (
@@ -146,3 +146,42 @@ func BenchmarkTimeNow(b *testing.B) {
 		_ = now
 	})
 }
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFakeClock(start)
+	require.Equal(t, start, c.Now())
+	require.Equal(t, start.UnixNano(), c.NowUnixNano())
+	require.Equal(t, int64(1000), c.NowUnix())
+
+	short, long := c.After(time.Second), c.After(time.Minute)
+	c.BlockUntil(2)
+
+	c.Advance(30 * time.Second)
+	require.Equal(t, start.Add(30*time.Second), <-short)
+	select {
+	case <-long:
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	c.Set(start.Add(time.Hour))
+	require.Equal(t, start.Add(time.Hour), <-long)
+	require.Equal(t, start.Add(time.Hour), c.Now())
+
+	// Non-positive durations fire immediately.
+	require.Equal(t, start.Add(time.Hour), <-c.After(0))
+}
+
+func TestFakeClockBlockUntil(t *testing.T) {
+	c := NewFakeClock(time.Unix(0, 0))
+
+	fired := make(chan time.Time)
+	go func() {
+		fired <- <-c.After(time.Second)
+	}()
+
+	c.BlockUntil(1)
+	c.Advance(time.Second)
+	require.Equal(t, time.Unix(1, 0), <-fired)
+}
@@ -3,6 +3,7 @@
 package memory
 
 import (
+	"context"
 	"encoding/binary"
 	"net"
 	"runtime"
@@ -53,12 +54,33 @@ func (d driver) NewPeerStore(icfg interface{}) (storage.PeerStore, error) {
 	return New(cfg)
 }
 
+func (d driver) CheckConfig(icfg interface{}) error {
+	bytes, err := yaml.Marshal(icfg)
+	if err != nil {
+		return err
+	}
+
+	var cfg Config
+	err = yaml.UnmarshalStrict(bytes, &cfg)
+	if err != nil {
+		return err
+	}
+
+	cfg.Validate()
+	return nil
+}
+
 // Config holds the configuration of a memory PeerStore.
 type Config struct {
 	GarbageCollectionInterval   time.Duration `yaml:"gc_interval"`
 	PrometheusReportingInterval time.Duration `yaml:"prometheus_reporting_interval"`
 	PeerLifetime                time.Duration `yaml:"peer_lifetime"`
 	ShardCount                  int           `yaml:"shard_count"`
+
+	// Clock is used to timestamp peers and to schedule garbage collection
+	// and metrics reporting.
+	// If it is nil, the global timecache is used.
+	Clock timecache.Clock `yaml:"-"`
 }
 
 // LogFields renders the current config as a set of Logrus fields.
@@ -115,6 +137,10 @@ func (cfg Config) Validate() Config {
 		})
 	}
 
+	if cfg.Clock == nil {
+		validcfg.Clock = timecache.Default()
+	}
+
 	return validcfg
 }
 
@@ -139,10 +165,10 @@ func New(provided Config) (storage.PeerStore, error) {
 			select {
 			case <-ps.closed:
 				return
-			case <-time.After(cfg.GarbageCollectionInterval):
-				before := time.Now().Add(-cfg.PeerLifetime)
+			case <-cfg.Clock.After(cfg.GarbageCollectionInterval):
+				before := cfg.Clock.Now().Add(-cfg.PeerLifetime)
 				log.Debug("storage: purging peers with no announces since", log.Fields{"before": before})
-				ps.collectGarbage(before)
+				ps.CollectGarbage(before)
 			}
 		}
 	}()
@@ -151,13 +177,11 @@ func New(provided Config) (storage.PeerStore, error) {
 	ps.wg.Add(1)
 	go func() {
 		defer ps.wg.Done()
-		t := time.NewTicker(cfg.PrometheusReportingInterval)
 		for {
 			select {
 			case <-ps.closed:
-				t.Stop()
 				return
-			case <-t.C:
+			case <-cfg.Clock.After(cfg.PrometheusReportingInterval):
 				before := time.Now()
 				ps.populateProm()
 				log.Debug("storage: populateProm() finished", log.Fields{"timeTaken": time.Since(before)})
@@ -218,7 +242,12 @@ type peerStore struct {
 	wg     sync.WaitGroup
 }
 
-var _ storage.PeerStore = &peerStore{}
+var (
+	_ storage.PeerStore        = &peerStore{}
+	_ storage.SwarmDeleter     = &peerStore{}
+	_ storage.GarbageCollector = &peerStore{}
+	_ storage.FullScraper      = &peerStore{}
+)
 
 // populateProm aggregates metrics over all shards and then posts them to
 // prometheus.
@@ -244,7 +273,7 @@ func recordGCDuration(duration time.Duration) {
 }
 
 func (ps *peerStore) getClock() int64 {
-	return timecache.NowUnixNano()
+	return ps.cfg.Clock.NowUnixNano()
 }
 
 func (ps *peerStore) shardIndex(infoHash bittorrent.InfoHash, af bittorrent.AddressFamily) uint32 {
@@ -258,13 +287,17 @@ func (ps *peerStore) shardIndex(infoHash bittorrent.InfoHash, af bittorrent.Addr
 	return idx
 }
 
-func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
 	default:
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	pk := newPeerKey(p)
 
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
@@ -289,13 +322,17 @@ func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error
 	return nil
 }
 
-func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
 	default:
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	pk := newPeerKey(p)
 
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
@@ -322,13 +359,17 @@ func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) err
 	return nil
 }
 
-func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
 	default:
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	pk := newPeerKey(p)
 
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
@@ -353,13 +394,17 @@ func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error
 	return nil
 }
 
-func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
 	default:
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	pk := newPeerKey(p)
 
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
@@ -386,13 +431,17 @@ func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) er
 	return nil
 }
 
-func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
 	default:
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	pk := newPeerKey(p)
 
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
@@ -423,13 +472,17 @@ func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer)
 	return nil
 }
 
-func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
+func (ps *peerStore) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
 	default:
 	}
 
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	shard := ps.shards[ps.shardIndex(ih, announcer.IP.AddressFamily)]
 	shard.RLock()
 
@@ -462,6 +515,7 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 		}
 
 		// Append leechers until we reach numWant.
+		// Peers that are also seeders have already been appended.
 		if numWant > 0 {
 			leechers := shard.swarms[ih].leechers
 			announcerPK := newPeerKey(announcer)
@@ -470,6 +524,10 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 					continue
 				}
 
+				if _, isSeeder := seeders[pk]; isSeeder {
+					continue
+				}
+
 				if numWant == 0 {
 					break
 				}
@@ -484,7 +542,7 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 	return
 }
 
-func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) (resp bittorrent.Scrape) {
+func (ps *peerStore) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) (resp bittorrent.Scrape) {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -492,6 +550,9 @@ func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, addressFamily bittorren
 	}
 
 	resp.InfoHash = ih
+	if ctx.Err() != nil {
+		return
+	}
 	shard := ps.shards[ps.shardIndex(ih, addressFamily)]
 	shard.RLock()
 
@@ -508,12 +569,87 @@ func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, addressFamily bittorren
 	return
 }
 
-// collectGarbage deletes all Peers from the PeerStore which are older than the
+// ScrapeSwarms calls fn with the Scrape of every swarm of the address family
+// that has peers.
+//
+// Shards are scraped one at a time, so that only the Scrapes of one shard are
+// held in memory and the shard is not locked while fn runs.
+func (ps *peerStore) ScrapeSwarms(ctx context.Context, af bittorrent.AddressFamily, fn func(bittorrent.Scrape) error) error {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	shards := ps.shards[:len(ps.shards)/2]
+	if af == bittorrent.IPv6 {
+		shards = ps.shards[len(ps.shards)/2:]
+	}
+
+	var scrapes []bittorrent.Scrape
+	for _, shard := range shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		scrapes = scrapes[:0]
+		shard.RLock()
+		for ih, swarm := range shard.swarms {
+			if len(swarm.seeders)+len(swarm.leechers) == 0 {
+				continue
+			}
+			scrapes = append(scrapes, bittorrent.Scrape{
+				InfoHash:   ih,
+				Complete:   uint32(len(swarm.seeders)),
+				Incomplete: uint32(len(swarm.leechers)),
+			})
+		}
+		shard.RUnlock()
+
+		for _, scrape := range scrapes {
+			if err := fn(scrape); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// DeleteSwarm deletes a swarm along with all of its Peers.
+func (ps *peerStore) DeleteSwarm(ctx context.Context, ih bittorrent.InfoHash, af bittorrent.AddressFamily) error {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	shard := ps.shards[ps.shardIndex(ih, af)]
+	shard.Lock()
+	defer shard.Unlock()
+
+	swarm, ok := shard.swarms[ih]
+	if !ok {
+		return storage.ErrResourceDoesNotExist
+	}
+
+	shard.numSeeders -= uint64(len(swarm.seeders))
+	shard.numLeechers -= uint64(len(swarm.leechers))
+	delete(shard.swarms, ih)
+
+	return nil
+}
+
+// CollectGarbage deletes all Peers from the PeerStore which are older than the
 // cutoff time.
 //
 // This function must be able to execute while other methods on this interface
 // are being executed in parallel.
-func (ps *peerStore) collectGarbage(cutoff time.Time) error {
+func (ps *peerStore) CollectGarbage(cutoff time.Time) error {
 	select {
 	case <-ps.closed:
 		return nil
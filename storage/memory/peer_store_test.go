@@ -1,18 +1,30 @@
 package memory
 
 import (
+	"context"
+	"net"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/pkg/timecache"
 	s "github.com/doujincafe/chihaya/storage"
+	"github.com/doujincafe/chihaya/storage/storagetest"
 )
 
 func createNew() s.PeerStore {
+	return createNewWithClock(nil)
+}
+
+func createNewWithClock(clock timecache.Clock) s.PeerStore {
 	ps, err := New(Config{
 		ShardCount:                  1024,
 		GarbageCollectionInterval:   10 * time.Minute,
 		PrometheusReportingInterval: 10 * time.Minute,
 		PeerLifetime:                30 * time.Minute,
+		Clock:                       clock,
 	})
 	if err != nil {
 		panic(err)
@@ -20,32 +32,115 @@ func createNew() s.PeerStore {
 	return ps
 }
 
-func TestPeerStore(t *testing.T) { s.TestPeerStore(t, createNew()) }
-
-func BenchmarkNop(b *testing.B)                        { s.Nop(b, createNew()) }
-func BenchmarkPut(b *testing.B)                        { s.Put(b, createNew()) }
-func BenchmarkPut1k(b *testing.B)                      { s.Put1k(b, createNew()) }
-func BenchmarkPut1kInfohash(b *testing.B)              { s.Put1kInfohash(b, createNew()) }
-func BenchmarkPut1kInfohash1k(b *testing.B)            { s.Put1kInfohash1k(b, createNew()) }
-func BenchmarkPutDelete(b *testing.B)                  { s.PutDelete(b, createNew()) }
-func BenchmarkPutDelete1k(b *testing.B)                { s.PutDelete1k(b, createNew()) }
-func BenchmarkPutDelete1kInfohash(b *testing.B)        { s.PutDelete1kInfohash(b, createNew()) }
-func BenchmarkPutDelete1kInfohash1k(b *testing.B)      { s.PutDelete1kInfohash1k(b, createNew()) }
-func BenchmarkDeleteNonexist(b *testing.B)             { s.DeleteNonexist(b, createNew()) }
-func BenchmarkDeleteNonexist1k(b *testing.B)           { s.DeleteNonexist1k(b, createNew()) }
-func BenchmarkDeleteNonexist1kInfohash(b *testing.B)   { s.DeleteNonexist1kInfohash(b, createNew()) }
-func BenchmarkDeleteNonexist1kInfohash1k(b *testing.B) { s.DeleteNonexist1kInfohash1k(b, createNew()) }
-func BenchmarkPutGradDelete(b *testing.B)              { s.PutGradDelete(b, createNew()) }
-func BenchmarkPutGradDelete1k(b *testing.B)            { s.PutGradDelete1k(b, createNew()) }
-func BenchmarkPutGradDelete1kInfohash(b *testing.B)    { s.PutGradDelete1kInfohash(b, createNew()) }
-func BenchmarkPutGradDelete1kInfohash1k(b *testing.B)  { s.PutGradDelete1kInfohash1k(b, createNew()) }
-func BenchmarkGradNonexist(b *testing.B)               { s.GradNonexist(b, createNew()) }
-func BenchmarkGradNonexist1k(b *testing.B)             { s.GradNonexist1k(b, createNew()) }
-func BenchmarkGradNonexist1kInfohash(b *testing.B)     { s.GradNonexist1kInfohash(b, createNew()) }
-func BenchmarkGradNonexist1kInfohash1k(b *testing.B)   { s.GradNonexist1kInfohash1k(b, createNew()) }
-func BenchmarkAnnounceLeecher(b *testing.B)            { s.AnnounceLeecher(b, createNew()) }
-func BenchmarkAnnounceLeecher1kInfohash(b *testing.B)  { s.AnnounceLeecher1kInfohash(b, createNew()) }
-func BenchmarkAnnounceSeeder(b *testing.B)             { s.AnnounceSeeder(b, createNew()) }
-func BenchmarkAnnounceSeeder1kInfohash(b *testing.B)   { s.AnnounceSeeder1kInfohash(b, createNew()) }
-func BenchmarkScrapeSwarm(b *testing.B)                { s.ScrapeSwarm(b, createNew()) }
-func BenchmarkScrapeSwarm1kInfohash(b *testing.B)      { s.ScrapeSwarm1kInfohash(b, createNew()) }
+func TestPeerStore(t *testing.T) { storagetest.TestPeerStore(t, createNewWithClock) }
+
+func FuzzPeerStore(f *testing.F) { storagetest.FuzzPeerStore(f, createNewWithClock) }
+
+func TestAnnouncePeersSeederAndLeecher(t *testing.T) {
+	ps := createNew()
+	defer func() { require.Nil(t, ps.Stop().Wait()) }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("00000000000000000001"),
+		IP:   bittorrent.IP{IP: net.IPv4(192, 0, 2, 1).To4(), AddressFamily: bittorrent.IPv4},
+		Port: 1,
+	}
+	announcer := peer
+	announcer.Port = 2
+
+	// A peer that completed the download is a seeder until its leecher
+	// entry is deleted or expires, and must not be returned twice.
+	require.Nil(t, ps.PutLeecher(context.Background(), ih, peer))
+	require.Nil(t, ps.PutSeeder(context.Background(), ih, peer))
+
+	peers, err := ps.AnnouncePeers(context.Background(), ih, false, 50, announcer)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{peer}, peers)
+}
+
+func TestGarbageCollectionLoop(t *testing.T) {
+	clock := timecache.NewFakeClock(time.Unix(0, 0))
+	ps := createNewWithClock(clock)
+	defer func() { require.Nil(t, ps.Stop().Wait()) }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	old := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("00000000000000000001"),
+		IP:   bittorrent.IP{IP: []byte{1, 1, 1, 1}, AddressFamily: bittorrent.IPv4},
+		Port: 1,
+	}
+	fresh := old
+	fresh.Port = 2
+
+	// Wait for the garbage collection and metrics goroutines.
+	clock.BlockUntil(2)
+
+	require.Nil(t, ps.PutSeeder(context.Background(), ih, old))
+	clock.Advance(25 * time.Minute)
+	require.Nil(t, ps.PutSeeder(context.Background(), ih, fresh))
+
+	// The first sweep sees the clock at 25 minutes, when neither peer is older
+	// than the peer lifetime of 30 minutes.
+	clock.BlockUntil(2)
+	require.Equal(t, uint32(2), ps.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4).Complete)
+
+	// The next sweep runs ten minutes after the first one finished and only
+	// sees old as expired.
+	clock.Advance(10 * time.Minute)
+	clock.BlockUntil(2)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4).Complete)
+
+	clock.Advance(30 * time.Minute)
+	clock.BlockUntil(2)
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4).Complete)
+}
+
+func BenchmarkNop(b *testing.B)                   { storagetest.Nop(b, createNew()) }
+func BenchmarkPut(b *testing.B)                   { storagetest.Put(b, createNew()) }
+func BenchmarkPut1k(b *testing.B)                 { storagetest.Put1k(b, createNew()) }
+func BenchmarkPut1kInfohash(b *testing.B)         { storagetest.Put1kInfohash(b, createNew()) }
+func BenchmarkPut1kInfohash1k(b *testing.B)       { storagetest.Put1kInfohash1k(b, createNew()) }
+func BenchmarkPutDelete(b *testing.B)             { storagetest.PutDelete(b, createNew()) }
+func BenchmarkPutDelete1k(b *testing.B)           { storagetest.PutDelete1k(b, createNew()) }
+func BenchmarkPutDelete1kInfohash(b *testing.B)   { storagetest.PutDelete1kInfohash(b, createNew()) }
+func BenchmarkPutDelete1kInfohash1k(b *testing.B) { storagetest.PutDelete1kInfohash1k(b, createNew()) }
+func BenchmarkDeleteNonexist(b *testing.B)        { storagetest.DeleteNonexist(b, createNew()) }
+func BenchmarkDeleteNonexist1k(b *testing.B)      { storagetest.DeleteNonexist1k(b, createNew()) }
+func BenchmarkDeleteNonexist1kInfohash(b *testing.B) {
+	storagetest.DeleteNonexist1kInfohash(b, createNew())
+}
+func BenchmarkDeleteNonexist1kInfohash1k(b *testing.B) {
+	storagetest.DeleteNonexist1kInfohash1k(b, createNew())
+}
+func BenchmarkPutGradDelete(b *testing.B)   { storagetest.PutGradDelete(b, createNew()) }
+func BenchmarkPutGradDelete1k(b *testing.B) { storagetest.PutGradDelete1k(b, createNew()) }
+func BenchmarkPutGradDelete1kInfohash(b *testing.B) {
+	storagetest.PutGradDelete1kInfohash(b, createNew())
+}
+func BenchmarkPutGradDelete1kInfohash1k(b *testing.B) {
+	storagetest.PutGradDelete1kInfohash1k(b, createNew())
+}
+func BenchmarkGradNonexist(b *testing.B)   { storagetest.GradNonexist(b, createNew()) }
+func BenchmarkGradNonexist1k(b *testing.B) { storagetest.GradNonexist1k(b, createNew()) }
+func BenchmarkGradNonexist1kInfohash(b *testing.B) {
+	storagetest.GradNonexist1kInfohash(b, createNew())
+}
+func BenchmarkGradNonexist1kInfohash1k(b *testing.B) {
+	storagetest.GradNonexist1kInfohash1k(b, createNew())
+}
+func BenchmarkAnnounceLeecher(b *testing.B) { storagetest.AnnounceLeecher(b, createNew()) }
+func BenchmarkAnnounceLeecher1kInfohash(b *testing.B) {
+	storagetest.AnnounceLeecher1kInfohash(b, createNew())
+}
+func BenchmarkAnnounceSeeder(b *testing.B) { storagetest.AnnounceSeeder(b, createNew()) }
+func BenchmarkAnnounceSeeder1kInfohash(b *testing.B) {
+	storagetest.AnnounceSeeder1kInfohash(b, createNew())
+}
+func BenchmarkScrapeSwarm(b *testing.B)           { storagetest.ScrapeSwarm(b, createNew()) }
+func BenchmarkScrapeSwarm1kInfohash(b *testing.B) { storagetest.ScrapeSwarm1kInfohash(b, createNew()) }
+
+func TestCheckConfig(t *testing.T) {
+	require.Nil(t, driver{}.CheckConfig(map[interface{}]interface{}{"shard_count": 16}))
+	require.NotNil(t, driver{}.CheckConfig(map[interface{}]interface{}{"shard_cuont": 16}))
+}
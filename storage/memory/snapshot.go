@@ -0,0 +1,188 @@
+package memory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/storage"
+)
+
+// snapshotMagic starts every snapshot, identifying its format.
+const snapshotMagic = "chihaya memory snapshot v1\n"
+
+// Record types of a snapshot.
+const (
+	snapshotEnd   byte = 0
+	snapshotSwarm byte = 1
+)
+
+var errInvalidSnapshot = errors.New("memory: invalid snapshot")
+
+var _ storage.Snapshotter = &peerStore{}
+
+// WriteSnapshot writes all swarms to w.
+//
+// A snapshot is the magic string followed by one record per swarm and an end
+// record. A swarm record holds the infohash, the number of seeders and
+// leechers and then every peer as its serialized key and the unix time in
+// nanoseconds it last announced.
+//
+// Shards are locked one at a time, so peers that change while the snapshot
+// is written may or may not be part of it.
+func (ps *peerStore) WriteSnapshot(w io.Writer) error {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(snapshotMagic); err != nil {
+		return err
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	writeUvarint := func(v uint64) {
+		n := binary.PutUvarint(buf[:], v)
+		bw.Write(buf[:n])
+	}
+	writePeers := func(peers map[serializedPeer]int64) {
+		for pk, mtime := range peers {
+			writeUvarint(uint64(len(pk)))
+			bw.WriteString(string(pk))
+			n := binary.PutVarint(buf[:], mtime)
+			bw.Write(buf[:n])
+		}
+	}
+
+	for _, shard := range ps.shards {
+		shard.RLock()
+		for ih, swarm := range shard.swarms {
+			bw.WriteByte(snapshotSwarm)
+			bw.Write(ih[:])
+			writeUvarint(uint64(len(swarm.seeders)))
+			writeUvarint(uint64(len(swarm.leechers)))
+			writePeers(swarm.seeders)
+			writePeers(swarm.leechers)
+		}
+		shard.RUnlock()
+	}
+
+	// Errors of the writes above are returned by Flush.
+	bw.WriteByte(snapshotEnd)
+	return bw.Flush()
+}
+
+// RestoreSnapshot adds the swarms of a snapshot written by WriteSnapshot.
+//
+// Peers that are in the PeerStore already keep the most recent of both times
+// they last announced.
+func (ps *peerStore) RestoreSnapshot(r io.Reader) error {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return err
+	}
+	if string(magic) != snapshotMagic {
+		return errInvalidSnapshot
+	}
+
+	for {
+		typ, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case snapshotEnd:
+			return nil
+		case snapshotSwarm:
+		default:
+			return errInvalidSnapshot
+		}
+
+		var ih bittorrent.InfoHash
+		if _, err := io.ReadFull(br, ih[:]); err != nil {
+			return err
+		}
+		numSeeders, err := binary.ReadUvarint(br)
+		if err != nil {
+			return err
+		}
+		numLeechers, err := binary.ReadUvarint(br)
+		if err != nil {
+			return err
+		}
+
+		for i := uint64(0); i < numSeeders+numLeechers; i++ {
+			pk, mtime, err := readSnapshotPeer(br)
+			if err != nil {
+				return err
+			}
+			ps.restorePeer(ih, pk, i < numSeeders, mtime)
+		}
+	}
+}
+
+// readSnapshotPeer reads the key and time of a peer of a swarm record.
+func readSnapshotPeer(br *bufio.Reader) (serializedPeer, int64, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", 0, err
+	}
+	if n != 22+net.IPv4len && n != 22+net.IPv6len {
+		return "", 0, errInvalidSnapshot
+	}
+
+	pk := make([]byte, n)
+	if _, err := io.ReadFull(br, pk); err != nil {
+		return "", 0, err
+	}
+	mtime, err := binary.ReadVarint(br)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return serializedPeer(pk), mtime, nil
+}
+
+// restorePeer adds a peer of a snapshot to its swarm.
+func (ps *peerStore) restorePeer(ih bittorrent.InfoHash, pk serializedPeer, seeder bool, mtime int64) {
+	af := bittorrent.IPv6
+	if net.IP(pk[22:]).To4() != nil {
+		af = bittorrent.IPv4
+	}
+
+	shard := ps.shards[ps.shardIndex(ih, af)]
+	shard.Lock()
+	defer shard.Unlock()
+
+	if _, ok := shard.swarms[ih]; !ok {
+		shard.swarms[ih] = swarm{
+			seeders:  make(map[serializedPeer]int64),
+			leechers: make(map[serializedPeer]int64),
+		}
+	}
+
+	peers, count := shard.swarms[ih].leechers, &shard.numLeechers
+	if seeder {
+		peers, count = shard.swarms[ih].seeders, &shard.numSeeders
+	}
+
+	current, ok := peers[pk]
+	if !ok {
+		*count++
+	}
+	if !ok || mtime > current {
+		peers[pk] = mtime
+	}
+}
@@ -1,8 +1,11 @@
 package storage
 
 import (
+	"context"
 	"errors"
+	"io"
 	"sync"
+	"time"
 
 	"github.com/doujincafe/chihaya/bittorrent"
 	"github.com/doujincafe/chihaya/pkg/log"
@@ -19,6 +22,56 @@ type Driver interface {
 	NewPeerStore(cfg interface{}) (PeerStore, error)
 }
 
+// Checker can be implemented by a Driver to check a config without creating
+// a PeerStore.
+//
+// CheckConfig parses the config strictly, so that unknown keys are errors,
+// and validates it like NewPeerStore does, but without starting goroutines
+// or connecting to a data store. Values replaced by defaults are logged like
+// NewPeerStore logs them.
+type Checker interface {
+	CheckConfig(cfg interface{}) error
+}
+
+// SwarmDeleter is implemented by PeerStores that can delete whole Swarms.
+type SwarmDeleter interface {
+	// DeleteSwarm removes the Swarm identified by the provided InfoHash and
+	// AddressFamily along with all of its Peers.
+	//
+	// If the Swarm does not exist, this function returns
+	// ErrResourceDoesNotExist.
+	DeleteSwarm(ctx context.Context, infoHash bittorrent.InfoHash, af bittorrent.AddressFamily) error
+}
+
+// GarbageCollector is implemented by PeerStores that allow a garbage
+// collection sweep to be triggered with an explicit cutoff.
+type GarbageCollector interface {
+	// CollectGarbage removes all Peers that have not announced since cutoff.
+	CollectGarbage(cutoff time.Time) error
+}
+
+// Snapshotter is implemented by PeerStores whose Peers can be written to a
+// snapshot and restored from it, e.g. to hand them over to another process.
+type Snapshotter interface {
+	// WriteSnapshot writes all Swarms along with their Peers to w.
+	WriteSnapshot(w io.Writer) error
+
+	// RestoreSnapshot adds the Swarms and Peers of a snapshot written by
+	// WriteSnapshot, keeping the time the Peers last announced.
+	RestoreSnapshot(r io.Reader) error
+}
+
+// FullScraper is implemented by PeerStores that can scrape all of their Swarms
+// at once.
+type FullScraper interface {
+	// ScrapeSwarms calls fn with the Scrape of every Swarm of the
+	// AddressFamily that has Peers, in no particular order. It stops at the
+	// first error returned by fn or the context and returns it.
+	//
+	// The Scrapes should not all be held in memory at once.
+	ScrapeSwarms(ctx context.Context, af bittorrent.AddressFamily, fn func(bittorrent.Scrape) error) error
+}
+
 // ErrResourceDoesNotExist is the error returned by all delete methods and the
 // AnnouncePeers method of the PeerStore interface if the requested resource
 // does not exist.
@@ -28,6 +81,10 @@ var ErrResourceDoesNotExist = bittorrent.ClientError("resource does not exist")
 // store driver with that name does not exist.
 var ErrDriverDoesNotExist = errors.New("peer store driver with that name does not exist")
 
+// ErrCheckUnsupported is the error returned by CheckConfig when a peer store
+// driver does not implement Checker.
+var ErrCheckUnsupported = errors.New("peer store driver does not support checking configs")
+
 // PeerStore is an interface that abstracts the interactions of storing and
 // manipulating Peers such that it can be implemented for various data stores.
 //
@@ -43,39 +100,43 @@ var ErrDriverDoesNotExist = errors.New("peer store driver with that name does no
 //     A PeerStore must be able to transparently handle IPv4 and IPv6 Peers, but
 //     must separate them. AnnouncePeers and ScrapeSwarm must return information
 //     about the Swarm matching the given AddressFamily only.
+// - Honour the context passed to every method.
+//     The context carries the deadline of the request the operation is done
+//     for. Once it is done, methods should return its error as soon as
+//     possible; ScrapeSwarm may return an incomplete Scrape instead.
 //
-// Implementations can be tested against this interface using the tests in
-// storage_tests.go and the benchmarks in storage_bench.go.
+// Implementations can be tested against this interface using the conformance
+// suite, fuzz target and benchmarks in the storagetest package.
 type PeerStore interface {
 	// PutSeeder adds a Seeder to the Swarm identified by the provided
 	// InfoHash.
-	PutSeeder(infoHash bittorrent.InfoHash, p bittorrent.Peer) error
+	PutSeeder(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error
 
 	// DeleteSeeder removes a Seeder from the Swarm identified by the
 	// provided InfoHash.
 	//
 	// If the Swarm or Peer does not exist, this function returns
 	// ErrResourceDoesNotExist.
-	DeleteSeeder(infoHash bittorrent.InfoHash, p bittorrent.Peer) error
+	DeleteSeeder(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error
 
 	// PutLeecher adds a Leecher to the Swarm identified by the provided
 	// InfoHash.
 	// If the Swarm does not exist already, it is created.
-	PutLeecher(infoHash bittorrent.InfoHash, p bittorrent.Peer) error
+	PutLeecher(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error
 
 	// DeleteLeecher removes a Leecher from the Swarm identified by the
 	// provided InfoHash.
 	//
 	// If the Swarm or Peer does not exist, this function returns
 	// ErrResourceDoesNotExist.
-	DeleteLeecher(infoHash bittorrent.InfoHash, p bittorrent.Peer) error
+	DeleteLeecher(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error
 
 	// GraduateLeecher promotes a Leecher to a Seeder in the Swarm
 	// identified by the provided InfoHash.
 	//
 	// If the given Peer is not present as a Leecher or the swarm does not exist
 	// already, the Peer is added as a Seeder and no error is returned.
-	GraduateLeecher(infoHash bittorrent.InfoHash, p bittorrent.Peer) error
+	GraduateLeecher(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error
 
 	// AnnouncePeers is a best effort attempt to return Peers from the Swarm
 	// identified by the provided InfoHash.
@@ -92,7 +153,7 @@ type PeerStore interface {
 	//   leechers
 	//
 	// Returns ErrResourceDoesNotExist if the provided InfoHash is not tracked.
-	AnnouncePeers(infoHash bittorrent.InfoHash, seeder bool, numWant int, p bittorrent.Peer) (peers []bittorrent.Peer, err error)
+	AnnouncePeers(ctx context.Context, infoHash bittorrent.InfoHash, seeder bool, numWant int, p bittorrent.Peer) (peers []bittorrent.Peer, err error)
 
 	// ScrapeSwarm returns information required to answer a Scrape request
 	// about a Swarm identified by the given InfoHash.
@@ -102,7 +163,7 @@ type PeerStore interface {
 	// filling the Snatches field is optional.
 	//
 	// If the Swarm does not exist, an empty Scrape and no error is returned.
-	ScrapeSwarm(infoHash bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) bittorrent.Scrape
+	ScrapeSwarm(ctx context.Context, infoHash bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) bittorrent.Scrape
 
 	// stop.Stopper is an interface that expects a Stop method to stop the
 	// PeerStore.
@@ -152,3 +213,23 @@ func NewPeerStore(name string, cfg interface{}) (ps PeerStore, err error) {
 
 	return d.NewPeerStore(cfg)
 }
+
+// CheckConfig checks a config for the registered Driver with the given name.
+//
+// If a driver does not exist, returns ErrDriverDoesNotExist. If it does not
+// implement Checker, returns ErrCheckUnsupported.
+func CheckConfig(name string, cfg interface{}) error {
+	driversM.RLock()
+	defer driversM.RUnlock()
+
+	d, ok := drivers[name]
+	if !ok {
+		return ErrDriverDoesNotExist
+	}
+
+	c, ok := d.(Checker)
+	if !ok {
+		return ErrCheckUnsupported
+	}
+	return c.CheckConfig(cfg)
+}
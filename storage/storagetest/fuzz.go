@@ -0,0 +1,147 @@
+package storagetest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+	"github.com/doujincafe/chihaya/storage"
+)
+
+// Operations understood by FuzzPeerStore.
+const (
+	opPutSeeder = iota
+	opPutLeecher
+	opDeleteSeeder
+	opDeleteLeecher
+	opGraduateLeecher
+	opAnnounceSeeder
+	opAnnounceLeecher
+	opScrape
+	numOps
+)
+
+// opSize is the number of input bytes consumed by a single operation:
+// operation, infohash, peer and numWant.
+const opSize = 4
+
+// FuzzPeerStore is a fuzz target that decodes its input into a sequence of
+// PeerStore operations, executes them against a PeerStore created by newPS
+// and compares the results with a reference model.
+//
+// Drivers wire it up from a fuzz test of their own:
+//
+//	func FuzzPeerStore(f *testing.F) { storagetest.FuzzPeerStore(f, newMyStore) }
+//
+// Garbage collection is not exercised, the Clock passed to newPS never
+// advances.
+func FuzzPeerStore(f *testing.F, newPS PeerStoreFunc) {
+	f.Add([]byte{
+		opPutLeecher, 0, 1, 0,
+		opPutSeeder, 0, 2, 0,
+		opAnnounceLeecher, 0, 3, 50,
+		opGraduateLeecher, 0, 1, 0,
+		opScrape, 0, 0, 0,
+		opDeleteSeeder, 0, 2, 0,
+		opDeleteLeecher, 0, 1, 0,
+	})
+	f.Add([]byte{
+		opGraduateLeecher, 1, 9, 0,
+		opPutLeecher, 1, 10, 0,
+		opAnnounceSeeder, 1, 9, 1,
+		opDeleteLeecher, 1, 9, 0,
+		opScrape, 1, 9, 0,
+	})
+
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		ps := newPS(timecache.NewFakeClock(epoch))
+		defer func() {
+			if errs := ps.Stop().Wait(); len(errs) != 0 {
+				t.Fatal(errs)
+			}
+		}()
+
+		runOps(t, ps, ops)
+	})
+}
+
+func runOps(t *testing.T, ps storage.PeerStore, ops []byte) {
+	m := newModel()
+	for i := 0; i+opSize <= len(ops); i += opSize {
+		op := ops[i] % numOps
+		ih := infoHash(ops[i+1] % 3)
+
+		// Half of the peers are IPv4, the other half IPv6.
+		var peer bittorrent.Peer
+		if n := ops[i+2] % 16; n < 8 {
+			peer = v4Peer(n)
+		} else {
+			peer = v6Peer(n)
+		}
+		numWant := int(ops[i+3] % 20)
+
+		switch op {
+		case opPutSeeder:
+			compareErr(t, i, m.putSeeder(ih, peer), ps.PutSeeder(context.Background(), ih, peer))
+		case opPutLeecher:
+			compareErr(t, i, m.putLeecher(ih, peer), ps.PutLeecher(context.Background(), ih, peer))
+		case opDeleteSeeder:
+			compareErr(t, i, m.deleteSeeder(ih, peer), ps.DeleteSeeder(context.Background(), ih, peer))
+		case opDeleteLeecher:
+			compareErr(t, i, m.deleteLeecher(ih, peer), ps.DeleteLeecher(context.Background(), ih, peer))
+		case opGraduateLeecher:
+			compareErr(t, i, m.graduateLeecher(ih, peer), ps.GraduateLeecher(context.Background(), ih, peer))
+		case opAnnounceSeeder, opAnnounceLeecher:
+			seeder := op == opAnnounceSeeder
+			candidates, want := m.candidates(ih, seeder, peer)
+			peers, got := ps.AnnouncePeers(context.Background(), ih, seeder, numWant, peer)
+			compareErr(t, i, want, got)
+			if want == nil {
+				checkAnnounce(t, i, candidates, peers, numWant, peer)
+			}
+		case opScrape:
+			af := peer.IP.AddressFamily
+			want, got := m.scrape(ih, af), ps.ScrapeSwarm(context.Background(), ih, af)
+			if want.Complete != got.Complete || want.Incomplete != got.Incomplete {
+				t.Fatalf("op %d: scrape: want %d/%d complete/incomplete, got %d/%d",
+					i/opSize, want.Complete, want.Incomplete, got.Complete, got.Incomplete)
+			}
+		}
+	}
+}
+
+func compareErr(t *testing.T, offset int, want, got error) {
+	if want != got {
+		t.Fatalf("op %d: want error %v, got %v", offset/opSize, want, got)
+	}
+}
+
+func checkAnnounce(t *testing.T, offset int, candidates map[string]bittorrent.Peer, peers []bittorrent.Peer, numWant int, announcer bittorrent.Peer) {
+	if hasDuplicates(peers) {
+		t.Fatalf("op %d: announce returned duplicate peers: %v", offset/opSize, peers)
+	}
+
+	for _, p := range peers {
+		if _, ok := candidates[p.String()]; !ok {
+			t.Fatalf("op %d: announce returned unexpected peer %s", offset/opSize, p)
+		}
+	}
+
+	// The announcer may or may not be returned if it is a candidate, so
+	// the number of peers lies in between.
+	upper := len(candidates)
+	lower := upper
+	if _, ok := candidates[announcer.String()]; ok {
+		lower--
+	}
+	if upper > numWant {
+		upper = numWant
+	}
+	if lower > numWant {
+		lower = numWant
+	}
+	if len(peers) < lower || len(peers) > upper {
+		t.Fatalf("op %d: announce returned %d peers, want between %d and %d", offset/opSize, len(peers), lower, upper)
+	}
+}
@@ -0,0 +1,120 @@
+package storagetest
+
+import (
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/storage"
+)
+
+// model is a trivially correct reference implementation of the semantics
+// documented on storage.PeerStore, without garbage collection.
+type model struct {
+	swarms map[swarmKey]*modelSwarm
+}
+
+type swarmKey struct {
+	ih bittorrent.InfoHash
+	af bittorrent.AddressFamily
+}
+
+type modelSwarm struct {
+	seeders  map[string]bittorrent.Peer
+	leechers map[string]bittorrent.Peer
+}
+
+func newModel() *model {
+	return &model{swarms: make(map[swarmKey]*modelSwarm)}
+}
+
+func (m *model) swarm(ih bittorrent.InfoHash, af bittorrent.AddressFamily, create bool) *modelSwarm {
+	k := swarmKey{ih, af}
+	s, ok := m.swarms[k]
+	if !ok && create {
+		s = &modelSwarm{
+			seeders:  make(map[string]bittorrent.Peer),
+			leechers: make(map[string]bittorrent.Peer),
+		}
+		m.swarms[k] = s
+	}
+	return s
+}
+
+// gc removes the swarm identified by ih and af if it is empty.
+func (m *model) gc(ih bittorrent.InfoHash, af bittorrent.AddressFamily) {
+	k := swarmKey{ih, af}
+	if s, ok := m.swarms[k]; ok && len(s.seeders)+len(s.leechers) == 0 {
+		delete(m.swarms, k)
+	}
+}
+
+func (m *model) putSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	m.swarm(ih, p.IP.AddressFamily, true).seeders[p.String()] = p
+	return nil
+}
+
+func (m *model) putLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	m.swarm(ih, p.IP.AddressFamily, true).leechers[p.String()] = p
+	return nil
+}
+
+func (m *model) deleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	s := m.swarm(ih, p.IP.AddressFamily, false)
+	if s == nil {
+		return storage.ErrResourceDoesNotExist
+	}
+	if _, ok := s.seeders[p.String()]; !ok {
+		return storage.ErrResourceDoesNotExist
+	}
+	delete(s.seeders, p.String())
+	m.gc(ih, p.IP.AddressFamily)
+	return nil
+}
+
+func (m *model) deleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	s := m.swarm(ih, p.IP.AddressFamily, false)
+	if s == nil {
+		return storage.ErrResourceDoesNotExist
+	}
+	if _, ok := s.leechers[p.String()]; !ok {
+		return storage.ErrResourceDoesNotExist
+	}
+	delete(s.leechers, p.String())
+	m.gc(ih, p.IP.AddressFamily)
+	return nil
+}
+
+func (m *model) graduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	s := m.swarm(ih, p.IP.AddressFamily, true)
+	delete(s.leechers, p.String())
+	s.seeders[p.String()] = p
+	return nil
+}
+
+func (m *model) scrape(ih bittorrent.InfoHash, af bittorrent.AddressFamily) bittorrent.Scrape {
+	scrape := bittorrent.Scrape{InfoHash: ih}
+	if s := m.swarm(ih, af, false); s != nil {
+		scrape.Complete = uint32(len(s.seeders))
+		scrape.Incomplete = uint32(len(s.leechers))
+	}
+	return scrape
+}
+
+// candidates returns the Peers that may be returned by AnnouncePeers for the
+// given arguments, or ErrResourceDoesNotExist if the swarm does not exist.
+func (m *model) candidates(ih bittorrent.InfoHash, seeder bool, announcer bittorrent.Peer) (map[string]bittorrent.Peer, error) {
+	s := m.swarm(ih, announcer.IP.AddressFamily, false)
+	if s == nil {
+		return nil, storage.ErrResourceDoesNotExist
+	}
+
+	candidates := make(map[string]bittorrent.Peer)
+	for k, p := range s.leechers {
+		candidates[k] = p
+	}
+	if !seeder {
+		delete(candidates, announcer.String())
+		for k, p := range s.seeders {
+			candidates[k] = p
+		}
+	}
+	return candidates, nil
+}
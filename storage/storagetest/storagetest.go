@@ -0,0 +1,750 @@
+// Package storagetest implements a conformance test suite, a fuzz target and
+// benchmarks for implementations of the storage.PeerStore interface.
+//
+// Third-party drivers can run the suite from their own tests:
+//
+//	func TestPeerStore(t *testing.T) {
+//		storagetest.TestPeerStore(t, func(c timecache.Clock) storage.PeerStore {
+//			return newMyStore(c)
+//		})
+//	}
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doujincafe/chihaya/bittorrent"
+	"github.com/doujincafe/chihaya/pkg/timecache"
+	"github.com/doujincafe/chihaya/storage"
+)
+
+// PeerEqualityFunc is the boolean function to use to check two Peers for
+// equality.
+// Depending on the implementation of the PeerStore, this can be changed to
+// use (Peer).EqualEndpoint instead.
+var PeerEqualityFunc = func(p1, p2 bittorrent.Peer) bool { return p1.Equal(p2) }
+
+// GarbageCollector is storage.GarbageCollector.
+//
+// PeerStores that do not implement it skip the garbage collection cases of
+// the conformance suite.
+type GarbageCollector = storage.GarbageCollector
+
+// PeerStoreFunc creates a new, empty PeerStore.
+// It is called once for every case of the conformance suite.
+//
+// The PeerStore must use the provided Clock to timestamp Peers, so that the
+// suite can control their expiry.
+type PeerStoreFunc func(clock timecache.Clock) storage.PeerStore
+
+type caseFunc func(*testing.T, storage.PeerStore, *timecache.FakeClock)
+
+// withoutClock adapts a case that does not depend on the clock.
+func withoutClock(f func(*testing.T, storage.PeerStore)) caseFunc {
+	return func(t *testing.T, ps storage.PeerStore, _ *timecache.FakeClock) { f(t, ps) }
+}
+
+var conformanceCases = []struct {
+	name string
+	run  caseFunc
+}{
+	{"Lifecycle", withoutClock(testLifecycle)},
+	{"NonexistentSwarm", withoutClock(testNonexistentSwarm)},
+	{"AddressFamilyIsolation", withoutClock(testAddressFamilyIsolation)},
+	{"NumWant", withoutClock(testNumWant)},
+	{"AnnouncerExcluded", withoutClock(testAnnouncerExcluded)},
+	{"SeederGetsLeechers", withoutClock(testSeederGetsLeechers)},
+	{"PutIdempotent", withoutClock(testPutIdempotent)},
+	{"GraduateAbsent", withoutClock(testGraduateAbsent)},
+	{"GraduateLeecher", withoutClock(testGraduateLeecher)},
+	{"GarbageCollection", testGarbageCollection},
+	{"DeleteSwarm", withoutClock(testDeleteSwarm)},
+	{"Snapshot", testSnapshot},
+	{"ScrapeSwarms", withoutClock(testScrapeSwarms)},
+	{"Concurrency", withoutClock(testConcurrency)},
+	{"CanceledContext", withoutClock(testCanceledContext)},
+}
+
+// epoch is the time every FakeClock of the suite starts at.
+var epoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// TestPeerStore runs the conformance suite against PeerStores created by
+// newPS.
+// Every case runs as a subtest on a fresh PeerStore which is stopped
+// afterwards.
+func TestPeerStore(t *testing.T, newPS PeerStoreFunc) {
+	for _, tc := range conformanceCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			clock := timecache.NewFakeClock(epoch)
+			ps := newPS(clock)
+			tc.run(t, ps, clock)
+			require.Nil(t, ps.Stop().Wait())
+		})
+	}
+}
+
+func v4Peer(n byte) bittorrent.Peer {
+	return bittorrent.Peer{
+		ID:   peerID(n),
+		IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, n).To4(), AddressFamily: bittorrent.IPv4},
+		Port: 1000 + uint16(n),
+	}
+}
+
+func v6Peer(n byte) bittorrent.Peer {
+	ip := net.ParseIP("fc00::")
+	ip[15] = n
+	return bittorrent.Peer{
+		ID:   peerID(n),
+		IP:   bittorrent.IP{IP: ip, AddressFamily: bittorrent.IPv6},
+		Port: 1000 + uint16(n),
+	}
+}
+
+func peerID(n byte) bittorrent.PeerID {
+	return bittorrent.PeerIDFromString(fmt.Sprintf("-CT0001-%012d", n))
+}
+
+func infoHash(n byte) bittorrent.InfoHash {
+	return bittorrent.InfoHashFromString(fmt.Sprintf("%020d", n))
+}
+
+// forEachAF runs f once with a constructor for IPv4 peers and once with a
+// constructor for IPv6 peers.
+func forEachAF(t *testing.T, f func(t *testing.T, newPeer func(byte) bittorrent.Peer)) {
+	t.Run("IPv4", func(t *testing.T) { f(t, v4Peer) })
+	t.Run("IPv6", func(t *testing.T) { f(t, v6Peer) })
+}
+
+func testLifecycle(t *testing.T, p storage.PeerStore) {
+	forEachAF(t, func(t *testing.T, newPeer func(byte) bittorrent.Peer) {
+		ih := infoHash(1)
+		c := newPeer(1)
+		peer := newPeer(99)
+
+		// Insert dummy Peer to keep swarm active
+		err := p.PutLeecher(context.Background(), ih, peer)
+		require.Nil(t, err)
+
+		// Test ErrDNE for non-existent seeder.
+		err = p.DeleteSeeder(context.Background(), ih, peer)
+		require.Equal(t, storage.ErrResourceDoesNotExist, err)
+
+		// Test PutLeecher -> Announce -> DeleteLeecher -> Announce
+
+		err = p.PutLeecher(context.Background(), ih, c)
+		require.Nil(t, err)
+
+		peers, err := p.AnnouncePeers(context.Background(), ih, true, 50, peer)
+		require.Nil(t, err)
+		require.True(t, containsPeer(peers, c))
+
+		// non-seeder announce should still return the leecher
+		peers, err = p.AnnouncePeers(context.Background(), ih, false, 50, peer)
+		require.Nil(t, err)
+		require.True(t, containsPeer(peers, c))
+
+		scrape := p.ScrapeSwarm(context.Background(), ih, c.IP.AddressFamily)
+		require.Equal(t, uint32(2), scrape.Incomplete)
+		require.Equal(t, uint32(0), scrape.Complete)
+
+		err = p.DeleteLeecher(context.Background(), ih, c)
+		require.Nil(t, err)
+
+		peers, err = p.AnnouncePeers(context.Background(), ih, true, 50, peer)
+		require.Nil(t, err)
+		require.False(t, containsPeer(peers, c))
+
+		// Test PutSeeder -> Announce -> DeleteSeeder -> Announce
+
+		err = p.PutSeeder(context.Background(), ih, c)
+		require.Nil(t, err)
+
+		// Should be leecher to see the seeder
+		peers, err = p.AnnouncePeers(context.Background(), ih, false, 50, peer)
+		require.Nil(t, err)
+		require.True(t, containsPeer(peers, c))
+
+		scrape = p.ScrapeSwarm(context.Background(), ih, c.IP.AddressFamily)
+		require.Equal(t, uint32(1), scrape.Incomplete)
+		require.Equal(t, uint32(1), scrape.Complete)
+
+		err = p.DeleteSeeder(context.Background(), ih, c)
+		require.Nil(t, err)
+
+		peers, err = p.AnnouncePeers(context.Background(), ih, false, 50, peer)
+		require.Nil(t, err)
+		require.False(t, containsPeer(peers, c))
+
+		// Test PutLeecher -> Graduate -> Announce -> DeleteLeecher -> Announce
+
+		err = p.PutLeecher(context.Background(), ih, c)
+		require.Nil(t, err)
+
+		err = p.GraduateLeecher(context.Background(), ih, c)
+		require.Nil(t, err)
+
+		// Has to be leecher to see the graduated seeder
+		peers, err = p.AnnouncePeers(context.Background(), ih, false, 50, peer)
+		require.Nil(t, err)
+		require.True(t, containsPeer(peers, c))
+
+		// Deleting the Peer as a Leecher should have no effect
+		err = p.DeleteLeecher(context.Background(), ih, c)
+		require.Equal(t, storage.ErrResourceDoesNotExist, err)
+
+		// Verify it's still there
+		peers, err = p.AnnouncePeers(context.Background(), ih, false, 50, peer)
+		require.Nil(t, err)
+		require.True(t, containsPeer(peers, c))
+
+		// Clean up
+
+		err = p.DeleteLeecher(context.Background(), ih, peer)
+		require.Nil(t, err)
+
+		// Test ErrDNE for missing leecher
+		err = p.DeleteLeecher(context.Background(), ih, peer)
+		require.Equal(t, storage.ErrResourceDoesNotExist, err)
+
+		err = p.DeleteSeeder(context.Background(), ih, c)
+		require.Nil(t, err)
+
+		err = p.DeleteSeeder(context.Background(), ih, c)
+		require.Equal(t, storage.ErrResourceDoesNotExist, err)
+
+		// The swarm is empty and must be gone.
+		_, err = p.AnnouncePeers(context.Background(), ih, false, 50, peer)
+		require.Equal(t, storage.ErrResourceDoesNotExist, err)
+	})
+}
+
+func testNonexistentSwarm(t *testing.T, p storage.PeerStore) {
+	forEachAF(t, func(t *testing.T, newPeer func(byte) bittorrent.Peer) {
+		ih := infoHash(2)
+		c := newPeer(1)
+
+		err := p.DeleteLeecher(context.Background(), ih, c)
+		require.Equal(t, storage.ErrResourceDoesNotExist, err)
+
+		err = p.DeleteSeeder(context.Background(), ih, c)
+		require.Equal(t, storage.ErrResourceDoesNotExist, err)
+
+		_, err = p.AnnouncePeers(context.Background(), ih, false, 50, c)
+		require.Equal(t, storage.ErrResourceDoesNotExist, err)
+
+		_, err = p.AnnouncePeers(context.Background(), ih, true, 50, c)
+		require.Equal(t, storage.ErrResourceDoesNotExist, err)
+
+		// Scrapes of non-existent swarms are empty, not errors.
+		scrape := p.ScrapeSwarm(context.Background(), ih, c.IP.AddressFamily)
+		require.Equal(t, ih, scrape.InfoHash)
+		require.Equal(t, uint32(0), scrape.Complete)
+		require.Equal(t, uint32(0), scrape.Incomplete)
+		require.Equal(t, uint32(0), scrape.Snatches)
+	})
+}
+
+func testAddressFamilyIsolation(t *testing.T, p storage.PeerStore) {
+	ih := infoHash(3)
+
+	require.Nil(t, p.PutSeeder(context.Background(), ih, v4Peer(1)))
+	require.Nil(t, p.PutLeecher(context.Background(), ih, v4Peer(2)))
+
+	// The IPv6 swarm for the same infohash must not exist.
+	_, err := p.AnnouncePeers(context.Background(), ih, false, 50, v6Peer(3))
+	require.Equal(t, storage.ErrResourceDoesNotExist, err)
+
+	scrape := p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv6)
+	require.Equal(t, uint32(0), scrape.Complete)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+
+	require.Nil(t, p.PutLeecher(context.Background(), ih, v6Peer(4)))
+
+	peers, err := p.AnnouncePeers(context.Background(), ih, false, 50, v6Peer(3))
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	require.True(t, containsPeer(peers, v6Peer(4)))
+
+	peers, err = p.AnnouncePeers(context.Background(), ih, false, 50, v4Peer(3))
+	require.Nil(t, err)
+	require.Len(t, peers, 2)
+	for _, peer := range peers {
+		require.Equal(t, bittorrent.IPv4, peer.IP.AddressFamily)
+	}
+
+	scrape = p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4)
+	require.Equal(t, uint32(1), scrape.Complete)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+
+	scrape = p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv6)
+	require.Equal(t, uint32(0), scrape.Complete)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+
+	// Deleting the peer from the wrong swarm must not affect the other.
+	err = p.DeleteLeecher(context.Background(), ih, bittorrent.Peer{ID: v6Peer(4).ID, IP: v4Peer(4).IP, Port: v6Peer(4).Port})
+	require.Equal(t, storage.ErrResourceDoesNotExist, err)
+	require.Nil(t, p.DeleteLeecher(context.Background(), ih, v6Peer(4)))
+
+	scrape = p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4)
+	require.Equal(t, uint32(1), scrape.Complete)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+}
+
+func testNumWant(t *testing.T, p storage.PeerStore) {
+	forEachAF(t, func(t *testing.T, newPeer func(byte) bittorrent.Peer) {
+		ih := infoHash(4)
+		announcer := newPeer(200)
+		for i := byte(0); i < 10; i++ {
+			require.Nil(t, p.PutSeeder(context.Background(), ih, newPeer(i)))
+			require.Nil(t, p.PutLeecher(context.Background(), ih, newPeer(100+i)))
+		}
+
+		var cases = []struct {
+			numWant  int
+			seeder   bool
+			expected int
+		}{
+			{0, false, 0},
+			{0, true, 0},
+			{1, false, 1},
+			{1, true, 1},
+			{15, false, 15},
+			{15, true, 10},
+			{20, false, 20},
+			{50, false, 20},
+			{50, true, 10},
+		}
+
+		for _, tt := range cases {
+			peers, err := p.AnnouncePeers(context.Background(), ih, tt.seeder, tt.numWant, announcer)
+			require.Nil(t, err)
+			require.Len(t, peers, tt.expected, "numWant %d, seeder %t", tt.numWant, tt.seeder)
+			require.False(t, hasDuplicates(peers))
+		}
+
+		// Leechers should preferably get seeders.
+		peers, err := p.AnnouncePeers(context.Background(), ih, false, 10, announcer)
+		require.Nil(t, err)
+		for i := byte(0); i < 10; i++ {
+			require.True(t, containsPeer(peers, newPeer(i)))
+		}
+	})
+}
+
+func testAnnouncerExcluded(t *testing.T, p storage.PeerStore) {
+	forEachAF(t, func(t *testing.T, newPeer func(byte) bittorrent.Peer) {
+		ih := infoHash(5)
+		announcer := newPeer(1)
+
+		require.Nil(t, p.PutLeecher(context.Background(), ih, announcer))
+		require.Nil(t, p.PutLeecher(context.Background(), ih, newPeer(2)))
+
+		peers, err := p.AnnouncePeers(context.Background(), ih, false, 50, announcer)
+		require.Nil(t, err)
+		require.Len(t, peers, 1)
+		require.False(t, containsPeer(peers, announcer))
+
+		// A swarm containing only the announcer exists, but has nothing to
+		// offer.
+		require.Nil(t, p.DeleteLeecher(context.Background(), ih, newPeer(2)))
+		peers, err = p.AnnouncePeers(context.Background(), ih, false, 50, announcer)
+		require.Nil(t, err)
+		require.Len(t, peers, 0)
+	})
+}
+
+func testSeederGetsLeechers(t *testing.T, p storage.PeerStore) {
+	forEachAF(t, func(t *testing.T, newPeer func(byte) bittorrent.Peer) {
+		ih := infoHash(6)
+		require.Nil(t, p.PutSeeder(context.Background(), ih, newPeer(1)))
+		require.Nil(t, p.PutSeeder(context.Background(), ih, newPeer(2)))
+		require.Nil(t, p.PutLeecher(context.Background(), ih, newPeer(3)))
+
+		peers, err := p.AnnouncePeers(context.Background(), ih, true, 50, newPeer(1))
+		require.Nil(t, err)
+		require.Len(t, peers, 1)
+		require.True(t, containsPeer(peers, newPeer(3)))
+	})
+}
+
+func testPutIdempotent(t *testing.T, p storage.PeerStore) {
+	forEachAF(t, func(t *testing.T, newPeer func(byte) bittorrent.Peer) {
+		ih := infoHash(7)
+		for i := 0; i < 3; i++ {
+			require.Nil(t, p.PutSeeder(context.Background(), ih, newPeer(1)))
+			require.Nil(t, p.PutLeecher(context.Background(), ih, newPeer(2)))
+		}
+
+		scrape := p.ScrapeSwarm(context.Background(), ih, newPeer(1).IP.AddressFamily)
+		require.Equal(t, uint32(1), scrape.Complete)
+		require.Equal(t, uint32(1), scrape.Incomplete)
+
+		require.Nil(t, p.DeleteSeeder(context.Background(), ih, newPeer(1)))
+		require.Equal(t, storage.ErrResourceDoesNotExist, p.DeleteSeeder(context.Background(), ih, newPeer(1)))
+		require.Nil(t, p.DeleteLeecher(context.Background(), ih, newPeer(2)))
+		require.Equal(t, storage.ErrResourceDoesNotExist, p.DeleteLeecher(context.Background(), ih, newPeer(2)))
+	})
+}
+
+func testGraduateAbsent(t *testing.T, p storage.PeerStore) {
+	forEachAF(t, func(t *testing.T, newPeer func(byte) bittorrent.Peer) {
+		ih := infoHash(8)
+
+		// Graduating a Peer of a swarm that does not exist creates the swarm
+		// and adds the Peer as a Seeder.
+		require.Nil(t, p.GraduateLeecher(context.Background(), ih, newPeer(1)))
+
+		scrape := p.ScrapeSwarm(context.Background(), ih, newPeer(1).IP.AddressFamily)
+		require.Equal(t, uint32(1), scrape.Complete)
+		require.Equal(t, uint32(0), scrape.Incomplete)
+
+		// Graduating a Peer that is not a Leecher of an existing swarm adds it
+		// as a Seeder as well.
+		require.Nil(t, p.GraduateLeecher(context.Background(), ih, newPeer(2)))
+
+		scrape = p.ScrapeSwarm(context.Background(), ih, newPeer(1).IP.AddressFamily)
+		require.Equal(t, uint32(2), scrape.Complete)
+		require.Equal(t, uint32(0), scrape.Incomplete)
+
+		// Graduating a Seeder again is a no-op.
+		require.Nil(t, p.GraduateLeecher(context.Background(), ih, newPeer(2)))
+
+		scrape = p.ScrapeSwarm(context.Background(), ih, newPeer(1).IP.AddressFamily)
+		require.Equal(t, uint32(2), scrape.Complete)
+
+		peers, err := p.AnnouncePeers(context.Background(), ih, false, 50, newPeer(3))
+		require.Nil(t, err)
+		require.True(t, containsPeer(peers, newPeer(1)))
+		require.True(t, containsPeer(peers, newPeer(2)))
+	})
+}
+
+func testGraduateLeecher(t *testing.T, p storage.PeerStore) {
+	forEachAF(t, func(t *testing.T, newPeer func(byte) bittorrent.Peer) {
+		ih := infoHash(9)
+		require.Nil(t, p.PutLeecher(context.Background(), ih, newPeer(1)))
+		require.Nil(t, p.PutLeecher(context.Background(), ih, newPeer(2)))
+
+		require.Nil(t, p.GraduateLeecher(context.Background(), ih, newPeer(1)))
+
+		scrape := p.ScrapeSwarm(context.Background(), ih, newPeer(1).IP.AddressFamily)
+		require.Equal(t, uint32(1), scrape.Complete)
+		require.Equal(t, uint32(1), scrape.Incomplete)
+
+		// The graduated Peer is no longer a Leecher.
+		peers, err := p.AnnouncePeers(context.Background(), ih, true, 50, newPeer(3))
+		require.Nil(t, err)
+		require.Len(t, peers, 1)
+		require.True(t, containsPeer(peers, newPeer(2)))
+	})
+}
+
+func testGarbageCollection(t *testing.T, p storage.PeerStore, clock *timecache.FakeClock) {
+	gc, ok := p.(GarbageCollector)
+	if !ok {
+		t.Skip("PeerStore does not implement GarbageCollector")
+	}
+
+	ih := infoHash(10)
+	require.Nil(t, p.PutSeeder(context.Background(), ih, v4Peer(1)))
+	require.Nil(t, p.PutLeecher(context.Background(), ih, v6Peer(3)))
+
+	clock.Advance(10 * time.Minute)
+	require.Nil(t, p.PutLeecher(context.Background(), ih, v4Peer(2)))
+
+	// Nothing has been idle for more than ten minutes.
+	require.Nil(t, gc.CollectGarbage(clock.Now().Add(-11*time.Minute)))
+
+	scrape := p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4)
+	require.Equal(t, uint32(1), scrape.Complete)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+	scrape = p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv6)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+
+	// Only the peers that announced ten minutes ago have expired.
+	require.Nil(t, gc.CollectGarbage(clock.Now().Add(-5*time.Minute)))
+
+	scrape = p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4)
+	require.Equal(t, uint32(0), scrape.Complete)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+	scrape = p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv6)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+
+	// Announcing refreshes a Peer.
+	clock.Advance(10 * time.Minute)
+	require.Nil(t, p.PutLeecher(context.Background(), ih, v4Peer(2)))
+	require.Nil(t, gc.CollectGarbage(clock.Now().Add(-5*time.Minute)))
+
+	scrape = p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+
+	// Peers that announced exactly at the cutoff have expired.
+	require.Nil(t, gc.CollectGarbage(clock.Now()))
+
+	scrape = p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4)
+	require.Equal(t, uint32(0), scrape.Complete)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+	scrape = p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv6)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+
+	// Emptied swarms are removed.
+	_, err := p.AnnouncePeers(context.Background(), ih, false, 50, v4Peer(4))
+	require.Equal(t, storage.ErrResourceDoesNotExist, err)
+	_, err = p.AnnouncePeers(context.Background(), ih, false, 50, v6Peer(4))
+	require.Equal(t, storage.ErrResourceDoesNotExist, err)
+}
+
+func testDeleteSwarm(t *testing.T, p storage.PeerStore) {
+	d, ok := p.(storage.SwarmDeleter)
+	if !ok {
+		t.Skip("PeerStore does not implement SwarmDeleter")
+	}
+
+	ih := infoHash(11)
+	require.Equal(t, storage.ErrResourceDoesNotExist, d.DeleteSwarm(context.Background(), ih, bittorrent.IPv4))
+
+	require.Nil(t, p.PutSeeder(context.Background(), ih, v4Peer(1)))
+	require.Nil(t, p.PutLeecher(context.Background(), ih, v4Peer(2)))
+	require.Nil(t, p.PutLeecher(context.Background(), ih, v6Peer(3)))
+
+	require.Nil(t, d.DeleteSwarm(context.Background(), ih, bittorrent.IPv4))
+	scrape := p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4)
+	require.Equal(t, uint32(0), scrape.Complete)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+	_, err := p.AnnouncePeers(context.Background(), ih, false, 50, v4Peer(4))
+	require.Equal(t, storage.ErrResourceDoesNotExist, err)
+
+	// The swarm of the other address family is kept.
+	scrape = p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv6)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+	require.Equal(t, storage.ErrResourceDoesNotExist, d.DeleteSwarm(context.Background(), ih, bittorrent.IPv4))
+}
+
+func testSnapshot(t *testing.T, p storage.PeerStore, clock *timecache.FakeClock) {
+	sn, ok := p.(storage.Snapshotter)
+	if !ok {
+		t.Skip("PeerStore does not implement Snapshotter")
+	}
+
+	ih, other := infoHash(12), infoHash(13)
+	require.Nil(t, p.PutSeeder(context.Background(), ih, v4Peer(1)))
+	require.Nil(t, p.PutLeecher(context.Background(), ih, v6Peer(2)))
+	require.Nil(t, p.PutLeecher(context.Background(), other, v4Peer(3)))
+
+	var buf bytes.Buffer
+	require.Nil(t, sn.WriteSnapshot(&buf))
+	snapshot := buf.Bytes()
+
+	require.Nil(t, p.DeleteSeeder(context.Background(), ih, v4Peer(1)))
+	require.Nil(t, p.DeleteLeecher(context.Background(), other, v4Peer(3)))
+	clock.Advance(10 * time.Minute)
+	require.Nil(t, p.PutLeecher(context.Background(), ih, v6Peer(2)))
+
+	require.Nil(t, sn.RestoreSnapshot(bytes.NewReader(snapshot)))
+
+	// Deleted peers are restored, present ones are not counted twice.
+	require.Equal(t, uint32(1), p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4).Complete)
+	require.Equal(t, uint32(1), p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv6).Incomplete)
+	require.Equal(t, uint32(1), p.ScrapeSwarm(context.Background(), other, bittorrent.IPv4).Incomplete)
+	peers, err := p.AnnouncePeers(context.Background(), other, true, 50, v4Peer(4))
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{v4Peer(3)}, peers)
+
+	// Restored peers keep the time they last announced.
+	if gc, ok := p.(GarbageCollector); ok {
+		require.Nil(t, gc.CollectGarbage(clock.Now().Add(-5*time.Minute)))
+		require.Equal(t, uint32(0), p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4).Complete)
+		require.Equal(t, uint32(1), p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv6).Incomplete)
+		require.Equal(t, uint32(0), p.ScrapeSwarm(context.Background(), other, bittorrent.IPv4).Incomplete)
+	}
+
+	require.NotNil(t, sn.RestoreSnapshot(bytes.NewReader(snapshot[:len(snapshot)-1])))
+	require.NotNil(t, sn.RestoreSnapshot(bytes.NewReader([]byte("not a snapshot"))))
+}
+
+func testScrapeSwarms(t *testing.T, p storage.PeerStore) {
+	fs, ok := p.(storage.FullScraper)
+	if !ok {
+		t.Skip("PeerStore does not implement FullScraper")
+	}
+
+	ih, other, emptied := infoHash(14), infoHash(15), infoHash(16)
+	require.Nil(t, p.PutSeeder(context.Background(), ih, v4Peer(1)))
+	require.Nil(t, p.PutLeecher(context.Background(), ih, v4Peer(2)))
+	require.Nil(t, p.PutLeecher(context.Background(), ih, v6Peer(3)))
+	require.Nil(t, p.PutSeeder(context.Background(), other, v4Peer(4)))
+	require.Nil(t, p.PutLeecher(context.Background(), emptied, v4Peer(5)))
+	require.Nil(t, p.DeleteLeecher(context.Background(), emptied, v4Peer(5)))
+
+	scrapes := make(map[bittorrent.InfoHash]bittorrent.Scrape)
+	require.Nil(t, fs.ScrapeSwarms(context.Background(), bittorrent.IPv4, func(s bittorrent.Scrape) error {
+		require.NotContains(t, scrapes, s.InfoHash)
+		scrapes[s.InfoHash] = s
+		return nil
+	}))
+	require.Len(t, scrapes, 2)
+	require.Equal(t, uint32(1), scrapes[ih].Complete)
+	require.Equal(t, uint32(1), scrapes[ih].Incomplete)
+	require.Equal(t, uint32(1), scrapes[other].Complete)
+
+	var v6 []bittorrent.Scrape
+	require.Nil(t, fs.ScrapeSwarms(context.Background(), bittorrent.IPv6, func(s bittorrent.Scrape) error {
+		v6 = append(v6, s)
+		return nil
+	}))
+	require.Len(t, v6, 1)
+	require.Equal(t, ih, v6[0].InfoHash)
+	require.Equal(t, uint32(1), v6[0].Incomplete)
+
+	// Errors of fn stop the scrape.
+	errStop := errors.New("stop")
+	calls := 0
+	require.Equal(t, errStop, fs.ScrapeSwarms(context.Background(), bittorrent.IPv4, func(bittorrent.Scrape) error {
+		calls++
+		return errStop
+	}))
+	require.Equal(t, 1, calls)
+}
+
+func testConcurrency(t *testing.T, p storage.PeerStore) {
+	const (
+		workers        = 8
+		peersPerWorker = 25
+		swarms         = 4
+	)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// Readers announce and scrape continuously while the writers run.
+	for i := 0; i < workers/2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				ih := infoHash(byte(100 + i%swarms))
+				peers, err := p.AnnouncePeers(context.Background(), ih, i%2 == 0, 30, v4Peer(250))
+				if err != nil && err != storage.ErrResourceDoesNotExist {
+					t.Error(err)
+					return
+				}
+				if len(peers) > 30 {
+					t.Errorf("got %d peers, want at most 30", len(peers))
+					return
+				}
+				p.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4)
+			}
+		}(i)
+	}
+
+	// Every writer owns a distinct set of Peers in every swarm: it adds them
+	// as leechers, graduates half of them and deletes half of the rest.
+	var writers sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for s := 0; s < swarms; s++ {
+				ih := infoHash(byte(100 + s))
+				for i := 0; i < peersPerWorker; i++ {
+					peer := v4Peer(byte(w*peersPerWorker + i))
+					if err := p.PutLeecher(context.Background(), ih, peer); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				for i := 0; i < peersPerWorker; i++ {
+					peer := v4Peer(byte(w*peersPerWorker + i))
+					var err error
+					switch {
+					case i%2 == 0:
+						err = p.GraduateLeecher(context.Background(), ih, peer)
+					case i%4 == 1:
+						err = p.DeleteLeecher(context.Background(), ih, peer)
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+
+	writers.Wait()
+	close(done)
+	wg.Wait()
+
+	var seeders, leechers uint32
+	for i := 0; i < peersPerWorker; i++ {
+		switch {
+		case i%2 == 0:
+			seeders++
+		case i%4 == 3:
+			leechers++
+		}
+	}
+
+	for s := 0; s < swarms; s++ {
+		scrape := p.ScrapeSwarm(context.Background(), infoHash(byte(100+s)), bittorrent.IPv4)
+		require.Equal(t, workers*seeders, scrape.Complete)
+		require.Equal(t, workers*leechers, scrape.Incomplete)
+	}
+}
+
+func testCanceledContext(t *testing.T, p storage.PeerStore) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	forEachAF(t, func(t *testing.T, newPeer func(byte) bittorrent.Peer) {
+		ih := infoHash(12)
+
+		// Operations with a done context fail with its error and have no
+		// effect.
+		require.ErrorIs(t, p.PutSeeder(ctx, ih, newPeer(1)), context.Canceled)
+		require.ErrorIs(t, p.PutLeecher(ctx, ih, newPeer(2)), context.Canceled)
+		_, err := p.AnnouncePeers(ctx, ih, false, 50, newPeer(3))
+		require.ErrorIs(t, err, context.Canceled)
+
+		scrape := p.ScrapeSwarm(context.Background(), ih, newPeer(1).IP.AddressFamily)
+		require.Equal(t, uint32(0), scrape.Complete)
+		require.Equal(t, uint32(0), scrape.Incomplete)
+	})
+}
+
+func containsPeer(peers []bittorrent.Peer, p bittorrent.Peer) bool {
+	for _, peer := range peers {
+		if PeerEqualityFunc(peer, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDuplicates(peers []bittorrent.Peer) bool {
+	for i := range peers {
+		for j := i + 1; j < len(peers); j++ {
+			if PeerEqualityFunc(peers[i], peers[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}